@@ -0,0 +1,276 @@
+// Package client manages a running load balancer through its admin API,
+// as described by loadbalancer/openapi.json (also served at
+// /lb/openapi.json).
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Strategy names a balancing algorithm
+type Strategy string
+
+const (
+	RoundRobin   Strategy = "round-robin"
+	LeastLatency Strategy = "least-latency"
+	LeastConn    Strategy = "least-conn"
+	Hash         Strategy = "hash"
+)
+
+// Backend is what the admin API reports for one backend
+type Backend struct {
+	ID            string           `json:"id"`
+	Pool          string           `json:"pool"`
+	URL           string           `json:"url"`
+	Alive         bool             `json:"alive"`
+	Status        string           `json:"status"`
+	AvgLatency    int64            `json:"avg_latency"`
+	RequestCount  int64            `json:"request_count"`
+	Active        int64            `json:"active"`
+	ClusterActive int64            `json:"cluster_active"`
+	ClusterDown   bool             `json:"cluster_down,omitempty"`
+	BytesSent     int64            `json:"bytes_sent"`
+	BytesReceived int64            `json:"bytes_received"`
+	Responses     map[string]int64 `json:"responses"`
+	Cordoned      bool             `json:"cordoned"`
+	Weight        float64          `json:"weight"`
+	Tier          string           `json:"tier"`
+	Zone          string           `json:"zone,omitempty"`
+	ResolvedFrom  string           `json:"resolved_from,omitempty"`
+}
+
+// Pool summarizes a pool, rates cover the last minute
+type Pool struct {
+	Name         string  `json:"name"`
+	Backends     int     `json:"backends"`
+	Up           int     `json:"up"`
+	RequestCount int64   `json:"request_count"`
+	RPS          float64 `json:"rps"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatency   int64   `json:"avg_latency"`
+}
+
+// Stats is the part of /lb/stats the spec types; Raw holds the whole
+// document for the sections it leaves open
+type Stats struct {
+	Algorithm Strategy  `json:"algorithm"`
+	Pools     []Pool    `json:"pools"`
+	Backends  []Backend `json:"backends"`
+	// Matched is how many backends passed the filters, before paging
+	Matched int `json:"matched"`
+
+	Raw map[string]json.RawMessage `json:"-"`
+}
+
+// StatsQuery narrows down the backends Stats reports, the zero value
+// reports all of them
+type StatsQuery struct {
+	Pool      string
+	Unhealthy bool
+	// Sort is "latency" or "requests", slowest or busiest first
+	Sort   string
+	Offset int
+	Limit  int
+}
+
+func (q StatsQuery) values() url.Values {
+	v := url.Values{}
+	if q.Pool != "" {
+		v.Set("pool", q.Pool)
+	}
+	if q.Unhealthy {
+		v.Set("unhealthy", "true")
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+// BackendRef names a backend of a pool by ID or URL; an empty pool is
+// the default one
+type BackendRef struct {
+	Pool string `json:"pool,omitempty"`
+	ID   string `json:"id,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Algorithm is the default balancing algorithm and the ones available
+type Algorithm struct {
+	Algorithm Strategy   `json:"algorithm"`
+	Available []Strategy `json:"available"`
+}
+
+// DrainResult is the state of a backend after a drain
+type DrainResult struct {
+	ID     string `json:"id"`
+	Pool   string `json:"pool"`
+	URL    string `json:"url"`
+	Status string `json:"status"`
+}
+
+// ReloadResult reports a config reload
+type ReloadResult struct {
+	Status string   `json:"status"`
+	File   string   `json:"file"`
+	Pools  []string `json:"pools"`
+}
+
+// Error is a response the admin API refused, with its plain text message
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client talks to the admin API of one balancer
+type Client struct {
+	base string
+	// HTTP sends the requests, http.DefaultClient if nil
+	HTTP *http.Client
+	// Token is sent as the bearer token the balancer's admin.token asks
+	// for
+	Token string
+	// Header is added to every request, e.g. for an auth proxy in front
+	// of the admin endpoints
+	Header http.Header
+}
+
+// New returns a client for the balancer at base, e.g. http://localhost:8080
+func New(base string) (*Client, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: base must be an http(s) URL, got %q", base)
+	}
+	return &Client{base: strings.TrimSuffix(base, "/")}, nil
+}
+
+// Stats reports pools, backends and traffic
+func (c *Client) Stats(ctx context.Context, q StatsQuery) (*Stats, error) {
+	path := "/lb/stats"
+	if v := q.values(); len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	var doc json.RawMessage
+	if err := c.do(ctx, http.MethodGet, path, nil, &doc); err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+	if err := json.Unmarshal(doc, stats); err != nil {
+		return nil, err
+	}
+	return stats, json.Unmarshal(doc, &stats.Raw)
+}
+
+// Backends lists the backends of every pool
+func (c *Client) Backends(ctx context.Context) ([]Backend, error) {
+	var out []Backend
+	return out, c.do(ctx, http.MethodGet, "/lb/backends", nil, &out)
+}
+
+// AddBackend adds the backend at ref.URL to ref.Pool, with ref.ID if set,
+// and returns the pool's backends
+func (c *Client) AddBackend(ctx context.Context, ref BackendRef) ([]Backend, error) {
+	var out []Backend
+	return out, c.do(ctx, http.MethodPost, "/lb/backends", ref, &out)
+}
+
+// RemoveBackend removes a backend, named by ID or URL, and returns the
+// pool's remaining backends
+func (c *Client) RemoveBackend(ctx context.Context, ref BackendRef) ([]Backend, error) {
+	var out []Backend
+	return out, c.do(ctx, http.MethodDelete, "/lb/backends", ref, &out)
+}
+
+// Algorithm reports the default balancing algorithm
+func (c *Client) Algorithm(ctx context.Context) (*Algorithm, error) {
+	out := &Algorithm{}
+	return out, c.do(ctx, http.MethodGet, "/lb/algorithm", nil, out)
+}
+
+// SetAlgorithm switches the default balancing algorithm
+func (c *Client) SetAlgorithm(ctx context.Context, name Strategy) (*Algorithm, error) {
+	out := &Algorithm{}
+	return out, c.do(ctx, http.MethodPost, "/lb/algorithm", map[string]Strategy{"name": name}, out)
+}
+
+// Drain takes a backend out of rotation, or puts it back when drain is
+// false
+func (c *Client) Drain(ctx context.Context, ref BackendRef, drain bool) (*DrainResult, error) {
+	body := struct {
+		BackendRef
+		Drain bool `json:"drain"`
+	}{ref, drain}
+	out := &DrainResult{}
+	return out, c.do(ctx, http.MethodPost, "/lb/drain", body, out)
+}
+
+// Reload has the balancer read its config file again and switch to it
+func (c *Client) Reload(ctx context.Context) (*ReloadResult, error) {
+	out := &ReloadResult{}
+	return out, c.do(ctx, http.MethodPost, "/lb/reload", nil, out)
+}
+
+// Do calls an admin endpoint the methods above do not cover, such as
+// /lb/har, sending body as JSON and decoding the response into out
+func (c *Client) Do(ctx context.Context, method, path string, body, out interface{}) error {
+	return c.do(ctx, method, path, body, out)
+}
+
+// do sends a request with body as JSON and decodes the response into out
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,8 @@
+// Command lb runs the load balancer
+package main
+
+import "github.com/imransultan57/Load-blancer/loadbalancer"
+
+func main() {
+	loadbalancer.Main()
+}
@@ -0,0 +1,16 @@
+module github.com/imransultan57/Load-blancer/cmd/lbctl
+
+go 1.24
+
+require (
+	github.com/imransultan57/Load-blancer v0.0.0
+	github.com/spf13/cobra v1.10.1
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.9 // indirect
+)
+
+// The client package is versioned with the balancer it talks to
+replace github.com/imransultan57/Load-blancer => ../..
@@ -0,0 +1,276 @@
+// Command lbctl controls a running load balancer through its admin API.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/imransultan57/Load-blancer/client"
+	"github.com/spf13/cobra"
+)
+
+// printBackends renders backends as a table
+func printBackends(w io.Writer, backends []client.Backend) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tID\tURL\tSTATUS\tREQUESTS\tACTIVE\tAVG LATENCY\t5XX\tWEIGHT")
+	for _, b := range backends {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%dms\t%d\t%.2f\n",
+			b.Pool, b.ID, b.URL, b.Status, b.RequestCount, b.Active, b.AvgLatency, b.Responses["5xx"], b.Weight)
+	}
+	tw.Flush()
+}
+
+// ref names a backend of pool by URL, or by ID when arg is not a URL
+func ref(pool, arg string) client.BackendRef {
+	if strings.Contains(arg, "://") {
+		return client.BackendRef{Pool: pool, URL: arg}
+	}
+	return client.BackendRef{Pool: pool, ID: arg}
+}
+
+func main() {
+	var c *client.Client
+	var addr, token, pool, id string
+
+	root := &cobra.Command{
+		Use:           "lbctl",
+		Short:         "Control a running load balancer through its admin API",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if c, err = client.New(addr); err != nil {
+				return err
+			}
+			c.HTTP = &http.Client{Timeout: 10 * time.Second}
+			c.Token = token
+			return nil
+		},
+	}
+	defaultAddr := os.Getenv("LBCTL_ADDR")
+	if defaultAddr == "" {
+		defaultAddr = "http://localhost:8080"
+	}
+	root.PersistentFlags().StringVar(&addr, "addr", defaultAddr, "admin base URL (env LBCTL_ADDR)")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("LBCTL_TOKEN"), "admin token (env LBCTL_TOKEN)")
+
+	backends := &cobra.Command{
+		Use:     "backends",
+		Aliases: []string{"ls"},
+		Short:   "List backends",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := c.Backends(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if pool != "" {
+				filtered := list[:0]
+				for _, b := range list {
+					if b.Pool == pool {
+						filtered = append(filtered, b)
+					}
+				}
+				list = filtered
+			}
+			printBackends(cmd.OutOrStdout(), list)
+			return nil
+		},
+	}
+	backends.Flags().StringVar(&pool, "pool", "", "only show this pool")
+
+	add := &cobra.Command{
+		Use:   "add URL",
+		Short: "Add a backend to a pool",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := c.AddBackend(cmd.Context(), client.BackendRef{Pool: pool, URL: args[0], ID: id})
+			if err != nil {
+				return err
+			}
+			printBackends(cmd.OutOrStdout(), list)
+			return nil
+		},
+	}
+	remove := &cobra.Command{
+		Use:     "remove URL|ID",
+		Aliases: []string{"rm"},
+		Short:   "Remove a backend from a pool",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := c.RemoveBackend(cmd.Context(), ref(pool, args[0]))
+			if err != nil {
+				return err
+			}
+			printBackends(cmd.OutOrStdout(), list)
+			return nil
+		},
+	}
+	drainCmd := func(use, short string, drain bool) *cobra.Command {
+		return &cobra.Command{
+			Use:   use + " URL|ID",
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				out, err := c.Drain(cmd.Context(), ref(pool, args[0]), drain)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s %s (pool %s) is %s\n", out.ID, out.URL, out.Pool, out.Status)
+				return nil
+			},
+		}
+	}
+	drain := drainCmd("drain", "Stop sending new requests to a backend", true)
+	undrain := drainCmd("undrain", "Put a drained backend back into rotation", false)
+	for _, cmd := range []*cobra.Command{add, remove, drain, undrain} {
+		cmd.Flags().StringVar(&pool, "pool", "", "pool of the backend (default pool if empty)")
+	}
+	add.Flags().StringVar(&id, "id", "", "stable ID for the backend (derived from pool and URL if empty)")
+
+	algorithm := &cobra.Command{
+		Use:   "algorithm [NAME]",
+		Short: "Show or switch the balancing algorithm",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var out *client.Algorithm
+			var err error
+			if len(args) == 1 {
+				out, err = c.SetAlgorithm(cmd.Context(), client.Strategy(args[0]))
+			} else {
+				out, err = c.Algorithm(cmd.Context())
+			}
+			if err != nil {
+				return err
+			}
+			available := make([]string, len(out.Available))
+			for i, name := range out.Available {
+				available[i] = string(name)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s (available: %s)\n", out.Algorithm, strings.Join(available, ", "))
+			return nil
+		},
+	}
+
+	var follow bool
+	stats := &cobra.Command{
+		Use:   "stats",
+		Short: "Print stats, or keep printing them with --follow",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !follow {
+				out, err := c.Stats(cmd.Context(), client.StatsQuery{})
+				if err != nil {
+					return err
+				}
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(out.Raw)
+			}
+			return tailStats(addr, cmd.OutOrStdout())
+		},
+	}
+	stats.Flags().BoolVarP(&follow, "follow", "f", false, "follow /lb/stats/stream")
+
+	var duration time.Duration
+	var sample float64
+	var bodies bool
+	record := &cobra.Command{
+		Use:   "record start|stop|status",
+		Short: "Record sampled traffic to a HAR file on the balancer",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var out map[string]interface{}
+			var err error
+			switch args[0] {
+			case "start":
+				q := url.Values{"duration": {duration.String()}, "bodies": {fmt.Sprint(bodies)}}
+				if sample > 0 {
+					q.Set("sample", fmt.Sprint(sample))
+				}
+				err = c.Do(cmd.Context(), http.MethodPost, "/lb/har/start?"+q.Encode(), nil, &out)
+			case "stop":
+				err = c.Do(cmd.Context(), http.MethodPost, "/lb/har/stop", nil, &out)
+			case "status":
+				err = c.Do(cmd.Context(), http.MethodGet, "/lb/har", nil, &out)
+			default:
+				return fmt.Errorf("unknown action %q, want start, stop or status", args[0])
+			}
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		},
+	}
+	record.Flags().DurationVar(&duration, "duration", time.Minute, "how long to record")
+	record.Flags().Float64Var(&sample, "sample", 0, "share of requests recorded, 0 to 1 (balancer default if 0)")
+	record.Flags().BoolVar(&bodies, "bodies", true, "record request and response bodies, needed to replay requests with a body")
+
+	var opts replayOptions
+	replayCmd := &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Send the requests of a HAR recording to a backend and compare statuses",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return replay(args[0], opts, cmd.OutOrStdout())
+		},
+	}
+	replayCmd.Flags().StringVar(&opts.target, "target", "", "base URL to send the requests to, e.g. http://localhost:8081")
+	replayCmd.Flags().StringVar(&opts.host, "host", "", "Host header to send instead of the recorded one")
+	replayCmd.Flags().IntVar(&opts.concurrency, "concurrency", 1, "requests in flight at once")
+	replayCmd.Flags().BoolVar(&opts.check, "check", false, "fail when a status differs from the recording")
+	replayCmd.MarkFlagRequired("target")
+
+	root.AddCommand(backends, add, remove, drain, undrain, algorithm, stats, record, replayCmd)
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "lbctl:", err)
+		os.Exit(1)
+	}
+}
+
+// tailStats prints one backend summary per event of the stats stream at
+// base; the client package only covers request and response calls
+func tailStats(base string, w io.Writer) error {
+	resp, err := http.Get(strings.TrimSuffix(base, "/") + "/lb/stats/stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stats stream: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var stats struct {
+			Algorithm string           `json:"algorithm"`
+			Backends  []client.Backend `json:"backends"`
+		}
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			return err
+		}
+		sort.Slice(stats.Backends, func(i, j int) bool {
+			return stats.Backends[i].Pool+stats.Backends[i].URL < stats.Backends[j].Pool+stats.Backends[j].URL
+		})
+		fmt.Fprintf(w, "%s  algorithm=%s\n", time.Now().Format("15:04:05"), stats.Algorithm)
+		printBackends(w, stats.Backends)
+		fmt.Fprintln(w)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// harFile holds the parts of a HAR recording needed to replay it
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method   string      `json:"method"`
+				URL      string      `json:"url"`
+				Headers  []harHeader `json:"headers"`
+				PostData *struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"postData"`
+				BodySize int64 `json:"bodySize"`
+			} `json:"request"`
+			Response struct {
+				Status int `json:"status"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// harHeader is one recorded header line
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// replayResult is the outcome of resending one recorded request
+type replayResult struct {
+	method, url string
+	recorded    int
+	status      int
+	latency     time.Duration
+	skipped     string
+	err         error
+}
+
+// hopHeaders are not replayed, the client sets them for its own connection
+var hopHeaders = map[string]bool{
+	"Connection": true, "Keep-Alive": true, "Proxy-Connection": true, "Te": true,
+	"Trailer": true, "Transfer-Encoding": true, "Upgrade": true, "Content-Length": true,
+}
+
+// replayOptions control how a recording is sent again
+type replayOptions struct {
+	target      string
+	host        string
+	concurrency int
+	check       bool
+}
+
+// replay resends every request of the HAR file at path to the target and
+// prints how each response compares with the recorded one
+func replay(path string, opts replayOptions, w io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	target, err := url.Parse(opts.target)
+	if err != nil || target.Host == "" {
+		return fmt.Errorf("target must be a URL such as http://localhost:8081")
+	}
+
+	entries := har.Log.Entries
+	results := make([]replayResult, len(entries))
+	client := &http.Client{
+		Timeout:       30 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range max(opts.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				e := entries[i]
+				res := replayResult{method: e.Request.Method, url: e.Request.URL, recorded: e.Response.Status}
+				body := ""
+				if p := e.Request.PostData; p != nil {
+					body = p.Text
+					if p.Encoding == "base64" {
+						b, err := base64.StdEncoding.DecodeString(p.Text)
+						if err != nil {
+							res.err = fmt.Errorf("body: %w", err)
+							results[i] = res
+							continue
+						}
+						body = string(b)
+					}
+				}
+				if e.Request.BodySize > int64(len(body)) {
+					// Bodies beyond the recorder's limit were cut short
+					res.skipped = "body not recorded in full"
+					results[i] = res
+					continue
+				}
+				res.status, res.latency, res.err = replayOne(client, target, opts.host, e.Request.Method, e.Request.URL, e.Request.Headers, body)
+				results[i] = res
+			}
+		}()
+	}
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tURL\tRECORDED\tREPLAYED\tLATENCY\t")
+	differ, skipped, failed := 0, 0, 0
+	for _, res := range results {
+		replayed := fmt.Sprint(res.status)
+		mark := ""
+		switch {
+		case res.skipped != "":
+			skipped++
+			replayed = "skipped: " + res.skipped
+		case res.err != nil:
+			failed++
+			replayed = "error: " + res.err.Error()
+		case res.status != res.recorded:
+			differ++
+			mark = "differs"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", res.method, res.url, res.recorded, replayed, res.latency.Round(time.Millisecond), mark)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d replayed, %d with a different status, %d failed, %d skipped\n",
+		len(results)-skipped, differ, failed, skipped)
+	if opts.check && differ+failed > 0 {
+		return fmt.Errorf("%d of %d responses did not match the recording", differ+failed, len(results)-skipped)
+	}
+	return nil
+}
+
+// replayOne sends one recorded request to target, keeping its path, query,
+// headers and body, and returns the status it got
+func replayOne(client *http.Client, target *url.URL, host, method, rawURL string, headers []harHeader, body string) (int, time.Duration, error) {
+	recorded, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	u := *target
+	u.Path = strings.TrimSuffix(target.Path, "/") + recorded.Path
+	u.RawQuery = recorded.RawQuery
+
+	req, err := http.NewRequest(method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, h := range headers {
+		if !hopHeaders[http.CanonicalHeaderKey(h.Name)] {
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+	// Routes and virtual hosts see the recorded host unless told otherwise
+	req.Host = recorded.Host
+	if host != "" {
+		req.Host = host
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
@@ -0,0 +1,341 @@
+// Command loadgen sends concurrent traffic through the load balancer and
+// reports throughput, latency percentiles and how requests were spread
+// over the backends, for comparing algorithms and their settings.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// options are the command line settings
+type options struct {
+	target        string
+	paths         []string
+	method        string
+	concurrency   int
+	duration      time.Duration
+	requests      int64
+	rate          float64
+	timeout       time.Duration
+	backendHeader string
+	backendField  string
+	jsonOut       string
+}
+
+func parseFlags(args []string) (options, error) {
+	var o options
+	var paths string
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	fs.StringVar(&o.target, "url", "http://localhost:8080", "balancer base URL")
+	fs.StringVar(&paths, "paths", "/api/products,/api/orders,/api/users,/", "comma separated paths, requested in turn")
+	fs.StringVar(&o.method, "method", http.MethodGet, "request method")
+	fs.IntVar(&o.concurrency, "c", 50, "concurrent workers")
+	fs.DurationVar(&o.duration, "d", 30*time.Second, "how long to run")
+	fs.Int64Var(&o.requests, "n", 0, "stop after this many requests, 0 runs for the whole duration")
+	fs.Float64Var(&o.rate, "rate", 0, "total requests per second, 0 sends as fast as the workers can")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "per-request timeout")
+	fs.StringVar(&o.backendHeader, "backend-header", "", "response header naming the backend that answered")
+	fs.StringVar(&o.backendField, "backend-field", "server_id", "JSON response field naming the backend, used without -backend-header")
+	fs.StringVar(&o.jsonOut, "json", "", "also write the results as JSON to this file")
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			o.paths = append(o.paths, p)
+		}
+	}
+	switch {
+	case len(o.paths) == 0:
+		return o, errors.New("-paths is empty")
+	case o.concurrency < 1:
+		return o, errors.New("-c must be at least 1")
+	case o.duration <= 0 && o.requests <= 0:
+		return o, errors.New("set -d or -n")
+	}
+	return o, nil
+}
+
+// result is the outcome of one request
+type result struct {
+	latency time.Duration
+	status  int
+	backend string
+	err     error
+}
+
+// report aggregates the results of a run
+type report struct {
+	Total        int                `json:"total_requests"`
+	Successful   int                `json:"successful_requests"`
+	Failed       int                `json:"failed_requests"`
+	Distribution map[string]int     `json:"server_distribution"`
+	Statuses     map[string]int     `json:"status_codes"`
+	Errors       map[string]int     `json:"errors,omitempty"`
+	Latency      map[string]float64 `json:"response_time_stats"`
+	Duration     float64            `json:"duration"`
+	RPS          float64            `json:"requests_per_second"`
+}
+
+func main() {
+	o, err := parseFlags(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "loadgen:", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("Sending %s %s%v with %d workers", o.method, o.target, o.paths, o.concurrency)
+	if o.requests > 0 {
+		fmt.Printf(", %d requests", o.requests)
+	}
+	if o.duration > 0 {
+		fmt.Printf(", for up to %s", o.duration)
+	}
+	fmt.Println()
+
+	start := time.Now()
+	results := run(o)
+	rep := summarize(results, time.Since(start))
+	rep.print(os.Stdout)
+
+	if o.jsonOut != "" {
+		data, _ := json.MarshalIndent(rep, "", "  ")
+		if err := os.WriteFile(o.jsonOut, append(data, '\n'), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "loadgen:", err)
+			os.Exit(1)
+		}
+	}
+	if rep.Successful == 0 {
+		os.Exit(1)
+	}
+}
+
+// run drives the workers until the duration or request count is reached
+func run(o options) []result {
+	ctx := context.Background()
+	if o.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.duration)
+		defer cancel()
+	}
+	client := &http.Client{
+		Timeout: o.timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        o.concurrency,
+			MaxIdleConnsPerHost: o.concurrency,
+		},
+	}
+
+	// A shared ticker paces the workers when a rate is set
+	var tick <-chan time.Time
+	if o.rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / o.rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	var sent atomic.Int64
+	var mu sync.Mutex
+	var results []result
+	var wg sync.WaitGroup
+	for w := 0; w < o.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []result
+			for {
+				n := sent.Add(1)
+				if o.requests > 0 && n > o.requests {
+					break
+				}
+				if tick != nil {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				local = append(local, send(ctx, client, o, o.paths[int(n-1)%len(o.paths)]))
+			}
+			mu.Lock()
+			results = append(results, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// send makes one request and works out which backend answered it
+func send(ctx context.Context, client *http.Client, o options, path string) result {
+	req, err := http.NewRequestWithContext(ctx, o.method, strings.TrimSuffix(o.target, "/")+path, nil)
+	if err != nil {
+		return result{err: err}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Cut short by the end of the run, not a failure of the target
+			return result{err: context.Canceled}
+		}
+		return result{latency: time.Since(start), err: err}
+	}
+	defer resp.Body.Close()
+
+	res := result{status: resp.StatusCode}
+	if o.backendHeader != "" {
+		res.backend = resp.Header.Get(o.backendHeader)
+		io.Copy(io.Discard, resp.Body)
+	} else {
+		var body map[string]interface{}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil {
+			if v, ok := body[o.backendField]; ok {
+				res.backend = fmt.Sprint(v)
+			}
+		}
+		io.Copy(io.Discard, resp.Body)
+	}
+	res.latency = time.Since(start)
+	return res
+}
+
+// summarize aggregates results of a run that took elapsed
+func summarize(results []result, elapsed time.Duration) report {
+	rep := report{
+		Distribution: map[string]int{},
+		Statuses:     map[string]int{},
+		Errors:       map[string]int{},
+		Latency:      map[string]float64{},
+		Duration:     elapsed.Seconds(),
+	}
+	var latencies []float64
+	for _, r := range results {
+		if errors.Is(r.err, context.Canceled) {
+			continue
+		}
+		rep.Total++
+		if r.err != nil {
+			rep.Failed++
+			rep.Errors[errorKind(r.err)]++
+			continue
+		}
+		latencies = append(latencies, float64(r.latency.Microseconds())/1000)
+		rep.Statuses[fmt.Sprint(r.status)]++
+		if r.status >= 200 && r.status < 400 {
+			rep.Successful++
+			if r.backend != "" {
+				rep.Distribution[r.backend]++
+			}
+		} else {
+			rep.Failed++
+		}
+	}
+	if elapsed > 0 {
+		rep.RPS = float64(rep.Total) / elapsed.Seconds()
+	}
+	if len(latencies) > 0 {
+		sort.Float64s(latencies)
+		sum := 0.0
+		for _, l := range latencies {
+			sum += l
+		}
+		rep.Latency["min"] = latencies[0]
+		rep.Latency["max"] = latencies[len(latencies)-1]
+		rep.Latency["mean"] = sum / float64(len(latencies))
+		for _, p := range []float64{50, 90, 95, 99} {
+			rep.Latency[fmt.Sprintf("p%g", p)] = percentile(latencies, p)
+		}
+	}
+	return rep
+}
+
+// percentile returns the p-th percentile of sorted values, nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// errorKind shortens transport errors so similar failures group together
+func errorKind(err error) string {
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return "timeout"
+	}
+	msg := err.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return msg
+}
+
+// print writes the report as text
+func (r report) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nRequests\t%d\n", r.Total)
+	fmt.Fprintf(tw, "Successful\t%d\n", r.Successful)
+	fmt.Fprintf(tw, "Failed\t%d\n", r.Failed)
+	fmt.Fprintf(tw, "Duration\t%.2fs\n", r.Duration)
+	fmt.Fprintf(tw, "Throughput\t%.1f req/s\n", r.RPS)
+	if len(r.Latency) > 0 {
+		fmt.Fprintf(tw, "\nLatency (ms)\n")
+		for _, k := range []string{"min", "mean", "p50", "p90", "p95", "p99", "max"} {
+			fmt.Fprintf(tw, "  %s\t%.2f\n", k, r.Latency[k])
+		}
+	}
+	fmt.Fprintf(tw, "\nStatus codes\n")
+	for _, k := range sortedKeys(r.Statuses) {
+		fmt.Fprintf(tw, "  %s\t%d\n", k, r.Statuses[k])
+	}
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(tw, "\nErrors\n")
+		for _, k := range sortedKeys(r.Errors) {
+			fmt.Fprintf(tw, "  %s\t%d\n", k, r.Errors[k])
+		}
+	}
+	fmt.Fprintf(tw, "\nBackends\n")
+	total := 0
+	for _, n := range r.Distribution {
+		total += n
+	}
+	if total == 0 {
+		fmt.Fprintf(tw, "  (no responses named a backend)\n")
+	}
+	for _, k := range sortedKeys(r.Distribution) {
+		fmt.Fprintf(tw, "  %s\t%d\t%.1f%%\n", k, r.Distribution[k], 100*float64(r.Distribution[k])/float64(total))
+	}
+	tw.Flush()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,8 @@
+module github.com/imransultan57/Load-blancer
+
+go 1.24
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	golang.org/x/sync v0.10.0
+)
@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogConfig controls the structured (JSON lines) access log
+type AccessLogConfig struct {
+	Enabled bool `json:"enabled"`
+	// Path of the log file, standard output if empty
+	Path string `json:"path"`
+	// Fields enables optional fields: "tls", "sni", "client_cert",
+	// "proto" and "geo"
+	Fields []string `json:"fields"`
+}
+
+// accessLogFields lists the optional fields that can be enabled
+var accessLogFields = map[string]bool{
+	"tls":         true,
+	"sni":         true,
+	"client_cert": true,
+	"proto":       true,
+	"geo":         true,
+}
+
+// validate checks the optional field names
+func (c *AccessLogConfig) validate() error {
+	for _, f := range c.Fields {
+		if !accessLogFields[f] {
+			return fmt.Errorf("access_log: unknown field %q", f)
+		}
+	}
+	return nil
+}
+
+// accessLogger writes one JSON object per request
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	fields map[string]bool
+}
+
+// accessLog is nil when access logging is disabled
+var accessLog *accessLogger
+
+// openAccessLog opens the configured destination
+func openAccessLog(cfg AccessLogConfig) (*accessLogger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	var out io.Writer = os.Stdout
+	if cfg.Path != "" {
+		f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("access_log: %w", err)
+		}
+		out = f
+	}
+	fields := map[string]bool{}
+	for _, f := range cfg.Fields {
+		fields[f] = true
+	}
+	return &accessLogger{out: out, fields: fields}, nil
+}
+
+// Log writes the entry for a finished request
+func (l *accessLogger) Log(r *http.Request, status int, bytes int64, duration time.Duration, backend string, labels Labels) {
+	if l == nil {
+		return
+	}
+	entry := map[string]interface{}{
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+		"client":      clientString(r),
+		"method":      r.Method,
+		"host":        r.Host,
+		"path":        r.URL.RequestURI(),
+		"status":      status,
+		"bytes":       bytes,
+		"duration_ms": duration.Milliseconds(),
+		"backend":     backend,
+		"route":       labels["route"],
+		"pool":        labels["pool"],
+	}
+	if l.fields["proto"] {
+		entry["proto"] = protoName(r)
+	}
+	if cs := r.TLS; cs != nil {
+		if l.fields["tls"] {
+			entry["tls_version"] = tlsVersionName(cs.Version)
+			entry["tls_cipher"] = tls.CipherSuiteName(cs.CipherSuite)
+		}
+		if l.fields["sni"] && cs.ServerName != "" {
+			entry["sni"] = cs.ServerName
+		}
+		if l.fields["client_cert"] && len(cs.PeerCertificates) > 0 {
+			entry["client_cert_subject"] = cs.PeerCertificates[0].Subject.String()
+		}
+	}
+	if l.fields["geo"] {
+		if addr, ok := clientAddr(r); ok {
+			if country := geoIP.Country(addr); country != "" {
+				entry["geo_country"] = country
+			}
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	l.out.Write(append(line, '\n'))
+	l.mu.Unlock()
+}
+
+// protoName shortens the request protocol to h1, h2 or h3
+func protoName(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 2:
+		return "h2"
+	case r.ProtoMajor == 3:
+		return "h3"
+	case strings.HasPrefix(r.Proto, "HTTP/1"):
+		return "h1"
+	}
+	return r.Proto
+}
@@ -0,0 +1,167 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// countingBody adds the bytes read through it to n
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingWriter counts the response body bytes written through it
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// countBody has the bytes of body read counted in n, leaving empty bodies
+// as they are so the transport still sees them as empty
+func countBody(body io.ReadCloser, n *int64) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &countingBody{ReadCloser: body, n: n}
+}
+
+// countBackendBytes counts the request body sent to b, called from the
+// Director once the request is bound for it
+func countBackendBytes(b *Backend, r *http.Request) {
+	r.Body = countBody(r.Body, &b.bytesSent)
+}
+
+// countBackendResponse counts the response body b sends. Upgraded
+// connections keep their body as it is, the proxy writes to it.
+func countBackendResponse(b *Backend, resp *http.Response) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = countBody(resp.Body, &b.bytesReceived)
+	}
+}
+
+// routeBytes counts request and response body bytes of each route
+type routeBytes struct {
+	mu     sync.Mutex
+	routes map[string]*routeCounters
+}
+
+type routeCounters struct {
+	requests, in, out atomic.Int64
+}
+
+var routeTraffic = &routeBytes{routes: map[string]*routeCounters{}}
+
+// add counts one request to route with in bytes of body from the client
+// and out bytes of response body to it
+func (t *routeBytes) add(route string, in, out int64) {
+	t.mu.Lock()
+	c := t.routes[route]
+	if c == nil {
+		c = &routeCounters{}
+		t.routes[route] = c
+	}
+	t.mu.Unlock()
+	c.requests.Add(1)
+	c.in.Add(in)
+	c.out.Add(out)
+}
+
+// Snapshot returns the counters of every route seen, by name
+func (t *routeBytes) Snapshot() []map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.routes))
+	for name := range t.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		c := t.routes[name]
+		result = append(result, map[string]interface{}{
+			"route":     name,
+			"requests":  c.requests.Load(),
+			"bytes_in":  c.in.Load(),
+			"bytes_out": c.out.Load(),
+		})
+	}
+	return result
+}
+
+// connCounters track the client connections of one listener
+type connCounters struct {
+	open, accepted atomic.Int64
+}
+
+// clientConns tracks client connections by listener name
+type clientConns struct {
+	mu        sync.Mutex
+	listeners map[string]*connCounters
+}
+
+var connections = &clientConns{listeners: map[string]*connCounters{}}
+
+// track returns a ConnState hook counting the connections of listener.
+// Upgraded connections, such as WebSockets, stop counting as open once the
+// server hands them over.
+func (c *clientConns) track(listener string) func(net.Conn, http.ConnState) {
+	c.mu.Lock()
+	counters := c.listeners[listener]
+	if counters == nil {
+		counters = &connCounters{}
+		c.listeners[listener] = counters
+	}
+	c.mu.Unlock()
+	return func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			counters.accepted.Add(1)
+			counters.open.Add(1)
+		case http.StateHijacked, http.StateClosed:
+			counters.open.Add(-1)
+		}
+	}
+}
+
+// Snapshot returns the connection counts of every listener, by name
+func (c *clientConns) Snapshot() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.listeners))
+	for name := range c.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		counters := c.listeners[name]
+		result = append(result, map[string]interface{}{
+			"listener": name,
+			"open":     counters.open.Load(),
+			"accepted": counters.accepted.Load(),
+		})
+	}
+	return result
+}
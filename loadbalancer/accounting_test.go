@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteAccounting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			brw.Flush()
+			io.Copy(conn, brw)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("x"), 300))
+	}))
+	t.Cleanup(backend.Close)
+	lb, pool := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.Routes = append([]RouteConfig{}, cfg.Routes...)
+	cfg.Routes[0].ResponseLimit = &ResponseLimitConfig{MaxBytes: 1000}
+	lb.setConfig(&cfg)
+	front := httptest.NewUnstartedServer(lb.Handler())
+	front.Config.ConnState = connections.track("accounting")
+	front.Start()
+	t.Cleanup(front.Close)
+
+	routeBefore := map[string]interface{}{"bytes_in": int64(0), "bytes_out": int64(0)}
+	for _, r := range routeTraffic.Snapshot() {
+		if r["route"] == "test" {
+			routeBefore = r
+		}
+	}
+	resp, err := http.Post(front.URL+"/", "text/plain", strings.NewReader(strings.Repeat("y", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	b := pool.GetBackends()[0]
+	if b.BytesSent != 100 || b.BytesReceived != 300 {
+		t.Errorf("backend sent %d, received %d bytes; want 100 and 300", b.BytesSent, b.BytesReceived)
+	}
+	for _, r := range routeTraffic.Snapshot() {
+		if r["route"] != "test" {
+			continue
+		}
+		in := r["bytes_in"].(int64) - routeBefore["bytes_in"].(int64)
+		out := r["bytes_out"].(int64) - routeBefore["bytes_out"].(int64)
+		if in != 100 || out != 300 {
+			t.Errorf("route got %d bytes in, %d out; want 100 and 300", in, out)
+		}
+	}
+	for _, l := range connections.Snapshot() {
+		if l["listener"] == "accounting" && (l["accepted"].(int64) != 1 || l["open"].(int64) != 1) {
+			t.Errorf("listener connections %v, want one accepted and open", l)
+		}
+	}
+
+	// Upgrades pass the response limit and the counting untouched
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(status, "101") {
+		t.Errorf("upgrade answered %q, %v", status, err)
+	}
+}
@@ -0,0 +1,255 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// AdminConfig guards the /lb/ admin endpoints
+type AdminConfig struct {
+	// Address, when set, moves the admin endpoints to a listener of their
+	// own, e.g. 127.0.0.1:9091; the proxy listeners then only answer
+	// /lb/healthz and /lb/readyz
+	Address string `json:"address,omitempty"`
+	// Token must come as "Authorization: Bearer <token>" with every admin
+	// request on the proxy listeners, and with changes on the admin
+	// listener. Without one the admin endpoints are only served on the
+	// admin listener.
+	Token string `json:"token,omitempty"`
+}
+
+// validate checks the admin address
+func (c *AdminConfig) validate() error {
+	if c.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("admin: address must be host:port")
+	}
+	return nil
+}
+
+// adminHandler serves the admin endpoints to clients with the admin token,
+// and on the admin listener reads to everyone. dedicated is set on the
+// admin listener.
+func (lb *Balancer) adminHandler(dedicated bool) http.Handler {
+	admin := http.NewServeMux()
+	admin.HandleFunc("/lb/healthz", healthzHandler)
+	admin.HandleFunc("/lb/readyz", lb.readyzHandler)
+	admin.HandleFunc("/lb/stats", lb.statsHandler)
+	admin.HandleFunc("/lb/stats/cluster", lb.clusterStatsHandler)
+	admin.HandleFunc("/lb/cluster/gossip", lb.gossipHandler)
+	admin.HandleFunc("/lb/ha", lb.haHandler)
+	admin.HandleFunc("/lb/stats/stream", lb.statsStreamHandler)
+	admin.HandleFunc("/lb/stats/history", lb.historyHandler)
+	admin.HandleFunc("/lb/metrics", lb.metricsHandler)
+	admin.HandleFunc("/lb/algorithm", lb.algorithmHandler)
+	admin.HandleFunc("/lb/backends", lb.backendsHandler)
+	admin.HandleFunc("/lb/drain", lb.drainHandler)
+	admin.HandleFunc("/lb/reload", lb.reloadHandler)
+	admin.HandleFunc("/lb/openapi.json", openAPIHandler)
+	admin.HandleFunc("/lb/maintenance", lb.maintenanceHandler)
+	admin.HandleFunc("/lb/faults", lb.faultsHandler)
+	admin.Handle("/lb/ui/", uiHandler())
+	admin.Handle("/lb/ui", http.RedirectHandler("/lb/ui/", http.StatusMovedPermanently))
+	admin.HandleFunc("/lb/cache/purge", cachePurgeHandler)
+	admin.HandleFunc("/lb/synthetic", syntheticHandler)
+	admin.HandleFunc("/lb/har", harStatusHandler)
+	admin.HandleFunc("/lb/har/start", lb.harStartHandler)
+	admin.HandleFunc("/lb/har/stop", harStopHandler)
+	registerDebug(admin, lb.config().Debug, dedicated)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withBalancer(r.Context(), lb))
+		if openAdminPath(r.URL.Path) || lb.adminAllowed(w, r, dedicated) {
+			admin.ServeHTTP(w, r)
+		}
+	})
+}
+
+// openAdminPath reports whether path is served without the admin token:
+// the probes load balancers poll, and gossip, which peers sign with the
+// cluster secret
+func openAdminPath(path string) bool {
+	switch path {
+	case "/lb/healthz", "/lb/readyz", "/lb/cluster/gossip":
+		return true
+	}
+	return false
+}
+
+// changesBalancer reports whether an admin request may change the balancer
+func changesBalancer(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// adminAllowed checks r carries the admin token, or is a read on the admin
+// listener or a change there with no token configured; it writes the
+// refusal itself. Client addresses are not trusted, loopback included:
+// they can come from a PROXY header or a local proxy.
+func (lb *Balancer) adminAllowed(w http.ResponseWriter, r *http.Request, dedicated bool) bool {
+	changes := changesBalancer(r)
+	// Pages on other sites must not drive a balancer through the
+	// operator's browser
+	if site := r.Header.Get("Sec-Fetch-Site"); changes && site != "" && site != "same-origin" && site != "none" {
+		http.Error(w, "Cross-site admin request refused", http.StatusForbidden)
+		return false
+	}
+	token := lb.config().Admin.Token
+	if dedicated && (!changes || token == "") {
+		return true
+	}
+	if token == "" {
+		http.Error(w, "Admin endpoints need admin.token or admin.address", http.StatusForbidden)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="lb-admin"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// adminError is an admin operation refused, with the HTTP status and gRPC
+// code that say why
+type adminError struct {
+	status int
+	code   grpcCode
+	msg    string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+// adminErrorf returns an adminError with the gRPC code matching status
+func adminErrorf(status int, format string, args ...interface{}) error {
+	return &adminError{status: status, code: grpcCodeFor(status), msg: fmt.Sprintf(format, args...)}
+}
+
+// writeAdminError answers an admin request with err as plain text
+func writeAdminError(w http.ResponseWriter, err error) {
+	var ae *adminError
+	if errors.As(err, &ae) {
+		http.Error(w, ae.msg, ae.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// adminPool returns the pool named name, the default one if empty
+func (lb *Balancer) adminPool(name string) (*ServerPool, error) {
+	if name == "" {
+		name = defaultPool
+	}
+	pool, ok := lb.pools()[name]
+	if !ok {
+		return nil, adminErrorf(http.StatusNotFound, "Unknown pool %q", name)
+	}
+	return pool, nil
+}
+
+// addBackend adds the backend at rawURL to the named pool, with id if set
+func (lb *Balancer) addBackend(poolName, id, rawURL string) (*ServerPool, error) {
+	pool, err := lb.adminPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	if pool.findBackend("", rawURL) != nil {
+		return nil, adminErrorf(http.StatusConflict, "Backend %q already in pool %s", rawURL, pool.Name)
+	}
+	if id != "" && pool.findBackend(id, "") != nil {
+		return nil, adminErrorf(http.StatusConflict, "Backend ID %q already in pool %s", id, pool.Name)
+	}
+	backend, err := newBackend(rawURL, pool)
+	if err != nil || backend.URL.Scheme == "" || backend.URL.Host == "" {
+		return nil, adminErrorf(http.StatusBadRequest, "Invalid backend URL %q", rawURL)
+	}
+	if id != "" {
+		backend.ID = id
+	}
+	// Kept apart from configured and discovered members
+	backend.origin = "admin"
+	pool.AddBackend(backend)
+	slog.Info("Admin added backend", "backend", backend.URL.String(), "backend_id", backend.ID, "pool", pool.Name)
+	return pool, nil
+}
+
+// removeBackend removes the backend named by id or rawURL from the named
+// pool
+func (lb *Balancer) removeBackend(poolName, id, rawURL string) (*ServerPool, error) {
+	pool, err := lb.adminPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	existing := pool.findBackend(id, rawURL)
+	if existing == nil {
+		return nil, adminErrorf(http.StatusNotFound, "Unknown backend %q in pool %s", backendRef(id, rawURL), pool.Name)
+	}
+	pool.RemoveBackend(existing)
+	slog.Info("Admin removed backend", "backend", existing.URL.String(), "backend_id", existing.ID, "pool", pool.Name)
+	return pool, nil
+}
+
+// drainBackend takes the backend named by id or rawURL out of rotation, or
+// puts it back
+func (lb *Balancer) drainBackend(poolName, id, rawURL string, drain bool) (*ServerPool, *Backend, error) {
+	pool, err := lb.adminPool(poolName)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := pool.findBackend(id, rawURL)
+	if b == nil {
+		return nil, nil, adminErrorf(http.StatusNotFound, "Unknown backend %q in pool %s", backendRef(id, rawURL), pool.Name)
+	}
+	b.SetCordoned(drain)
+	reason := "drained by operator"
+	if !drain {
+		reason = "restored by operator"
+	}
+	watchers.status(pool, b, reason)
+	slog.Info("Admin changed backend state", "backend", b.URL.String(), "backend_id", b.ID, "pool", pool.Name, "status", b.Status())
+	return pool, b, nil
+}
+
+// switchAlgorithm makes name the default balancing algorithm
+func (lb *Balancer) switchAlgorithm(name Strategy) error {
+	if name == "" || name.validate() != nil {
+		return adminErrorf(http.StatusBadRequest, "Unknown algorithm %q", name)
+	}
+	if old := lb.setAlgorithm(name); old != name {
+		slog.Info("Algorithm switched", "from", old, "to", name)
+	}
+	return nil
+}
+
+// reloadConfig reads the config file again and switches to it, keeping the
+// running config if the file is invalid. Balancers following etcd take
+// their config from there instead.
+func (lb *Balancer) reloadConfig() error {
+	if lb.config().Etcd != nil {
+		return &adminError{http.StatusConflict, grpcFailedPrecondition, "Config comes from etcd, update it there"}
+	}
+	if cli.configPath == "" {
+		return &adminError{http.StatusConflict, grpcFailedPrecondition, "No config file to reload"}
+	}
+	cfg, err := loadConfig(cli.configPath)
+	if err == nil {
+		err = lb.applyConfig(cfg)
+	}
+	if err != nil {
+		slog.Warn("Config not reloaded", "file", cli.configPath, "error", err)
+		return adminErrorf(http.StatusUnprocessableEntity, "%s", err)
+	}
+	slog.Info("Config reloaded", "file", cli.configPath)
+	return nil
+}
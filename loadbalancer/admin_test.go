@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	lb, _ := installPool(t, RoundRobin, testBackend(t, "a", 0).URL)
+	cfg := *lb.config()
+	lb.setConfig(&cfg)
+	request := func(h http.Handler, method, path, remote, token string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"name": "round-robin"}`))
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	remote, local := "192.0.2.10:40000", "127.0.0.1:40000"
+
+	// Without a token the proxy listeners serve no admin endpoint to
+	// anyone, loopback clients included, probes and gossip aside
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		for _, addr := range []string{remote, local} {
+			if code := request(lb.Handler(), method, "/lb/algorithm", addr, ""); code != http.StatusForbidden {
+				t.Errorf("%s from %s without a token: status %d, want 403", method, addr, code)
+			}
+		}
+	}
+	for _, path := range []string{"/lb/stats", "/lb/backends", "/lb/debug/runtime", "/lb/metrics"} {
+		if code := request(lb.Handler(), http.MethodGet, path, local, ""); code != http.StatusForbidden {
+			t.Errorf("%s without a token: status %d, want 403", path, code)
+		}
+	}
+	if code := request(lb.Handler(), http.MethodGet, "/lb/healthz", remote, ""); code != http.StatusOK {
+		t.Errorf("health check without a token: status %d, want 200", code)
+	}
+
+	// With one, everyone needs it there, for reads too
+	cfg.Admin.Token = "admin-token"
+	for _, path := range []string{"/lb/algorithm", "/lb/drain", "/lb/reload", "/lb/backends", "/lb/ha"} {
+		if code := request(lb.Handler(), http.MethodPost, path, local, ""); code != http.StatusUnauthorized {
+			t.Errorf("%s without the token: status %d, want 401", path, code)
+		}
+		if code := request(lb.Handler(), http.MethodPost, path, local, "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("%s with a wrong token: status %d, want 401", path, code)
+		}
+	}
+	if code := request(lb.Handler(), http.MethodGet, "/lb/stats", remote, ""); code != http.StatusUnauthorized {
+		t.Errorf("read without the token: status %d, want 401", code)
+	}
+	if code := request(lb.Handler(), http.MethodGet, "/lb/stats", remote, "admin-token"); code != http.StatusOK {
+		t.Errorf("read with the token: status %d, want 200", code)
+	}
+	if code := request(lb.Handler(), http.MethodPost, "/lb/algorithm", remote, "admin-token"); code != http.StatusOK {
+		t.Errorf("change with the token: status %d, want 200", code)
+	}
+	// The admin listener serves reads to anyone but changes need the token
+	if code := request(lb.adminHandler(true), http.MethodGet, "/lb/stats", remote, ""); code != http.StatusOK {
+		t.Errorf("read on the admin listener: status %d, want 200", code)
+	}
+	if code := request(lb.adminHandler(true), http.MethodPost, "/lb/algorithm", remote, ""); code != http.StatusUnauthorized {
+		t.Errorf("change on the admin listener without the token: status %d, want 401", code)
+	}
+
+	// An admin listener takes the endpoints off the proxy's, probes aside
+	cfg.Admin = AdminConfig{Address: "127.0.0.1:0"}
+	if code := request(lb.Handler(), http.MethodGet, "/lb/stats", local, ""); code != http.StatusNotFound {
+		t.Errorf("stats on the proxy listener: status %d, want 404", code)
+	}
+	if code := request(lb.Handler(), http.MethodGet, "/lb/healthz", remote, ""); code != http.StatusOK {
+		t.Errorf("health check on the proxy listener: status %d, want 200", code)
+	}
+	if code := request(lb.adminHandler(true), http.MethodPost, "/lb/algorithm", remote, ""); code != http.StatusOK {
+		t.Errorf("change on the admin listener: status %d, want 200", code)
+	}
+}
@@ -0,0 +1,115 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer balances requests over the pools of its config. The lb
+// command runs one from its config file; programs embedding the package
+// create one with New and install a Router on it.
+type Balancer struct {
+	// running is swapped whole when the config changes, so requests see
+	// a config and its pools together; it is only read through config
+	// and pools
+	running atomic.Pointer[runningState]
+	// reloadMu serializes config changes
+	reloadMu sync.Mutex
+	// algorithm is used by routes that do not set their own strategy; it
+	// is switched from the admin API while requests read it, so it is
+	// only accessed through currentAlgorithm and setAlgorithm
+	algorithm atomic.Pointer[Strategy]
+	// warmUpNew is set once Start runs, backends added after that have to
+	// warm up before receiving traffic
+	warmUpNew atomic.Bool
+	// lastHealthCycle holds the summary of the most recent check cycle
+	lastHealthCycle atomic.Pointer[healthSummary]
+	// cluster holds what the other nodes gossiped, ha the node's part in
+	// failover, nil unless configured
+	cluster *clusterState
+	ha      *haNode
+}
+
+// New returns a balancer running the default config without any pools
+func New() *Balancer {
+	lb := &Balancer{}
+	lb.cluster = newClusterState(lb)
+	lb.running.Store(&runningState{config: defaultConfig(), pools: map[string]*ServerPool{}})
+	return lb
+}
+
+// runningState is the config the balancer runs with and the pools built
+// from it
+type runningState struct {
+	config *Config
+	pools  map[string]*ServerPool
+}
+
+// config returns the running config, which must not be modified
+func (lb *Balancer) config() *Config {
+	return lb.running.Load().config
+}
+
+// pools returns the running pools by name; the map must not be modified
+func (lb *Balancer) pools() map[string]*ServerPool {
+	return lb.running.Load().pools
+}
+
+// setConfig switches to cfg, keeping the pools
+func (lb *Balancer) setConfig(cfg *Config) {
+	lb.reloadMu.Lock()
+	defer lb.reloadMu.Unlock()
+	lb.running.Store(&runningState{config: cfg, pools: lb.pools()})
+}
+
+// switchConfig switches to cfg and next, stopping the discovery of
+// pools left out of next; reloadMu must be held
+func (lb *Balancer) switchConfig(cfg *Config, next map[string]*ServerPool) {
+	for _, pool := range next {
+		if pool.lb == nil {
+			pool.lb = lb
+		}
+	}
+	previous := lb.running.Swap(&runningState{config: cfg, pools: next})
+	for name, pool := range previous.pools {
+		if next[name] != pool {
+			pool.close()
+		}
+	}
+}
+
+// currentAlgorithm returns the active algorithm, round-robin until set
+func (lb *Balancer) currentAlgorithm() Strategy {
+	if s := lb.algorithm.Load(); s != nil {
+		return *s
+	}
+	return RoundRobin
+}
+
+// setAlgorithm switches the active algorithm and returns the previous one
+func (lb *Balancer) setAlgorithm(s Strategy) Strategy {
+	if old := lb.algorithm.Swap(&s); old != nil {
+		return *old
+	}
+	return RoundRobin
+}
+
+type balancerKey struct{}
+
+// withBalancer attaches the balancer serving a request to its context
+func withBalancer(ctx context.Context, lb *Balancer) context.Context {
+	return context.WithValue(ctx, balancerKey{}, lb)
+}
+
+// balancerFrom returns the balancer attached to ctx; every request the
+// balancer's handlers serve carries it
+func balancerFrom(ctx context.Context) *Balancer {
+	return ctx.Value(balancerKey{}).(*Balancer)
+}
+
+// requestConfig returns the running config of the balancer serving r
+func requestConfig(r *http.Request) *Config {
+	return balancerFrom(r.Context()).config()
+}
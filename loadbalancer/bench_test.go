@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchPool returns a pool of n members with spread out latencies
+func benchPool(b *testing.B, n int) *ServerPool {
+	b.Helper()
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://10.0.%d.%d:8080", i/250, i%250+1)
+	}
+	pool, err := NewPool("bench", urls...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i, backend := range pool.Backends() {
+		backend.UpdateLatency(int64(10 + i%7))
+	}
+	return pool
+}
+
+var benchSizes = []int{3, 32, 256}
+
+func BenchmarkGetNextPeer(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("backends=%d", n), func(b *testing.B) {
+			pool := benchPool(b, n)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if pool.GetNextPeer() == nil {
+						b.Fatal("no peer")
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetLeastLatencyPeer(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("backends=%d", n), func(b *testing.B) {
+			pool := benchPool(b, n)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if pool.GetLeastLatencyPeer() == nil {
+						b.Fatal("no peer")
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSelectPeer covers every strategy selectPeer knows, so new ones
+// are measured without touching this file
+func BenchmarkSelectPeer(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("client-%d", i)
+	}
+	for _, strategy := range strategies {
+		for _, n := range benchSizes {
+			b.Run(fmt.Sprintf("%s/backends=%d", strategy, n), func(b *testing.B) {
+				pool := benchPool(b, n)
+				route := &RouteConfig{Strategy: strategy}
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						i++
+						if selectPeer(route, pool, keys[i%len(keys)], nil) == nil {
+							b.Fatal("no peer")
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig controls the in-memory response cache
+type CacheConfig struct {
+	Enabled       bool     `json:"enabled"`
+	TTL           Duration `json:"ttl"`
+	MaxBytes      int64    `json:"max_bytes"`
+	MaxEntryBytes int64    `json:"max_entry_bytes"`
+
+	// StaleWhileRevalidate serves expired entries for this long while a
+	// background request refreshes them
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+	// StaleIfError serves expired entries for this long when no backend
+	// of the pool is available
+	StaleIfError Duration `json:"stale_if_error"`
+}
+
+// RouteCacheConfig overrides the cache settings for one route
+type RouteCacheConfig struct {
+	Enabled              *bool    `json:"enabled,omitempty"`
+	TTL                  Duration `json:"ttl,omitempty"`
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         Duration `json:"stale_if_error,omitempty"`
+	// Cookies caches requests carrying cookies, for routes whose
+	// responses do not depend on them; they skip the cache otherwise
+	Cookies bool `json:"cookies,omitempty"`
+}
+
+// cachePolicy is the effective cache behaviour of a route
+type cachePolicy struct {
+	enabled              bool
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	cookies              bool
+}
+
+// CacheFor returns the cache policy of route, the TTL applies when the
+// backend does not send one
+func (c *Config) CacheFor(route *RouteConfig) cachePolicy {
+	p := cachePolicy{
+		enabled:              c.Cache.Enabled,
+		ttl:                  time.Duration(c.Cache.TTL),
+		staleWhileRevalidate: time.Duration(c.Cache.StaleWhileRevalidate),
+		staleIfError:         time.Duration(c.Cache.StaleIfError),
+	}
+	if route != nil && route.Cache != nil {
+		rc := route.Cache
+		if rc.Enabled != nil {
+			p.enabled = *rc.Enabled
+		}
+		if rc.TTL != 0 {
+			p.ttl = time.Duration(rc.TTL)
+		}
+		if rc.StaleWhileRevalidate != 0 {
+			p.staleWhileRevalidate = time.Duration(rc.StaleWhileRevalidate)
+		}
+		if rc.StaleIfError != 0 {
+			p.staleIfError = time.Duration(rc.StaleIfError)
+		}
+		p.cookies = rc.Cookies
+	}
+	return p
+}
+
+// cacheState describes how usable a cached entry is
+type cacheState int
+
+const (
+	cacheMiss  cacheState = iota
+	cacheFresh            // within its TTL
+	cacheStale            // expired but inside the stale-while-revalidate window
+	cacheError            // only usable when the backends are unavailable
+)
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	// key is the request's cacheKey followed by the values of the
+	// headers the response varies on
+	key        string
+	uri        string
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	staleUntil time.Time
+	errorUntil time.Time
+}
+
+// state classifies the entry at time now
+func (e *cacheEntry) state(now time.Time) cacheState {
+	switch {
+	case now.Before(e.expires):
+		return cacheFresh
+	case now.Before(e.staleUntil):
+		return cacheStale
+	case now.Before(e.errorUntil):
+		return cacheError
+	}
+	return cacheMiss
+}
+
+// size approximates the memory held by the entry
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.key) + len(e.body))
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// responseCache is an LRU cache bounded by total body size
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// varies holds the Vary header names of the latest response stored
+	// for each cacheKey, which the keys of its entries go by
+	varies     map[string]*variants
+	lru        *list.List
+	bytes      int64
+	hits       int64
+	misses     int64
+	stale      int64
+	refreshing map[string]bool
+}
+
+// variants are the entries stored for one cacheKey
+type variants struct {
+	vary    []string
+	entries int
+}
+
+var cache = &responseCache{
+	entries:    map[string]*list.Element{},
+	varies:     map[string]*variants{},
+	lru:        list.New(),
+	refreshing: map[string]bool{},
+}
+
+// cacheKey identifies a request in the cache, up to the headers its
+// response varies on
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// varyKey extends cacheKey with the values r has for the vary headers,
+// so every variant of a response has an entry of its own
+func varyKey(r *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(cacheKey(r))
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the sorted, canonical header names h varies on
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// key returns the key r's entry is stored under; c.mu must be held
+func (c *responseCache) key(r *http.Request) string {
+	var vary []string
+	if v := c.varies[cacheKey(r)]; v != nil {
+		vary = v.vary
+	}
+	return varyKey(r, vary)
+}
+
+// Key returns the key r's entry is stored under
+func (c *responseCache) Key(r *http.Request) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.key(r)
+}
+
+// Get returns the entry matching r and how usable it is; callers that
+// cannot use a stale or error-only entry should treat it as a miss
+func (c *responseCache) Get(r *http.Request) (*cacheEntry, cacheState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[c.key(r)]
+	if !ok {
+		return nil, cacheMiss
+	}
+	e := el.Value.(*cacheEntry)
+	state := e.state(time.Now())
+	if state == cacheMiss {
+		c.remove(el)
+		return nil, cacheMiss
+	}
+	c.lru.MoveToFront(el)
+	return e, state
+}
+
+// count records the outcome of a lookup
+func (c *responseCache) count(state cacheState) {
+	c.mu.Lock()
+	switch state {
+	case cacheFresh:
+		c.hits++
+	case cacheStale, cacheError:
+		c.stale++
+	default:
+		c.misses++
+	}
+	c.mu.Unlock()
+}
+
+// beginRefresh claims the background refresh of key, false if one is running
+func (c *responseCache) beginRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+// endRefresh releases a claim taken with beginRefresh
+func (c *responseCache) endRefresh(key string) {
+	c.mu.Lock()
+	delete(c.refreshing, key)
+	c.mu.Unlock()
+}
+
+// Set stores e, the response to r varying on vary, evicting least
+// recently used entries to stay under maxBytes
+func (c *responseCache) Set(r *http.Request, vary []string, e *cacheEntry, maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.uri, e.key = cacheKey(r), varyKey(r, vary)
+	if old, ok := c.entries[e.key]; ok {
+		c.remove(old)
+	}
+	// Entries keyed on other headers are left to age out of the LRU
+	v := c.varies[e.uri]
+	if v == nil {
+		v = &variants{}
+		c.varies[e.uri] = v
+	}
+	v.vary = vary
+	v.entries++
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+
+	for c.bytes > maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an element, the caller holds c.mu
+func (c *responseCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.bytes -= e.size()
+	if v := c.varies[e.uri]; v != nil {
+		if v.entries--; v.entries == 0 {
+			delete(c.varies, e.uri)
+		}
+	}
+}
+
+// Purge empties the cache
+func (c *responseCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.lru.Len()
+	c.entries = map[string]*list.Element{}
+	c.varies = map[string]*variants{}
+	c.lru.Init()
+	c.bytes = 0
+	return n
+}
+
+// Stats returns hit/miss counters and the current size
+func (c *responseCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]interface{}{
+		"entries": c.lru.Len(),
+		"bytes":   c.bytes,
+		"hits":    c.hits,
+		"stale":   c.stale,
+		"misses":  c.misses,
+	}
+}
+
+// cacheableRequest reports whether r may be answered from or stored in
+// the cache under policy p. Cookies usually pick what the backend answers
+// without a Vary saying so, requests with them skip the cache unless the
+// route says otherwise.
+func cacheableRequest(r *http.Request, p cachePolicy) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	if r.Header.Get("Cookie") != "" && !p.cookies {
+		return false
+	}
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noStore := cc["no-store"]
+	return !noStore
+}
+
+// wantsRevalidation reports whether the client asked to bypass cached copies
+func wantsRevalidation(r *http.Request) bool {
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	return noCache || r.Header.Get("Pragma") == "no-cache"
+}
+
+// parseCacheControl splits a Cache-Control header into directives
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return cc
+}
+
+// cacheableStatus lists the statuses we are willing to store
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// staleWindows applies the response's own stale-while-revalidate and
+// stale-if-error directives (RFC 5861) over the route policy
+func staleWindows(h http.Header, p cachePolicy) (time.Duration, time.Duration) {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	swr, sie := p.staleWhileRevalidate, p.staleIfError
+	if v, ok := cc["stale-while-revalidate"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			swr = time.Duration(secs) * time.Second
+		}
+	}
+	if v, ok := cc["stale-if-error"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			sie = time.Duration(secs) * time.Second
+		}
+	}
+	if _, ok := cc["must-revalidate"]; ok {
+		swr, sie = 0, 0
+	}
+	return swr, sie
+}
+
+// responseTTL works out how long a response may be cached, zero means not at all
+func responseTTL(status int, h http.Header, fallback time.Duration) time.Duration {
+	if !cacheableStatus[status] || h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return 0
+	}
+
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return time.Until(expires)
+	}
+	return fallback
+}
+
+// serveCached writes a cached entry to the client
+func serveCached(w http.ResponseWriter, e *cacheEntry, state cacheState) {
+	header := w.Header()
+	for k, vs := range e.header {
+		header[k] = append([]string(nil), vs...)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	if state == cacheFresh {
+		header.Set("X-Cache", "HIT")
+	} else {
+		header.Set("X-Cache", "STALE")
+		header.Add("Warning", `110 - "Response is Stale"`)
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// cacheWriter copies a response while it is streamed to the client
+type cacheWriter struct {
+	http.ResponseWriter
+	status int
+	// header is the response header as the backend sent it; writers
+	// further out, such as compression, change the shared map after
+	// seeing the body, which the stored copy must not describe
+	header   http.Header
+	body     []byte
+	limit    int64
+	overflow bool
+}
+
+func (c *cacheWriter) WriteHeader(code int) {
+	// Only the final response is stored, informational ones pass through
+	if c.status == 0 && code >= 200 {
+		c.status = code
+		c.header = c.Header().Clone()
+		if c.Header().Get("X-Cache") == "" {
+			c.Header().Set("X-Cache", "MISS")
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if int64(len(c.body)+len(b)) > c.limit {
+			c.overflow = true
+			c.body = nil
+		} else {
+			c.body = append(c.body, b...)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// store saves the captured response for r if it is cacheable
+func (c *cacheWriter) store(r *http.Request, p cachePolicy) {
+	if c.overflow || c.status == 0 {
+		return
+	}
+	storeResponse(r, c.status, c.header, c.body, p)
+}
+
+// storeResponse caches a complete response to r according to policy p
+func storeResponse(r *http.Request, status int, h http.Header, body []byte, p cachePolicy) {
+	ttl := responseTTL(status, h, p.ttl)
+	if ttl <= 0 {
+		return
+	}
+	swr, sie := staleWindows(h, p)
+
+	header := h.Clone()
+	header.Del("X-Cache")
+
+	now := time.Now()
+	expires := now.Add(ttl)
+	staleUntil := expires.Add(swr)
+	cache.Set(r, varyHeaders(header), &cacheEntry{
+		status:     status,
+		header:     header,
+		body:       body,
+		stored:     now,
+		expires:    expires,
+		staleUntil: staleUntil,
+		errorUntil: staleUntil.Add(sie),
+	}, requestConfig(r).Cache.MaxBytes)
+}
+
+// refreshCache re-fetches r from pool in the background and stores the
+// result, at most one refresh per key runs at a time
+func refreshCache(r *http.Request, pool *ServerPool, timeouts TimeoutConfig, p cachePolicy) {
+	key := cache.Key(r)
+	if !cache.beginRefresh(key) {
+		return
+	}
+
+	go func() {
+		defer cache.endRefresh(key)
+
+		// Refreshes count towards the backend's latency like live requests
+		ctx := withUpstreamTiming(withTimeouts(withBalancer(context.Background(), pool.lb), timeouts), &upstreamTiming{})
+		if timeouts.Total > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeouts.Total))
+			defer cancel()
+		}
+		req := r.Clone(ctx)
+		req.Header.Del("Cache-Control")
+		req.Header.Del("Pragma")
+
+		peer := pool.GetNextPeer()
+		if peer == nil {
+			return
+		}
+		bw := &bufferWriter{header: http.Header{}, limit: pool.settings().Cache.MaxEntryBytes}
+		peer.ReverseProxy.ServeHTTP(bw, req)
+		if bw.status != 0 && bw.status < 500 && !bw.overflow {
+			storeResponse(req, bw.status, bw.header, bw.body, p)
+		}
+	}()
+}
+
+// errEntryTooLarge stops copying a response the cache would not store
+var errEntryTooLarge = errors.New("cache: response larger than max_entry_bytes")
+
+// bufferWriter collects a whole response in memory, up to limit bytes;
+// past that it drops what it has and fails the write, so the proxy stops
+// reading the body
+type bufferWriter struct {
+	header   http.Header
+	status   int
+	body     []byte
+	limit    int64
+	overflow bool
+}
+
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferWriter) WriteHeader(code int) {
+	// Informational responses come ahead of the one to store
+	if b.status == 0 && code >= 200 {
+		b.status = code
+	}
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	if b.overflow || int64(len(b.body)+len(p)) > b.limit {
+		b.overflow, b.body = true, nil
+		return 0, errEntryTooLarge
+	}
+	b.body = append(b.body, p...)
+	return len(p), nil
+}
+
+// cachePurgeHandler drops every cached response
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := cache.Purge()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"purged":  n,
+		"message": "Cache purged",
+	})
+}
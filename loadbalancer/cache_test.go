@@ -0,0 +1,184 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCacheWithCompression(t *testing.T) {
+	page := strings.Repeat("cacheable text ", 110)
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, page)
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.Cache.Enabled = true
+	cfg.Compression.Enabled = true
+	lb.setConfig(&cfg)
+	cache.Purge()
+	t.Cleanup(func() { cache.Purge() })
+
+	get := func(acceptEncoding string) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		lb.Handler().ServeHTTP(rec, req)
+		var body io.Reader = rec.Body
+		switch rec.Header().Get("Content-Encoding") {
+		case "gzip":
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				t.Fatalf("gzip body: %v", err)
+			}
+			body = zr
+		case "br":
+			body = brotli.NewReader(body)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s body: %v", rec.Header().Get("Content-Encoding"), err)
+		}
+		return rec, string(data)
+	}
+
+	rec, body := get("gzip")
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Header().Get("Content-Encoding") != "gzip" || body != page {
+		t.Errorf("first request: %s, encoding %q, %d bytes", rec.Header().Get("X-Cache"), rec.Header().Get("Content-Encoding"), len(body))
+	}
+	// The stored copy is the backend's, compressed again for each client
+	rec, body = get("")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Content-Encoding") != "" || body != page {
+		t.Errorf("hit without compression: %s, encoding %q, %d bytes", rec.Header().Get("X-Cache"), rec.Header().Get("Content-Encoding"), len(body))
+	}
+	rec, body = get("br, gzip")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Content-Encoding") != "br" || body != page ||
+		!slices.Contains(rec.Header().Values("Vary"), "Accept-Encoding") {
+		t.Errorf("hit with brotli: %s, encoding %q, vary %q, %d bytes", rec.Header().Get("X-Cache"),
+			rec.Header().Get("Content-Encoding"), rec.Header().Values("Vary"), len(body))
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend saw %d requests, want 1", n)
+	}
+
+	// Authenticated requests neither get nor leave a cached copy
+	cache.Purge()
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Header.Set("Authorization", "Bearer user-token")
+	rec = httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rec, req)
+	if rec.Header().Get("X-Cache") != "" || rec.Body.String() != page {
+		t.Errorf("authenticated request: %q, %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if rec, _ = get(""); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("request after an authenticated one: %s, want MISS", rec.Header().Get("X-Cache"))
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("backend saw %d requests, want 3", n)
+	}
+}
+
+func TestCacheVaryAndCookies(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "accept-language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.Cache.Enabled = true
+	lb.setConfig(&cfg)
+	cache.Purge()
+	t.Cleanup(func() { cache.Purge() })
+
+	get := func(lang, cookie string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/greeting", nil)
+		req.Header.Set("Accept-Language", lang)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		lb.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Each language gets an entry of its own rather than replacing the other's
+	for i, want := range []string{"MISS", "MISS", "HIT", "HIT"} {
+		lang := []string{"en", "fr"}[i%2]
+		if rec := get(lang, ""); rec.Header().Get("X-Cache") != want || rec.Body.String() != lang {
+			t.Errorf("request %d for %s: %s with %q, want %s", i, lang, rec.Header().Get("X-Cache"), rec.Body.String(), want)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("backend saw %d requests, want one per language", n)
+	}
+
+	// Requests with cookies skip the cache...
+	if rec := get("en", "session=alice"); rec.Header().Get("X-Cache") != "" {
+		t.Errorf("request with a cookie: X-Cache %q, want the cache skipped", rec.Header().Get("X-Cache"))
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("backend saw %d requests, want the one with a cookie to reach it", n)
+	}
+	// ...unless the route opts in
+	cfg.Routes = slices.Clone(cfg.Routes)
+	cfg.Routes[0].Cache = &RouteCacheConfig{Cookies: true}
+	if rec := get("en", "session=alice"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "en" {
+		t.Errorf("request with a cookie on an opted-in route: %s with %q, want HIT", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+// TestRefreshBufferLimit checks a background refresh stops reading a body
+// the cache would not keep instead of buffering all of it
+func TestRefreshBufferLimit(t *testing.T) {
+	const size = 64 << 20
+	var written atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 32<<10)
+		for written.Load() < size {
+			n, err := w.Write(chunk)
+			written.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	_, pool := installPool(t, RoundRobin, backend.URL)
+
+	bw := &bufferWriter{header: http.Header{}, limit: 1 << 10}
+	pool.Backends()[0].ReverseProxy.ServeHTTP(bw, httptest.NewRequest(http.MethodGet, "/big", nil))
+	if !bw.overflow || bw.body != nil {
+		t.Errorf("overflow %v with %d bytes kept, want the body dropped", bw.overflow, len(bw.body))
+	}
+	if n := written.Load(); n >= size {
+		t.Errorf("backend sent all %d bytes to a refresh keeping at most 1KiB", n)
+	}
+
+	// Early hints do not stand in for the final status
+	bw = &bufferWriter{header: http.Header{}, limit: 1 << 10}
+	bw.WriteHeader(http.StatusEarlyHints)
+	bw.WriteHeader(http.StatusNotFound)
+	if bw.status != http.StatusNotFound {
+		t.Errorf("status %d after 103 and 404, want 404", bw.status)
+	}
+}
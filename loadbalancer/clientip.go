@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPConfig finds the real client address when the balancer sits
+// behind a CDN or other proxies that append to X-Forwarded-For. The
+// address is what IP filters, GeoIP, client hashing, scripts and the
+// access log see.
+type ClientIPConfig struct {
+	// TrustedHops is how many proxies in front of the balancer append to
+	// X-Forwarded-For; the client is that many entries from the right.
+	// 0 uses the address of the connection.
+	TrustedHops int `json:"trusted_hops"`
+	// TrustedProxies, if set, limits X-Forwarded-For to connections from
+	// these networks, others are taken at their connection's address
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	proxies []netip.Prefix
+}
+
+// validate checks the hop count and parses the trusted networks
+func (c *ClientIPConfig) validate() error {
+	if c.TrustedHops < 0 {
+		return fmt.Errorf("client_ip: trusted_hops must not be negative")
+	}
+	var err error
+	if c.proxies, err = parsePrefixes(c.TrustedProxies); err != nil {
+		return fmt.Errorf("client_ip: trusted_proxies: %w", err)
+	}
+	return nil
+}
+
+// clientAddr returns the address of the client, past any trusted proxies
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	peer, ok := peerAddr(r)
+	if !ok {
+		return peer, false
+	}
+	return requestConfig(r).ClientIP.forwardedFor(peer, r), true
+}
+
+// peerAddr returns the address of whoever is connected to the balancer
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedFor returns the client address the trusted hops put in
+// X-Forwarded-For, or peer when there is none to believe. A header with
+// fewer entries than hops came through fewer proxies, all of them trusted,
+// so its first entry is the client.
+func (c *ClientIPConfig) forwardedFor(peer netip.Addr, r *http.Request) netip.Addr {
+	if c.TrustedHops == 0 || !c.trusts(peer) {
+		return peer
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 {
+		return peer
+	}
+	i := len(hops) - c.TrustedHops
+	if i < 0 {
+		i = 0
+	}
+	addr, err := netip.ParseAddr(hops[i])
+	if err != nil {
+		return peer
+	}
+	return addr.Unmap()
+}
+
+// trusts reports whether X-Forwarded-For from peer is believed
+func (c *ClientIPConfig) trusts(peer netip.Addr) bool {
+	if len(c.proxies) == 0 {
+		return true
+	}
+	for _, p := range c.proxies {
+		if p.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientString is the client for logs: the connection's address and port,
+// or the forwarded address when there are trusted hops
+func clientString(r *http.Request) string {
+	if requestConfig(r).ClientIP.TrustedHops == 0 {
+		return r.RemoteAddr
+	}
+	if addr, ok := clientAddr(r); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
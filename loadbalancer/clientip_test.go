@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedHops(t *testing.T) {
+	lb := New()
+	cfg := *lb.config()
+	request := func(remote string, xff ...string) *http.Request {
+		r := httptest.NewRequestWithContext(withBalancer(context.Background(), lb), http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		for _, v := range xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		name    string
+		client  ClientIPConfig
+		request *http.Request
+		want    string
+	}{
+		{"no hops", ClientIPConfig{}, request("10.0.0.9:1234", "1.1.1.1"), "10.0.0.9"},
+		{"one hop", ClientIPConfig{TrustedHops: 1}, request("10.0.0.9:1234", "6.6.6.6, 1.1.1.1"), "1.1.1.1"},
+		{"two hops over two headers", ClientIPConfig{TrustedHops: 2}, request("10.0.0.9:1234", "6.6.6.6, 1.1.1.1", "2.2.2.2"), "1.1.1.1"},
+		{"fewer entries than hops", ClientIPConfig{TrustedHops: 3}, request("10.0.0.9:1234", "1.1.1.1"), "1.1.1.1"},
+		{"no header", ClientIPConfig{TrustedHops: 1}, request("10.0.0.9:1234"), "10.0.0.9"},
+		{"garbage", ClientIPConfig{TrustedHops: 1}, request("10.0.0.9:1234", "unknown"), "10.0.0.9"},
+		{"trusted proxy", ClientIPConfig{TrustedHops: 1, TrustedProxies: []string{"10.0.0.0/8"}}, request("10.0.0.9:1234", "1.1.1.1"), "1.1.1.1"},
+		{"untrusted proxy", ClientIPConfig{TrustedHops: 1, TrustedProxies: []string{"10.0.0.0/8"}}, request("6.6.6.6:1234", "1.1.1.1"), "6.6.6.6"},
+	} {
+		c := cfg
+		c.ClientIP = tc.client
+		if err := c.ClientIP.validate(); err != nil {
+			t.Fatal(err)
+		}
+		lb.setConfig(&c)
+		if addr, ok := clientAddr(tc.request); !ok || addr.String() != tc.want {
+			t.Errorf("%s: client %v, want %s", tc.name, addr, tc.want)
+		}
+		if key := HashOn("client:ip").key(tc.request); key != tc.want {
+			t.Errorf("%s: hash key %q, want %s", tc.name, key, tc.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientConcurrencyConfig caps how many requests each client has in
+// flight, so one client sending slow requests cannot tie up every
+// backend. Unlike a rate limit it leaves clients whose requests finish
+// quickly alone.
+type ClientConcurrencyConfig struct {
+	MaxInFlight int `json:"max_in_flight"`
+	// IPv6PrefixBits counts IPv6 clients by network, since one host
+	// usually has a whole /64 to pick addresses from; 64 if 0
+	IPv6PrefixBits int `json:"ipv6_prefix_bits,omitempty"`
+	// Exempt lists CIDRs or addresses that are never capped
+	Exempt []string `json:"exempt,omitempty"`
+	// DryRun logs and meters rejections without rejecting the client
+	DryRun bool `json:"dry_run,omitempty"`
+
+	exempt []netip.Prefix
+}
+
+// validate fills in defaults and parses the exemptions
+func (c *ClientConcurrencyConfig) validate() error {
+	if c.MaxInFlight <= 0 {
+		return fmt.Errorf("client_concurrency: max_in_flight must be positive")
+	}
+	if c.IPv6PrefixBits == 0 {
+		c.IPv6PrefixBits = 64
+	}
+	if c.IPv6PrefixBits < 0 || c.IPv6PrefixBits > 128 {
+		return fmt.Errorf("client_concurrency: ipv6_prefix_bits must be between 1 and 128")
+	}
+	exempt, err := parsePrefixes(c.Exempt)
+	if err != nil {
+		return fmt.Errorf("client_concurrency: exempt: %w", err)
+	}
+	c.exempt = exempt
+	return nil
+}
+
+// keyFor returns what addr's requests are counted under, false if they
+// are exempt
+func (c *ClientConcurrencyConfig) keyFor(addr netip.Addr) (netip.Prefix, bool) {
+	for _, p := range c.exempt {
+		if p.Contains(addr) {
+			return netip.Prefix{}, false
+		}
+	}
+	bits := addr.BitLen()
+	if addr.Is6() {
+		bits = c.IPv6PrefixBits
+	}
+	key, _ := addr.Prefix(bits)
+	return key, true
+}
+
+// clientSlots counts the requests each client has in flight
+type clientSlots struct {
+	mu       sync.Mutex
+	inFlight map[netip.Prefix]int
+	rejected atomic.Int64
+}
+
+var clientsInFlight = &clientSlots{inFlight: map[netip.Prefix]int{}}
+
+// acquire takes one of key's slots, reporting false if all max are taken
+func (s *clientSlots) acquire(key netip.Prefix, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[key] >= max {
+		s.rejected.Add(1)
+		return false
+	}
+	s.inFlight[key]++
+	return true
+}
+
+// release returns a slot taken by acquire
+func (s *clientSlots) release(key netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight[key]--; s.inFlight[key] <= 0 {
+		delete(s.inFlight, key)
+	}
+}
+
+// clients returns how many clients have requests in flight
+func (s *clientSlots) clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inFlight)
+}
+
+// limitClients holds each client to its share of requests in flight
+func limitClients(x *exchange, next func()) {
+	c := x.lb.config().ClientConcurrency
+	if c == nil {
+		next()
+		return
+	}
+	addr, ok := clientAddr(x.r)
+	if !ok {
+		// Unix sockets and the like carry no address to count by
+		next()
+		return
+	}
+	key, capped := c.keyFor(addr)
+	if !capped {
+		next()
+		return
+	}
+	if !clientsInFlight.acquire(key, c.MaxInFlight) {
+		if x.lb.config().DryRun || c.DryRun {
+			dryRuns.Record("client_concurrency", "reject", x.r)
+			next()
+			return
+		}
+		slog.Debug("Client has too many requests in flight", "client", key.String(), "max", c.MaxInFlight, "path", x.r.URL.Path)
+		x.w.Header().Set("Retry-After", "1")
+		writeError(x.w, x.r, http.StatusTooManyRequests, "Too many concurrent requests")
+		return
+	}
+	defer clientsInFlight.release(key)
+	next()
+}
@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestClientConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	var inside sync.WaitGroup
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			inside.Done()
+			<-release
+		}
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.ClientConcurrency = &ClientConcurrencyConfig{MaxInFlight: 2}
+	if err := cfg.ClientConcurrency.validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb.setConfig(&cfg)
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+
+	get := func(path string) int {
+		resp, err := http.Get(front.URL + path)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	var slow sync.WaitGroup
+	inside.Add(2)
+	for i := 0; i < 2; i++ {
+		slow.Add(1)
+		go func() {
+			defer slow.Done()
+			if status := get("/slow"); status != http.StatusOK {
+				t.Errorf("slow request: status %d", status)
+			}
+		}()
+	}
+	inside.Wait()
+	if status := get("/"); status != http.StatusTooManyRequests {
+		t.Errorf("third request in flight: status %d, want 429", status)
+	}
+	close(release)
+	slow.Wait()
+	if status := get("/"); status != http.StatusOK {
+		t.Errorf("request after the others finished: status %d", status)
+	}
+	if n := clientsInFlight.clients(); n != 0 {
+		t.Errorf("%d clients still counted in flight", n)
+	}
+
+	c := &ClientConcurrencyConfig{MaxInFlight: 1, Exempt: []string{"10.0.0.0/8"}}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, capped := c.keyFor(netip.MustParseAddr("10.1.2.3")); capped {
+		t.Error("exempt client was capped")
+	}
+	a, _ := c.keyFor(netip.MustParseAddr("2001:db8::1"))
+	b, _ := c.keyFor(netip.MustParseAddr("2001:db8::ffff"))
+	if a != b || a.String() != "2001:db8::/64" {
+		t.Errorf("IPv6 clients in one /64 counted as %v and %v", a, b)
+	}
+}
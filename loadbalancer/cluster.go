@@ -0,0 +1,228 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterConfig lists the other balancer replicas serving the same traffic
+type ClusterConfig struct {
+	// Peers are admin base URLs such as http://10.0.0.2:8080
+	Peers   []string `json:"peers"`
+	Timeout Duration `json:"timeout"`
+	// Node names this replica to its peers, the hostname if empty
+	Node string `json:"node,omitempty"`
+	// GossipInterval, when set, has the replicas share backend health
+	// and requests in flight so balancing reflects the whole cluster
+	GossipInterval Duration `json:"gossip_interval,omitempty"`
+	// Secret is the key the replicas sign their gossip with, required
+	// with gossip_interval
+	Secret string `json:"secret,omitempty"`
+}
+
+// replicaStats is one replica's /lb/stats answer
+type replicaStats struct {
+	peer  string
+	stats map[string]interface{}
+	err   error
+}
+
+// fetchPeerStats asks every peer for its stats concurrently
+func fetchPeerStats(ctx context.Context, cfg ClusterConfig) []replicaStats {
+	results := make([]replicaStats, len(cfg.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range cfg.Peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			stats, err := fetchStats(ctx, strings.TrimSuffix(peer, "/")+"/lb/stats")
+			results[i] = replicaStats{peer: peer, stats: stats, err: err}
+		}(i, peer)
+	}
+	wg.Wait()
+	return results
+}
+
+// fetchStats decodes the stats document at endpoint
+func fetchStats(ctx context.Context, endpoint string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned %s", resp.Status)
+	}
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// localStats returns this replica's stats in the same shape peers send them
+func (lb *Balancer) localStats() map[string]interface{} {
+	var stats map[string]interface{}
+	raw, _ := json.Marshal(lb.collectStats(statsQuery{}))
+	json.Unmarshal(raw, &stats)
+	return stats
+}
+
+// number reads a JSON number, missing or mistyped values count as zero
+func number(v interface{}) float64 {
+	f, _ := v.(float64)
+	return f
+}
+
+// mergeBackends sums backend counters across replicas; average latency is
+// weighted by each replica's request count
+func mergeBackends(replicas []replicaStats) []map[string]interface{} {
+	type merged struct {
+		entry        map[string]interface{}
+		responses    map[string]float64
+		requests     float64
+		latencySum   float64
+		latencyCount float64
+		up           int
+		seen         int
+	}
+	byKey := map[string]*merged{}
+	var keys []string
+	for _, rep := range replicas {
+		list, _ := rep.stats["backends"].([]interface{})
+		for _, item := range list {
+			b, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key := fmt.Sprint(b["pool"], " ", b["url"])
+			m := byKey[key]
+			if m == nil {
+				m = &merged{
+					entry:     map[string]interface{}{"pool": b["pool"], "url": b["url"]},
+					responses: map[string]float64{},
+				}
+				byKey[key] = m
+				keys = append(keys, key)
+			}
+			requests := number(b["request_count"])
+			m.requests += requests
+			counts, _ := b["responses"].(map[string]interface{})
+			for class, n := range counts {
+				m.responses[class] += number(n)
+			}
+			weight := requests
+			if weight == 0 {
+				weight = 1
+			}
+			if latency := number(b["avg_latency"]); latency > 0 {
+				m.latencySum += latency * weight
+				m.latencyCount += weight
+			}
+			m.seen++
+			if alive, _ := b["alive"].(bool); alive {
+				m.up++
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		m := byKey[key]
+		m.entry["request_count"] = int64(m.requests)
+		m.entry["responses"] = m.responses
+		m.entry["avg_latency"] = int64(0)
+		if m.latencyCount > 0 {
+			m.entry["avg_latency"] = int64(m.latencySum / m.latencyCount)
+		}
+		m.entry["up_on"] = m.up
+		m.entry["reported_by"] = m.seen
+		result = append(result, m.entry)
+	}
+	return result
+}
+
+// mergeTraffic sums the per-label counters across replicas
+func mergeTraffic(replicas []replicaStats) []map[string]interface{} {
+	byKey := map[string]map[string]interface{}{}
+	var keys []string
+	for _, rep := range replicas {
+		list, _ := rep.stats["traffic"].([]interface{})
+		for _, item := range list {
+			set, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			raw, _ := json.Marshal(set["labels"])
+			key := string(raw)
+			m := byKey[key]
+			if m == nil {
+				m = map[string]interface{}{"labels": set["labels"]}
+				byKey[key] = m
+				keys = append(keys, key)
+			}
+			for _, field := range []string{"requests", "errors", "bytes_out", "latency_ms"} {
+				m[field] = number(m[field]) + number(set[field])
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, byKey[key])
+	}
+	return result
+}
+
+// mergeCounters sums the numeric fields of one stats section
+func mergeCounters(replicas []replicaStats, section string) map[string]float64 {
+	result := map[string]float64{}
+	for _, rep := range replicas {
+		counters, _ := rep.stats[section].(map[string]interface{})
+		for k, v := range counters {
+			if f, ok := v.(float64); ok {
+				result[k] += f
+			}
+		}
+	}
+	return result
+}
+
+// clusterStatsHandler merges the stats of this replica and its peers
+func (lb *Balancer) clusterStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(lb.config().Cluster.Timeout))
+	defer cancel()
+
+	replicas := append([]replicaStats{{peer: "self", stats: lb.localStats()}}, fetchPeerStats(ctx, lb.config().Cluster)...)
+
+	status := make([]map[string]interface{}, len(replicas))
+	reachable := replicas[:0:0]
+	for i, rep := range replicas {
+		status[i] = map[string]interface{}{"peer": rep.peer, "ok": rep.err == nil}
+		if rep.err != nil {
+			status[i]["error"] = rep.err.Error()
+			continue
+		}
+		reachable = append(reachable, rep)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"replicas": status,
+		"backends": mergeBackends(reachable),
+		"traffic":  mergeTraffic(reachable),
+		"cache":    mergeCounters(reachable, "cache"),
+	})
+}
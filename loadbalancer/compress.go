@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// CompressionConfig controls response compression at the balancer
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// MinSize is the smallest body, in bytes, worth compressing
+	MinSize int `json:"min_size"`
+	// Level is passed to the encoder, -1 picks its default
+	Level int `json:"level"`
+	// Types lists compressible media types, "text/*" style wildcards allowed
+	Types []string `json:"types"`
+	// Encodings in order of preference
+	Encodings []string `json:"encodings"`
+}
+
+// encoderFunc wraps w in a compressing writer
+type encoderFunc func(w io.Writer, level int) (io.WriteCloser, error)
+
+// encoders holds the content codings we can produce
+var encoders = map[string]encoderFunc{
+	"br": func(w io.Writer, level int) (io.WriteCloser, error) {
+		// Levels follow flate's scale, Brotli's own goes up to 11
+		if level < 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	},
+	"gzip": func(w io.Writer, level int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	},
+	"deflate": func(w io.Writer, level int) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	},
+}
+
+// validate checks the configured encodings and level
+func (c *CompressionConfig) validate() error {
+	for _, enc := range c.Encodings {
+		if _, ok := encoders[enc]; !ok {
+			return fmt.Errorf("compression: unsupported encoding %q", enc)
+		}
+	}
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return fmt.Errorf("compression: level %d out of range", c.Level)
+	}
+	return nil
+}
+
+// negotiateEncoding picks the first configured encoding the client accepts
+func negotiateEncoding(acceptEncoding string, preferred []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	for _, enc := range preferred {
+		if q, ok := accepted[enc]; ok {
+			if q > 0 {
+				return enc
+			}
+			continue
+		}
+		if q, ok := accepted["*"]; ok && q > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressibleType reports whether a Content-Type matches the configured types
+func compressibleType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses the response once enough of it has been seen
+// to decide whether that is worthwhile
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      *CompressionConfig
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	encoder  io.WriteCloser
+}
+
+// newCompressWriter returns a compressing writer for r, or nil when the
+// client does not accept any configured encoding
+func newCompressWriter(w http.ResponseWriter, r *http.Request, cfg *CompressionConfig) *compressWriter {
+	if !cfg.Enabled || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+		return nil
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+	if encoding == "" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, cfg: cfg, encoding: encoding}
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	// Informational responses such as 103 Early Hints go out as they
+	// come, the final status is held back with the body
+	if code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if c.status == 0 {
+		c.status = code
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		if c.encoder != nil {
+			return c.encoder.Write(b)
+		}
+		return c.ResponseWriter.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.cfg.MinSize {
+		if err := c.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide settles on compressing or not and writes out what was buffered
+func (c *compressWriter) decide() error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	h := c.Header()
+	if c.shouldCompress(h) {
+		enc, err := encoders[c.encoding](c.ResponseWriter, c.cfg.Level)
+		if err == nil {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", c.encoding)
+			h.Add("Vary", "Accept-Encoding")
+			c.encoder = enc
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.encoder != nil {
+		_, err = c.encoder.Write(buf)
+	} else {
+		_, err = c.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// shouldCompress checks the response against the configured rules
+func (c *compressWriter) shouldCompress(h http.Header) bool {
+	if len(c.buf) < c.cfg.MinSize {
+		return false
+	}
+	if c.status < 200 || c.status == http.StatusNoContent || c.status == http.StatusNotModified ||
+		c.status == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	return compressibleType(h.Get("Content-Type"), c.cfg.Types)
+}
+
+// Flush decides early so streamed responses are not held back
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide()
+	}
+	if f, ok := c.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Close finishes the compressed stream, it must be called once the
+// handler is done writing
+func (c *compressWriter) Close() error {
+	if !c.decided {
+		if c.status == 0 {
+			// Nothing was written at all, leave the response alone
+			return nil
+		}
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+	if c.encoder != nil {
+		return c.encoder.Close()
+	}
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
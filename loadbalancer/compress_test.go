@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// TestEarlyHints checks 103 responses reach the client through the
+// compression and cache stages, which keep only the final response
+func TestEarlyHints(t *testing.T) {
+	page := strings.Repeat("hinted page ", 120)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, page)
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.Cache.Enabled = true
+	cfg.Compression.Enabled = true
+	lb.setConfig(&cfg)
+	cache.Purge()
+	t.Cleanup(func() { cache.Purge() })
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+
+	get := func() (*http.Response, []string) {
+		t.Helper()
+		var hints []string
+		trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header.Get("Link"))
+			}
+			return nil
+		}}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, front.URL+"/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp, hints
+	}
+
+	resp, hints := get()
+	if len(hints) != 1 || hints[0] != "</style.css>; rel=preload; as=style" {
+		t.Errorf("early hints = %q, want the backend's", hints)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("final response: %d, encoding %q, %s", resp.StatusCode, resp.Header.Get("Content-Encoding"), resp.Header.Get("X-Cache"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(zr); err != nil || string(body) != page {
+		t.Errorf("body: %d bytes, %v", len(body), err)
+	}
+
+	// The cached copy is the final response, not the hint
+	resp, _ = get()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "HIT" {
+		t.Errorf("cached response: %d, %s; want 200 HIT", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+}
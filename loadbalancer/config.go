@@ -0,0 +1,846 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes as a string like "2s"
+type Duration time.Duration
+
+// UnmarshalJSON accepts either a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	*d = Duration(n)
+	return nil
+}
+
+// MarshalJSON writes the duration in its string form
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// TimeoutConfig holds upstream timeouts, a zero value means no limit
+type TimeoutConfig struct {
+	Connect        Duration `json:"connect"`
+	ResponseHeader Duration `json:"response_header"`
+	Total          Duration `json:"total"`
+	// Streaming marks routes whose responses are held open, such as long
+	// polls, so neither the response header nor the total timeout applies
+	Streaming bool `json:"streaming,omitempty"`
+	// StreamingTypes are response content types the total timeout stops
+	// at once their headers arrive; upgraded connections such as
+	// WebSockets are always exempt
+	StreamingTypes []string `json:"streaming_types,omitempty"`
+	// DeadlineHeader names a header telling backends the milliseconds
+	// left of the total timeout, e.g. X-Request-Deadline; none if empty
+	DeadlineHeader string `json:"deadline_header,omitempty"`
+}
+
+// merge returns t with every non-zero field of o applied on top
+func (t TimeoutConfig) merge(o *TimeoutConfig) TimeoutConfig {
+	if o == nil {
+		return t
+	}
+	if o.Connect != 0 {
+		t.Connect = o.Connect
+	}
+	if o.ResponseHeader != 0 {
+		t.ResponseHeader = o.ResponseHeader
+	}
+	if o.Total != 0 {
+		t.Total = o.Total
+	}
+	if o.Streaming {
+		t.Streaming = true
+	}
+	if o.StreamingTypes != nil {
+		t.StreamingTypes = o.StreamingTypes
+	}
+	if o.DeadlineHeader != "" {
+		t.DeadlineHeader = o.DeadlineHeader
+	}
+	return t
+}
+
+// RouteConfig holds settings for requests matching a path prefix
+type RouteConfig struct {
+	Name string `json:"name"`
+	// Host restricts the route to one virtual host, "*.example.com"
+	// matches any subdomain
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"path_prefix"`
+	Pool       string `json:"pool,omitempty"`
+	// Listeners restricts the route to the named listeners, all if empty
+	Listeners []string `json:"listeners,omitempty"`
+	// Countries and Continents restrict the route to clients located
+	// there by the GeoIP database, e.g. ["DE", "FR"] or ["EU"]
+	Countries  []string `json:"countries,omitempty"`
+	Continents []string `json:"continents,omitempty"`
+	// Strategy overrides the balancing algorithm for this route
+	Strategy Strategy `json:"strategy,omitempty"`
+	// HashOn overrides the attribute the hash strategy keys on
+	HashOn   HashOn            `json:"hash_on,omitempty"`
+	Timeouts *TimeoutConfig    `json:"timeouts,omitempty"`
+	Labels   Labels            `json:"labels,omitempty"`
+	Cache    *RouteCacheConfig `json:"cache,omitempty"`
+	IPFilter *IPFilterConfig   `json:"ip_filter,omitempty"`
+	// JWT rejects requests without a valid bearer token
+	JWT *JWTConfig `json:"jwt,omitempty"`
+	// Auth requires basic-auth credentials or an API key
+	Auth *AuthConfig `json:"auth,omitempty"`
+	CORS *CORSConfig `json:"cors,omitempty"`
+	// Mirror copies a share of the traffic to a shadow backend
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+	// Faults injects delays and errors for resilience testing
+	Faults *FaultConfig `json:"faults,omitempty"`
+	// Tenancy picks the pool by tenant instead of Pool
+	Tenancy *TenancyConfig `json:"tenancy,omitempty"`
+	// Transform filters request and response bodies
+	Transform *TransformConfig `json:"transform,omitempty"`
+	// Script is a policy hook run for every request on the route
+	Script *ScriptConfig `json:"script,omitempty"`
+	// Middleware lists the stages the route's requests go through, in
+	// order, instead of the config's chain
+	Middleware []string `json:"middleware,omitempty"`
+	// LatencySLO deprioritizes backends whose recent p95 on this route
+	// exceeds it, without affecting how they serve other routes
+	LatencySLO Duration `json:"latency_slo,omitempty"`
+	// DryRun evaluates and meters the route without sending traffic to it
+	DryRun bool `json:"dry_run,omitempty"`
+	// ResponseLimit caps the size of the route's upstream responses
+	ResponseLimit *ResponseLimitConfig `json:"response_limit,omitempty"`
+	// Hedge sends idempotent requests a slow backend sits on to a second
+	// one as well, answering with whichever responds first
+	Hedge *HedgeConfig `json:"hedge,omitempty"`
+
+	labels Labels
+}
+
+// defaultPool is the pool used by routes that do not name one
+const defaultPool = "default"
+
+// PoolConfig describes a named group of backends
+type PoolConfig struct {
+	Backends []string `json:"backends"`
+	// Backup members only get traffic while every backend is down, e.g.
+	// the same service in another region
+	Backup []string      `json:"backup,omitempty"`
+	Proxy  *EgressProxy  `json:"proxy,omitempty"`
+	Probes []ProbeConfig `json:"probes,omitempty"`
+	// DNSRefresh, when set, expands backends given by hostname into one
+	// member per A/AAAA record and re-resolves them on this interval.
+	// Service names such as http://_api._tcp.example.com expand into one
+	// member per SRV record instead, on the port from the answer.
+	DNSRefresh Duration `json:"dns_refresh,omitempty"`
+	// Consul, when set, adds the healthy instances of a Consul service
+	// to the pool and keeps them in sync
+	Consul *ConsulConfig `json:"consul,omitempty"`
+	// Docker, when set, adds running containers carrying a label
+	Docker *DockerConfig `json:"docker,omitempty"`
+	// TLS applies to https backends, e.g. a client certificate for mTLS
+	TLS *UpstreamTLS `json:"tls,omitempty"`
+	// RateLimit caps the requests per second each member receives
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	// Zones maps backend URLs onto the zone they run in
+	Zones map[string]string `json:"zones,omitempty"`
+	// IDs maps backend URLs onto stable IDs for the admin API, logs and
+	// metrics; other members get one derived from the pool and URL
+	IDs map[string]string `json:"ids,omitempty"`
+	// Quorum is how many primary backends must be available, 1 if 0;
+	// webhooks hear when the pool falls below it
+	Quorum int `json:"quorum,omitempty"`
+
+	// inCode is set for pools built with NewPool, which may start out
+	// empty and get their members through the admin API
+	inCode bool
+}
+
+// Config is the load balancer configuration
+type Config struct {
+	Backends []string               `json:"backends"`
+	Pools    map[string]*PoolConfig `json:"pools"`
+	Listener ListenerConfig         `json:"listener"`
+	// Listeners replaces Listener when several are needed, e.g. HTTP and
+	// HTTPS on different interfaces with their own routes
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+	// Server limits how slowly clients may send requests and read
+	// responses on every listener
+	Server    ServerConfig    `json:"server"`
+	Timeouts  TimeoutConfig   `json:"timeouts"`
+	Retry     RetryConfig     `json:"retry"`
+	History   HistoryConfig   `json:"history"`
+	Transport TransportConfig `json:"transport"`
+	Routes    []RouteConfig   `json:"routes"`
+	// Algorithm is used by routes that do not set a strategy, round-robin
+	// if unset; the admin API can switch it at runtime
+	Algorithm Strategy `json:"algorithm,omitempty"`
+	// HashOn is the request attribute the hash strategy keys on
+	HashOn      HashOn            `json:"hash_on,omitempty"`
+	Cache       CacheConfig       `json:"cache"`
+	Compression CompressionConfig `json:"compression"`
+	WeightHint  WeightHintConfig  `json:"weight_hint"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	// LatencyDecay fades the statistics of backends that see no traffic
+	LatencyDecay LatencyDecayConfig `json:"latency_decay"`
+	IPFilter     *IPFilterConfig    `json:"ip_filter"`
+	// Passthrough listeners route TLS by SNI without terminating it
+	Passthrough []PassthroughConfig `json:"passthrough,omitempty"`
+	// TCP listeners balance raw connections over a pool
+	TCP []TCPProxyConfig `json:"tcp,omitempty"`
+	// UDP listeners forward datagrams with source-hash affinity
+	UDP []UDPProxyConfig `json:"udp,omitempty"`
+	// SecurityHeaders are added to every proxied response
+	SecurityHeaders *SecurityHeadersConfig `json:"security_headers,omitempty"`
+	// Middleware lists the stages requests go through, in order; routes
+	// may name their own
+	Middleware []string `json:"middleware,omitempty"`
+	// DryRun puts every routing and filtering rule in dry-run mode
+	DryRun    bool             `json:"dry_run"`
+	HAR       HARConfig        `json:"har"`
+	Synthetic []SyntheticCheck `json:"synthetic"`
+	Snapshots []SnapshotConfig `json:"snapshots"`
+	Cluster   ClusterConfig    `json:"cluster"`
+	AccessLog AccessLogConfig  `json:"access_log"`
+	Log       LogConfig        `json:"log"`
+	// StatsD, when set, sends backend metrics to a StatsD agent
+	StatsD *StatsDConfig `json:"statsd,omitempty"`
+	// Webhooks are told when backends go up or down and pools lose quorum
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"`
+	// Readiness picks the pools /lb/readyz depends on
+	Readiness ReadinessConfig `json:"readiness"`
+	// ClientIP finds the client address behind CDNs and other proxies
+	ClientIP ClientIPConfig `json:"client_ip"`
+	// ClientConcurrency, when set, caps the requests each client has in
+	// flight
+	ClientConcurrency *ClientConcurrencyConfig `json:"client_concurrency,omitempty"`
+	// State, when set, keeps learned backend stats and health across
+	// restarts
+	State *StateConfig `json:"state,omitempty"`
+	// HA, when set, makes this node primary or standby for a virtual IP
+	HA *HAConfig `json:"ha,omitempty"`
+	// Control, when set, serves the gRPC control plane
+	Control *ControlConfig `json:"control,omitempty"`
+	// Admin guards the admin endpoints and may move them to a listener
+	// of their own
+	Admin AdminConfig `json:"admin"`
+	// Debug exposes pprof and runtime stats on the admin endpoints
+	Debug DebugConfig `json:"debug"`
+	// ErrorPages are keyed by status: "502", "503" or "504"
+	ErrorPages  map[string]*ErrorPage `json:"error_pages,omitempty"`
+	Maintenance MaintenanceConfig     `json:"maintenance"`
+	Zones       ZoneConfig            `json:"zones"`
+	GeoIP       *GeoIPConfig          `json:"geoip,omitempty"`
+	Etcd        *EtcdConfig           `json:"etcd,omitempty"`
+
+	// Labels apply to all traffic, routes add to and override them
+	Labels            Labels `json:"labels"`
+	LabelHeaderPrefix string `json:"label_header_prefix"`
+
+	defaultLabels Labels
+}
+
+// defaultBackends are used when neither backends nor pools are configured
+var defaultBackends = []string{
+	"http://localhost:8081",
+	"http://localhost:8082",
+	"http://localhost:8083",
+}
+
+// defaultConfig returns the configuration used when no file is given
+func defaultConfig() *Config {
+	return &Config{
+		Listener: ListenerConfig{
+			Addresses: []string{":8080"},
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			IdleTimeout:       Duration(120 * time.Second),
+			MaxHeaderBytes:    64 << 10,
+		},
+		Timeouts: TimeoutConfig{
+			Connect:        Duration(3 * time.Second),
+			ResponseHeader: Duration(15 * time.Second),
+			Total:          Duration(30 * time.Second),
+			StreamingTypes: []string{"text/event-stream"},
+		},
+		Transport: TransportConfig{
+			MaxIdleConns:        1000,
+			MaxIdleConnsPerHost: 256,
+			IdleConnTimeout:     Duration(90 * time.Second),
+			KeepAlive:           Duration(30 * time.Second),
+			TLSHandshakeTimeout: Duration(10 * time.Second),
+			// RFC 8305's recommended connection attempt delay
+			AttemptDelay: Duration(250 * time.Millisecond),
+		},
+		LabelHeaderPrefix: defaultLabelHeaderPrefix,
+		Cache: CacheConfig{
+			MaxBytes:      64 << 20,
+			MaxEntryBytes: 1 << 20,
+		},
+		Compression: CompressionConfig{
+			MinSize: 1024,
+			Level:   -1,
+			Types: []string{
+				"text/*",
+				"application/json",
+				"application/javascript",
+				"application/xml",
+				"image/svg+xml",
+			},
+			Encodings: []string{"br", "gzip", "deflate"},
+		},
+		WeightHint: WeightHintConfig{
+			Header:    defaultWeightHintHeader,
+			Smoothing: 0.3,
+			TTL:       Duration(30 * time.Second),
+		},
+		HealthCheck: HealthCheckConfig{
+			Interval:    Duration(10 * time.Second),
+			Concurrency: 16,
+			WarmUp: WarmUpConfig{
+				Probes:   3,
+				Interval: Duration(time.Second),
+			},
+			Passive: PassiveHealthConfig{
+				Failures: 1,
+				Window:   Duration(10 * time.Second),
+			},
+		},
+		LatencyDecay: LatencyDecayConfig{
+			IdleAfter: Duration(time.Minute),
+			HalfLife:  Duration(5 * time.Minute),
+		},
+		Cluster: ClusterConfig{
+			Timeout: Duration(2 * time.Second),
+		},
+		Retry: RetryConfig{
+			MaxBodyBytes: 64 << 10,
+		},
+		History: HistoryConfig{
+			Retention: Duration(6 * time.Hour),
+		},
+		HAR: HARConfig{
+			Dir:          "har",
+			SampleRate:   0.1,
+			MaxEntries:   1000,
+			MaxBodyBytes: 64 << 10,
+			Redact:       []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"},
+		},
+	}
+}
+
+// loadConfig reads a JSON config file on top of the defaults
+func loadConfig(path string) (*Config, error) {
+	return loadConfigWith(path, nil)
+}
+
+// loadConfigWith is loadConfig letting overlay change the settings read
+// from the file before they are checked
+func loadConfigWith(path string, overlay func(*Config)) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	cli.apply(cfg)
+	if overlay != nil {
+		overlay(cfg)
+	}
+	if err := cfg.normalize(); err != nil {
+		if path == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// clone returns a deep copy of c to build the next config from; like a
+// config file just read, it still has to be normalized
+func (c *Config) clone() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	next := &Config{}
+	if err := json.Unmarshal(data, next); err != nil {
+		return nil, err
+	}
+	for name, pool := range c.Pools {
+		if pool != nil && pool.inCode {
+			next.Pools[name].inCode = true
+		}
+	}
+	return next, nil
+}
+
+// normalize fills in the default pool and checks for obvious mistakes
+func (c *Config) normalize() error {
+	if c.Pools == nil {
+		c.Pools = map[string]*PoolConfig{}
+	}
+	if len(c.Pools) == 0 && len(c.Backends) == 0 {
+		c.Backends = defaultBackends
+	}
+	// Top-level backends form the default pool
+	if _, ok := c.Pools[defaultPool]; !ok && len(c.Backends) > 0 {
+		c.Pools[defaultPool] = &PoolConfig{Backends: c.Backends}
+	}
+	if len(c.Listeners) == 0 {
+		c.Listeners = []ListenerConfig{c.Listener}
+	}
+	if err := c.Server.validate(); err != nil {
+		return err
+	}
+	listenerNames := map[string]bool{}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if err := l.validate(); err != nil {
+			return err
+		}
+		if l.Name == "" {
+			l.Name = l.Addresses[0]
+		}
+		if listenerNames[l.Name] {
+			return fmt.Errorf("listener %s: duplicate name", l.Name)
+		}
+		listenerNames[l.Name] = true
+	}
+	if err := c.Algorithm.validate(); err != nil {
+		return fmt.Errorf("algorithm: %w", err)
+	}
+	if err := c.HashOn.validate(); err != nil {
+		return err
+	}
+	if err := c.Compression.validate(); err != nil {
+		return err
+	}
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+	if c.StatsD != nil {
+		if err := c.StatsD.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Readiness.validate(c.Pools); err != nil {
+		return err
+	}
+	if err := c.ClientIP.validate(); err != nil {
+		return err
+	}
+	if c.ClientConcurrency != nil {
+		if err := c.ClientConcurrency.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Transport.validate(); err != nil {
+		return err
+	}
+	if err := c.Cluster.validate(); err != nil {
+		return err
+	}
+	if c.State != nil {
+		if err := c.State.validate(); err != nil {
+			return err
+		}
+	}
+	if c.HA != nil {
+		if err := c.HA.validate(c.Cluster); err != nil {
+			return err
+		}
+	}
+	if err := c.Admin.validate(); err != nil {
+		return err
+	}
+	if c.Control != nil {
+		if err := c.Control.validate(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].validate(); err != nil {
+			return err
+		}
+	}
+	if r := time.Duration(c.History.Retention); r != 0 && r < time.Minute {
+		return fmt.Errorf("history: retention must be at least a minute, or 0 to turn it off")
+	}
+	if c.HealthCheck.Interval <= 0 {
+		return fmt.Errorf("health_check: interval must be positive")
+	}
+	if c.HealthCheck.Concurrency <= 0 {
+		return fmt.Errorf("health_check: concurrency must be positive")
+	}
+	if c.HealthCheck.WarmUp.Probes < 0 || c.HealthCheck.WarmUp.Interval <= 0 {
+		return fmt.Errorf("health_check: warm_up needs a non-negative probe count and a positive interval")
+	}
+	if c.HealthCheck.Passive.Failures < 0 || c.HealthCheck.Passive.Window <= 0 {
+		return fmt.Errorf("health_check: passive needs a non-negative failure count and a positive window")
+	}
+	if s := c.WeightHint.Smoothing; s <= 0 || s > 1 {
+		return fmt.Errorf("weight_hint: smoothing must be in (0, 1]")
+	}
+	if c.SecurityHeaders != nil {
+		if err := c.SecurityHeaders.validate(); err != nil {
+			return err
+		}
+	}
+	if c.IPFilter != nil {
+		if err := c.IPFilter.parse(); err != nil {
+			return fmt.Errorf("ip_filter: %w", err)
+		}
+	}
+
+	for name, pool := range c.Pools {
+		if pool == nil || (len(pool.Backends) == 0 && pool.Consul == nil && pool.Docker == nil && !pool.inCode) {
+			return fmt.Errorf("pool %s: no backends configured", name)
+		}
+		if pool.Consul != nil {
+			if err := pool.Consul.validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+		if pool.Docker != nil {
+			if err := pool.Docker.validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+		if pool.Proxy != nil {
+			if err := pool.Proxy.validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+		if pool.TLS != nil {
+			if err := pool.TLS.validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+		if err := validateIDs(pool.IDs); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		if pool.Quorum < 0 {
+			return fmt.Errorf("pool %s: quorum must not be negative", name)
+		}
+		if pool.RateLimit != nil {
+			if err := pool.RateLimit.validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+		if len(pool.Probes) == 0 {
+			pool.Probes = append([]ProbeConfig(nil), defaultProbes...)
+		}
+		for i := range pool.Probes {
+			if err := pool.Probes[i].validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", name, err)
+			}
+		}
+	}
+	for i, route := range c.Routes {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("route %d (%s): path_prefix must start with /", i, route.Name)
+		}
+		pool := route.Pool
+		if pool == "" {
+			pool = defaultPool
+		}
+		if _, ok := c.Pools[pool]; !ok {
+			return fmt.Errorf("route %d (%s): unknown pool %q", i, route.Name, pool)
+		}
+		if err := route.Strategy.validate(); err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+		if err := route.HashOn.validate(); err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+		for _, name := range route.Listeners {
+			if !listenerNames[name] {
+				return fmt.Errorf("route %d (%s): unknown listener %q", i, route.Name, name)
+			}
+		}
+		if route.hasGeo() && c.GeoIP == nil {
+			return fmt.Errorf("route %d (%s): countries and continents need a geoip database", i, route.Name)
+		}
+		for j, code := range route.Countries {
+			route.Countries[j] = strings.ToUpper(code)
+		}
+		for j, code := range route.Continents {
+			route.Continents[j] = strings.ToUpper(code)
+		}
+		if route.IPFilter != nil {
+			if err := route.IPFilter.parse(); err != nil {
+				return fmt.Errorf("route %d (%s): ip_filter: %w", i, route.Name, err)
+			}
+		}
+		if route.JWT != nil {
+			if err := route.JWT.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Auth != nil {
+			if err := route.Auth.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.CORS != nil {
+			if err := route.CORS.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Mirror != nil {
+			if err := route.Mirror.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Faults != nil {
+			if err := route.Faults.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.ResponseLimit != nil {
+			if err := route.ResponseLimit.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Hedge != nil {
+			if err := route.Hedge.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Tenancy != nil {
+			if err := route.Tenancy.validate(&route, c.Pools); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Transform != nil {
+			if err := route.Transform.validate(); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if route.Script != nil {
+			if err := route.Script.validate(routeKey(&route)); err != nil {
+				return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+			}
+		}
+		if err := validateMiddleware(route.Middleware); err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+		if err := c.validateChain(&route); err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+	}
+
+	for i := range c.TCP {
+		if err := c.TCP[i].validate(c.Pools); err != nil {
+			return err
+		}
+	}
+	for i := range c.UDP {
+		if err := c.UDP[i].validate(c.Pools); err != nil {
+			return err
+		}
+	}
+	for i := range c.Passthrough {
+		if err := c.Passthrough[i].validate(c.Pools); err != nil {
+			return err
+		}
+	}
+	for i := range c.Synthetic {
+		if err := c.Synthetic[i].validate(); err != nil {
+			return err
+		}
+	}
+	if c.Etcd != nil {
+		if err := c.Etcd.validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return err
+	}
+	if err := c.Log.validate(); err != nil {
+		return err
+	}
+	if slices.Contains(c.AccessLog.Fields, "geo") && c.GeoIP == nil {
+		return fmt.Errorf("access_log: the geo field needs a geoip database")
+	}
+	for i := range c.Snapshots {
+		if err := c.Snapshots[i].validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateErrorPages(c.ErrorPages); err != nil {
+		return err
+	}
+	if err := c.Maintenance.validate(c.Routes); err != nil {
+		return err
+	}
+	if err := c.Zones.validate(); err != nil {
+		return err
+	}
+	if err := validateMiddleware(c.Middleware); err != nil {
+		return err
+	}
+	if err := c.validateChain(nil); err != nil {
+		return err
+	}
+
+	for i := range c.Routes {
+		c.Routes[i].labels = c.buildLabels(&c.Routes[i])
+	}
+	c.defaultLabels = c.buildLabels(nil)
+	return nil
+}
+
+// PoolNames returns the configured pool names in a stable order
+func (c *Config) PoolNames() []string {
+	names := make([]string, 0, len(c.Pools))
+	for name := range c.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findRoute returns the route with the given key
+func (c *Config) findRoute(key string) *RouteConfig {
+	for i := range c.Routes {
+		if routeKey(&c.Routes[i]) == key {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// MatchRoute returns the enforced route matching a request to host and
+// path on the named listener, "" matching routes on any listener, from a
+// client in country; routes naming the host win over the rest, then the
+// longest prefix wins, then routes limited to a location
+func (c *Config) MatchRoute(listener, host, path, country string) *RouteConfig {
+	return c.matchRoute(listener, host, path, country, false)
+}
+
+// DryRunRoute returns the dry-run route that would have handled the
+// request had it been enforced, or nil if the enforced match stands
+func (c *Config) DryRunRoute(listener, host, path, country string) *RouteConfig {
+	best := c.matchRoute(listener, host, path, country, true)
+	if best == nil || !c.isDryRun(best) {
+		return nil
+	}
+	return best
+}
+
+// isDryRun reports whether a route is only evaluated, not enforced
+func (c *Config) isDryRun(route *RouteConfig) bool {
+	return c.DryRun || route.DryRun
+}
+
+// matchRoute finds the best matching route, optionally including dry-run
+// routes
+func (c *Config) matchRoute(listener, host, path, country string, includeDryRun bool) *RouteConfig {
+	var best *RouteConfig
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if !strings.HasPrefix(path, route.PathPrefix) || !route.matchesHost(host) || !route.onListener(listener) ||
+			!route.matchesCountry(country) {
+			continue
+		}
+		if !includeDryRun && c.isDryRun(route) {
+			continue
+		}
+		if best == nil || routeMoreSpecific(route, best) {
+			best = route
+		}
+	}
+	return best
+}
+
+// routeMoreSpecific orders routes by whether they name a host, then by
+// prefix length
+func routeMoreSpecific(a, b *RouteConfig) bool {
+	if (a.Host != "") != (b.Host != "") {
+		return a.Host != ""
+	}
+	if len(a.PathPrefix) != len(b.PathPrefix) {
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	}
+	// Of two routes for the same prefix the one limited to a region wins
+	return a.hasGeo() && !b.hasGeo()
+}
+
+// matchesHost compares the route's host with a request Host header
+func (r *RouteConfig) matchesHost(host string) bool {
+	if r.Host == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return hostMatches(r.Host, host)
+}
+
+// hasGeo reports whether the route is limited to client locations
+func (r *RouteConfig) hasGeo() bool {
+	return len(r.Countries) > 0 || len(r.Continents) > 0
+}
+
+// matchesCountry reports whether clients in country may use the route;
+// clients of unknown location only match routes without a location
+func (r *RouteConfig) matchesCountry(country string) bool {
+	if !r.hasGeo() {
+		return true
+	}
+	if country == "" {
+		return false
+	}
+	return slices.Contains(r.Countries, country) || slices.Contains(r.Continents, geoIP.Continent(country))
+}
+
+// onListener reports whether the route serves the named listener
+func (r *RouteConfig) onListener(name string) bool {
+	return name == "" || len(r.Listeners) == 0 || slices.Contains(r.Listeners, name)
+}
+
+// hostMatches matches host against a name or a "*.example.com" wildcard
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return len(host) > len(suffix)+1 && strings.EqualFold(host[len(host)-len(suffix)-1:], "."+suffix)
+	}
+	return strings.EqualFold(host, pattern)
+}
+
+// TimeoutsFor returns the global timeouts with route overrides applied
+func (c *Config) TimeoutsFor(route *RouteConfig) TimeoutConfig {
+	t := c.Timeouts
+	if route != nil {
+		t = t.merge(route.Timeouts)
+	}
+	if t.Streaming {
+		t.ResponseHeader, t.Total = 0, 0
+	}
+	return t
+}
@@ -0,0 +1,189 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ConsulConfig makes a pool follow the healthy instances of a Consul service
+type ConsulConfig struct {
+	// Address of the Consul agent, defaults to http://127.0.0.1:8500
+	Address    string `json:"address"`
+	Service    string `json:"service"`
+	Tag        string `json:"tag,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Token      string `json:"token,omitempty"`
+	// Scheme used to reach the instances, http or https
+	Scheme string `json:"scheme,omitempty"`
+	// Wait is how long a blocking query may be held open by Consul
+	Wait Duration `json:"wait,omitempty"`
+}
+
+// validate fills in defaults and checks required fields
+func (c *ConsulConfig) validate() error {
+	if c.Service == "" {
+		return fmt.Errorf("consul: service is required")
+	}
+	if c.Address == "" {
+		c.Address = "http://127.0.0.1:8500"
+	}
+	if _, err := url.Parse(c.Address); err != nil {
+		return fmt.Errorf("consul: address: %w", err)
+	}
+	switch c.Scheme {
+	case "":
+		c.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("consul: unsupported scheme %q", c.Scheme)
+	}
+	if c.Wait <= 0 {
+		c.Wait = Duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// consulWatcher keeps a pool in sync with a Consul service
+type consulWatcher struct {
+	pool   *ServerPool
+	cfg    *ConsulConfig
+	client *http.Client
+	index  uint64
+}
+
+// newConsulWatcher returns a watcher for pool
+func newConsulWatcher(pool *ServerPool, cfg *ConsulConfig) *consulWatcher {
+	return &consulWatcher{pool: pool, cfg: cfg, client: &http.Client{}}
+}
+
+// origin tags the members the watcher manages
+func (c *consulWatcher) origin() string {
+	return "consul:" + c.cfg.Service
+}
+
+// consulEntry is the part of a /v1/health/service entry we use
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// query fetches the passing instances, blocking until they change when a
+// previous index is known
+func (c *consulWatcher) query() ([]string, error) {
+	params := url.Values{"passing": {"1"}}
+	if c.cfg.Tag != "" {
+		params.Set("tag", c.cfg.Tag)
+	}
+	if c.cfg.Datacenter != "" {
+		params.Set("dc", c.cfg.Datacenter)
+	}
+	if c.index > 0 {
+		params.Set("index", strconv.FormatUint(c.index, 10))
+		params.Set("wait", time.Duration(c.cfg.Wait).String())
+	}
+
+	// Consul adds up to wait/16 of jitter to blocking queries
+	wait := time.Duration(c.cfg.Wait)
+	ctx, cancel := context.WithTimeout(c.pool.lifetime(), wait+wait/16+10*time.Second)
+	defer cancel()
+
+	endpoint := c.cfg.Address + "/v1/health/service/" + url.PathEscape(c.cfg.Service) + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", c.cfg.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	// A missing or zero index cannot be blocked on, and one that went
+	// backwards means starting over as Consul recommends; either way the
+	// next query is a plain read after a backoff
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < c.index {
+		index = 0
+	}
+	c.index = index
+
+	members := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		u := url.URL{Scheme: c.cfg.Scheme, Host: net.JoinHostPort(host, strconv.Itoa(e.Service.Port))}
+		members = append(members, u.String())
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// refresh queries Consul once and reconciles the pool with the answer; on
+// failure the current members are kept
+func (c *consulWatcher) refresh() error {
+	want, err := c.query()
+	if err != nil {
+		slog.Warn("Consul lookup failed, keeping current members", "service", c.cfg.Service, "error", err)
+		return err
+	}
+
+	added, removed := c.pool.SyncMembers(c.origin(), want, func(member string) (*Backend, error) {
+		return newBackend(member, c.pool)
+	})
+	for _, member := range added {
+		slog.Info("Consul member added", "pool", c.pool.Name, "member", member, "service", c.cfg.Service)
+	}
+	for _, member := range removed {
+		slog.Info("Consul member removed", "pool", c.pool.Name, "member", member, "service", c.cfg.Service)
+	}
+	return nil
+}
+
+// watch keeps issuing blocking queries, backing off after errors and
+// answers without an index to block on, which would otherwise return at
+// once and make the loop spin
+func (c *consulWatcher) watch() {
+	done := c.pool.lifetime().Done()
+	backoff := time.Second
+	for {
+		err := c.refresh()
+		if err == nil && c.index > 0 {
+			backoff = time.Second
+			continue
+		}
+		c.index = 0
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
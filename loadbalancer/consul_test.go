@@ -0,0 +1,61 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsulIndex(t *testing.T) {
+	lb := New()
+	for name, indexes := range map[string][]string{
+		"missing":   {""},
+		"zero":      {"0"},
+		"backwards": {"10", "3"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var queries []string
+			consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				queries = append(queries, r.URL.Query().Get("index"))
+				n := len(queries)
+				mu.Unlock()
+				if index := indexes[min(n, len(indexes))-1]; index != "" {
+					w.Header().Set("X-Consul-Index", index)
+				}
+				io.WriteString(w, `[{"Node":{"Address":"127.0.0.1"},"Service":{"Port":9000}}]`)
+			}))
+			t.Cleanup(consul.Close)
+			cfg := &ConsulConfig{Address: consul.URL, Service: "api"}
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+			pool, err := lb.buildPool("consul", &PoolConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(pool.close)
+
+			// Without an index to block on the watcher backs off rather
+			// than querying in a loop
+			go newConsulWatcher(pool, cfg).watch()
+			time.Sleep(300 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(queries) != len(indexes) {
+				t.Fatalf("%d queries in 300ms, want %d", len(queries), len(indexes))
+			}
+			if want := indexes[:len(indexes)-1]; !slices.Equal(queries[1:], want) {
+				t.Errorf("queried with indexes %q, want %q", queries[1:], want)
+			}
+			if len(pool.snapshot()) != 1 {
+				t.Errorf("pool has %d members, want the one Consul returned", len(pool.snapshot()))
+			}
+		})
+	}
+}
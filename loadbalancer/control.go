@@ -0,0 +1,525 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ControlConfig serves the gRPC control plane described in control.proto,
+// for orchestrators that manage backends and want their changes streamed
+type ControlConfig struct {
+	// Address is where the service listens, e.g. 127.0.0.1:9090
+	Address string `json:"address"`
+	// TLS serves gRPC over TLS, without it the service speaks cleartext
+	// HTTP/2 as clients with insecure credentials expect
+	TLS *ListenerTLS `json:"tls,omitempty"`
+	// Token, when set, must come with every call as "authorization:
+	// Bearer <token>" metadata
+	Token string `json:"token,omitempty"`
+}
+
+// validate checks the address and TLS settings
+func (c *ControlConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("control: address must be host:port")
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("control: %w", err)
+		}
+	}
+	return nil
+}
+
+// listenControl binds the control service of lb, ready to be served
+func (lb *Balancer) listenControl(c *ControlConfig) (*http.Server, net.Listener, error) {
+	server := &http.Server{Handler: c.handler(lb), Protocols: new(http.Protocols)}
+	ln, err := net.Listen("tcp", c.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("control: %w", err)
+	}
+	if c.TLS == nil {
+		server.Protocols.SetUnencryptedHTTP2(true)
+		return server, ln, nil
+	}
+	tlsConfig, err := c.TLS.config()
+	if err != nil {
+		ln.Close()
+		return nil, nil, fmt.Errorf("control: %w", err)
+	}
+	tlsConfig.NextProtos = []string{"h2"}
+	server.Protocols.SetHTTP2(true)
+	return server, tls.NewListener(ln, tlsConfig), nil
+}
+
+// gRPC status codes
+type grpcCode int
+
+const (
+	grpcInvalidArgument    grpcCode = 3
+	grpcNotFound           grpcCode = 5
+	grpcAlreadyExists      grpcCode = 6
+	grpcResourceExhausted  grpcCode = 8
+	grpcFailedPrecondition grpcCode = 9
+	grpcAborted            grpcCode = 10
+	grpcUnimplemented      grpcCode = 12
+	grpcInternal           grpcCode = 13
+	grpcUnavailable        grpcCode = 14
+	grpcUnauthenticated    grpcCode = 16
+)
+
+// grpcCodeFor maps an admin API status onto a gRPC code
+func grpcCodeFor(status int) grpcCode {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return grpcInvalidArgument
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAlreadyExists
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// controlService prefixes the path of every method
+const controlService = "/lb.control.v1.Control/"
+
+// maxControlMessage bounds request messages, as gRPC servers do by default
+const maxControlMessage = 4 << 20
+
+// controlMethods are the unary methods, taking and returning encoded
+// messages
+var controlMethods = map[string]func(*Balancer, []byte) ([]byte, error){
+	"ListBackends":  (*Balancer).controlListBackends,
+	"AddBackend":    (*Balancer).controlAddBackend,
+	"RemoveBackend": (*Balancer).controlRemoveBackend,
+	"DrainBackend":  (*Balancer).controlDrainBackend,
+	"GetAlgorithm":  (*Balancer).controlGetAlgorithm,
+	"SetAlgorithm":  (*Balancer).controlSetAlgorithm,
+	"GetStats":      (*Balancer).controlGetStats,
+	"Reload":        (*Balancer).controlReload,
+}
+
+// handler serves the gRPC calls to lb; anything else gets a plain 415
+func (c *ControlConfig) handler(lb *Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !isGRPC(r.Header.Get("Content-Type")) {
+			http.Error(w, "gRPC only, see control.proto", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		if c.Token != "" {
+			got := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(got, []byte("Bearer "+c.Token)) != 1 {
+				grpcFail(w, &adminError{http.StatusUnauthorized, grpcUnauthenticated, "Missing or invalid token"})
+				return
+			}
+		}
+
+		method, ok := strings.CutPrefix(r.URL.Path, controlService)
+		unary := controlMethods[method]
+		if !ok || (unary == nil && method != "Watch") {
+			grpcFail(w, &adminError{http.StatusNotFound, grpcUnimplemented, "Unknown method " + r.URL.Path})
+			return
+		}
+		req, err := readGRPCMessage(r.Body)
+		if err != nil {
+			grpcFail(w, err)
+			return
+		}
+		if method == "Watch" {
+			lb.controlWatch(w, r, req)
+			return
+		}
+		resp, err := unary(lb, req)
+		if err != nil {
+			grpcFail(w, err)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		writeGRPCMessage(w, resp)
+		w.Header().Set("Grpc-Status", "0")
+	})
+}
+
+// isGRPC reports whether contentType is gRPC with the protobuf codec
+func isGRPC(contentType string) bool {
+	return contentType == "application/grpc" || contentType == "application/grpc+proto"
+}
+
+// grpcStatus returns the code and message to end a call failed with err
+func grpcStatus(err error) (grpcCode, string) {
+	var ae *adminError
+	if errors.As(err, &ae) {
+		return ae.code, ae.msg
+	}
+	return grpcInternal, err.Error()
+}
+
+// grpcFail ends a call that sent nothing yet with a trailers-only response
+func grpcFail(w http.ResponseWriter, err error) {
+	code, msg := grpcStatus(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	w.Header().Set("Grpc-Message", grpcEscape(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEscape percent-encodes msg for the grpc-message trailer
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readGRPCMessage reads the one length-prefixed message a call sends
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &adminError{http.StatusBadRequest, grpcInvalidArgument, "Missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &adminError{http.StatusBadRequest, grpcUnimplemented, "Compressed messages are not supported"}
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxControlMessage {
+		return nil, &adminError{http.StatusRequestEntityTooLarge, grpcResourceExhausted, "Request message too large"}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, &adminError{http.StatusBadRequest, grpcInvalidArgument, "Truncated request message"}
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage sends msg with its length prefix
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// invalidMessage is the error for a request that does not decode
+func invalidMessage(err error) error {
+	return &adminError{http.StatusBadRequest, grpcInvalidArgument, "Invalid request message: " + err.Error()}
+}
+
+// backendRefMessage is a decoded BackendRef
+type backendRefMessage struct {
+	pool, id, url string
+}
+
+func decodeBackendRef(msg []byte) (backendRefMessage, error) {
+	var ref backendRefMessage
+	r := protoReader{buf: msg}
+	for r.next() {
+		switch r.field {
+		case 1:
+			ref.pool = r.string()
+		case 2:
+			ref.id = r.string()
+		case 3:
+			ref.url = r.string()
+		}
+	}
+	if r.err != nil {
+		return ref, invalidMessage(r.err)
+	}
+	return ref, nil
+}
+
+// decodePool reads the pool field of ListBackendsRequest and WatchRequest
+func (lb *Balancer) decodePool(msg []byte) (string, error) {
+	var pool string
+	r := protoReader{buf: msg}
+	for r.next() {
+		if r.field == 1 {
+			pool = r.string()
+		}
+	}
+	if r.err != nil {
+		return "", invalidMessage(r.err)
+	}
+	if pool != "" && lb.pools()[pool] == nil {
+		return "", adminErrorf(http.StatusNotFound, "Unknown pool %q", pool)
+	}
+	return pool, nil
+}
+
+func encodeBackend(w *protoWriter, b BackendStats) {
+	w.string(1, b.ID)
+	w.string(2, b.Pool)
+	w.string(3, b.URL)
+	w.bool(4, b.Alive)
+	w.string(5, b.Status)
+	w.int(6, b.AvgLatency)
+	w.int(7, b.RequestCount)
+	w.int(8, b.Active)
+	w.int(9, b.ClusterActive)
+	w.bool(10, b.ClusterDown)
+	w.int(11, b.BytesSent)
+	w.int(12, b.BytesReceived)
+	w.counts(13, b.Responses)
+	w.bool(14, b.Cordoned)
+	w.double(15, b.Weight)
+	w.string(16, b.Tier)
+	w.string(17, b.Zone)
+	w.string(18, b.ResolvedFrom)
+}
+
+// encodeBackendList encodes a BackendList
+func encodeBackendList(backends []BackendStats) []byte {
+	var w protoWriter
+	for _, b := range backends {
+		w.message(1, func(w *protoWriter) { encodeBackend(w, b) })
+	}
+	return w.buf
+}
+
+func (lb *Balancer) encodeAlgorithm() []byte {
+	var w protoWriter
+	w.string(1, string(lb.currentAlgorithm()))
+	for _, s := range strategies {
+		w.string(2, string(s))
+	}
+	return w.buf
+}
+
+func (lb *Balancer) controlListBackends(msg []byte) ([]byte, error) {
+	pool, err := lb.decodePool(msg)
+	if err != nil {
+		return nil, err
+	}
+	if pool != "" {
+		return encodeBackendList(lb.pools()[pool].GetBackends()), nil
+	}
+	return encodeBackendList(lb.allBackends()), nil
+}
+
+func (lb *Balancer) controlAddBackend(msg []byte) ([]byte, error) {
+	ref, err := decodeBackendRef(msg)
+	if err != nil {
+		return nil, err
+	}
+	if ref.url == "" {
+		return nil, adminErrorf(http.StatusBadRequest, "Backend url is required")
+	}
+	pool, err := lb.addBackend(ref.pool, ref.id, ref.url)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBackendList(pool.GetBackends()), nil
+}
+
+func (lb *Balancer) controlRemoveBackend(msg []byte) ([]byte, error) {
+	ref, err := decodeBackendRef(msg)
+	if err != nil {
+		return nil, err
+	}
+	if ref.id == "" && ref.url == "" {
+		return nil, adminErrorf(http.StatusBadRequest, "Backend id or url is required")
+	}
+	pool, err := lb.removeBackend(ref.pool, ref.id, ref.url)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBackendList(pool.GetBackends()), nil
+}
+
+func (lb *Balancer) controlDrainBackend(msg []byte) ([]byte, error) {
+	var ref backendRefMessage
+	var drain bool
+	var err error
+	r := protoReader{buf: msg}
+	for r.next() {
+		switch r.field {
+		case 1:
+			ref, err = decodeBackendRef(r.message())
+		case 2:
+			drain = r.bool()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.err != nil {
+		return nil, invalidMessage(r.err)
+	}
+	pool, b, err := lb.drainBackend(ref.pool, ref.id, ref.url, drain)
+	if err != nil {
+		return nil, err
+	}
+	var w protoWriter
+	encodeBackend(&w, pool.backendStats(b))
+	return w.buf, nil
+}
+
+func (lb *Balancer) controlGetAlgorithm(msg []byte) ([]byte, error) {
+	return lb.encodeAlgorithm(), nil
+}
+
+func (lb *Balancer) controlSetAlgorithm(msg []byte) ([]byte, error) {
+	var name string
+	r := protoReader{buf: msg}
+	for r.next() {
+		if r.field == 1 {
+			name = r.string()
+		}
+	}
+	if r.err != nil {
+		return nil, invalidMessage(r.err)
+	}
+	if err := lb.switchAlgorithm(Strategy(name)); err != nil {
+		return nil, err
+	}
+	return lb.encodeAlgorithm(), nil
+}
+
+func (lb *Balancer) controlGetStats(msg []byte) ([]byte, error) {
+	v := url.Values{}
+	r := protoReader{buf: msg}
+	for r.next() {
+		switch r.field {
+		case 1:
+			v.Set("pool", r.string())
+		case 2:
+			v.Set("unhealthy", strconv.FormatBool(r.bool()))
+		case 3:
+			v.Set("sort", r.string())
+		case 4:
+			v.Set("offset", strconv.FormatInt(r.int(), 10))
+		case 5:
+			v.Set("limit", strconv.FormatInt(r.int(), 10))
+		}
+	}
+	if r.err != nil {
+		return nil, invalidMessage(r.err)
+	}
+	q, err := lb.parseStatsQuery(v)
+	if err != nil {
+		return nil, adminErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	stats := lb.collectStats(q)
+	var w protoWriter
+	w.string(1, string(stats.Algorithm))
+	for _, p := range stats.Pools {
+		w.message(2, func(w *protoWriter) {
+			w.string(1, p.Name)
+			w.int(2, int64(p.Backends))
+			w.int(3, int64(p.Up))
+			w.int(4, p.RequestCount)
+			w.double(5, p.RPS)
+			w.double(6, p.ErrorRate)
+			w.int(7, p.AvgLatency)
+		})
+	}
+	for _, b := range stats.Backends {
+		w.message(3, func(w *protoWriter) { encodeBackend(w, b) })
+	}
+	w.int(4, int64(stats.Matched))
+	return w.buf, nil
+}
+
+func (lb *Balancer) controlReload(msg []byte) ([]byte, error) {
+	if err := lb.reloadConfig(); err != nil {
+		return nil, err
+	}
+	var w protoWriter
+	w.string(1, cli.configPath)
+	w.strings(2, lb.poolNames())
+	return w.buf, nil
+}
+
+// encodeEvent encodes a BackendEvent
+func encodeEvent(ev backendEvent) []byte {
+	var w protoWriter
+	w.int(1, int64(ev.typ))
+	if ev.typ != eventSynced {
+		w.message(2, func(w *protoWriter) { encodeBackend(w, ev.backend) })
+	}
+	w.string(3, ev.previous)
+	w.string(4, ev.reason)
+	w.int(5, ev.time.UnixMilli())
+	return w.buf
+}
+
+// controlWatch streams the backends of the requested pool, then their
+// changes, until the client cancels or falls behind
+func (lb *Balancer) controlWatch(w http.ResponseWriter, r *http.Request, msg []byte) {
+	pool, err := lb.decodePool(msg)
+	if err != nil {
+		grpcFail(w, err)
+		return
+	}
+	// Subscribing first means no change is lost between the listing and
+	// the stream
+	sub := watchers.subscribe(pool)
+	defer watchers.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	send := func(ev backendEvent) error {
+		if err := writeGRPCMessage(w, encodeEvent(ev)); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	backends := lb.allBackends()
+	if pool != "" {
+		backends = lb.pools()[pool].GetBackends()
+	}
+	now := time.Now()
+	for _, b := range backends {
+		if send(backendEvent{typ: eventAdded, backend: b, time: now}) != nil {
+			return
+		}
+	}
+	if send(backendEvent{typ: eventSynced, time: now}) != nil {
+		return
+	}
+	slog.Debug("Control watch started", "pool", pool, "remote_addr", r.RemoteAddr)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.events:
+			if !ok {
+				if sub.lagged {
+					slog.Warn("Control watcher fell behind", "pool", pool, "remote_addr", r.RemoteAddr)
+					w.Header().Set("Grpc-Status", strconv.Itoa(int(grpcAborted)))
+					w.Header().Set("Grpc-Message", "Watcher fell behind, watch again")
+				}
+				return
+			}
+			if send(ev) != nil {
+				return
+			}
+		}
+	}
+}
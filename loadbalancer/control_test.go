@@ -0,0 +1,203 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcClient calls the control service at base over cleartext HTTP/2
+type grpcClient struct {
+	t     *testing.T
+	base  string
+	http  *http.Client
+	token string
+}
+
+// start sends a call and returns the response once its headers arrived
+func (c *grpcClient) start(ctx context.Context, method string, msg []byte) *http.Response {
+	c.t.Helper()
+	var body bytes.Buffer
+	writeGRPCMessage(&body, msg)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.base+controlService+method, &body)
+	req.Header.Set("Content-Type", "application/grpc")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// call makes a unary call and returns the response message and status
+func (c *grpcClient) call(method string, msg []byte) ([]byte, string) {
+	c.t.Helper()
+	resp := c.start(context.Background(), method, msg)
+	defer resp.Body.Close()
+	reply, _ := readGRPCMessage(resp.Body)
+	io.Copy(io.Discard, resp.Body)
+	if status := resp.Header.Get("Grpc-Status"); status != "" {
+		return reply, status
+	}
+	return reply, resp.Trailer.Get("Grpc-Status")
+}
+
+// decodeBackends returns the IDs and statuses in a BackendList
+func decodeBackends(t *testing.T, msg []byte) map[string]string {
+	t.Helper()
+	result := map[string]string{}
+	r := protoReader{buf: msg}
+	for r.next() {
+		id, status := decodeBackendMessage(t, r.message())
+		result[id] = status
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return result
+}
+
+func decodeBackendMessage(t *testing.T, msg []byte) (id, status string) {
+	t.Helper()
+	r := protoReader{buf: msg}
+	for r.next() {
+		switch r.field {
+		case 1:
+			id = r.string()
+		case 5:
+			status = r.string()
+		}
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return id, status
+}
+
+func TestControlService(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL)
+	lb.pools()["test"].Backends()[0].ID = "a"
+
+	srv := httptest.NewUnstartedServer((&ControlConfig{Token: "s3cret"}).handler(lb))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	c := &grpcClient{t: t, base: srv.URL, http: &http.Client{Transport: transport}}
+
+	var pool protoWriter
+	pool.string(1, "test")
+	if _, status := c.call("ListBackends", pool.buf); status != "16" {
+		t.Errorf("call without the token: status %s, want 16", status)
+	}
+	c.token = "s3cret"
+	if _, status := c.call("Nope", nil); status != "12" {
+		t.Errorf("unknown method: status %s, want 12", status)
+	}
+	reply, status := c.call("ListBackends", pool.buf)
+	if got := decodeBackends(t, reply); status != "0" || len(got) != 1 || got["a"] != "up" {
+		t.Errorf("list backends: %v, status %s", got, status)
+	}
+
+	// Watch starts with the current backends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := c.start(ctx, "Watch", pool.buf)
+	defer watch.Body.Close()
+	type event struct {
+		typ                          int64
+		id, status, previous, reason string
+	}
+	next := func() event {
+		t.Helper()
+		msg, err := readGRPCMessage(watch.Body)
+		if err != nil {
+			t.Fatalf("watch ended: %v, status %s", err, watch.Trailer.Get("Grpc-Status"))
+		}
+		var ev event
+		r := protoReader{buf: msg}
+		for r.next() {
+			switch r.field {
+			case 1:
+				ev.typ = r.int()
+			case 2:
+				ev.id, ev.status = decodeBackendMessage(t, r.message())
+			case 3:
+				ev.previous = r.string()
+			case 4:
+				ev.reason = r.string()
+			}
+		}
+		return ev
+	}
+	if ev := next(); ev.typ != eventAdded || ev.id != "a" {
+		t.Errorf("first event %+v, want a added", ev)
+	}
+	if ev := next(); ev.typ != eventSynced {
+		t.Errorf("second event %+v, want synced", ev)
+	}
+
+	var ref protoWriter
+	ref.string(1, "test")
+	ref.string(2, "b")
+	ref.string(3, b.URL)
+	reply, status = c.call("AddBackend", ref.buf)
+	if got := decodeBackends(t, reply); status != "0" || len(got) != 2 {
+		t.Errorf("add backend: %v, status %s", got, status)
+	}
+	if _, status := c.call("AddBackend", ref.buf); status != "6" {
+		t.Errorf("adding a backend twice: status %s, want 6", status)
+	}
+	if ev := next(); ev.typ != eventAdded || ev.id != "b" || ev.status != "up" {
+		t.Errorf("event %+v, want b added", ev)
+	}
+
+	// Drains over HTTP show up too
+	if rec := admin(t, lb, http.MethodPost, "/lb/drain", `{"pool": "test", "id": "b", "drain": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("drain: %d %s", rec.Code, rec.Body.String())
+	}
+	if ev := next(); ev.typ != eventStatus || ev.id != "b" || ev.status != "drained" || ev.previous != "up" || ev.reason != "drained by operator" {
+		t.Errorf("event %+v, want b drained", ev)
+	}
+	var drain protoWriter
+	drain.message(1, func(w *protoWriter) { w.string(1, "test"); w.string(2, "b") })
+	reply, status = c.call("DrainBackend", drain.buf)
+	if id, got := decodeBackendMessage(t, reply); status != "0" || id != "b" || got != "up" {
+		t.Errorf("restore: %s %s, status %s", id, got, status)
+	}
+	if ev := next(); ev.typ != eventStatus || ev.status != "up" || ev.previous != "drained" {
+		t.Errorf("event %+v, want b up", ev)
+	}
+
+	if reply, status = c.call("RemoveBackend", ref.buf); status != "0" || len(decodeBackends(t, reply)) != 1 {
+		t.Errorf("remove backend: status %s", status)
+	}
+	if ev := next(); ev.typ != eventRemoved || ev.id != "b" {
+		t.Errorf("event %+v, want b removed", ev)
+	}
+
+	var name protoWriter
+	name.string(1, "bogus")
+	if _, status := c.call("SetAlgorithm", name.buf); status != "3" {
+		t.Errorf("unknown algorithm: status %s, want 3", status)
+	}
+	name = protoWriter{}
+	name.string(1, string(LeastConn))
+	reply, status = c.call("SetAlgorithm", name.buf)
+	r := protoReader{buf: reply}
+	if !r.next() || r.string() != string(LeastConn) || status != "0" {
+		t.Errorf("set algorithm: %q, status %s", reply, status)
+	}
+	if _, status := c.call("GetStats", []byte{0xff}); status != "3" {
+		t.Errorf("garbled request: status %s, want 3", status)
+	}
+}
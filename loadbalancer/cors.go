@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig is a route's cross-origin policy; the balancer answers
+// preflights itself and sets the response headers, replacing any the
+// backend sent
+type CORSConfig struct {
+	// AllowedOrigins are exact origins, "*" or wildcards such as
+	// "https://*.example.com"
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// AllowedHeaders lists request headers clients may send, "*" allows
+	// whatever the preflight asks for
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	// MaxAge is how long browsers may cache a preflight
+	MaxAge Duration `json:"max_age,omitempty"`
+}
+
+// validate fills in defaults and rejects unsafe combinations
+func (c *CORSConfig) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("cors: allowed_origins is required")
+	}
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, "*") {
+		return fmt.Errorf("cors: allow_credentials cannot be combined with origin *")
+	}
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	for i, m := range c.AllowedMethods {
+		c.AllowedMethods[i] = strings.ToUpper(m)
+	}
+	return nil
+}
+
+// allowsOrigin matches origin against the allowed origins
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether every header a preflight asks for is allowed
+func (c *CORSConfig) allowsHeaders(requested string) bool {
+	if slices.Contains(c.AllowedHeaders, "*") {
+		return true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !slices.ContainsFunc(c.AllowedHeaders, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// setOriginHeaders adds the headers shared by preflight and actual responses
+func (c *CORSConfig) setOriginHeaders(h http.Header, origin string) {
+	if slices.Contains(c.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handleCORS applies the route's policy. It answers preflight requests
+// itself and returns false for them; other cross-origin requests get a
+// writer that puts our headers on the backend's response.
+func handleCORS(w http.ResponseWriter, r *http.Request, route *RouteConfig) (http.ResponseWriter, bool) {
+	origin := r.Header.Get("Origin")
+	if route == nil || route.CORS == nil || origin == "" {
+		return w, true
+	}
+	c := route.CORS
+
+	if method := r.Header.Get("Access-Control-Request-Method"); r.Method == http.MethodOptions && method != "" {
+		h := w.Header()
+		h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		requested := r.Header.Get("Access-Control-Request-Headers")
+		if !c.allowsOrigin(origin) || !slices.Contains(c.AllowedMethods, strings.ToUpper(method)) || !c.allowsHeaders(requested) {
+			// Without the allow headers the browser blocks the request
+			w.WriteHeader(http.StatusNoContent)
+			return w, false
+		}
+		c.setOriginHeaders(h, origin)
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		if requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge).Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return w, false
+	}
+
+	allowed := c.allowsOrigin(origin)
+	return &headerHook{ResponseWriter: w, hook: func(h http.Header) {
+		// The backend's CORS headers are replaced by the route's policy
+		for name := range h {
+			if strings.HasPrefix(name, "Access-Control-") {
+				h.Del(name)
+			}
+		}
+		// The response depends on the origin unless every origin is allowed
+		if !slices.Contains(c.AllowedOrigins, "*") {
+			h.Add("Vary", "Origin")
+		}
+		if allowed {
+			c.setOriginHeaders(h, origin)
+			if len(c.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+			}
+		}
+	}}, true
+}
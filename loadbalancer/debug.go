@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// DebugConfig exposes the balancer's own internals on the admin endpoints
+// for diagnosing performance problems in production
+type DebugConfig struct {
+	// Pprof serves the Go profiler under /lb/debug/pprof/ on the admin
+	// listener
+	Pprof bool `json:"pprof"`
+	// Runtime serves goroutine, GC and heap stats at /lb/debug/runtime
+	// and adds them to /lb/metrics
+	Runtime bool `json:"runtime"`
+}
+
+// registerDebug adds the enabled debug endpoints to the admin mux.
+// dedicated is set for the admin listener.
+func registerDebug(admin *http.ServeMux, cfg DebugConfig, dedicated bool) {
+	if cfg.Pprof {
+		// The pprof handlers expect to be mounted at /debug/pprof/. They
+		// give away command lines and memory and can keep the CPU busy,
+		// so other listeners do not serve them at all.
+		strip := func(h http.HandlerFunc) http.Handler {
+			stripped := http.StripPrefix("/lb", h)
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !dedicated {
+					http.NotFound(w, r)
+					return
+				}
+				stripped.ServeHTTP(w, r)
+			})
+		}
+		admin.Handle("/lb/debug/pprof/", strip(pprof.Index))
+		admin.Handle("/lb/debug/pprof/cmdline", strip(pprof.Cmdline))
+		admin.Handle("/lb/debug/pprof/profile", strip(pprof.Profile))
+		admin.Handle("/lb/debug/pprof/symbol", strip(pprof.Symbol))
+		admin.Handle("/lb/debug/pprof/trace", strip(pprof.Trace))
+	}
+	if cfg.Runtime {
+		admin.HandleFunc("/lb/debug/runtime", runtimeHandler)
+	}
+}
+
+// RuntimeStats is a snapshot of the Go runtime
+type RuntimeStats struct {
+	Goroutines int `json:"goroutines"`
+	Threads    int `json:"threads"`
+	GOMAXPROCS int `json:"gomaxprocs"`
+	// Heap figures are in bytes
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	HeapInuse   uint64 `json:"heap_inuse_bytes"`
+	HeapSys     uint64 `json:"heap_sys_bytes"`
+	HeapObjects uint64 `json:"heap_objects"`
+	NextGC      uint64 `json:"next_gc_bytes"`
+	NumGC       uint32 `json:"num_gc"`
+	// GC pauses are in milliseconds, the recent ones cover the last 256
+	// collections at most
+	PauseTotal     float64 `json:"gc_pause_total_ms"`
+	LastPause      float64 `json:"gc_last_pause_ms"`
+	RecentPauseP99 float64 `json:"gc_recent_pause_p99_ms"`
+	RecentPauseMax float64 `json:"gc_recent_pause_max_ms"`
+	GCCPUFraction  float64 `json:"gc_cpu_fraction"`
+}
+
+// readRuntimeStats takes a snapshot of the runtime; it stops the world
+// briefly, so it is only done on request
+func readRuntimeStats() RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	threads, _ := runtime.ThreadCreateProfile(nil)
+	s := RuntimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		Threads:       threads,
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		HeapAlloc:     m.HeapAlloc,
+		HeapInuse:     m.HeapInuse,
+		HeapSys:       m.HeapSys,
+		HeapObjects:   m.HeapObjects,
+		NextGC:        m.NextGC,
+		NumGC:         m.NumGC,
+		PauseTotal:    nanosToMs(m.PauseTotalNs),
+		GCCPUFraction: m.GCCPUFraction,
+	}
+	n := int(m.NumGC)
+	if n == 0 {
+		return s
+	}
+	s.LastPause = nanosToMs(m.PauseNs[(n+255)%256])
+	if n > 256 {
+		n = 256
+	}
+	pauses := append([]uint64{}, m.PauseNs[:n]...)
+	sort.Slice(pauses, func(i, j int) bool { return pauses[i] < pauses[j] })
+	s.RecentPauseP99 = nanosToMs(pauses[(len(pauses)*99-1)/100])
+	s.RecentPauseMax = nanosToMs(pauses[len(pauses)-1])
+	return s
+}
+
+// nanosToMs converts nanoseconds to milliseconds
+func nanosToMs(ns uint64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
+
+// runtimeHandler serves a runtime snapshot
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(readRuntimeStats())
+}
+
+// writeRuntimeMetrics adds the runtime snapshot to the Prometheus output
+func writeRuntimeMetrics(w io.Writer) {
+	s := readRuntimeStats()
+	gauge := func(name, help string, value interface{}) {
+		writeMetric(w, name, "gauge", help, []promSample{{nil, value}})
+	}
+	gauge("lb_go_goroutines", "Goroutines that currently exist.", s.Goroutines)
+	gauge("lb_go_threads", "OS threads created.", s.Threads)
+	gauge("lb_go_heap_alloc_bytes", "Bytes of allocated heap objects.", s.HeapAlloc)
+	gauge("lb_go_heap_inuse_bytes", "Bytes in in-use heap spans.", s.HeapInuse)
+	gauge("lb_go_heap_sys_bytes", "Bytes of heap memory obtained from the OS.", s.HeapSys)
+	gauge("lb_go_heap_objects", "Allocated heap objects.", s.HeapObjects)
+	gauge("lb_go_next_gc_bytes", "Heap size the next collection triggers at.", s.NextGC)
+	writeMetric(w, "lb_go_gc_total", "counter", "Completed GC cycles.", []promSample{{nil, s.NumGC}})
+	writeMetric(w, "lb_go_gc_pause_ms_total", "counter", "Total stop-the-world GC pause time in milliseconds.", []promSample{{nil, s.PauseTotal}})
+	gauge("lb_go_gc_recent_pause_max_ms", "Longest of the last 256 GC pauses in milliseconds.", s.RecentPauseMax)
+}
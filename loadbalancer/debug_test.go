@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	lb, _ := installPool(t, RoundRobin, testBackend(t, "a", 0).URL)
+	for _, path := range []string{"/lb/debug/pprof/", "/lb/debug/runtime"} {
+		if rec := admin(t, lb, http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s served with debug off: status %d", path, rec.Code)
+		}
+	}
+
+	cfg := *lb.config()
+	cfg.Debug = DebugConfig{Pprof: true, Runtime: true}
+	lb.setConfig(&cfg)
+	if rec := admin(t, lb, http.MethodGet, "/lb/debug/pprof/goroutine?debug=1", ""); rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine profile: status %d, body %.100q", rec.Code, rec.Body.String())
+	}
+	// The profiler stays off the proxy listeners, even with the token
+	cfg.Admin.Token = "admin-token"
+	req := httptest.NewRequest(http.MethodGet, "/lb/debug/pprof/goroutine?debug=1", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set("Authorization", "Bearer admin-token")
+	remote := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(remote, req)
+	if remote.Code != http.StatusNotFound {
+		t.Errorf("goroutine profile on a proxy listener: status %d, want 404", remote.Code)
+	}
+	remote = httptest.NewRecorder()
+	lb.adminHandler(true).ServeHTTP(remote, httptest.NewRequest(http.MethodGet, "/lb/debug/pprof/goroutine?debug=1", nil))
+	if remote.Code != http.StatusOK {
+		t.Errorf("goroutine profile on the admin listener: status %d, want 200", remote.Code)
+	}
+	rec := admin(t, lb, http.MethodGet, "/lb/debug/runtime", "")
+	var stats RuntimeStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || stats.Goroutines == 0 || stats.HeapAlloc == 0 {
+		t.Errorf("runtime stats = %+v, %v; want goroutines and heap", stats, err)
+	}
+	if rec := admin(t, lb, http.MethodGet, "/lb/metrics", ""); !strings.Contains(rec.Body.String(), "lb_go_goroutines ") {
+		t.Error("metrics lack lb_go_goroutines with runtime stats on")
+	}
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// unknownLatency is assumed, in milliseconds, for backends without a
+// current latency measurement
+const unknownLatency = 100
+
+// LatencyDecayConfig fades latency measurements of idle backends so old
+// numbers do not steer the first requests after a quiet period
+type LatencyDecayConfig struct {
+	// IdleAfter is how long a backend goes without requests before its
+	// statistics start to decay
+	IdleAfter Duration `json:"idle_after"`
+	// HalfLife is how long it takes an idle backend's average to get
+	// halfway back to neutral, zero disables decay
+	HalfLife Duration `json:"half_life"`
+}
+
+// decayInterval is how often idle backends are decayed
+const decayInterval = 10 * time.Second
+
+// forgetWeight is the sample weight below which history is dropped and
+// the backend is treated as unmeasured again
+const forgetWeight = 0.05
+
+// latencyStats holds the decayable sums behind Backend.AvgLatency
+type latencyStats struct {
+	mu     sync.Mutex
+	sum    float64
+	weight float64
+	last   time.Time
+}
+
+// decayLatency moves an idle backend's average towards unknownLatency and
+// lowers the weight of its history so fresh samples dominate
+func (b *Backend) decayLatency(now time.Time, cfg LatencyDecayConfig) {
+	b.latency.mu.Lock()
+	defer b.latency.mu.Unlock()
+
+	s := &b.latency
+	if s.weight == 0 || now.Sub(s.last) < time.Duration(cfg.IdleAfter) {
+		return
+	}
+	factor := math.Pow(0.5, float64(decayInterval)/float64(cfg.HalfLife))
+	avg := unknownLatency + (s.sum/s.weight-unknownLatency)*factor
+	s.weight *= factor
+	if s.weight < forgetWeight {
+		s.sum, s.weight = 0, 0
+		atomic.StoreInt64(&b.AvgLatency, 0)
+		return
+	}
+	s.sum = avg * s.weight
+	atomic.StoreInt64(&b.AvgLatency, int64(avg))
+}
+
+// decayRoutine periodically decays the statistics of idle backends
+func (lb *Balancer) decayRoutine() {
+	t := time.NewTicker(decayInterval)
+	defer t.Stop()
+	for now := range t.C {
+		cfg := lb.config().LatencyDecay
+		if cfg.HalfLife <= 0 {
+			continue
+		}
+		for _, pool := range lb.pools() {
+			for _, b := range pool.Backends() {
+				b.decayLatency(now, cfg)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// happyDialer races connections to the addresses of a backend hostname,
+// IPv6 and IPv4 interleaved, starting another attempt every delay or as
+// soon as one fails (RFC 8305), so a broken address family costs at most
+// a few delays rather than a connect timeout
+type happyDialer struct {
+	dialer   *net.Dialer
+	resolver *net.Resolver
+	delay    time.Duration
+}
+
+// DialContext connects to addr through whichever of its addresses answers
+// first
+func (d *happyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := interleaveFamilies(ips)
+	for i, ip := range addrs {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return raceDial(ctx, addrs, d.delay, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// interleaveFamilies orders ips IPv6 first, alternating families
+func interleaveFamilies(ips []net.IPAddr) []string {
+	var v6, v4 []string
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	result := make([]string, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			result, v6 = append(result, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			result, v4 = append(result, v4[0]), v4[1:]
+		}
+	}
+	return result
+}
+
+// raceDial dials addrs in order, each attempt starting delay after the
+// previous one or when it fails, and returns the first connection made;
+// the others are cancelled or closed
+func raceDial(ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn, err}
+		}()
+		timer.Reset(delay)
+	}
+	start()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close what the attempts still running connect, if anything
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
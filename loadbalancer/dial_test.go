@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHappyEyeballs(t *testing.T) {
+	ips := []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("2001:db8::1")}}
+	if got := strings.Join(interleaveFamilies(ips), " "); got != "2001:db8::1 10.0.0.1 10.0.0.2" {
+		t.Errorf("dial order %q, want IPv6 first then alternating", got)
+	}
+
+	// IPv6 is blackholed, IPv4 answers once its attempt starts
+	abandoned := make(chan struct{})
+	start := time.Now()
+	conn, err := raceDial(context.Background(), []string{"[2001:db8::1]:80", "10.0.0.1:80"}, 50*time.Millisecond,
+		func(ctx context.Context, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "[") {
+				<-ctx.Done()
+				close(abandoned)
+				return nil, ctx.Err()
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connected after %s with a blackholed IPv6 address", elapsed)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Error("the IPv6 attempt was not cancelled")
+	}
+
+	// A refused attempt starts the next without waiting out the delay
+	start = time.Now()
+	_, err = raceDial(context.Background(), []string{"a:80", "b:80"}, 10*time.Second,
+		func(ctx context.Context, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("%s refused", addr)
+		})
+	if err == nil || err.Error() != "a:80 refused" || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("raceDial = %v after %s, want the first error at once", err, time.Since(start))
+	}
+}
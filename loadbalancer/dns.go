@@ -0,0 +1,192 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsTarget is a backend configured by hostname whose addresses become
+// individual pool members. Names like _api._tcp.example.com are looked up
+// as SRV records instead, see resolveSRV.
+type dnsTarget struct {
+	pool   *ServerPool
+	origin *url.URL
+	srv    bool
+}
+
+// newDNSTarget returns the target for a backend URL naming a host
+func newDNSTarget(pool *ServerPool, origin *url.URL) *dnsTarget {
+	return &dnsTarget{pool: pool, origin: origin, srv: isSRVName(origin.Hostname())}
+}
+
+// isSRVName reports whether host is a service name, such as
+// _api._tcp.example.com or api._tcp.service.consul
+func isSRVName(host string) bool {
+	labels := strings.Split(host, ".")
+	return len(labels) >= 3 && labels[1] == "_tcp"
+}
+
+// lookupSRV is the resolver's SRV lookup, replaced in tests
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// needsResolution reports whether rawURL names its host rather than an IP
+func needsResolution(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(u.Hostname()) == nil
+}
+
+// resolve looks up the target's A/AAAA records and returns one member URL
+// per address, sorted for stable ordering
+func (t *dnsTarget) resolve() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if t.srv {
+		return t.resolveSRV(ctx)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, t.origin.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	port := t.origin.Port()
+	if port == "" {
+		port = "80"
+		if t.origin.Scheme == "https" {
+			port = "443"
+		}
+	}
+	members := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		u := *t.origin
+		u.Host = net.JoinHostPort(a.IP.String(), port)
+		members = append(members, u.String())
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// resolveSRV looks up the target's SRV records and returns one member URL
+// per answer of the lowest priority, the others being fallbacks the pool
+// does not use. Members keep the target hostname so TLS verifies against
+// it, and take their port from the answer. SRV weights are ignored.
+func (t *dnsTarget) resolveSRV(ctx context.Context) ([]string, error) {
+	_, records, err := lookupSRV(ctx, "", "", t.origin.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	lowest := uint16(math.MaxUint16)
+	for _, rec := range records {
+		lowest = min(lowest, rec.Priority)
+	}
+	members := []string{}
+	for _, rec := range records {
+		// "." says the service is not available at this name
+		target := strings.TrimSuffix(rec.Target, ".")
+		if target == "" || rec.Priority != lowest {
+			continue
+		}
+		u := *t.origin
+		u.Host = net.JoinHostPort(target, strconv.Itoa(int(rec.Port)))
+		members = append(members, u.String())
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", t.origin.Hostname())
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// refresh re-resolves the target and adds or removes pool members to
+// match the answer; on lookup failure the current members are kept
+func (t *dnsTarget) refresh() error {
+	want, err := t.resolve()
+	if err != nil {
+		slog.Warn("DNS lookup failed, keeping current members", "host", t.origin.Host, "error", err)
+		return err
+	}
+
+	added, removed := t.pool.SyncMembers(t.origin.String(), want, t.newMember)
+	for _, member := range added {
+		slog.Info("DNS member added", "pool", t.pool.Name, "member", member, "host", t.origin.Host)
+	}
+	for _, member := range removed {
+		slog.Info("DNS member removed", "pool", t.pool.Name, "member", member, "host", t.origin.Host)
+	}
+	return nil
+}
+
+// newMember creates the backend for one resolved address. TLS backends
+// still verify against the configured hostname rather than the IP.
+func (t *dnsTarget) newMember(member string) (*Backend, error) {
+	backend, err := newBackend(member, t.pool)
+	if err != nil {
+		return nil, err
+	}
+	if t.origin.Scheme == "https" && !t.srv {
+		backend.ReverseProxy.Transport = withServerName(t.pool.transport, t.origin.Hostname())
+	}
+	return backend, nil
+}
+
+// addUnresolved adds the target by hostname, used when the first lookup
+// fails so the pool still has a member to try. A service name is no host
+// to try, its members come with the first lookup that succeeds.
+func (t *dnsTarget) addUnresolved() error {
+	if t.srv {
+		return nil
+	}
+	backend, err := newBackend(t.origin.String(), t.pool)
+	if err != nil {
+		return err
+	}
+	backend.origin = t.origin.String()
+	t.pool.AddBackend(backend)
+	return nil
+}
+
+// watch re-resolves the target every interval
+func (t *dnsTarget) watch(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.refresh()
+		case <-t.pool.lifetime().Done():
+			return
+		}
+	}
+}
+
+// withServerName returns a copy of rt whose TLS handshakes use name for
+// SNI and certificate verification
+func withServerName(rt http.RoundTripper, name string) http.RoundTripper {
+	tt, ok := rt.(*timeoutTransport)
+	if !ok {
+		return rt
+	}
+	inner, ok := tt.next.(*http.Transport)
+	if !ok {
+		return rt
+	}
+	clone := inner.Clone()
+	if clone.TLSClientConfig == nil {
+		clone.TLSClientConfig = &tls.Config{}
+	}
+	clone.TLSClientConfig.ServerName = name
+	return &timeoutTransport{next: clone}
+}
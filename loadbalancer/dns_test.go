@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSRVDiscovery(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL)
+	portOf := func(srv *httptest.Server) uint16 {
+		port, _ := strconv.Atoi(srv.URL[strings.LastIndex(srv.URL, ":")+1:])
+		return uint16(port)
+	}
+	var mu sync.Mutex
+	answer := []*net.SRV{
+		{Target: "localhost.", Port: portOf(a), Priority: 1},
+		{Target: "fallback.example.", Port: 80, Priority: 2},
+	}
+	oldLookup := lookupSRV
+	t.Cleanup(func() { lookupSRV = oldLookup })
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if service != "" || proto != "" || name != "api._tcp.service.consul" {
+			t.Errorf("SRV lookup of %q %q %q", service, proto, name)
+		}
+		if answer == nil {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return name, answer, nil
+	}
+
+	pool, err := lb.buildPool("srv", &PoolConfig{Backends: []string{"http://api._tcp.service.consul/v1"}, DNSRefresh: Duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := func() []string {
+		var urls []string
+		for _, b := range pool.Backends() {
+			urls = append(urls, b.URL.String())
+		}
+		return urls
+	}
+	want := fmt.Sprintf("http://localhost:%d/v1", portOf(a))
+	if got := members(); len(got) != 1 || got[0] != want {
+		t.Fatalf("members %v, want only %s from the lowest priority", got, want)
+	}
+	lb.pools()["srv"] = pool
+	cfg := *lb.config()
+	cfg.Routes = append([]RouteConfig{{Host: "srv.test", Pool: "srv"}}, cfg.Routes...)
+	lb.setConfig(&cfg)
+	rec := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://srv.test/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend") != "a" {
+		t.Errorf("request through the SRV member: %d from %q", rec.Code, rec.Header().Get("X-Backend"))
+	}
+
+	// The answer moves the service to another port
+	target := newDNSTarget(pool, &url.URL{Scheme: "http", Host: "api._tcp.service.consul", Path: "/v1"})
+	mu.Lock()
+	answer = []*net.SRV{{Target: "localhost.", Port: portOf(b), Priority: 1}}
+	mu.Unlock()
+	target.refresh()
+	if got := members(); len(got) != 1 || got[0] != fmt.Sprintf("http://localhost:%d/v1", portOf(b)) {
+		t.Errorf("members after the move: %v", got)
+	}
+
+	// Failed lookups keep the members, and a pool whose first lookup fails
+	// starts empty rather than with the service name as a host
+	mu.Lock()
+	answer = nil
+	mu.Unlock()
+	if target.refresh() == nil || len(members()) != 1 {
+		t.Errorf("failed lookup: members %v", members())
+	}
+	empty, err := lb.buildPool("srv2", &PoolConfig{Backends: []string{"http://api._tcp.service.consul"}, DNSRefresh: Duration(time.Hour)})
+	if err != nil || len(empty.Backends()) != 0 {
+		t.Errorf("pool after a failed first lookup: %v, %v", empty.Backends(), err)
+	}
+	if isSRVName("api.service.consul") || !isSRVName("_api._tcp.example.com") {
+		t.Error("isSRVName misjudges names")
+	}
+}
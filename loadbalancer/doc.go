@@ -0,0 +1,12 @@
+// Package loadbalancer is an HTTP, TCP and UDP load balancer. The lb
+// command runs it from a config file; other programs can embed it by
+// building pools and routes in code:
+//
+//	web, err := loadbalancer.NewPool("web", "http://10.0.0.5:8080", "http://10.0.0.6:8080")
+//	r := loadbalancer.NewRouter()
+//	r.PathPrefix("/").Pool(web).Strategy(loadbalancer.LeastConn)
+//	lb := loadbalancer.New()
+//	err = lb.Install(r)
+//	lb.Start()
+//	http.ListenAndServe(":8080", lb.Handler())
+package loadbalancer
@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// DockerConfig makes a pool follow running containers carrying a label
+type DockerConfig struct {
+	// Host is the Docker API endpoint, unix:///var/run/docker.sock by default
+	Host string `json:"host"`
+	// Label selects containers, "key" or "key=value"
+	Label string `json:"label"`
+	// PortLabel names the label holding the port to send traffic to
+	PortLabel string `json:"port_label"`
+	// PoolLabel, when present on a container, must name this pool
+	PoolLabel string `json:"pool_label"`
+	// Network picks the container network to use, any network if empty
+	Network  string   `json:"network,omitempty"`
+	Scheme   string   `json:"scheme,omitempty"`
+	Interval Duration `json:"interval"`
+}
+
+// validate fills in defaults and checks the API endpoint
+func (c *DockerConfig) validate() error {
+	if c.Host == "" {
+		c.Host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(c.Host)
+	if err != nil {
+		return fmt.Errorf("docker: host: %w", err)
+	}
+	switch u.Scheme {
+	case "unix", "tcp", "http":
+	default:
+		return fmt.Errorf("docker: unsupported host scheme %q", u.Scheme)
+	}
+	if c.Label == "" {
+		c.Label = "lb.enable=true"
+	}
+	if c.PortLabel == "" {
+		c.PortLabel = "lb.port"
+	}
+	if c.PoolLabel == "" {
+		c.PoolLabel = "lb.pool"
+	}
+	switch c.Scheme {
+	case "":
+		c.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("docker: unsupported scheme %q", c.Scheme)
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(10 * time.Second)
+	}
+	return nil
+}
+
+// dockerWatcher keeps a pool in sync with labelled containers
+type dockerWatcher struct {
+	pool   *ServerPool
+	cfg    *DockerConfig
+	client *http.Client
+	base   string
+}
+
+// newDockerWatcher returns a watcher for pool, talking to the Docker API
+// over a unix socket or TCP
+func newDockerWatcher(pool *ServerPool, cfg *DockerConfig) *dockerWatcher {
+	u, _ := url.Parse(cfg.Host)
+	w := &dockerWatcher{pool: pool, cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	if u.Scheme == "unix" {
+		socket := u.Path
+		w.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		w.base = "http://docker"
+	} else {
+		w.base = "http://" + u.Host
+	}
+	return w
+}
+
+// origin tags the members the watcher manages
+func (d *dockerWatcher) origin() string {
+	return "docker:" + d.cfg.Label
+}
+
+// dockerContainer is the part of a /containers/json entry we use
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// list returns one member URL per running container matching the label
+func (d *dockerWatcher) list() ([]string, error) {
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {d.cfg.Label},
+		"status": {"running"},
+	})
+	resp, err := d.client.Get(d.base + "/containers/json?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker returned %s", resp.Status)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(containers))
+	for _, c := range containers {
+		if pool, ok := c.Labels[d.cfg.PoolLabel]; ok && pool != d.pool.Name {
+			continue
+		}
+		port := c.Labels[d.cfg.PortLabel]
+		if port == "" {
+			port = "80"
+		}
+		ip := d.containerIP(c)
+		if ip == "" {
+			slog.Warn("Docker container has no address on network", "container", c.ID[:min(12, len(c.ID))], "network", d.cfg.Network)
+			continue
+		}
+		u := url.URL{Scheme: d.cfg.Scheme, Host: net.JoinHostPort(ip, port)}
+		members = append(members, u.String())
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// containerIP picks the container's address on the configured network, or
+// on the first network by name when none is configured
+func (d *dockerWatcher) containerIP(c dockerContainer) string {
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		if d.cfg.Network == "" || name == d.cfg.Network {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := c.NetworkSettings.Networks[name]
+		if n.IPAddress != "" {
+			return n.IPAddress
+		}
+		if n.GlobalIPv6Address != "" {
+			return n.GlobalIPv6Address
+		}
+	}
+	return ""
+}
+
+// refresh lists the containers and reconciles the pool with them; on
+// failure the current members are kept
+func (d *dockerWatcher) refresh() error {
+	want, err := d.list()
+	if err != nil {
+		slog.Warn("Docker lookup failed, keeping current members", "label", d.cfg.Label, "error", err)
+		return err
+	}
+
+	added, removed := d.pool.SyncMembers(d.origin(), want, func(member string) (*Backend, error) {
+		return newBackend(member, d.pool)
+	})
+	for _, member := range added {
+		slog.Info("Docker member added", "pool", d.pool.Name, "member", member)
+	}
+	for _, member := range removed {
+		slog.Info("Docker member removed", "pool", d.pool.Name, "member", member)
+	}
+	return nil
+}
+
+// watch lists the containers every interval
+func (d *dockerWatcher) watch() {
+	tick := time.NewTicker(time.Duration(d.cfg.Interval))
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			d.refresh()
+		case <-d.pool.lifetime().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// dryRunKey identifies a rule and what it would have done
+type dryRunKey struct {
+	rule   string
+	action string
+}
+
+// dryRunMetrics counts requests dry-run rules would have acted on
+type dryRunMetrics struct {
+	mu      sync.Mutex
+	matches map[dryRunKey]int64
+}
+
+var dryRuns = &dryRunMetrics{matches: map[dryRunKey]int64{}}
+
+// Record meters and logs that rule would have applied action to r
+func (d *dryRunMetrics) Record(rule, action string, r *http.Request) {
+	d.mu.Lock()
+	d.matches[dryRunKey{rule, action}]++
+	d.mu.Unlock()
+
+	slog.Info("Dry run match", "rule", rule, "action", action, "method", r.Method, "path", r.URL.Path, "client", clientString(r))
+}
+
+// Snapshot returns the match count of every rule
+func (d *dryRunMetrics) Snapshot() []map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := make([]map[string]interface{}, 0, len(d.matches))
+	for k, n := range d.matches {
+		result = append(result, map[string]interface{}{
+			"rule":    k.rule,
+			"action":  k.action,
+			"matches": n,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["rule"].(string) < result[j]["rule"].(string)
+	})
+	return result
+}
@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ErrorPage replaces the plain-text body of a 502, 503 or 504 the balancer
+// generates itself. Templates see the fields of errorPageData.
+type ErrorPage struct {
+	HTML     string `json:"html,omitempty"`
+	HTMLFile string `json:"html_file,omitempty"`
+	JSON     string `json:"json,omitempty"`
+	JSONFile string `json:"json_file,omitempty"`
+	// RetryAfter is sent with the page; 503s default to the health check
+	// interval, the soonest a backend can come back
+	RetryAfter Duration `json:"retry_after,omitempty"`
+
+	html, json pageTemplate
+}
+
+// pageTemplate is satisfied by both html/template and text/template
+type pageTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// jsonFuncs lets JSON templates quote values safely, as in {{json .Path}}
+var jsonFuncs = template.FuncMap{"json": func(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}}
+
+// errorPageData is what error page templates can refer to
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Method     string
+	Host       string
+	Path       string
+	RetryAfter int
+}
+
+// errorPageStatuses are the statuses a page can be configured for
+var errorPageStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// validate reads template files and parses the templates; HTML escapes
+// what it inserts, JSON is rendered as written
+func (p *ErrorPage) validate(status string) error {
+	var err error
+	if p.HTML, err = inlineOrFile(p.HTML, p.HTMLFile); err != nil {
+		return fmt.Errorf("error_pages %s: %w", status, err)
+	}
+	if p.JSON, err = inlineOrFile(p.JSON, p.JSONFile); err != nil {
+		return fmt.Errorf("error_pages %s: %w", status, err)
+	}
+	if p.HTML == "" && p.JSON == "" {
+		return fmt.Errorf("error_pages %s: html or json is required", status)
+	}
+	if p.HTML != "" {
+		if p.html, err = htmltemplate.New(status).Parse(p.HTML); err != nil {
+			return fmt.Errorf("error_pages %s: %w", status, err)
+		}
+	}
+	if p.JSON != "" {
+		if p.json, err = template.New(status).Funcs(jsonFuncs).Parse(p.JSON); err != nil {
+			return fmt.Errorf("error_pages %s: %w", status, err)
+		}
+	}
+	if p.RetryAfter < 0 {
+		return fmt.Errorf("error_pages %s: retry_after must not be negative", status)
+	}
+	return nil
+}
+
+// inlineOrFile returns the inline value, or the file's contents if a file
+// is given instead
+func inlineOrFile(inline, file string) (string, error) {
+	if file == "" {
+		return inline, nil
+	}
+	if inline != "" {
+		return "", fmt.Errorf("set either the template or its file, not both")
+	}
+	b, err := os.ReadFile(file)
+	return string(b), err
+}
+
+// validateErrorPages checks the configured statuses and their pages
+func validateErrorPages(pages map[string]*ErrorPage) error {
+	for status, p := range pages {
+		code, err := strconv.Atoi(status)
+		if err != nil || !slices.Contains(errorPageStatuses, code) {
+			return fmt.Errorf("error_pages: status %q is not one of %v", status, errorPageStatuses)
+		}
+		if err := p.validate(status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeError answers with status using the configured page, falling back
+// to msg as plain text. JSON is picked when the client asks for it.
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writePage(w, r, requestConfig(r).ErrorPages[strconv.Itoa(status)], status, msg)
+}
+
+// writePage answers with status using page, or msg as plain text when
+// page is nil
+func writePage(w http.ResponseWriter, r *http.Request, page *ErrorPage, status int, msg string) {
+	retryAfter := time.Duration(0)
+	if page != nil && page.RetryAfter > 0 {
+		retryAfter = time.Duration(page.RetryAfter)
+	} else if status == http.StatusServiceUnavailable {
+		retryAfter = time.Duration(requestConfig(r).HealthCheck.Interval)
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+
+	tmpl, contentType := page.pick(r.Header.Get("Accept"))
+	if tmpl == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		RetryAfter: int((retryAfter + time.Second - 1) / time.Second),
+	})
+	if err != nil {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// pick chooses the JSON template for clients that accept JSON and the
+// HTML one otherwise, using whichever exists
+func (p *ErrorPage) pick(accept string) (pageTemplate, string) {
+	if p == nil {
+		return nil, ""
+	}
+	wantsJSON := strings.Contains(accept, "json")
+	switch {
+	case p.json != nil && (wantsJSON || p.html == nil):
+		return p.json, "application/json"
+	case p.html != nil:
+		return p.html, "text/html; charset=utf-8"
+	}
+	return nil, ""
+}
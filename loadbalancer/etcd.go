@@ -0,0 +1,334 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EtcdConfig keeps backends and routes in an etcd key so every replica
+// picks up changes without a restart. The key holds a JSON document with
+// "backends", "pools" and "routes" in the config file format; its routes
+// replace the file's and its pools add to or replace the file's.
+type EtcdConfig struct {
+	// Endpoints are etcd client URLs, the v3 JSON gateway is used
+	Endpoints []string `json:"endpoints"`
+	Key       string   `json:"key"`
+	Username  string   `json:"username,omitempty"`
+	Password  string   `json:"password,omitempty"`
+	Timeout   Duration `json:"timeout"`
+}
+
+// validate fills in defaults and checks required fields
+func (e *EtcdConfig) validate() error {
+	if len(e.Endpoints) == 0 {
+		return fmt.Errorf("etcd: no endpoints configured")
+	}
+	if e.Key == "" {
+		e.Key = "/lb/config"
+	}
+	if e.Timeout <= 0 {
+		e.Timeout = Duration(5 * time.Second)
+	}
+	return nil
+}
+
+// etcdDocument is the part of the configuration stored in etcd
+type etcdDocument struct {
+	Backends []string               `json:"backends"`
+	Pools    map[string]*PoolConfig `json:"pools"`
+	Routes   []RouteConfig          `json:"routes"`
+}
+
+// etcdSource reads and watches the configuration key of a balancer
+type etcdSource struct {
+	lb         *Balancer
+	cfg        *EtcdConfig
+	configPath string
+	client     *http.Client
+	endpoint   int
+	token      string
+	revision   int64
+}
+
+// newEtcdSource returns a source for cfg applying changes to lb;
+// configPath is re-read on every change so the etcd document is always
+// applied to the file's settings
+func newEtcdSource(lb *Balancer, cfg *EtcdConfig, configPath string) *etcdSource {
+	return &etcdSource{lb: lb, cfg: cfg, configPath: configPath, client: &http.Client{}}
+}
+
+// call posts a JSON request to the gateway, trying each endpoint in turn
+func (e *etcdSource) call(ctx context.Context, path string, in interface{}) (*http.Response, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for range e.cfg.Endpoints {
+		base := strings.TrimSuffix(e.cfg.Endpoints[e.endpoint], "/")
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if e.token != "" {
+			req.Header.Set("Authorization", e.token)
+		}
+		resp, err := e.client.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s returned %s", base, resp.Status)
+		}
+		lastErr = err
+		e.endpoint = (e.endpoint + 1) % len(e.cfg.Endpoints)
+	}
+	return nil, lastErr
+}
+
+// authenticate obtains a token when credentials are configured
+func (e *etcdSource) authenticate(ctx context.Context) error {
+	if e.cfg.Username == "" {
+		return nil
+	}
+	e.token = ""
+	resp, err := e.call(ctx, "/v3/auth/authenticate", map[string]string{
+		"name":     e.cfg.Username,
+		"password": e.cfg.Password,
+	})
+	if err != nil {
+		return fmt.Errorf("etcd: authenticate: %w", err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("etcd: authenticate: %w", err)
+	}
+	e.token = out.Token
+	return nil
+}
+
+// etcdKV is a key/value pair as rendered by the gateway
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+// get reads the key, returning nil if it does not exist
+func (e *etcdSource) get() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.cfg.Timeout))
+	defer cancel()
+	if err := e.authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := e.call(ctx, "/v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.cfg.Key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("etcd: get %s: %w", e.cfg.Key, err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("etcd: get %s: %w", e.cfg.Key, err)
+	}
+	e.revision, _ = strconv.ParseInt(out.Header.Revision, 10, 64)
+	if len(out.KVs) == 0 {
+		return nil, nil
+	}
+	return out.KVs[0].Value, nil
+}
+
+// load builds the configuration from the file and the etcd document
+func (e *etcdSource) load(value []byte) (*Config, error) {
+	var doc etcdDocument
+	if value != nil {
+		if err := json.Unmarshal(value, &doc); err != nil {
+			return nil, fmt.Errorf("etcd: %s: %w", e.cfg.Key, err)
+		}
+	}
+	return loadConfigWith(e.configPath, func(cfg *Config) {
+		if doc.Backends != nil {
+			cfg.Backends = doc.Backends
+		}
+		if cfg.Pools == nil {
+			cfg.Pools = map[string]*PoolConfig{}
+		}
+		for name, pool := range doc.Pools {
+			cfg.Pools[name] = pool
+		}
+		if doc.Routes != nil {
+			cfg.Routes = doc.Routes
+		}
+	})
+}
+
+// watch streams changes to the key and applies each new document,
+// reconnecting after errors
+func (e *etcdSource) watch() {
+	backoff := time.Second
+	for {
+		err := e.watchOnce()
+		slog.Warn("etcd watch ended", "key", e.cfg.Key, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+
+		// Catch up on anything missed while disconnected
+		value, err := e.get()
+		if err != nil {
+			slog.Warn("etcd read failed", "key", e.cfg.Key, "error", err)
+			continue
+		}
+		backoff = time.Second
+		e.apply(value)
+	}
+}
+
+// watchOnce runs one watch stream until it fails
+func (e *etcdSource) watchOnce() error {
+	resp, err := e.call(context.Background(), "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(e.cfg.Key)),
+			"start_revision": strconv.FormatInt(e.revision+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var msg struct {
+			Result struct {
+				Header struct {
+					Revision string `json:"revision"`
+				} `json:"header"`
+				Canceled bool `json:"canceled"`
+				Events   []struct {
+					Type string `json:"type"`
+					KV   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%s", msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("watch canceled")
+		}
+		for _, ev := range msg.Result.Events {
+			e.revision, _ = strconv.ParseInt(ev.KV.ModRevision, 10, 64)
+			if ev.Type == "DELETE" {
+				e.apply(nil)
+				continue
+			}
+			e.apply(ev.KV.Value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// apply loads value and swaps it in, keeping the running config on errors
+func (e *etcdSource) apply(value []byte) {
+	cfg, err := e.load(value)
+	if err != nil {
+		slog.Warn("etcd revision ignored", "revision", e.revision, "error", err)
+		return
+	}
+	if err := e.lb.applyConfig(cfg); err != nil {
+		slog.Warn("etcd revision ignored", "revision", e.revision, "error", err)
+		return
+	}
+	slog.Info("etcd revision applied", "revision", e.revision, "key", e.cfg.Key)
+}
+
+// applyConfig switches lb to cfg. Routes take effect immediately and static
+// members of existing pools are added or removed; new pools are built
+// from scratch. Transport, proxy, probe and discovery settings of pools
+// that already exist need a restart.
+func (lb *Balancer) applyConfig(cfg *Config) error {
+	lb.reloadMu.Lock()
+	defer lb.reloadMu.Unlock()
+	current := lb.pools()
+	next := map[string]*ServerPool{}
+	for _, name := range cfg.PoolNames() {
+		poolCfg := cfg.Pools[name]
+		pool, ok := current[name]
+		if !ok {
+			built, err := lb.buildPool(name, poolCfg)
+			if err != nil {
+				// Pools built so far would never be used
+				for name, pool := range next {
+					if current[name] != pool {
+						pool.close()
+					}
+				}
+				return err
+			}
+			next[name] = built
+			continue
+		}
+
+		var want []string
+		for _, member := range poolCfg.Backends {
+			if poolCfg.DNSRefresh > 0 && needsResolution(member) {
+				continue
+			}
+			want = append(want, member)
+		}
+		added, removed := pool.SyncMembers("", want, func(member string) (*Backend, error) {
+			return newBackend(member, pool)
+		})
+		backupAdded, backupRemoved := pool.SyncMembers(backupOrigin, poolCfg.Backup, func(member string) (*Backend, error) {
+			return newBackupBackend(member, pool)
+		})
+		added, removed = append(added, backupAdded...), append(removed, backupRemoved...)
+		if len(added) > 0 || len(removed) > 0 {
+			slog.Info("Pool updated", "pool", name, "added", added, "removed", removed)
+		}
+		next[name] = pool
+	}
+	for name, pool := range current {
+		if _, ok := next[name]; !ok {
+			slog.Info("Pool removed", "pool", name)
+			for _, b := range pool.snapshot() {
+				watchers.removed(pool, b)
+			}
+		}
+	}
+
+	setupLogging(cfg.Log)
+	lb.switchConfig(cfg, next)
+	return nil
+}
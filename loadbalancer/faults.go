@@ -0,0 +1,217 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FaultConfig injects failures into a route's traffic to test how clients
+// cope. Each fault hits its percentage of requests independently.
+type FaultConfig struct {
+	// Enabled starts injecting at startup, the admin API switches it
+	Enabled bool `json:"enabled,omitempty"`
+	// Delay holds DelayPercent of requests back before they are proxied
+	Delay        Duration `json:"delay,omitempty"`
+	DelayPercent float64  `json:"delay_percent,omitempty"`
+	// AbortStatus answers AbortPercent of requests without a backend
+	AbortStatus  int     `json:"abort_status,omitempty"`
+	AbortPercent float64 `json:"abort_percent,omitempty"`
+	// ResetPercent of connections are closed without any response
+	ResetPercent float64 `json:"reset_percent,omitempty"`
+}
+
+// validate fills in defaults and checks the percentages
+func (f *FaultConfig) validate() error {
+	for name, p := range map[string]float64{"delay_percent": f.DelayPercent, "abort_percent": f.AbortPercent, "reset_percent": f.ResetPercent} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("faults: %s must be between 0 and 100", name)
+		}
+	}
+	if f.DelayPercent > 0 && f.Delay <= 0 {
+		return fmt.Errorf("faults: delay is required with delay_percent")
+	}
+	if f.AbortStatus == 0 {
+		f.AbortStatus = http.StatusInternalServerError
+	}
+	if f.AbortStatus < 400 || f.AbortStatus > 599 {
+		return fmt.Errorf("faults: abort_status must be a 4xx or 5xx status")
+	}
+	return nil
+}
+
+// faultCounters are the faults injected into one route
+type faultCounters struct {
+	delayed, aborted, reset atomic.Int64
+}
+
+// faultState holds the faults being injected right now, by route
+type faultState struct {
+	mu       sync.RWMutex
+	active   map[string]*FaultConfig
+	counters map[string]*faultCounters
+}
+
+var faults = &faultState{active: map[string]*FaultConfig{}, counters: map[string]*faultCounters{}}
+
+// Reset injects the faults of the routes that enable them in routes
+func (s *faultState) Reset(routes []RouteConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = map[string]*FaultConfig{}
+	for i := range routes {
+		if f := routes[i].Faults; f != nil && f.Enabled {
+			s.active[routeKey(&routes[i])] = f
+		}
+	}
+}
+
+// Set starts injecting f into route, or stops when f is nil
+func (s *faultState) Set(route string, f *FaultConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f == nil {
+		delete(s.active, route)
+		return
+	}
+	s.active[route] = f
+	if s.counters[route] == nil {
+		s.counters[route] = &faultCounters{}
+	}
+}
+
+// lookup returns the faults injected into route
+func (s *faultState) lookup(route *RouteConfig) (*FaultConfig, *faultCounters) {
+	if route == nil {
+		return nil, nil
+	}
+	key := routeKey(route)
+	s.mu.RLock()
+	f, c := s.active[key], s.counters[key]
+	s.mu.RUnlock()
+	if f != nil && c == nil {
+		s.mu.Lock()
+		if c = s.counters[key]; c == nil {
+			c = &faultCounters{}
+			s.counters[key] = c
+		}
+		s.mu.Unlock()
+	}
+	return f, c
+}
+
+// inject applies the route's faults to a request, returning false when it
+// was answered or its connection dropped
+func (s *faultState) inject(w http.ResponseWriter, r *http.Request, route *RouteConfig) bool {
+	f, c := s.lookup(route)
+	if f == nil {
+		return true
+	}
+	if f.DelayPercent > 0 && rand.Float64()*100 < f.DelayPercent {
+		c.delayed.Add(1)
+		t := time.NewTimer(time.Duration(f.Delay))
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+		}
+	}
+	if f.ResetPercent > 0 && rand.Float64()*100 < f.ResetPercent {
+		c.reset.Add(1)
+		// The server closes the connection without writing a response
+		panic(http.ErrAbortHandler)
+	}
+	if f.AbortPercent > 0 && rand.Float64()*100 < f.AbortPercent {
+		c.aborted.Add(1)
+		http.Error(w, "Fault injected", f.AbortStatus)
+		return false
+	}
+	return true
+}
+
+// Snapshot lists the routes with faults and what was injected into them
+func (s *faultState) Snapshot() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	routes := make([]string, 0, len(s.counters))
+	for route := range s.counters {
+		routes = append(routes, route)
+	}
+	for route := range s.active {
+		if s.counters[route] == nil {
+			routes = append(routes, route)
+		}
+	}
+	sort.Strings(routes)
+	out := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		entry := map[string]interface{}{
+			"route":   route,
+			"enabled": s.active[route] != nil,
+			"delayed": int64(0),
+			"aborted": int64(0),
+			"reset":   int64(0),
+		}
+		if f := s.active[route]; f != nil {
+			entry["faults"] = f
+		}
+		if c := s.counters[route]; c != nil {
+			entry["delayed"] = c.delayed.Load()
+			entry["aborted"] = c.aborted.Load()
+			entry["reset"] = c.reset.Load()
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// faultsHandler shows the injected faults on GET and switches them on
+// POST {"route": "api", "enabled": true}; "faults" replaces the route's
+// configured faults
+func (lb *Balancer) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Route   string       `json:"route"`
+			Enabled bool         `json:"enabled"`
+			Faults  *FaultConfig `json:"faults"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		route := lb.config().findRoute(req.Route)
+		if route == nil {
+			http.Error(w, fmt.Sprintf("Unknown route %q", req.Route), http.StatusNotFound)
+			return
+		}
+		f := req.Faults
+		if f == nil {
+			f = route.Faults
+		}
+		if !req.Enabled {
+			f = nil
+		} else if f == nil {
+			http.Error(w, fmt.Sprintf("Route %q has no faults configured, send them as \"faults\"", req.Route), http.StatusBadRequest)
+			return
+		} else if err := f.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		faults.Set(req.Route, f)
+		slog.Info("Admin switched fault injection", "route", req.Route, "enabled", req.Enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(faults.Snapshot())
+}
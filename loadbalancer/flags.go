@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// cliOptions are settings given as flags or environment variables; flags
+// win over the environment and both win over the config file
+type cliOptions struct {
+	configPath     string
+	listen         string
+	healthInterval time.Duration
+	algorithm      string
+	logLevel       string
+	logFormat      string
+}
+
+// cli holds the parsed options, applied whenever a config is loaded so
+// they survive reloads
+var cli cliOptions
+
+// parseFlags reads the options from args, taking defaults from LB_CONFIG,
+// LB_LISTEN, LB_HEALTH_INTERVAL, LB_ALGORITHM, LB_LOG_LEVEL and LB_LOG_FORMAT
+func parseFlags(args []string) (cliOptions, error) {
+	var o cliOptions
+	fs := flag.NewFlagSet("lb", flag.ContinueOnError)
+	fs.StringVar(&o.configPath, "config", os.Getenv("LB_CONFIG"), "path to JSON config file (env LB_CONFIG)")
+	fs.StringVar(&o.listen, "listen", os.Getenv("LB_LISTEN"), "comma-separated addresses to bind, e.g. :8080 (env LB_LISTEN)")
+	fs.StringVar(&o.algorithm, "algorithm", os.Getenv("LB_ALGORITHM"),
+		fmt.Sprintf("default balancing algorithm, one of %v (env LB_ALGORITHM)", strategies))
+	fs.StringVar(&o.logLevel, "log-level", os.Getenv("LB_LOG_LEVEL"), "debug, info, warn or error (env LB_LOG_LEVEL)")
+	fs.StringVar(&o.logFormat, "log-format", os.Getenv("LB_LOG_FORMAT"), "text or json (env LB_LOG_FORMAT)")
+
+	var interval time.Duration
+	if v := os.Getenv("LB_HEALTH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return o, fmt.Errorf("LB_HEALTH_INTERVAL: %w", err)
+		}
+		interval = d
+	}
+	fs.DurationVar(&o.healthInterval, "health-interval", interval, "time between health check cycles (env LB_HEALTH_INTERVAL)")
+
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	if err := Strategy(o.algorithm).validate(); err != nil {
+		return o, fmt.Errorf("algorithm: %w", err)
+	}
+	if o.healthInterval < 0 {
+		return o, fmt.Errorf("health-interval must be positive")
+	}
+	return o, nil
+}
+
+// apply overrides the settings of cfg the options set; the listen
+// addresses replace those of the first listener
+func (o cliOptions) apply(cfg *Config) {
+	if o.listen != "" {
+		addrs := strings.Split(o.listen, ",")
+		for i := range addrs {
+			addrs[i] = strings.TrimSpace(addrs[i])
+		}
+		if len(cfg.Listeners) > 0 {
+			cfg.Listeners[0].Addresses = addrs
+		} else {
+			cfg.Listener.Addresses = addrs
+		}
+	}
+	if o.healthInterval > 0 {
+		cfg.HealthCheck.Interval = Duration(o.healthInterval)
+	}
+	if o.algorithm != "" {
+		cfg.Algorithm = Strategy(o.algorithm)
+	}
+	if o.logLevel != "" {
+		cfg.Log.Level = o.logLevel
+	}
+	if o.logFormat != "" {
+		cfg.Log.Format = o.logFormat
+	}
+}
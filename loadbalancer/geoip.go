@@ -0,0 +1,201 @@
+package loadbalancer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+)
+
+// GeoIPConfig points at a MaxMind GeoLite2/GeoIP2 Country database in its
+// CSV distribution format
+type GeoIPConfig struct {
+	// BlocksFiles are the Country-Blocks-IPv4/IPv6 files
+	BlocksFiles []string `json:"blocks_files"`
+	// LocationsFile is a Country-Locations file, e.g. the -en one
+	LocationsFile string `json:"locations_file"`
+}
+
+// geoDatabase maps networks onto ISO country codes
+type geoDatabase struct {
+	// networks are sorted by first address, enclosing networks ahead of
+	// the ones they contain
+	networks []geoNetwork
+	// continents maps country codes onto continent codes such as EU
+	continents map[string]string
+}
+
+// geoNetwork is the address range of one network of the database
+type geoNetwork struct {
+	first, last netip.Addr
+	country     string
+	// parent is the index of the closest network containing this one, -1
+	// if there is none
+	parent int
+}
+
+// geoIP is loaded at startup when configured, nil otherwise
+var geoIP *geoDatabase
+
+// loadGeoIP reads the locations and then the network blocks
+func loadGeoIP(cfg *GeoIPConfig) (*geoDatabase, error) {
+	countries := map[string]string{}
+	continents := map[string]string{}
+	err := readCSV(cfg.LocationsFile, func(col map[string]int, rec []string) error {
+		if code := field(rec, col, "country_iso_code"); code != "" {
+			countries[field(rec, col, "geoname_id")] = code
+			if continent := field(rec, col, "continent_code"); continent != "" {
+				continents[code] = continent
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	networks := map[netip.Prefix]string{}
+	for _, file := range cfg.BlocksFiles {
+		err := readCSV(file, func(col map[string]int, rec []string) error {
+			prefix, err := netip.ParsePrefix(field(rec, col, "network"))
+			if err != nil {
+				return err
+			}
+			id := field(rec, col, "geoname_id")
+			if id == "" {
+				id = field(rec, col, "registered_country_geoname_id")
+			}
+			if code, ok := countries[id]; ok {
+				networks[prefix.Masked()] = code
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &geoDatabase{networks: geoTable(networks), continents: continents}, nil
+}
+
+// geoTable sorts networks into the table Country searches. Networks are
+// either nested or disjoint, so each one's parent is the innermost of
+// those before it it still falls into.
+func geoTable(networks map[netip.Prefix]string) []geoNetwork {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for p := range networks {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+
+	table := make([]geoNetwork, len(prefixes))
+	var open []int // the networks enclosing the current one, innermost last
+	for i, p := range prefixes {
+		for len(open) > 0 && !prefixes[open[len(open)-1]].Contains(p.Addr()) {
+			open = open[:len(open)-1]
+		}
+		table[i] = geoNetwork{first: p.Addr(), last: lastAddr(p), country: networks[p], parent: -1}
+		if len(open) > 0 {
+			table[i].parent = open[len(open)-1]
+		}
+		open = append(open, i)
+	}
+	return table
+}
+
+// lastAddr returns the highest address of the masked prefix p
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// readCSV calls fn for every record of a CSV file with a header row
+func readCSV(path string, fn func(col map[string]int, rec []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("geoip: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("geoip: %s: %w", path, err)
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[name] = i
+	}
+	for line := 2; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("geoip: %s: %w", path, err)
+		}
+		if err := fn(col, rec); err != nil {
+			return fmt.Errorf("geoip: %s:%d: %w", path, line, err)
+		}
+	}
+}
+
+// field returns the named column of rec, or "" if it is missing
+func field(rec []string, col map[string]int, name string) string {
+	if i, ok := col[name]; ok && i < len(rec) {
+		return rec[i]
+	}
+	return ""
+}
+
+// Country returns the ISO code of the most specific network containing
+// addr, or "" when it is unknown or no database is loaded
+func (db *geoDatabase) Country(addr netip.Addr) string {
+	if db == nil || !addr.IsValid() {
+		return ""
+	}
+	addr = addr.WithZone("")
+	// The last network starting at or below addr, or one enclosing it
+	i := sort.Search(len(db.networks), func(i int) bool { return addr.Less(db.networks[i].first) }) - 1
+	for i >= 0 && db.networks[i].last.Less(addr) {
+		i = db.networks[i].parent
+	}
+	if i < 0 {
+		return ""
+	}
+	return db.networks[i].country
+}
+
+// Continent returns the continent code of a country, "" if unknown
+func (db *geoDatabase) Continent(country string) string {
+	if db == nil {
+		return ""
+	}
+	return db.continents[country]
+}
+
+// clientCountry returns the country of the client connected to the
+// balancer, "" when it is unknown or no database is loaded
+func clientCountry(r *http.Request) string {
+	if geoIP == nil {
+		return ""
+	}
+	addr, ok := clientAddr(r)
+	if !ok {
+		return ""
+	}
+	return geoIP.Country(addr)
+}
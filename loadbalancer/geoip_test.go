@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGeoFile writes a CSV file of the GeoLite2 distribution into dir
+func writeGeoFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &GeoIPConfig{
+		LocationsFile: writeGeoFile(t, dir, "locations.csv", `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name
+2921044,en,EU,Europe,DE,Germany
+2635167,en,EU,Europe,GB,United Kingdom
+6252001,en,NA,North America,US,United States
+`),
+		BlocksFiles: []string{
+			writeGeoFile(t, dir, "blocks-ipv4.csv", `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+81.0.0.0/8,2921044,2921044,,0,0
+81.2.69.0/24,2635167,2635167,,0,0
+81.2.69.160/27,6252001,6252001,,0,0
+192.0.2.0/24,,6252001,,0,0
+`),
+			writeGeoFile(t, dir, "blocks-ipv6.csv", `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+2001:db8::/32,2921044,2921044,,0,0
+2001:db8:1::/48,2635167,2635167,,0,0
+2a02:ff00::/24,6252001,6252001,,0,0
+`),
+		},
+	}
+	db, err := loadGeoIP(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]string{
+		// IPv4, most specific network first
+		"81.2.69.170":    "US",
+		"81.2.69.192":    "GB",
+		"81.2.70.1":      "DE",
+		"81.0.0.0":       "DE",
+		"81.255.255.255": "DE",
+		// Only the registered country is known
+		"192.0.2.1": "US",
+		// IPv6
+		"2001:db8:1::1": "GB",
+		"2001:db8:2::1": "DE",
+		"2a02:ffff::1":  "US",
+		// Unknown
+		"80.255.255.255": "",
+		"82.0.0.0":       "",
+		"10.0.0.1":       "",
+		"2001:db9::1":    "",
+		"::1":            "",
+		"fe80::1%eth0":   "",
+	} {
+		if got := db.Country(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Country(%s) = %q, want %q", addr, got, want)
+		}
+	}
+	if got := db.Continent("GB"); got != "EU" {
+		t.Errorf("Continent(GB) = %q, want EU", got)
+	}
+
+	var none *geoDatabase
+	if got := none.Country(netip.MustParseAddr("81.2.69.170")); got != "" {
+		t.Errorf("Country without a database = %q", got)
+	}
+}
@@ -0,0 +1,415 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// validate fills in the node name and checks the gossip settings
+func (c *ClusterConfig) validate() error {
+	if c.GossipInterval < 0 {
+		return fmt.Errorf("cluster: gossip_interval must not be negative")
+	}
+	if c.GossipInterval > 0 && len(c.Peers) == 0 {
+		return fmt.Errorf("cluster: gossip needs peers")
+	}
+	if c.GossipInterval > 0 && c.Secret == "" {
+		return fmt.Errorf("cluster: gossip needs a secret")
+	}
+	if c.Node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cluster: no node name and %w", err)
+		}
+		c.Node = host
+	}
+	return nil
+}
+
+// gossipBackend is one node's view of a backend
+type gossipBackend struct {
+	Pool   string `json:"pool"`
+	ID     string `json:"id"`
+	Alive  bool   `json:"alive"`
+	Active int64  `json:"active"`
+}
+
+// gossipView is what nodes exchange every gossip interval. It names its
+// node and when it was sent, so the signature covers both and a recorded
+// view cannot be passed off later or as another node's.
+type gossipView struct {
+	Node     string          `json:"node"`
+	Sent     time.Time       `json:"sent"`
+	Backends []gossipBackend `json:"backends"`
+	// Ready and Priority are what HA elections go by
+	Ready    bool `json:"ready"`
+	Priority int  `json:"priority,omitempty"`
+}
+
+// localView returns this node's view of its backends
+func (lb *Balancer) localView() gossipView {
+	_, unavailable := lb.readiness()
+	cfg := lb.config()
+	view := gossipView{Node: cfg.Cluster.Node, Sent: time.Now(), Backends: []gossipBackend{}, Ready: len(unavailable) == 0}
+	if cfg.HA != nil {
+		view.Priority = cfg.HA.Priority
+	}
+	for _, name := range lb.poolNames() {
+		for _, b := range lb.pools()[name].snapshot() {
+			view.Backends = append(view.Backends, gossipBackend{
+				Pool:   name,
+				ID:     b.ID,
+				Alive:  b.IsAlive(),
+				Active: atomic.LoadInt64(&b.active),
+			})
+		}
+	}
+	return view
+}
+
+// clusterState holds the latest view of every other node of a balancer's
+// cluster
+type clusterState struct {
+	lb    *Balancer
+	mu    sync.Mutex
+	views map[string]gossipView
+	seen  map[string]time.Time
+	// sent is when the latest view admitted from each node was sent
+	sent map[string]time.Time
+	// peers maps node names to the configured peer that answered as them
+	peers map[string]string
+}
+
+func newClusterState(lb *Balancer) *clusterState {
+	return &clusterState{lb: lb, views: map[string]gossipView{}, seen: map[string]time.Time{}, sent: map[string]time.Time{}, peers: map[string]string{}}
+}
+
+// maxGossipAge is how far a view's send time may be from now, allowing
+// for the clocks of the nodes to differ a little
+const maxGossipAge = 30 * time.Second
+
+// errGossipReplayed refuses a view sent no later than one already admitted
+var errGossipReplayed = errors.New("view not newer than the last one from its node")
+
+// admit checks a signed view was sent recently and after the last one
+// admitted from its node, so recorded views cannot be replayed
+func (c *clusterState) admit(view gossipView, now time.Time) error {
+	if age := now.Sub(view.Sent); age > maxGossipAge || age < -maxGossipAge {
+		return fmt.Errorf("view sent at %s, too far from now", view.Sent.Format(time.RFC3339))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !view.Sent.After(c.sent[view.Node]) {
+		return errGossipReplayed
+	}
+	c.sent[view.Node] = view.Sent
+	return nil
+}
+
+// receive stores a node's view and reports whether it was kept. peer is
+// the configured peer whose reply carried the view, or empty when the
+// node sent it to us; those are only kept from nodes a configured peer
+// has answered as, so gossip cannot bring in nodes from outside the
+// config. Views of this node are ignored in case it is listed among its
+// own peers.
+func (c *clusterState) receive(view gossipView, peer string, now time.Time) bool {
+	if view.Node == "" || view.Node == c.lb.config().Cluster.Node {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if peer != "" {
+		c.peers[view.Node] = peer
+	} else if !c.isPeer(view.Node) {
+		return false
+	}
+	if _, known := c.views[view.Node]; !known {
+		slog.Info("Cluster node joined", "node", view.Node, "peer", c.peers[view.Node])
+	}
+	c.views[view.Node] = view
+	c.seen[view.Node] = now
+	return true
+}
+
+// isPeer reports whether node answered as one of the configured peers;
+// c.mu must be held
+func (c *clusterState) isPeer(node string) bool {
+	peer, ok := c.peers[node]
+	return ok && slices.Contains(c.lb.config().Cluster.Peers, peer)
+}
+
+// configuredPeers returns the views of nodes that answered as configured
+// peers
+func (c *clusterState) configuredPeers(views []gossipView) []gossipView {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := make([]gossipView, 0, len(views))
+	for _, v := range views {
+		if c.isPeer(v.Node) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// fresh returns the views heard from within three gossip intervals and
+// forgets the rest
+func (c *clusterState) fresh(now time.Time) []gossipView {
+	maxAge := 3 * time.Duration(c.lb.config().Cluster.GossipInterval)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	views := make([]gossipView, 0, len(c.views))
+	for node, view := range c.views {
+		// Peers dropped from the config are forgotten as if gone quiet
+		if now.Sub(c.seen[node]) > maxAge || !c.isPeer(node) {
+			slog.Warn("Cluster node left", "node", node, "last_seen", c.seen[node])
+			delete(c.views, node)
+			delete(c.seen, node)
+			continue
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// apply folds the other nodes' views into the backends: their requests in
+// flight count towards least-connections, and a backend most of the
+// cluster sees down is kept out of rotation here too
+func (c *clusterState) apply(now time.Time) {
+	views := c.fresh(now)
+	type tally struct {
+		active int64
+		down   int
+	}
+	byKey := map[string]*tally{}
+	for _, view := range views {
+		for _, gb := range view.Backends {
+			key := gb.Pool + "/" + gb.ID
+			t := byKey[key]
+			if t == nil {
+				t = &tally{}
+				byKey[key] = t
+			}
+			t.active += gb.Active
+			if !gb.Alive {
+				t.down++
+			}
+		}
+	}
+
+	nodes := len(views) + 1
+	for _, name := range c.lb.poolNames() {
+		for _, b := range c.lb.pools()[name].snapshot() {
+			t := byKey[name+"/"+b.ID]
+			if t == nil {
+				t = &tally{}
+			}
+			down := t.down
+			if !b.IsAlive() {
+				down++
+			}
+			atomic.StoreInt64(&b.clusterActive, t.active)
+			b.setClusterDown(2*down > nodes)
+		}
+	}
+}
+
+// setClusterDown records whether most of the cluster sees b down
+func (b *Backend) setClusterDown(down bool) {
+	b.mux.Lock()
+	changed := b.clusterDown != down
+	b.clusterDown = down
+	b.mux.Unlock()
+	if changed && down {
+		slog.Warn("Backend down on most of the cluster", "backend", b.URL.String(), "backend_id", b.ID)
+	} else if changed {
+		slog.Info("Backend up on most of the cluster", "backend", b.URL.String(), "backend_id", b.ID)
+	}
+}
+
+// isClusterDown reports whether most of the cluster sees b down
+func (b *Backend) isClusterDown() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.clusterDown
+}
+
+// gossipRoutine exchanges views with every peer each interval
+func (lb *Balancer) gossipRoutine() {
+	interval := time.Duration(lb.config().Cluster.GossipInterval)
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		lb.gossipRound()
+	}
+}
+
+// gossipRound sends this node's view to the peers, keeps theirs from the
+// replies and applies the result
+func (lb *Balancer) gossipRound() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(lb.config().Cluster.Timeout))
+	defer cancel()
+	view := lb.localView()
+	var wg sync.WaitGroup
+	for _, peer := range lb.config().Cluster.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			reply, err := lb.exchangeView(ctx, strings.TrimSuffix(peer, "/")+"/lb/cluster/gossip", view)
+			if err == nil {
+				err = lb.cluster.admit(reply, time.Now())
+			}
+			if err != nil {
+				slog.Debug("Gossip failed", "peer", peer, "error", err)
+				return
+			}
+			lb.cluster.receive(reply, peer, time.Now())
+		}(peer)
+	}
+	wg.Wait()
+	now := time.Now()
+	lb.cluster.apply(now)
+	lb.ha.elect(lb.localView(), lb.cluster.fresh(now))
+}
+
+// exchangeView posts view to endpoint and decodes the peer's view
+func (lb *Balancer) exchangeView(ctx context.Context, endpoint string, view gossipView) (gossipView, error) {
+	var reply gossipView
+	body, err := json.Marshal(view)
+	if err != nil {
+		return reply, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return reply, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gossipSignatureHeader, lb.signGossip(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reply, fmt.Errorf("peer returned %s", resp.Status)
+	}
+	if body, err = io.ReadAll(io.LimitReader(resp.Body, maxGossipBytes)); err != nil {
+		return reply, err
+	}
+	if !lb.gossipSigned(body, resp.Header.Get(gossipSignatureHeader)) {
+		return reply, fmt.Errorf("peer reply not signed with the cluster secret")
+	}
+	err = json.Unmarshal(body, &reply)
+	return reply, err
+}
+
+// gossipSignatureHeader carries the hex HMAC-SHA256 of a gossip body,
+// keyed with the cluster secret, on requests and replies alike
+const gossipSignatureHeader = "X-LB-Gossip-Signature"
+
+// maxGossipBytes bounds the views nodes accept
+const maxGossipBytes = 4 << 20
+
+// signGossip returns the signature of a gossip body
+func (lb *Balancer) signGossip(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(lb.config().Cluster.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// gossipSigned reports whether signature is body's, always false without
+// a secret
+func (lb *Balancer) gossipSigned(body []byte, signature string) bool {
+	secret := lb.config().Cluster.Secret
+	got, err := hex.DecodeString(signature)
+	if err != nil || secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// gossipHandler swaps views with a peer on POST and lists the nodes heard
+// from on GET. Posted views must be signed with the cluster secret and be
+// newer than the last from their node; one from a node no configured peer
+// has answered as is not kept, but still gets this node's view back so
+// the two can find each other.
+func (lb *Balancer) gossipHandler(w http.ResponseWriter, r *http.Request) {
+	cluster := lb.cluster
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		nodes := []map[string]interface{}{}
+		for _, view := range cluster.fresh(now) {
+			cluster.mu.Lock()
+			seen := cluster.seen[view.Node]
+			cluster.mu.Unlock()
+			nodes = append(nodes, map[string]interface{}{
+				"node":      view.Node,
+				"last_seen": seen,
+				"backends":  len(view.Backends),
+			})
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i]["node"].(string) < nodes[j]["node"].(string) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"node":  lb.config().Cluster.Node,
+			"peers": nodes,
+		})
+	case http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGossipBytes))
+		if err != nil {
+			http.Error(w, "Invalid view: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !lb.gossipSigned(body, r.Header.Get(gossipSignatureHeader)) {
+			http.Error(w, "View not signed with the cluster secret", http.StatusUnauthorized)
+			return
+		}
+		var view gossipView
+		if err := json.Unmarshal(body, &view); err != nil {
+			http.Error(w, "Invalid view: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cluster.admit(view, time.Now()); err != nil {
+			http.Error(w, "View refused: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if cluster.receive(view, "", time.Now()) {
+			cluster.apply(time.Now())
+		} else if view.Node != lb.config().Cluster.Node {
+			slog.Debug("Gossip from unknown node ignored", "node", view.Node, "remote_addr", r.RemoteAddr)
+		}
+		reply, err := json.Marshal(lb.localView())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(gossipSignatureHeader, lb.signGossip(reply))
+		w.Write(reply)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,123 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGossip(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, pool := installPool(t, LeastConn, a.URL, b.URL)
+	cfg := *lb.config()
+	cfg.Cluster = ClusterConfig{Node: "self", Peers: []string{"http://peer-1", "http://peer-2"},
+		GossipInterval: Duration(time.Second), Secret: "cluster-secret"}
+	lb.setConfig(&cfg)
+	backendA, backendB := pool.Backends()[0], pool.Backends()[1]
+	// As if each peer had answered this node's gossip
+	lb.cluster.peers["peer-1"], lb.cluster.peers["peer-2"] = "http://peer-1", "http://peer-2"
+
+	// A peer busy on a steers least-connections here to b
+	gossip := func(node string, aAlive bool, aActive int64) gossipView {
+		t.Helper()
+		body, _ := json.Marshal(gossipView{Node: node, Sent: time.Now(), Backends: []gossipBackend{
+			{Pool: "test", ID: backendA.ID, Alive: aAlive, Active: aActive},
+			{Pool: "test", ID: backendB.ID, Alive: true},
+		}})
+		req := httptest.NewRequest(http.MethodPost, "/lb/cluster/gossip", bytes.NewReader(body))
+		req.Header.Set(gossipSignatureHeader, lb.signGossip(body))
+		rec := httptest.NewRecorder()
+		lb.Handler().ServeHTTP(rec, req)
+		var reply gossipView
+		if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("gossip: status %d, %v", rec.Code, err)
+		}
+		return reply
+	}
+	if reply := gossip("peer-1", true, 10); reply.Node != "self" || len(reply.Backends) != 2 {
+		t.Errorf("reply = %+v, want this node's view of both backends", reply)
+	}
+	for i := 0; i < 3; i++ {
+		if got := pool.LeastConnPeerAvoiding(nil); got != backendB {
+			t.Fatalf("least-connections picked %s with a peer busy on it", got.URL)
+		}
+	}
+
+	// One of two peers seeing a down is not a majority, both are
+	gossip("peer-1", false, 0)
+	if !backendA.IsAvailable() {
+		t.Error("a unavailable when one of three nodes sees it down")
+	}
+	gossip("peer-2", false, 0)
+	if backendA.IsAvailable() || !pool.GetBackends()[0].ClusterDown {
+		t.Error("a still available when two of three nodes see it down")
+	}
+	gossip("peer-1", true, 0)
+	if !backendA.IsAvailable() {
+		t.Error("a still unavailable after a peer saw it recover")
+	}
+
+	// Views without the cluster's signature are refused, views from nodes
+	// no configured peer answered as are not kept
+	body, _ := json.Marshal(gossipView{Node: "peer-1", Sent: time.Now(), Backends: []gossipBackend{{Pool: "test", ID: backendA.ID}}})
+	for _, signature := range []string{"", "sha256=" + strings.Repeat("0", 64)} {
+		req := httptest.NewRequest(http.MethodPost, "/lb/cluster/gossip", bytes.NewReader(body))
+		if signature != "" {
+			req.Header.Set(gossipSignatureHeader, signature)
+		}
+		rec := httptest.NewRecorder()
+		lb.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("view signed with %q: status %d, want 401", signature, rec.Code)
+		}
+	}
+	if !backendA.IsAvailable() {
+		t.Error("an unsigned view marked a down")
+	}
+	gossip("intruder", false, 0)
+	lb.cluster.mu.Lock()
+	_, kept := lb.cluster.views["intruder"]
+	lb.cluster.mu.Unlock()
+	if kept || !backendA.IsAvailable() {
+		t.Errorf("view of a node outside the peers kept (%v) or counted", kept)
+	}
+
+	// Signed views are only taken once, and only while recent
+	post := func(view gossipView) int {
+		t.Helper()
+		body, _ := json.Marshal(view)
+		req := httptest.NewRequest(http.MethodPost, "/lb/cluster/gossip", bytes.NewReader(body))
+		req.Header.Set(gossipSignatureHeader, lb.signGossip(body))
+		rec := httptest.NewRecorder()
+		lb.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	down := gossipView{Node: "peer-2", Sent: time.Now(), Backends: []gossipBackend{{Pool: "test", ID: backendA.ID}}}
+	if code := post(down); code != http.StatusOK {
+		t.Fatalf("fresh view: status %d", code)
+	}
+	if code := post(down); code != http.StatusUnauthorized {
+		t.Errorf("replayed view: status %d, want 401", code)
+	}
+	down.Sent = down.Sent.Add(-time.Millisecond)
+	if code := post(down); code != http.StatusUnauthorized {
+		t.Errorf("view older than the last: status %d, want 401", code)
+	}
+	down.Node, down.Sent = "peer-1", time.Now().Add(-time.Hour)
+	if code := post(down); code != http.StatusUnauthorized {
+		t.Errorf("stale view: status %d, want 401", code)
+	}
+	if !backendA.IsAvailable() {
+		t.Error("refused views marked a down")
+	}
+
+	// Views that stop arriving are forgotten
+	lb.cluster.apply(time.Now().Add(time.Minute))
+	if n := len(lb.cluster.fresh(time.Now().Add(time.Minute))); n != 0 {
+		t.Errorf("%d stale views kept", n)
+	}
+}
@@ -0,0 +1,260 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HA modes: a VRRP daemon such as keepalived decides which node is
+// primary and tells the balancer, or the gossiping cluster nodes elect one
+const (
+	haExternal = "external"
+	haElect    = "elect"
+)
+
+// HA states
+const (
+	haPrimary = "primary"
+	haStandby = "standby"
+)
+
+// HAConfig lets two or more balancers share a virtual IP: the primary
+// holds it and the others stand by to take over
+type HAConfig struct {
+	// Mode is "external" when keepalived's notify script posts the state
+	// to /lb/ha, or "elect" to pick the primary among the configured
+	// peers gossiping with each other
+	Mode string `json:"mode"`
+	// Priority ranks this node in elections, the highest ready node wins
+	// and ties go to the lowest node name. A node only wins while it hears
+	// from a majority of the configured nodes, itself included, so both
+	// sides of a split cluster cannot become primary.
+	Priority int `json:"priority,omitempty"`
+	// OnPrimary and OnStandby are run on becoming primary or standby, e.g.
+	// to claim or release the virtual IP, with LB_HA_STATE,
+	// LB_HA_PREVIOUS_STATE and LB_HA_NODE set. They run one at a time in
+	// the order of the transitions, in the background.
+	OnPrimary []string `json:"on_primary,omitempty"`
+	OnStandby []string `json:"on_standby,omitempty"`
+	// HookTimeout bounds each command, 10s if unset
+	HookTimeout Duration `json:"hook_timeout,omitempty"`
+}
+
+// validate fills in defaults and checks elections have gossip to run on
+func (c *HAConfig) validate(cluster ClusterConfig) error {
+	switch c.Mode {
+	case haExternal:
+	case haElect:
+		if cluster.GossipInterval <= 0 {
+			return fmt.Errorf("ha: elect mode needs cluster.gossip_interval")
+		}
+	default:
+		return fmt.Errorf("ha: mode must be %q or %q", haExternal, haElect)
+	}
+	if c.HookTimeout <= 0 {
+		c.HookTimeout = Duration(10 * time.Second)
+	}
+	return nil
+}
+
+// haNode tracks whether this node is primary; every node starts on
+// standby until told or elected otherwise
+type haNode struct {
+	lb  *Balancer
+	cfg *HAConfig
+
+	mu    sync.Mutex
+	state string
+	since time.Time
+	// pending are the hooks of transitions still to run, in order;
+	// draining is set while a goroutine is running them
+	pending  []haHook
+	draining bool
+}
+
+// haHook is the command of a transition, still to run
+type haHook struct {
+	command         []string
+	state, previous string
+}
+
+// newHA returns lb's HA state for cfg, nil if HA is off
+func newHA(lb *Balancer, cfg *HAConfig) *haNode {
+	if cfg == nil {
+		return nil
+	}
+	return &haNode{lb: lb, cfg: cfg, state: haStandby, since: time.Now()}
+}
+
+// parseHAState accepts the balancer's state names and the ones keepalived
+// passes to notify scripts; a fault means standing by
+func parseHAState(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case haPrimary, "master":
+		return haPrimary, true
+	case haStandby, "backup", "fault":
+		return haStandby, true
+	}
+	return "", false
+}
+
+// transition moves the node to state for reason, queueing its hook and
+// telling webhooks; it does nothing if the node is already there
+func (h *haNode) transition(state, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == state {
+		return
+	}
+	previous := h.state
+	h.state, h.since = state, time.Now()
+	slog.Warn("HA state changed", "state", state, "previous", previous, "reason", reason)
+
+	hook := h.cfg.OnStandby
+	if state == haPrimary {
+		hook = h.cfg.OnPrimary
+	}
+	if len(hook) > 0 {
+		h.pending = append(h.pending, haHook{command: hook, state: state, previous: previous})
+		if !h.draining {
+			h.draining = true
+			go h.runHooks()
+		}
+	}
+	cfg := h.lb.config()
+	notify(cfg.Webhooks, healthEvent{Event: "became_" + state, Time: h.since, Node: cfg.Cluster.Node, Reason: reason})
+}
+
+// runHooks runs the pending hooks until there are none left. Hooks can
+// take until their timeout, so they run without h.mu held and away from
+// the gossip and admin requests that decided on the transitions.
+func (h *haNode) runHooks() {
+	for {
+		h.mu.Lock()
+		if len(h.pending) == 0 {
+			h.draining = false
+			h.mu.Unlock()
+			return
+		}
+		next := h.pending[0]
+		h.pending = h.pending[1:]
+		h.mu.Unlock()
+		h.runHook(next.command, next.state, next.previous)
+	}
+}
+
+// runHook runs one of the transition commands and waits for it
+func (h *haNode) runHook(hook []string, state, previous string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.cfg.HookTimeout))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook[0], hook[1:]...)
+	cmd.Env = append(os.Environ(),
+		"LB_HA_STATE="+state,
+		"LB_HA_PREVIOUS_STATE="+previous,
+		"LB_HA_NODE="+h.lb.config().Cluster.Node,
+	)
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("HA hook failed", "state", state, "error", err, "output", strings.TrimSpace(string(out)))
+	}
+}
+
+// elect makes this node primary if it wins among itself and peers, the
+// views of the cluster nodes heard from recently. Only nodes that
+// answered as configured peers stand, and only while they and this node
+// are a majority of the configured nodes.
+func (h *haNode) elect(self gossipView, peers []gossipView) {
+	if h == nil || h.cfg.Mode != haElect {
+		return
+	}
+	heard := append([]gossipView{self}, h.lb.cluster.configuredPeers(peers)...)
+	if nodes := len(h.lb.config().Cluster.Peers) + 1; 2*len(heard) <= nodes {
+		h.transition(haStandby, fmt.Sprintf("no quorum, %d of %d nodes heard from", len(heard), nodes))
+		return
+	}
+	candidates := []gossipView{}
+	for _, v := range heard {
+		if v.Ready {
+			candidates = append(candidates, v)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority > candidates[j].Priority
+		}
+		return candidates[i].Node < candidates[j].Node
+	})
+	switch {
+	case len(candidates) > 0 && candidates[0].Node == self.Node:
+		h.transition(haPrimary, fmt.Sprintf("elected among %d ready nodes", len(candidates)))
+	case len(candidates) > 0:
+		h.transition(haStandby, candidates[0].Node+" was elected")
+	default:
+		h.transition(haStandby, "not ready")
+	}
+}
+
+// status returns the node's state and when it was entered
+func (h *haNode) status() (string, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state, h.since
+}
+
+// haHandler reports the node's HA state on GET and, in external mode,
+// takes the state keepalived decided on POST, e.g.
+//
+//	curl -H "Authorization: Bearer $LB_ADMIN_TOKEN" -d '{"state":"MASTER"}' http://localhost:8080/lb/ha
+//
+// Posts are admin changes: they need the admin token, or without one the
+// admin listener.
+func (lb *Balancer) haHandler(w http.ResponseWriter, r *http.Request) {
+	ha := lb.ha
+	if ha == nil {
+		http.Error(w, "HA is disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if ha.cfg.Mode != haExternal {
+			http.Error(w, "The primary is elected, not set", http.StatusConflict)
+			return
+		}
+		var req struct {
+			State string `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		state, ok := parseHAState(req.State)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown state %q", req.State), http.StatusBadRequest)
+			return
+		}
+		ha.transition(state, "set through the admin API")
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state, since := ha.status()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node":  lb.config().Cluster.Node,
+		"mode":  ha.cfg.Mode,
+		"state": state,
+		"since": since,
+	})
+}
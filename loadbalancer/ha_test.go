@@ -0,0 +1,122 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHA(t *testing.T) {
+	lb, _ := installPool(t, RoundRobin, testBackend(t, "a", 0).URL)
+	marker := filepath.Join(t.TempDir(), "state")
+	hook := []string{"sh", "-c", `echo "$LB_HA_PREVIOUS_STATE $LB_HA_STATE" >> ` + marker}
+	cfg := *lb.config()
+	cfg.Cluster.Node = "lb-a"
+	cfg.Cluster.Peers = []string{"http://lb-b", "http://lb-c"}
+	cfg.HA = &HAConfig{Mode: haExternal, OnPrimary: hook, OnStandby: hook}
+	if err := cfg.HA.validate(cfg.Cluster); err != nil {
+		t.Fatal(err)
+	}
+	lb.setConfig(&cfg)
+	lb.ha = newHA(lb, cfg.HA)
+
+	// keepalived's notify script posts its state names
+	for _, state := range []string{"MASTER", "MASTER", "FAULT"} {
+		if rec := admin(t, lb, http.MethodPost, "/lb/ha", `{"state":"`+state+`"}`); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, body %q", state, rec.Code, rec.Body.String())
+		}
+	}
+	// Hooks run in the background
+	want := "standby primary\nprimary standby\n"
+	var out []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if out, _ = os.ReadFile(marker); string(out) == want {
+			break
+		}
+	}
+	if string(out) != want {
+		t.Errorf("hooks ran with %q, want one run per transition", out)
+	}
+	if rec := admin(t, lb, http.MethodPost, "/lb/ha", `{"state":"leader"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown state: status %d, want 400", rec.Code)
+	}
+
+	// Other hosts need the admin token to change the state
+	post := func(token string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/lb/ha", strings.NewReader(`{"state":"MASTER"}`))
+		req.RemoteAddr = "192.0.2.10:40000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		lb.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(""); code != http.StatusForbidden {
+		t.Errorf("remote post without a token: status %d, want 403", code)
+	}
+	cfg.Admin.Token = "admin-token"
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("remote post with a wrong token: status %d, want 401", code)
+	}
+	cfg.Admin.Token = ""
+	if state, _ := lb.ha.status(); state != haStandby {
+		t.Errorf("state %s after refused posts, want standby", state)
+	}
+
+	// Elections go to the ready node with the highest priority
+	lb.cluster.peers["lb-b"], lb.cluster.peers["lb-c"] = "http://lb-b", "http://lb-c"
+	cfg.HA.Mode = haElect
+	lb.ha.elect(gossipView{Node: "lb-a", Ready: true, Priority: 10},
+		[]gossipView{{Node: "lb-b", Ready: false, Priority: 20}, {Node: "lb-c", Ready: true, Priority: 5}})
+	if state, _ := lb.ha.status(); state != haPrimary {
+		t.Errorf("state %s, want primary over a lower priority and a node not ready", state)
+	}
+	// A node outside the configured peers does not stand
+	lb.ha.elect(gossipView{Node: "lb-a", Ready: true, Priority: 10},
+		[]gossipView{{Node: "lb-x", Ready: true, Priority: 99}, {Node: "lb-c", Ready: true, Priority: 5}})
+	if state, _ := lb.ha.status(); state != haPrimary {
+		t.Errorf("state %s, want primary over a node that is not a peer", state)
+	}
+	// Nor does it count towards a quorum: one of three nodes is not a
+	// majority, whatever its priority
+	lb.ha.elect(gossipView{Node: "lb-a", Ready: true, Priority: 10}, []gossipView{{Node: "lb-x", Ready: true, Priority: 99}})
+	if state, _ := lb.ha.status(); state != haStandby {
+		t.Errorf("state %s, want standby without a quorum", state)
+	}
+	lb.ha.elect(gossipView{Node: "lb-a", Ready: true, Priority: 10}, []gossipView{{Node: "lb-c", Ready: true, Priority: 5}})
+	if state, _ := lb.ha.status(); state != haPrimary {
+		t.Errorf("state %s, want primary hearing from two of three nodes", state)
+	}
+	lb.ha.elect(gossipView{Node: "lb-a", Ready: true, Priority: 10}, []gossipView{{Node: "lb-b", Ready: true, Priority: 20}})
+	if state, _ := lb.ha.status(); state != haStandby {
+		t.Errorf("state %s, want standby to a higher priority node", state)
+	}
+	if rec := admin(t, lb, http.MethodPost, "/lb/ha", `{"state":"primary"}`); rec.Code != http.StatusConflict {
+		t.Errorf("setting the state in elect mode: status %d, want 409", rec.Code)
+	}
+}
+
+// TestHASlowHook checks a hook still running holds up neither the next
+// transition nor readers of the state
+func TestHASlowHook(t *testing.T) {
+	cfg := &HAConfig{Mode: haExternal, OnPrimary: []string{"sleep", "1"}, OnStandby: []string{"sleep", "1"}}
+	if err := cfg.validate(ClusterConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	node := newHA(New(), cfg)
+	start := time.Now()
+	node.transition(haPrimary, "test")
+	node.transition(haStandby, "test")
+	if state, _ := node.status(); state != haStandby {
+		t.Errorf("state %s, want standby", state)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("transitions waited %v for their hooks", elapsed)
+	}
+}
@@ -0,0 +1,463 @@
+package loadbalancer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 document types, only the fields we fill in
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// Encoding is "base64" for bodies that are not valid UTF-8, so they
+	// survive the JSON file and can be replayed byte for byte
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HARConfig controls recording of sampled traffic to HAR files
+type HARConfig struct {
+	Dir          string  `json:"dir"`
+	SampleRate   float64 `json:"sample_rate"`
+	MaxEntries   int     `json:"max_entries"`
+	Bodies       bool    `json:"bodies"`
+	MaxBodyBytes int64   `json:"max_body_bytes"`
+	// Redact lists the headers, and with Cookie the cookies, whose values
+	// are left out of recordings. Setting it replaces the default of
+	// Authorization, Proxy-Authorization, Cookie and Set-Cookie.
+	Redact []string `json:"redact"`
+}
+
+// harRedacted stands in for values left out of recordings
+const harRedacted = "[redacted]"
+
+// harRecorder collects entries while a recording window is open
+type harRecorder struct {
+	mu     sync.Mutex
+	active bool
+	until  time.Time
+	// cfg is the config the window was opened with, its sample rate and
+	// bodies those of the window
+	cfg     HARConfig
+	entries []harEntry
+	timer   *time.Timer
+}
+
+var recorder harRecorder
+
+// Start opens a recording window of length d, recording as cfg says
+func (h *harRecorder) Start(cfg HARConfig, d time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.active {
+		return fmt.Errorf("recording already in progress until %s", h.until.Format(time.RFC3339))
+	}
+	h.active = true
+	h.until = time.Now().Add(d)
+	h.cfg = cfg
+	h.entries = nil
+	h.timer = time.AfterFunc(d, func() {
+		if path, n, err := h.Stop(); err != nil {
+			slog.Error("HAR recording not written", "error", err)
+		} else if path != "" {
+			slog.Info("HAR recording finished", "entries", n, "path", path)
+		}
+	})
+	slog.Info("HAR recording started", "duration", d, "sample_rate", cfg.SampleRate)
+	return nil
+}
+
+// Stop closes the recording window and writes the HAR file
+func (h *harRecorder) Stop() (string, int, error) {
+	h.mu.Lock()
+	if !h.active {
+		h.mu.Unlock()
+		return "", 0, nil
+	}
+	h.active = false
+	h.timer.Stop()
+	entries := h.entries
+	h.entries = nil
+	dir := h.cfg.Dir
+	h.mu.Unlock()
+
+	if entries == nil {
+		entries = []harEntry{}
+	}
+	doc := map[string]harLog{"log": {
+		Version: "1.2",
+		Creator: harCreator{Name: "load-balancer", Version: "1.0"},
+		Entries: entries,
+	}}
+
+	// Recordings hold whatever clients and backends sent, so only the
+	// balancer's user may read them
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", 0, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("lb-%s.har", time.Now().Format("20060102-150405")))
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", 0, err
+	}
+	return path, len(entries), nil
+}
+
+// Status reports whether a recording is running and how much it holds
+func (h *harRecorder) Status() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := map[string]interface{}{
+		"recording": h.active,
+		"entries":   len(h.entries),
+	}
+	if h.active {
+		status["until"] = h.until.Format(time.RFC3339)
+		status["sample_rate"] = h.cfg.SampleRate
+	}
+	return status
+}
+
+// sampled decides whether the current request should be recorded and
+// returns the config of the window to record it with
+func (h *harRecorder) sampled() (bool, HARConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.active || len(h.entries) >= h.cfg.MaxEntries {
+		return false, HARConfig{}
+	}
+	return rand.Float64() < h.cfg.SampleRate, h.cfg
+}
+
+// add stores a finished entry if the window is still open
+func (h *harRecorder) add(e harEntry) {
+	h.mu.Lock()
+	if h.active && len(h.entries) < h.cfg.MaxEntries {
+		h.entries = append(h.entries, e)
+	}
+	h.mu.Unlock()
+}
+
+// limitedBuffer keeps at most max bytes and silently drops the rest
+type limitedBuffer struct {
+	buf   []byte
+	max   int64
+	total int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.max - int64(len(b.buf)); room > 0 {
+		if int64(len(p)) > room {
+			b.buf = append(b.buf, p[:room]...)
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// harCapture wraps a request/response pair to build a HAR entry
+type harCapture struct {
+	http.ResponseWriter
+	req       *http.Request
+	start     time.Time
+	firstByte time.Time
+	status    int
+	bodies    bool
+	redact    []string
+	reqBody   *limitedBuffer
+	respBody  *limitedBuffer
+}
+
+// newHARCapture starts capturing r as cfg says, the returned request
+// must be proxied
+func newHARCapture(w http.ResponseWriter, r *http.Request, cfg HARConfig) (*harCapture, *http.Request) {
+	bodies := cfg.Bodies
+	c := &harCapture{
+		ResponseWriter: w,
+		req:            r,
+		start:          time.Now(),
+		bodies:         bodies,
+		redact:         cfg.Redact,
+		reqBody:        &limitedBuffer{max: cfg.MaxBodyBytes},
+		respBody:       &limitedBuffer{max: cfg.MaxBodyBytes},
+	}
+	if bodies && r.Body != nil && r.Body != http.NoBody {
+		r2 := r.Clone(r.Context())
+		r2.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, c.reqBody), r.Body}
+		r = r2
+	}
+	if !bodies {
+		c.respBody.max = 0
+	}
+	return c, r
+}
+
+func (c *harCapture) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+		c.firstByte = time.Now()
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *harCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.respBody.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *harCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// entry builds the HAR entry once the response is complete
+func (c *harCapture) entry(backend string) harEntry {
+	end := time.Now()
+	if c.firstByte.IsZero() {
+		c.firstByte = end
+	}
+	r := c.req
+	redact := c.redact
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	req := harRequest{
+		Method:      r.Method,
+		URL:         scheme + "://" + r.Host + r.URL.RequestURI(),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(r.Header, redact),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    c.reqBody.total,
+	}
+	for _, cookie := range r.Cookies() {
+		value := cookie.Value
+		if harRedacts(redact, "Cookie") {
+			value = harRedacted
+		}
+		req.Cookies = append(req.Cookies, harNameValue{cookie.Name, value})
+	}
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			req.QueryString = append(req.QueryString, harNameValue{name, v})
+		}
+	}
+	if !c.bodies && r.ContentLength > 0 {
+		req.BodySize = r.ContentLength
+	}
+	if c.bodies && c.reqBody.total > 0 {
+		req.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: string(c.reqBody.buf)}
+		if !utf8.Valid(c.reqBody.buf) {
+			req.PostData.Text = base64.StdEncoding.EncodeToString(c.reqBody.buf)
+			req.PostData.Encoding = "base64"
+		}
+	}
+
+	header := c.Header()
+	resp := harResponse{
+		Status:      c.status,
+		StatusText:  http.StatusText(c.status),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(header, redact),
+		Content: harContent{
+			Size:     c.respBody.total,
+			MimeType: header.Get("Content-Type"),
+			Text:     string(c.respBody.buf),
+		},
+		RedirectURL: header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    c.respBody.total,
+	}
+
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return harEntry{
+		StartedDateTime: c.start.Format(time.RFC3339Nano),
+		Time:            ms(end.Sub(c.start)),
+		Request:         req,
+		Response:        resp,
+		Timings: harTimings{
+			Wait:    ms(c.firstByte.Sub(c.start)),
+			Receive: ms(end.Sub(c.firstByte)),
+		},
+		ServerIPAddress: backend,
+	}
+}
+
+// harHeaders flattens a header map into HAR name/value pairs, leaving out
+// the values of the headers in redact
+func harHeaders(h http.Header, redact []string) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range h {
+		hide := harRedacts(redact, name)
+		for _, v := range values {
+			if hide {
+				v = harRedacted
+			}
+			out = append(out, harNameValue{name, v})
+		}
+	}
+	return out
+}
+
+// harRedacts reports whether the header name is in redact
+func harRedacts(redact []string, name string) bool {
+	return slices.ContainsFunc(redact, func(r string) bool { return strings.EqualFold(r, name) })
+}
+
+// harStartHandler opens a recording window, e.g. POST /lb/har/start?duration=5m
+func (lb *Balancer) harStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	duration := time.Minute
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	cfg := lb.config().HAR
+	if v := q.Get("sample"); v != "" {
+		if _, err := fmt.Sscanf(v, "%g", &cfg.SampleRate); err != nil || cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+			http.Error(w, "Invalid sample rate", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("bodies"); v != "" {
+		cfg.Bodies = v == "true" || v == "1"
+	}
+
+	if err := recorder.Start(cfg, duration); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recorder.Status())
+}
+
+// harStopHandler ends the recording early and writes the file
+func harStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, n, err := recorder.Stop()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if path == "" {
+		http.Error(w, "No recording in progress", http.StatusConflict)
+		return
+	}
+	slog.Info("HAR recording stopped", "entries", n, "path", path)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file":    path,
+		"entries": n,
+	})
+}
+
+// harStatusHandler reports the current recording state
+func harStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recorder.Status())
+}
@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHARRedaction(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "backend-secret"})
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := lb.config().HAR
+	cfg.Dir = filepath.Join(t.TempDir(), "har")
+	cfg.SampleRate = 1
+
+	if err := recorder.Start(cfg, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/work?page=2", nil)
+	req.Header.Set("Authorization", "Bearer client-secret")
+	req.Header.Set("Cookie", "session=cookie-secret")
+	req.Header.Set("X-Trace", "kept")
+	lb.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	path, n, err := recorder.Stop()
+	if err != nil || n != 1 {
+		t.Fatalf("stop: %d entries, %v", n, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"client-secret", "cookie-secret", "backend-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("recording holds %q", secret)
+		}
+	}
+	if !strings.Contains(string(data), "kept") {
+		t.Error("recording lost a header that is not redacted")
+	}
+	for file, want := range map[string]os.FileMode{cfg.Dir: 0o700, path: 0o600} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, want %v", file, info.Mode().Perm(), want)
+		}
+	}
+}
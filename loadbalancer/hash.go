@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HashOn names the request attribute the hash strategy keys on:
+// "header:X-Tenant-ID", "cookie:session", "query:tenant", "path:2" for
+// the second path segment or "client:ip" for the client address. Requests
+// without it are spread round-robin.
+type HashOn string
+
+// validate checks the attribute syntax
+func (h HashOn) validate() error {
+	if h == "" {
+		return nil
+	}
+	kind, name, _ := strings.Cut(string(h), ":")
+	if name == "" {
+		return fmt.Errorf("hash_on %q: want kind:name", h)
+	}
+	switch kind {
+	case "header", "cookie", "query":
+		return nil
+	case "path":
+		if n, err := strconv.Atoi(name); err != nil || n < 1 {
+			return fmt.Errorf("hash_on %q: path segments count from 1", h)
+		}
+		return nil
+	case "client":
+		if name != "ip" {
+			return fmt.Errorf("hash_on %q: only client:ip is supported", h)
+		}
+		return nil
+	}
+	return fmt.Errorf("hash_on %q: kind must be header, cookie, query, path or client", h)
+}
+
+// key returns the value of the attribute in r, "" if r does not carry it
+func (h HashOn) key(r *http.Request) string {
+	kind, name, _ := strings.Cut(string(h), ":")
+	switch kind {
+	case "header":
+		return r.Header.Get(name)
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+	case "query":
+		return r.URL.Query().Get(name)
+	case "path":
+		n, _ := strconv.Atoi(name)
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n <= len(segments) {
+			return segments[n-1]
+		}
+	case "client":
+		if addr, ok := clientAddr(r); ok {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// hashKey returns the key the hash strategy uses for r on route, the
+// route's attribute taking precedence over the global one
+func hashKey(r *http.Request, route *RouteConfig) string {
+	on := requestConfig(r).HashOn
+	if route != nil && route.HashOn != "" {
+		on = route.HashOn
+	}
+	if on == "" {
+		return ""
+	}
+	return on.key(r)
+}
@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityHeadersConfig lists standard security headers added to every
+// proxied response
+type SecurityHeadersConfig struct {
+	// HSTSMaxAge enables Strict-Transport-Security on TLS connections
+	HSTSMaxAge            Duration `json:"hsts_max_age,omitempty"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains,omitempty"`
+	HSTSPreload           bool     `json:"hsts_preload,omitempty"`
+	// NoSniff sets X-Content-Type-Options: nosniff
+	NoSniff bool `json:"nosniff,omitempty"`
+	// FrameOptions is DENY or SAMEORIGIN
+	FrameOptions          string `json:"frame_options,omitempty"`
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"`
+	ReferrerPolicy        string `json:"referrer_policy,omitempty"`
+	// Override replaces headers a backend set itself, by default its
+	// values are kept
+	Override bool `json:"override,omitempty"`
+}
+
+// validate checks the frame options value
+func (s *SecurityHeadersConfig) validate() error {
+	s.FrameOptions = strings.ToUpper(s.FrameOptions)
+	switch s.FrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("security_headers: frame_options must be DENY or SAMEORIGIN")
+	}
+	if s.HSTSMaxAge < 0 {
+		return fmt.Errorf("security_headers: hsts_max_age must not be negative")
+	}
+	return nil
+}
+
+// headers returns the headers to add to a response to r
+func (s *SecurityHeadersConfig) headers(r *http.Request) map[string]string {
+	h := map[string]string{}
+	// Browsers ignore HSTS over plain HTTP
+	if s.HSTSMaxAge > 0 && r.TLS != nil {
+		v := "max-age=" + strconv.Itoa(int(time.Duration(s.HSTSMaxAge).Seconds()))
+		if s.HSTSIncludeSubdomains {
+			v += "; includeSubDomains"
+		}
+		if s.HSTSPreload {
+			v += "; preload"
+		}
+		h["Strict-Transport-Security"] = v
+	}
+	if s.NoSniff {
+		h["X-Content-Type-Options"] = "nosniff"
+	}
+	if s.FrameOptions != "" {
+		h["X-Frame-Options"] = s.FrameOptions
+	}
+	if s.ContentSecurityPolicy != "" {
+		h["Content-Security-Policy"] = s.ContentSecurityPolicy
+	}
+	if s.ReferrerPolicy != "" {
+		h["Referrer-Policy"] = s.ReferrerPolicy
+	}
+	return h
+}
+
+// withSecurityHeaders wraps w so responses to r carry the configured headers
+func withSecurityHeaders(w http.ResponseWriter, r *http.Request, s *SecurityHeadersConfig) http.ResponseWriter {
+	if s == nil {
+		return w
+	}
+	add := s.headers(r)
+	if len(add) == 0 {
+		return w
+	}
+	return &headerHook{ResponseWriter: w, hook: func(h http.Header) {
+		for k, v := range add {
+			if s.Override || h.Get(k) == "" {
+				h.Set(k, v)
+			}
+		}
+	}}
+}
+
+// headerHook lets the balancer adjust response headers after the backend
+// has set its own but before they are sent
+type headerHook struct {
+	http.ResponseWriter
+	hook func(http.Header)
+	done bool
+}
+
+func (h *headerHook) WriteHeader(code int) {
+	if !h.done {
+		h.done = true
+		h.hook(h.Header())
+	}
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h *headerHook) Write(b []byte) (int, error) {
+	if !h.done {
+		h.WriteHeader(http.StatusOK)
+	}
+	return h.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (h *headerHook) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
@@ -0,0 +1,352 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Probe kinds: a failing liveness probe marks the backend down, a failing
+// readiness probe only drains it from new traffic
+const (
+	probeLiveness  = "liveness"
+	probeReadiness = "readiness"
+)
+
+// Probe types: an HTTP GET expecting 200, only a TCP connect for backends
+// without a health endpoint, a command whose exit code decides, or a UDP
+// datagram that must be answered
+const (
+	probeHTTP = "http"
+	probeTCP  = "tcp"
+	probeExec = "exec"
+	probeUDP  = "udp"
+)
+
+// ProbeConfig is one health check run on the backends of a pool
+type ProbeConfig struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// Command is run by exec probes with LB_BACKEND_URL, LB_BACKEND_HOST
+	// and LB_BACKEND_PORT set; exit status 0 means healthy
+	Command []string `json:"command,omitempty"`
+	// Send is the payload of udp probes and Expect, if set, a string the
+	// answer must contain
+	Send   string `json:"send,omitempty"`
+	Expect string `json:"expect,omitempty"`
+	// Backends limits the probe to these backend URLs, all if empty
+	Backends []string `json:"backends,omitempty"`
+	// Timeout bounds a single check, 2s if unset
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// defaultProbeTimeout bounds a probe that does not set its own timeout
+const defaultProbeTimeout = 2 * time.Second
+
+// defaultProbes keeps the original single /health liveness check
+var defaultProbes = []ProbeConfig{{Type: probeHTTP, Path: "/health", Kind: probeLiveness, Timeout: Duration(defaultProbeTimeout)}}
+
+// validate checks the probe type, path and kind
+func (p *ProbeConfig) validate() error {
+	switch p.Type {
+	case "":
+		p.Type = probeHTTP
+		fallthrough
+	case probeHTTP:
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("probe path %q must start with /", p.Path)
+		}
+	case probeTCP:
+	case probeUDP:
+		if p.Send == "" {
+			return fmt.Errorf("udp probe: send is required")
+		}
+	case probeExec:
+		if len(p.Command) == 0 {
+			return fmt.Errorf("exec probe: command is required")
+		}
+	default:
+		return fmt.Errorf("probe: unknown type %q", p.Type)
+	}
+	switch p.Kind {
+	case "":
+		p.Kind = probeLiveness
+	case probeLiveness, probeReadiness:
+	default:
+		return fmt.Errorf("probe %s: unknown kind %q", p.name(), p.Kind)
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = Duration(defaultProbeTimeout)
+	}
+	return nil
+}
+
+// name identifies the probe in logs
+func (p *ProbeConfig) name() string {
+	switch p.Type {
+	case probeTCP, probeUDP:
+		return p.Type
+	case probeExec:
+		return "exec:" + filepath.Base(p.Command[0])
+	}
+	return p.Path
+}
+
+// appliesTo reports whether the probe checks the backend at u
+func (p *ProbeConfig) appliesTo(u *url.URL) bool {
+	if len(p.Backends) == 0 {
+		return true
+	}
+	for _, b := range p.Backends {
+		if strings.TrimSuffix(b, "/") == strings.TrimSuffix(u.String(), "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// probe runs p against the backend at u
+func (p *ProbeConfig) probe(ctx context.Context, client *http.Client, u *url.URL) bool {
+	switch p.Type {
+	case probeTCP:
+		return isPortOpen(ctx, u, *p)
+	case probeExec:
+		return commandSucceeds(ctx, u, *p)
+	case probeUDP:
+		return datagramAnswered(ctx, u, *p)
+	}
+	return isBackendAlive(ctx, client, u, *p)
+}
+
+// datagramAnswered sends the probe payload to the backend over UDP and
+// checks that an answer, containing Expect if set, arrives in time
+func datagramAnswered(ctx context.Context, u *url.URL, p ProbeConfig) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(u.Hostname(), backendPort(u)))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte(p.Send)); err != nil {
+		return false
+	}
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	return err == nil && strings.Contains(string(buf[:n]), p.Expect)
+}
+
+// isPortOpen checks that the backend accepts TCP connections. The dial is
+// direct, it does not go through a pool's egress proxy.
+func isPortOpen(ctx context.Context, u *url.URL, p ProbeConfig) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), backendPort(u)))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// commandSucceeds runs the probe's command for the backend at u and
+// reports whether it exited with status 0 before the timeout
+func commandSucceeds(ctx context.Context, u *url.URL, p ProbeConfig) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"LB_BACKEND_URL="+u.String(),
+		"LB_BACKEND_HOST="+u.Hostname(),
+		"LB_BACKEND_PORT="+backendPort(u),
+	)
+	// Don't wait on children that inherited the output pipes
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Warn("Probe command failed", "backend", u.String(), "probe", p.name(), "error", err, "output", strings.TrimSpace(string(out)))
+		return false
+	}
+	return true
+}
+
+// backendPort returns the backend's port, defaulting by scheme
+func backendPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// probeResult is the combined outcome of all probes of a backend
+type probeResult struct {
+	alive  bool
+	ready  bool
+	failed []string
+}
+
+// runProbes checks every probe of a backend concurrently
+func runProbes(ctx context.Context, client *http.Client, u *url.URL, probes []ProbeConfig) probeResult {
+	ok := make([]bool, len(probes))
+	var wg sync.WaitGroup
+	for i := range probes {
+		if !probes[i].appliesTo(u) {
+			ok[i] = true
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok[i] = probes[i].probe(ctx, client, u)
+		}(i)
+	}
+	wg.Wait()
+
+	result := probeResult{alive: true, ready: true}
+	for i, p := range probes {
+		if ok[i] {
+			continue
+		}
+		result.failed = append(result.failed, p.name())
+		if p.Kind == probeReadiness {
+			result.ready = false
+		} else {
+			result.alive = false
+		}
+	}
+	return result
+}
+
+// HealthCheckConfig controls the periodic health check cycle
+type HealthCheckConfig struct {
+	// Interval is the time between cycles
+	Interval Duration `json:"interval"`
+	// Concurrency caps the probes run at once across all pools
+	Concurrency int `json:"concurrency"`
+	// WarmUp applies to backends added while running
+	WarmUp WarmUpConfig `json:"warm_up"`
+	// Passive takes backends down on live traffic errors between cycles
+	Passive PassiveHealthConfig `json:"passive"`
+}
+
+// PassiveHealthConfig marks a backend down once proxying to it failed
+// Failures times within Window, until the next health check revives it;
+// 0 failures leaves it to the active checks
+type PassiveHealthConfig struct {
+	Failures int      `json:"failures"`
+	Window   Duration `json:"window"`
+}
+
+// passiveFailure counts a connection error on b and reports whether it
+// took b out of rotation
+func (b *Backend) passiveFailure(now time.Time) bool {
+	p := b.pool.settings().HealthCheck.Passive
+	if p.Failures <= 0 {
+		return false
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if now.Sub(b.lastFailure) > time.Duration(p.Window) {
+		b.failures = 0
+	}
+	b.failures++
+	b.lastFailure = now
+	if !b.Alive || b.failures < p.Failures {
+		return false
+	}
+	b.Alive = false
+	b.failures = 0
+	return true
+}
+
+// WarmUpConfig holds back backends added at runtime until they have
+// passed a number of consecutive probes; 0 probes admits them at once
+type WarmUpConfig struct {
+	Probes   int      `json:"probes"`
+	Interval Duration `json:"interval"`
+}
+
+// warmUp probes b, added to s at runtime, every interval until it is
+// admitted or removed from the pool; failures back off towards the
+// regular check interval
+func (s *ServerPool) warmUp(b *Backend, interval time.Duration) {
+	slog.Info("Backend warming up", "pool", s.Name, "backend", b.URL.String(), "backend_id", b.ID)
+	wait := interval
+	for {
+		time.Sleep(wait)
+		if !s.contains(b) {
+			return
+		}
+		s.checkBackend(context.Background(), b)
+		left := b.WarmUpLeft()
+		if left == 0 {
+			return
+		}
+		if left < s.settings().HealthCheck.WarmUp.Probes {
+			// Passing so far, keep the pace
+			wait = interval
+		} else {
+			wait = min(2*wait, time.Duration(s.settings().HealthCheck.Interval))
+		}
+	}
+}
+
+// healthSummary counts backends by the outcome of a check cycle
+type healthSummary struct {
+	Up        int `json:"up"`
+	Drained   int `json:"drained"`
+	Warming   int `json:"warming"`
+	Down      int `json:"down"`
+	Abandoned int `json:"abandoned"`
+}
+
+// add counts one backend by its status, "" meaning abandoned
+func (h *healthSummary) add(status string) {
+	switch status {
+	case "up":
+		h.Up++
+	case "drained":
+		h.Drained++
+	case "warming":
+		h.Warming++
+	case "down":
+		h.Down++
+	default:
+		h.Abandoned++
+	}
+}
+
+// merge adds the counts of other
+func (h *healthSummary) merge(other healthSummary) {
+	h.Up += other.Up
+	h.Drained += other.Drained
+	h.Warming += other.Warming
+	h.Down += other.Down
+	h.Abandoned += other.Abandoned
+}
+
+func (h healthSummary) String() string {
+	return fmt.Sprintf("%d up, %d drained, %d warming, %d down, %d abandoned",
+		h.Up, h.Drained, h.Warming, h.Down, h.Abandoned)
+}
@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HedgeConfig sends an idempotent request to a second backend when the
+// first has not answered in time, and answers with whichever is first
+type HedgeConfig struct {
+	// Delay is how long the first backend gets, its recent p95 time to
+	// first byte if 0
+	Delay Duration `json:"delay,omitempty"`
+	// MinDelay keeps a fast p95 from hedging most requests, 10ms if 0
+	MinDelay Duration `json:"min_delay,omitempty"`
+}
+
+// validate fills in defaults and checks the delays
+func (c *HedgeConfig) validate() error {
+	if c.Delay < 0 || c.MinDelay < 0 {
+		return fmt.Errorf("hedge: delays must not be negative")
+	}
+	if c.MinDelay == 0 {
+		c.MinDelay = Duration(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// delayFor returns how long peer gets before the request is hedged, 0
+// while there are no samples to take its p95 from
+func (c *HedgeConfig) delayFor(peer *Backend) time.Duration {
+	if c.Delay > 0 {
+		return time.Duration(c.Delay)
+	}
+	p95 := time.Duration(peer.firstBytes.P95()) * time.Millisecond
+	if p95 == 0 {
+		return 0
+	}
+	return max(p95, time.Duration(c.MinDelay))
+}
+
+// hedgeDelay returns how long peer gets to answer r before it is hedged,
+// 0 if r is not hedged. Only requests that may be repeated and whose body
+// can be sent twice are.
+func hedgeDelay(route *RouteConfig, peer *Backend, r *http.Request) time.Duration {
+	if route == nil || route.Hedge == nil || !isIdempotent(r) || r.GetBody == nil || r.Header.Get("Upgrade") != "" {
+		return 0
+	}
+	return route.Hedge.delayFor(peer)
+}
+
+// hedge decides which of a request's attempts answers the client
+type hedge struct {
+	mu      sync.Mutex
+	winner  int // the attempt that answered, -1 until one has
+	live    int // attempts still running
+	cancels []context.CancelFunc
+}
+
+// claim makes attempt i the one that answers unless another already
+// does, cancelling the rest. It reports whether i answers.
+func (h *hedge) claim(i int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.winner < 0 {
+		h.winner = i
+		for j, cancel := range h.cancels {
+			if j != i {
+				cancel()
+			}
+		}
+	}
+	return h.winner == i
+}
+
+// hedgeAttempt is one of the copies of a hedged request
+type hedgeAttempt struct {
+	h        *hedge
+	i        int
+	timing   *upstreamTiming
+	done     chan struct{}
+	panicked interface{}
+}
+
+type hedgeKey struct{}
+
+// hedgeOutcome tells the error handler of a hedged attempt whether
+// another attempt answered, and whether one is still running that might
+func hedgeOutcome(r *http.Request) (lost, pending bool) {
+	a, ok := r.Context().Value(hedgeKey{}).(*hedgeAttempt)
+	if !ok {
+		return false, false
+	}
+	a.h.mu.Lock()
+	defer a.h.mu.Unlock()
+	return a.h.winner >= 0 && a.h.winner != a.i, a.h.winner < 0 && a.h.live > 1
+}
+
+// hedgeWriter keeps an attempt's response to itself until the attempt
+// claims the client's writer; responses of attempts that lost are dropped
+type hedgeWriter struct {
+	http.ResponseWriter
+	header http.Header
+	a      *hedgeAttempt
+	won    bool
+}
+
+func (w *hedgeWriter) Header() http.Header {
+	if w.won {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *hedgeWriter) WriteHeader(code int) {
+	if !w.won {
+		// Informational responses do not decide the race
+		if code < 200 || !w.a.h.claim(w.a.i) {
+			return
+		}
+		w.won = true
+		dst := w.ResponseWriter.Header()
+		for k, v := range w.header {
+			dst[k] = v
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *hedgeWriter) Write(b []byte) (int, error) {
+	if !w.won {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.won {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// FlushError flushes the client's writer once the attempt answers it.
+// There is deliberately no Unwrap, which would let an attempt that lost
+// reach the client's writer.
+func (w *hedgeWriter) FlushError() error {
+	if !w.won {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// serveHedged proxies r to primary and, if nothing has answered after
+// delay, to a second member as well. It returns the timing of the attempt
+// that answered.
+func serveHedged(w http.ResponseWriter, r *http.Request, route *RouteConfig, pool *ServerPool, primary *Backend, delay time.Duration, avoid func(*Backend) bool) *upstreamTiming {
+	h := &hedge{winner: -1}
+	var attempts []*hedgeAttempt
+	var wg sync.WaitGroup
+	launch := func(peer *Backend, req *http.Request) *hedgeAttempt {
+		ctx, cancel := context.WithCancel(req.Context())
+		h.mu.Lock()
+		a := &hedgeAttempt{h: h, i: len(h.cancels), timing: &upstreamTiming{}, done: make(chan struct{})}
+		h.cancels = append(h.cancels, cancel)
+		h.live++
+		if h.winner >= 0 {
+			// Answered while this attempt was being set up
+			cancel()
+		}
+		h.mu.Unlock()
+		attempts = append(attempts, a)
+
+		ctx = context.WithValue(withUpstreamTiming(ctx, a.timing), hedgeKey{}, a)
+		req = req.WithContext(ctx)
+		hw := &hedgeWriter{ResponseWriter: w, header: http.Header{}, a: a}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(a.done)
+			defer func() {
+				// Panics are raised again on the handler's goroutine, where
+				// the server recovers them
+				a.panicked = recover()
+				h.mu.Lock()
+				h.live--
+				h.mu.Unlock()
+				cancel()
+			}()
+			atomic.AddInt64(&peer.active, 1)
+			defer atomic.AddInt64(&peer.active, -1)
+			peer.ReverseProxy.ServeHTTP(&sentTracker{ResponseWriter: hw}, req)
+		}()
+		return a
+	}
+
+	// The spare copy is taken before the first attempt starts using r
+	spare := r.Clone(r.Context())
+	first := launch(primary, r)
+	timer := time.NewTimer(delay)
+	select {
+	case <-first.done:
+	case <-timer.C:
+		h.mu.Lock()
+		decided := h.winner >= 0
+		h.mu.Unlock()
+		if decided {
+			break
+		}
+		if second := hedgePeer(route, pool, hashKey(r, route), primary, avoid); second != nil {
+			if body, err := r.GetBody(); err == nil {
+				spare.Body = body
+				slog.Debug("Request hedged", "method", r.Method, "path", r.URL.Path, "backend_id", primary.ID,
+					"hedge_backend_id", second.ID, "delay_ms", delay.Milliseconds())
+				launch(second, spare)
+			}
+		}
+	}
+	timer.Stop()
+	wg.Wait()
+
+	winner := first
+	if h.winner >= 0 {
+		winner = attempts[h.winner]
+	}
+	for _, a := range attempts {
+		if a.panicked != nil && (a == winner || a.panicked != http.ErrAbortHandler) {
+			panic(a.panicked)
+		}
+	}
+	return winner.timing
+}
+
+// hedgePeer picks the member to hedge primary with, nil if there is none
+// to spare
+func hedgePeer(route *RouteConfig, pool *ServerPool, key string, primary *Backend, avoid func(*Backend) bool) *Backend {
+	notPrimary := func(b *Backend) bool { return b == primary }
+	peer := selectPeer(route, pool, key, avoidEither(notPrimary, avoid))
+	if peer == nil {
+		peer = selectPeer(route, pool, key, notPrimary)
+	}
+	if peer == nil || peer == primary || !peer.throttle.take() {
+		return nil
+	}
+	return peer
+}
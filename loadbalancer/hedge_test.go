@@ -0,0 +1,81 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedging(t *testing.T) {
+	var hits atomic.Int64
+	serve := func(name string, delay time.Duration) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			w.Header().Set("X-Backend", name)
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	slow, fast := serve("slow", time.Second), serve("fast", 0)
+	lb, _ := installPool(t, RoundRobin, slow.URL, fast.URL)
+	cfg := *lb.config()
+	cfg.Routes = append([]RouteConfig{}, cfg.Routes...)
+	cfg.Routes[0].Hedge = &HedgeConfig{Delay: Duration(50 * time.Millisecond)}
+	if err := cfg.Routes[0].Hedge.validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb.setConfig(&cfg)
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		resp, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "fast" || resp.Header.Get("X-Backend") != "fast" || time.Since(start) > 500*time.Millisecond {
+			t.Errorf("GET %d: %q from %q after %v, want the fast backend's answer", i, body, resp.Header.Get("X-Backend"), time.Since(start))
+		}
+	}
+
+	// Requests that may not be repeated go to one backend only
+	hits.Store(0)
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(front.URL+"/", "text/plain", strings.NewReader("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("2 POSTs reached backends %d times", n)
+	}
+
+	// Without a fixed delay the backend's own p95 decides
+	b := &Backend{}
+	if d := (&HedgeConfig{MinDelay: Duration(10 * time.Millisecond)}).delayFor(b); d != 0 {
+		t.Errorf("delay without samples = %v, want no hedging", d)
+	}
+	for i := 1; i <= 100; i++ {
+		b.firstBytes.Add(int64(i))
+	}
+	if d := (&HedgeConfig{MinDelay: Duration(10 * time.Millisecond)}).delayFor(b); d != 96*time.Millisecond {
+		t.Errorf("delay from p95 = %v, want 96ms", d)
+	}
+	if d := (&HedgeConfig{MinDelay: Duration(time.Second)}).delayFor(b); d != time.Second {
+		t.Errorf("delay below the minimum = %v, want 1s", d)
+	}
+}
@@ -0,0 +1,246 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HistoryConfig keeps per-minute aggregates of every backend in memory
+// for triage without an external time series database
+type HistoryConfig struct {
+	// Retention is how far back history goes, 0 turns it off
+	Retention Duration `json:"retention"`
+}
+
+// latencyBuckets are quarter octaves of milliseconds, enough for about
+// 18 minutes; percentiles read from them are within 19% of the truth
+const latencyBuckets = 80
+
+// latencyBucket returns the histogram bucket of ms
+func latencyBucket(ms int64) int {
+	if ms < 0 {
+		ms = 0
+	}
+	i := int(4 * math.Log2(float64(ms)+1))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	return i
+}
+
+// bucketUpper is the largest latency counted in bucket i
+func bucketUpper(i int) int64 {
+	return int64(math.Exp2(float64(i+1)/4) - 1)
+}
+
+// minuteCounters accumulate a backend's traffic until the history rolls
+// over to the next minute
+type minuteCounters struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	latency  [latencyBuckets]atomic.Int64
+}
+
+// response counts one attempt, with its time to first byte if it got a
+// response at all
+func (m *minuteCounters) response(ttfb time.Duration, failed bool) {
+	m.requests.Add(1)
+	if failed {
+		m.errors.Add(1)
+	}
+	if ttfb > 0 {
+		m.latency[latencyBucket(ttfb.Milliseconds())].Add(1)
+	}
+}
+
+// take returns the minute's aggregate and starts the next one
+func (m *minuteCounters) take(minute time.Time) HistoryPoint {
+	p := HistoryPoint{
+		Time:     minute,
+		Requests: m.requests.Swap(0),
+		Errors:   m.errors.Swap(0),
+	}
+	p.RPS = float64(p.Requests) / 60
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range m.latency {
+		counts[i] = m.latency[i].Swap(0)
+		total += counts[i]
+	}
+	if total == 0 {
+		return p
+	}
+	targets := []struct {
+		q   float64
+		dst *int64
+	}{{0.50, &p.P50}, {0.95, &p.P95}, {0.99, &p.P99}}
+	var seen int64
+	for i, n := range counts {
+		seen += n
+		for len(targets) > 0 && float64(seen) >= targets[0].q*float64(total) {
+			*targets[0].dst = bucketUpper(i)
+			targets = targets[1:]
+		}
+	}
+	return p
+}
+
+// HistoryPoint is one backend's traffic in one minute
+type HistoryPoint struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	RPS      float64   `json:"rps"`
+	P50      int64     `json:"p50_ms"`
+	P95      int64     `json:"p95_ms"`
+	P99      int64     `json:"p99_ms"`
+}
+
+// BackendHistory is the recorded minutes of one backend, oldest first
+type BackendHistory struct {
+	Pool   string         `json:"pool"`
+	ID     string         `json:"id"`
+	URL    string         `json:"url"`
+	Points []HistoryPoint `json:"points"`
+}
+
+// historyRing holds the last minutes of one backend
+type historyRing struct {
+	pool, id, url string
+	points        []HistoryPoint
+	next          int
+	full          bool
+}
+
+func (r *historyRing) push(p HistoryPoint) {
+	r.points[r.next] = p
+	r.next = (r.next + 1) % len(r.points)
+	r.full = r.full || r.next == 0
+}
+
+// since returns the points at or after t, oldest first
+func (r *historyRing) since(t time.Time) []HistoryPoint {
+	ordered := r.points[:r.next]
+	if r.full {
+		ordered = append(append([]HistoryPoint{}, r.points[r.next:]...), r.points[:r.next]...)
+	}
+	result := []HistoryPoint{}
+	for _, p := range ordered {
+		if !p.Time.Before(t) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// newest returns the time of the latest point
+func (r *historyRing) newest() time.Time {
+	i := r.next - 1
+	if i < 0 {
+		i = len(r.points) - 1
+	}
+	return r.points[i].Time
+}
+
+// historyStore keeps the rings of every backend seen, by pool and ID
+type historyStore struct {
+	mu    sync.Mutex
+	rings map[string]*historyRing
+}
+
+var history = &historyStore{rings: map[string]*historyRing{}}
+
+// roll closes the minute before now for every backend; rings of removed
+// backends are dropped once their last point ages out
+func (h *historyStore) roll(pools map[string]*ServerPool, now time.Time, retention time.Duration) {
+	minute := now.Truncate(time.Minute).Add(-time.Minute)
+	size := int(retention / time.Minute)
+	if size < 1 {
+		size = 1
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, pool := range pools {
+		for _, b := range pool.Backends() {
+			key := name + "/" + b.ID
+			r := h.rings[key]
+			if r == nil || len(r.points) != size {
+				r = &historyRing{pool: name, id: b.ID, points: make([]HistoryPoint, size)}
+				h.rings[key] = r
+			}
+			r.url = b.URL.String()
+			r.push(b.minute.take(minute))
+		}
+	}
+	for key, r := range h.rings {
+		if now.Sub(r.newest()) > retention {
+			delete(h.rings, key)
+		}
+	}
+}
+
+// query returns the history of backends matching pool and id, "" for any,
+// from since on
+func (h *historyStore) query(pool, id string, since time.Time) []BackendHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := []BackendHistory{}
+	for _, r := range h.rings {
+		if (pool != "" && r.pool != pool) || (id != "" && r.id != id) {
+			continue
+		}
+		result = append(result, BackendHistory{Pool: r.pool, ID: r.id, URL: r.url, Points: r.since(since)})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Pool != result[j].Pool {
+			return result[i].Pool < result[j].Pool
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// historyRoutine rolls the history over at the start of every minute
+func (lb *Balancer) historyRoutine() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		if retention := time.Duration(lb.config().History.Retention); retention > 0 {
+			history.roll(lb.pools(), time.Now(), retention)
+		}
+	}
+}
+
+// historyHandler serves the recorded minutes, optionally narrowed down
+// with ?pool=, ?backend= (an ID) and ?since= (a duration like 30m)
+func (lb *Balancer) historyHandler(w http.ResponseWriter, r *http.Request) {
+	retention := time.Duration(lb.config().History.Retention)
+	if retention <= 0 {
+		http.Error(w, "History is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	since := time.Time{}
+	if s := q.Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid since %q", s), http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"interval":  Duration(time.Minute),
+		"retention": lb.config().History.Retention,
+		"backends":  history.query(q.Get("pool"), q.Get("backend"), since),
+	})
+}
@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	oldHistory := history
+	history = &historyStore{rings: map[string]*historyRing{}}
+	t.Cleanup(func() { history = oldHistory })
+
+	slow, dead := testBackend(t, "slow", 5*time.Millisecond), deadURL(t)
+	lb, pool := installPool(t, RoundRobin, slow.URL, dead)
+	send(t, lb.Handler(), 10)
+	now := time.Now()
+	history.roll(lb.pools(), now, time.Hour)
+	history.roll(lb.pools(), now.Add(time.Minute), time.Hour)
+
+	var slowID string
+	for _, b := range pool.Backends() {
+		if b.URL.String() == slow.URL {
+			slowID = b.ID
+		}
+	}
+	rec := admin(t, lb, http.MethodGet, "/lb/stats/history?backend="+slowID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Backends []BackendHistory `json:"backends"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Backends) != 1 || len(out.Backends[0].Points) != 2 {
+		t.Fatalf("history = %+v, want two minutes of one backend", out.Backends)
+	}
+	first, second := out.Backends[0].Points[0], out.Backends[0].Points[1]
+	if first.Requests != 10 || first.Errors != 0 {
+		t.Errorf("first minute had %d requests, %d errors, want 10 and 0", first.Requests, first.Errors)
+	}
+	if first.P50 < 5 || first.P99 > 50 {
+		t.Errorf("first minute p50 %dms, p99 %dms, want about 5ms", first.P50, first.P99)
+	}
+	if second.Requests != 0 {
+		t.Errorf("second minute had %d requests, want 0", second.Requests)
+	}
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+)
+
+// idFor returns the ID of the member at rawURL: the one configured for it,
+// or one derived from the pool name and URL so it survives restarts
+func (s *ServerPool) idFor(rawURL string, u *url.URL) string {
+	if id, ok := s.ids[rawURL]; ok {
+		return id
+	}
+	if id, ok := s.ids[u.String()]; ok {
+		return id
+	}
+	h := fnv.New32a()
+	h.Write([]byte(u.String()))
+	if s.Name == "" {
+		return fmt.Sprintf("%08x", h.Sum32())
+	}
+	return fmt.Sprintf("%s-%08x", s.Name, h.Sum32())
+}
+
+// validateIDs checks configured IDs are set and name one backend each
+func validateIDs(ids map[string]string) error {
+	seen := map[string]string{}
+	for u, id := range ids {
+		if id == "" {
+			return fmt.Errorf("ids: empty ID for %s", u)
+		}
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("ids: %q names both %s and %s", id, other, u)
+		}
+		seen[id] = u
+	}
+	return nil
+}
+
+// findBackend returns the member with the given ID, or URL when id is
+// empty, nil if there is none
+func (s *ServerPool) findBackend(id, rawURL string) *Backend {
+	for _, b := range s.snapshot() {
+		if (id != "" && b.ID == id) || (id == "" && b.URL.String() == rawURL) {
+			return b
+		}
+	}
+	return nil
+}
+
+// backendRef is how an admin request named a backend, for error messages
+func backendRef(id, rawURL string) string {
+	if id != "" {
+		return id
+	}
+	return rawURL
+}
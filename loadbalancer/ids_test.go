@@ -0,0 +1,35 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBackendIDs(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, pool := installPool(t, RoundRobin, a.URL)
+	first := pool.Backends()[0].ID
+	if again, _ := NewPool("test", a.URL); again.Backends()[0].ID != first {
+		t.Errorf("derived ID changed between pools: %q, then %q", first, again.Backends()[0].ID)
+	}
+
+	rec := admin(t, lb, http.MethodPost, "/lb/backends", `{"pool": "test", "url": "`+b.URL+`", "id": "b-1"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec := admin(t, lb, http.MethodPost, "/lb/backends", `{"pool": "test", "url": "`+b.URL+`/v2", "id": "b-1"}`); rec.Code != http.StatusConflict {
+		t.Errorf("adding a second b-1: status %d, want 409", rec.Code)
+	}
+	if rec := admin(t, lb, http.MethodPost, "/lb/drain", `{"pool": "test", "id": "b-1", "drain": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("drain by ID: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if counts := send(t, lb.Handler(), 4); counts["a"] != 4 {
+		t.Errorf("requests with b-1 drained went to %v", counts)
+	}
+	if rec := admin(t, lb, http.MethodDelete, "/lb/backends", `{"pool": "test", "id": "b-1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("remove by ID: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got := len(pool.Backends()); got != 1 {
+		t.Errorf("pool has %d members after removing b-1, want 1", got)
+	}
+}
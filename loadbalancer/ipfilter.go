@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPFilterConfig allows or denies clients by address. Deny entries win;
+// when Allow is non-empty only matching clients get through.
+type IPFilterConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// DryRun logs and meters denials without rejecting the client
+	DryRun bool `json:"dry_run,omitempty"`
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parse converts the configured CIDRs, bare addresses are single hosts
+func (f *IPFilterConfig) parse() error {
+	var err error
+	if f.allow, err = parsePrefixes(f.Allow); err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	if f.deny, err = parsePrefixes(f.Deny); err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+	return nil
+}
+
+// parsePrefixes parses a list of CIDRs or plain IP addresses
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Allowed reports whether addr passes the filter
+func (f *IPFilterConfig) Allowed(addr netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed applies the global and route filters to the request
+func clientAllowed(r *http.Request, route *RouteConfig) bool {
+	addr, ok := clientAddr(r)
+	if !ok {
+		// Unix sockets and the like carry no address to filter on
+		return true
+	}
+	if !filterAllows(requestConfig(r).IPFilter, "ip_filter", addr, r) {
+		return false
+	}
+	return route == nil || filterAllows(route.IPFilter, "ip_filter:"+routeKey(route), addr, r)
+}
+
+// filterAllows applies one filter, denials of dry-run filters are only
+// recorded
+func filterAllows(f *IPFilterConfig, rule string, addr netip.Addr, r *http.Request) bool {
+	if f.Allowed(addr) {
+		return true
+	}
+	if requestConfig(r).DryRun || f.DryRun {
+		dryRuns.Record(rule, "deny", r)
+		return true
+	}
+	return false
+}
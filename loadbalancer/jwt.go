@@ -0,0 +1,415 @@
+package loadbalancer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// JWTConfig makes a route require a bearer token signed by a key from a
+// JWKS endpoint, with the expected issuer and audience
+type JWTConfig struct {
+	JWKSURL string `json:"jwks_url"`
+	Issuer  string `json:"issuer,omitempty"`
+	// Audience must appear in the token's aud claim when set
+	Audience string `json:"audience,omitempty"`
+	// Refresh is how often the key set is fetched again
+	Refresh Duration `json:"refresh"`
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway Duration `json:"leeway"`
+	// AllowNoExpiry accepts tokens without an exp claim, which are
+	// otherwise refused as they would be good forever
+	AllowNoExpiry bool `json:"allow_no_expiry,omitempty"`
+	// DryRun only records requests that would have been rejected
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// validate fills in defaults and checks the JWKS URL
+func (c *JWTConfig) validate() error {
+	u, err := url.Parse(c.JWKSURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("jwt: jwks_url must be an http(s) URL")
+	}
+	if c.Refresh <= 0 {
+		c.Refresh = Duration(time.Hour)
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("jwt: leeway must not be negative")
+	}
+	return nil
+}
+
+// jwtAlgorithms maps the supported "alg" values onto their hash
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// jwtClaims holds the registered claims we check
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+}
+
+// jwtAudience accepts both forms of the aud claim
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// verify checks the token's signature against the key set and its claims
+// against c, returning every claim of a valid token
+func (c *JWTConfig) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	key, err := jwks.key(c, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !key.allows(header.Alg) {
+		return nil, fmt.Errorf("alg %q not allowed for key %q", header.Alg, header.Kid)
+	}
+	if err := verifyJWTSignature(header.Alg, hash, key.public, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	var all map[string]interface{}
+	if err := decodeJWTPart(parts[1], &all); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	now := time.Now()
+	leeway := time.Duration(c.Leeway)
+	if claims.ExpiresAt == nil && !c.AllowNoExpiry {
+		return nil, errors.New("token has no exp")
+	}
+	if claims.ExpiresAt != nil && now.After(time.Unix(*claims.ExpiresAt, 0).Add(leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(leeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if c.Issuer != "" && claims.Issuer != c.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if c.Audience != "" && !slices.Contains(claims.Audience, c.Audience) {
+		return nil, errors.New("audience not accepted")
+	}
+	return all, nil
+}
+
+// decodeJWTPart decodes one base64url JSON segment of a token
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifyJWTSignature checks sig over signed with key using alg
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, sig []byte) error {
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			valid = rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+		case "PS":
+			valid = rsa.VerifyPSS(k, hash, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			valid = ecdsa.Verify(k, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		valid = alg == "EdDSA" && ed25519.Verify(k, []byte(signed), sig)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// jwtKey is a key from a key set with the alg the set names for it, if any
+type jwtKey struct {
+	public crypto.PublicKey
+	alg    string
+}
+
+// ecdsaAlgs maps curves onto the one alg that signs with them
+var ecdsaAlgs = map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}
+
+// allows reports whether a token may be signed with k using alg: the alg
+// the key set names for k, or without one an alg of k's type and curve.
+// Tokens pick their alg, so they must not get to pick one the key was
+// not published for.
+func (k jwtKey) allows(alg string) bool {
+	if k.alg != "" {
+		return alg == k.alg
+	}
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return alg == ecdsaAlgs[pub.Curve.Params().Name]
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// jwkSet is one fetched key set, replaced rather than changed once it is
+// in the cache
+type jwkSet struct {
+	keys    map[string]jwtKey
+	fetched time.Time
+}
+
+// jwksCache holds the key sets of every configured JWKS URL. Fetches run
+// outside mu, one per URL at a time.
+type jwksCache struct {
+	mu       sync.Mutex
+	sets     map[string]*jwkSet
+	fetching singleflight.Group
+}
+
+var jwks = jwksCache{sets: map[string]*jwkSet{}}
+
+// jwksMinRefetch limits how often an unknown kid triggers a fetch
+const jwksMinRefetch = 30 * time.Second
+
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+// key returns the key kid from c's key set. A set due for refresh is
+// still used while it is fetched again in the background; requests wait
+// for a fetch only when the set is missing or does not know kid (keys
+// may have rotated).
+func (j *jwksCache) key(c *JWTConfig, kid string) (jwtKey, error) {
+	j.mu.Lock()
+	set := j.sets[c.JWKSURL]
+	j.mu.Unlock()
+
+	if set != nil {
+		key, ok := set.keys[kid]
+		age := time.Since(set.fetched)
+		switch {
+		case ok && age > time.Duration(c.Refresh):
+			j.fetching.DoChan(c.JWKSURL, func() (interface{}, error) { return j.fetch(c.JWKSURL) })
+			return key, nil
+		case ok:
+			return key, nil
+		case age <= jwksMinRefetch:
+			return jwtKey{}, fmt.Errorf("unknown key %q", kid)
+		}
+	}
+
+	v, err, _ := j.fetching.Do(c.JWKSURL, func() (interface{}, error) { return j.fetch(c.JWKSURL) })
+	if err != nil {
+		return jwtKey{}, fmt.Errorf("jwks: %w", err)
+	}
+	key, ok := v.(*jwkSet).keys[kid]
+	if !ok {
+		return jwtKey{}, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch downloads the key set of rawURL into the cache, keeping the
+// current keys if that fails
+func (j *jwksCache) fetch(rawURL string) (*jwkSet, error) {
+	keys, err := fetchJWKS(rawURL)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	set := j.sets[rawURL]
+	switch {
+	case err == nil:
+		set = &jwkSet{keys: keys, fetched: time.Now()}
+	case set == nil:
+		return nil, err
+	default:
+		// Keep using the keys we have until the endpoint recovers
+		slog.Warn("JWKS refresh failed, keeping current keys", "url", rawURL, "error", err)
+		set = &jwkSet{keys: set.keys, fetched: time.Now()}
+	}
+	j.sets[rawURL] = set
+	return set, nil
+}
+
+// fetchJWKS downloads a key set, skipping keys it cannot use
+func fetchJWKS(rawURL string) (map[string]jwtKey, error) {
+	resp, err := jwksClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	keys := map[string]jwtKey{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err == nil && k.Alg != "" && !(jwtKey{public: key}).allows(k.Alg) {
+			err = fmt.Errorf("alg %q does not fit the key", k.Alg)
+		}
+		if err != nil {
+			slog.Warn("JWKS key skipped", "url", rawURL, "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = jwtKey{public: key, alg: k.Alg}
+	}
+	return keys, nil
+}
+
+// jwk is a JSON Web Key as published in a key set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey builds the crypto key the JWK describes
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// jwtAllowed checks the bearer token of a request to a route that requires
+// one, writing the 401 itself when it is rejected. The claims of a valid
+// token are attached to the returned request.
+func jwtAllowed(w http.ResponseWriter, r *http.Request, route *RouteConfig) (*http.Request, bool) {
+	if route == nil || route.JWT == nil {
+		return r, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	challenge := "Bearer"
+	if ok {
+		claims, err := route.JWT.verify(strings.TrimSpace(token))
+		if err == nil {
+			return r.WithContext(withJWTClaims(r.Context(), claims)), true
+		}
+		challenge = fmt.Sprintf("Bearer error=%q, error_description=%q", "invalid_token", err.Error())
+	}
+	if requestConfig(r).DryRun || route.JWT.DryRun {
+		dryRuns.Record("jwt:"+routeKey(route), "deny", r)
+		return r, true
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return r, false
+}
@@ -0,0 +1,166 @@
+package loadbalancer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSRefresh(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		fmt.Fprintf(w, `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"new","x":%q}]}`, base64.RawURLEncoding.EncodeToString(pub))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	c := &JWTConfig{JWKSURL: server.URL}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	jwks.mu.Lock()
+	jwks.sets[c.JWKSURL] = &jwkSet{keys: map[string]jwtKey{"old": {public: pub}}, fetched: time.Now().Add(-2 * time.Hour)}
+	jwks.mu.Unlock()
+	t.Cleanup(func() {
+		jwks.mu.Lock()
+		delete(jwks.sets, c.JWKSURL)
+		jwks.mu.Unlock()
+	})
+
+	// A stale set keeps serving while a single refresh is in flight
+	for range 10 {
+		if _, err := jwks.key(c, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for fetches.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches, want 1", n)
+	}
+
+	// An unknown kid waits for the refresh that is running
+	done := make(chan error)
+	go func() {
+		_, err := jwks.key(c, "new")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("unknown kid answered before the refresh: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
+
+// signJWT returns a token for claims signed by key with alg
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := jwtAlgorithms[alg]
+	h := hash.New()
+	h.Write([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig, err = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), signErr
+	case *rsa.PrivateKey:
+		if alg[:2] == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, h.Sum(nil), nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil))
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "EC", "crv": "P-256", "kid": "ec", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64([]byte{1, 0, 1})},
+		}})
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		jwks.mu.Lock()
+		delete(jwks.sets, server.URL)
+		jwks.mu.Unlock()
+	})
+	c := &JWTConfig{JWKSURL: server.URL}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expiring := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	for _, tc := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256 with a P-256 key", signJWT(t, "ES256", "ec", ecKey, expiring), true},
+		{"RS256 with a key published for it", signJWT(t, "RS256", "rsa", rsaKey, expiring), true},
+		{"PS256 with a key published for RS256", signJWT(t, "PS256", "rsa", rsaKey, expiring), false},
+		{"RS512 with a key published for RS256", signJWT(t, "RS512", "rsa", rsaKey, expiring), false},
+		{"no exp", signJWT(t, "ES256", "ec", ecKey, map[string]interface{}{"sub": "alice"}), false},
+		{"expired", signJWT(t, "ES256", "ec", ecKey, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), false},
+	} {
+		if _, err := c.verify(tc.token); (err == nil) != tc.ok {
+			t.Errorf("%s: %v, want accepted %v", tc.name, err, tc.ok)
+		}
+	}
+
+	// The header cannot switch a P-256 key to another curve's alg
+	ecPub := jwtKey{public: &ecKey.PublicKey}
+	if ecPub.allows("ES384") || !ecPub.allows("ES256") || ecPub.allows("EdDSA") {
+		t.Error("an EC key without an alg allowed another curve's alg")
+	}
+
+	// Routes may take tokens without exp when they say so
+	c.AllowNoExpiry = true
+	if _, err := c.verify(signJWT(t, "ES256", "ec", ecKey, map[string]interface{}{"sub": "alice"})); err != nil {
+		t.Errorf("no exp on a route allowing it: %v", err)
+	}
+}
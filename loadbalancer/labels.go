@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultLabelHeaderPrefix prefixes the headers labels are sent to backends in
+const defaultLabelHeaderPrefix = "X-LB-Label-"
+
+// Labels are key/value tags used to attribute traffic to teams and products
+type Labels map[string]string
+
+// String renders labels as a stable "k=v,k=v" key
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + l[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+// LabelsFor derives the labels of a request from the route it matched:
+// global labels, then the route name and pool, then the route's own labels
+func (c *Config) LabelsFor(route *RouteConfig) Labels {
+	if route != nil && route.labels != nil {
+		return route.labels
+	}
+	if route == nil && c.defaultLabels != nil {
+		return c.defaultLabels
+	}
+	return c.buildLabels(route)
+}
+
+// buildLabels computes the labels for route, see LabelsFor
+func (c *Config) buildLabels(route *RouteConfig) Labels {
+	labels := Labels{"route": "default", "pool": defaultPool}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	if route == nil {
+		return labels
+	}
+	if route.Name != "" {
+		labels["route"] = route.Name
+	}
+	if route.Pool != "" {
+		labels["pool"] = route.Pool
+	}
+	for k, v := range route.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// setLabelHeaders replaces any client-supplied label headers with ours so
+// backends can trust them
+func setLabelHeaders(h http.Header, prefix string, labels Labels) {
+	for name := range h {
+		if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+			h.Del(name)
+		}
+	}
+	for k, v := range labels {
+		h.Set(prefix+k, v)
+	}
+}
+
+// labelCounters accumulates traffic for one label set
+type labelCounters struct {
+	labels    Labels
+	Requests  int64
+	Errors    int64
+	BytesOut  int64
+	LatencyMs int64
+}
+
+// labelMetrics tracks traffic per distinct label set
+type labelMetrics struct {
+	mu   sync.RWMutex
+	sets map[string]*labelCounters
+}
+
+var trafficByLabels = labelMetrics{sets: map[string]*labelCounters{}}
+
+// Observe records one finished request for labels
+func (m *labelMetrics) Observe(labels Labels, status int, bytes, latencyMs int64) {
+	key := labels.String()
+	m.mu.RLock()
+	c := m.sets[key]
+	m.mu.RUnlock()
+
+	if c == nil {
+		m.mu.Lock()
+		if c = m.sets[key]; c == nil {
+			c = &labelCounters{labels: labels}
+			m.sets[key] = c
+		}
+		m.mu.Unlock()
+	}
+
+	atomic.AddInt64(&c.Requests, 1)
+	atomic.AddInt64(&c.BytesOut, bytes)
+	atomic.AddInt64(&c.LatencyMs, latencyMs)
+	if status >= 500 {
+		atomic.AddInt64(&c.Errors, 1)
+	}
+}
+
+// Snapshot returns the counters of every label set, sorted by key
+func (m *labelMetrics) Snapshot() []map[string]interface{} {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.sets))
+	for k := range m.sets {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		m.mu.RLock()
+		c := m.sets[k]
+		m.mu.RUnlock()
+		result = append(result, map[string]interface{}{
+			"labels":     c.labels,
+			"requests":   atomic.LoadInt64(&c.Requests),
+			"errors":     atomic.LoadInt64(&c.Errors),
+			"bytes_out":  atomic.LoadInt64(&c.BytesOut),
+			"latency_ms": atomic.LoadInt64(&c.LatencyMs),
+		})
+	}
+	return result
+}
+
+// statusRecorder remembers the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,241 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ListenerConfig controls which addresses the balancer accepts connections on
+type ListenerConfig struct {
+	// Name is what routes refer to the listener by, its first address if unset
+	Name string `json:"name,omitempty"`
+	// Addresses to bind, e.g. ":8080", "0.0.0.0:8080" or "[::1]:8080"
+	Addresses []string `json:"addresses"`
+	// Family restricts binding to "ipv4", "ipv6" or "dual" (both)
+	Family    string `json:"family"`
+	ReuseAddr bool   `json:"reuse_addr"`
+	ReusePort bool   `json:"reuse_port"`
+	// TLS, when set, terminates TLS on every address
+	TLS *ListenerTLS `json:"tls,omitempty"`
+	// AcceptProxyProtocol expects a PROXY header (v1 or v2) from an
+	// upstream load balancer on every connection
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol,omitempty"`
+	// TrustedSources are the networks allowed to send PROXY headers;
+	// required with accept_proxy_protocol
+	TrustedSources []string `json:"trusted_sources,omitempty"`
+	// RedirectHTTP sends plain HTTP clients to the TLS listeners
+	RedirectHTTP *RedirectHTTP `json:"redirect_http,omitempty"`
+	// Zone is where clients of this listener are, for zone-aware routing
+	Zone string `json:"zone,omitempty"`
+	// Server overrides the config's client timeouts and limits
+	Server *ServerConfig `json:"server,omitempty"`
+
+	trusted []netip.Prefix
+}
+
+// ServerConfig bounds how long clients may take and how much header they
+// may send, so slow or oversized requests cannot hold connections open.
+// Zero timeouts mean no limit.
+type ServerConfig struct {
+	// ReadHeaderTimeout is how long a client has to send request headers
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	// ReadTimeout covers the whole request, body included
+	ReadTimeout Duration `json:"read_timeout"`
+	// WriteTimeout covers the whole response; it also cuts off streamed
+	// responses such as server-sent events
+	WriteTimeout Duration `json:"write_timeout"`
+	// IdleTimeout closes keep-alive connections waiting for a request
+	IdleTimeout Duration `json:"idle_timeout"`
+	// MaxHeaderBytes caps the request line and headers
+	MaxHeaderBytes int `json:"max_header_bytes"`
+}
+
+// merge returns c with every non-zero field of o applied on top
+func (c ServerConfig) merge(o *ServerConfig) ServerConfig {
+	if o == nil {
+		return c
+	}
+	if o.ReadHeaderTimeout != 0 {
+		c.ReadHeaderTimeout = o.ReadHeaderTimeout
+	}
+	if o.ReadTimeout != 0 {
+		c.ReadTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout != 0 {
+		c.WriteTimeout = o.WriteTimeout
+	}
+	if o.IdleTimeout != 0 {
+		c.IdleTimeout = o.IdleTimeout
+	}
+	if o.MaxHeaderBytes != 0 {
+		c.MaxHeaderBytes = o.MaxHeaderBytes
+	}
+	return c
+}
+
+// validate checks nothing is negative
+func (c ServerConfig) validate() error {
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return fmt.Errorf("server: timeouts must not be negative")
+	}
+	if c.MaxHeaderBytes < 0 {
+		return fmt.Errorf("server: max_header_bytes must not be negative")
+	}
+	return nil
+}
+
+// apply sets the limits on s
+func (c ServerConfig) apply(s *http.Server) {
+	s.ReadHeaderTimeout = time.Duration(c.ReadHeaderTimeout)
+	s.ReadTimeout = time.Duration(c.ReadTimeout)
+	s.WriteTimeout = time.Duration(c.WriteTimeout)
+	s.IdleTimeout = time.Duration(c.IdleTimeout)
+	s.MaxHeaderBytes = c.MaxHeaderBytes
+}
+
+// network maps the address family onto a Go network name
+func (l ListenerConfig) network() (string, error) {
+	switch l.Family {
+	case "", "dual":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("listener: unknown family %q", l.Family)
+}
+
+// validate checks addresses and family and parses the trusted sources
+func (l *ListenerConfig) validate() error {
+	if len(l.Addresses) == 0 {
+		return fmt.Errorf("listener: no addresses configured")
+	}
+	for _, addr := range l.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("listener: %w", err)
+		}
+	}
+	if l.TLS != nil {
+		if err := l.TLS.validate(); err != nil {
+			return err
+		}
+	}
+	if l.Server != nil {
+		if err := l.Server.validate(); err != nil {
+			return fmt.Errorf("listener: %w", err)
+		}
+	}
+	if l.RedirectHTTP != nil {
+		if l.TLS == nil {
+			return fmt.Errorf("listener: redirect_http needs tls")
+		}
+		if err := l.RedirectHTTP.validate(); err != nil {
+			return err
+		}
+	}
+	var err error
+	if l.trusted, err = parseTrustedSources(l.AcceptProxyProtocol, l.TrustedSources); err != nil {
+		return fmt.Errorf("listener: %w", err)
+	}
+	_, err = l.network()
+	return err
+}
+
+// Scheme is the URL scheme clients reach the listeners with
+func (l ListenerConfig) Scheme() string {
+	if l.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+type listenerKey struct{}
+
+// withListener attaches the listener a request arrived on to its context
+func withListener(ctx context.Context, l *ListenerConfig) context.Context {
+	return context.WithValue(ctx, listenerKey{}, l)
+}
+
+// listenerFrom returns the listener attached to ctx, nil if none
+func listenerFrom(ctx context.Context) *ListenerConfig {
+	l, _ := ctx.Value(listenerKey{}).(*ListenerConfig)
+	return l
+}
+
+// listenerName returns the name of the listener attached to ctx, "" if none
+func listenerName(ctx context.Context) string {
+	if l := listenerFrom(ctx); l != nil {
+		return l.Name
+	}
+	return ""
+}
+
+// Listen binds every configured address, closing any already opened
+// listeners if one of them fails
+func (l ListenerConfig) Listen() ([]net.Listener, error) {
+	var tlsConfig *tls.Config
+	if l.TLS != nil {
+		var err error
+		if tlsConfig, err = l.TLS.config(); err != nil {
+			return nil, err
+		}
+	}
+	return l.bind(l.Addresses, tlsConfig)
+}
+
+// ListenRedirect binds the plain HTTP redirect addresses, if configured
+func (l ListenerConfig) ListenRedirect() ([]net.Listener, error) {
+	if l.RedirectHTTP == nil {
+		return nil, nil
+	}
+	return l.bind(l.RedirectHTTP.Addresses, nil)
+}
+
+// bind opens addrs with the configured family and socket options, wrapped
+// in TLS when tlsConfig is set
+func (l ListenerConfig) bind(addrs []string, tlsConfig *tls.Config) ([]net.Listener, error) {
+	network, err := l.network()
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReuse(fd, l.ReuseAddr, l.ReusePort)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ln, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		// The PROXY header comes before the TLS handshake
+		if l.AcceptProxyProtocol {
+			ln = proxyProtoListener{ln, l.trusted}
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,6 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package loadbalancer
+
+// soReusePort is SO_REUSEPORT, which the frozen syscall package lacks
+const soReusePort = 0x200
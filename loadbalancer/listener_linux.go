@@ -0,0 +1,4 @@
+package loadbalancer
+
+// soReusePort is SO_REUSEPORT, which the frozen syscall package lacks
+const soReusePort = 0xf
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package loadbalancer
+
+import "errors"
+
+// setReuse is only supported on platforms with SO_REUSEPORT
+func setReuse(fd uintptr, reuseAddr, reusePort bool) error {
+	if reuseAddr || reusePort {
+		return errors.New("listener: address reuse options are not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerLimits(t *testing.T) {
+	limits := defaultConfig().Server.merge(&ServerConfig{ReadHeaderTimeout: Duration(100 * time.Millisecond), MaxHeaderBytes: 4096})
+	if limits.IdleTimeout != Duration(120*time.Second) {
+		t.Errorf("listener override lost the config's idle timeout: %v", limits.IdleTimeout)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	limits.apply(srv.Config)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// A client trickling its headers is cut off
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	io.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("slow client kept its connection for %v", elapsed)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("X-Big", strings.Repeat("x", 8192))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers: status %d, want 431", resp.StatusCode)
+	}
+}
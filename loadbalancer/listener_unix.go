@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package loadbalancer
+
+import "syscall"
+
+// setReuse applies SO_REUSEADDR and SO_REUSEPORT to a listening socket
+func setReuse(fd uintptr, reuseAddr, reusePort bool) error {
+	if reuseAddr {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return err
+		}
+	}
+	if reusePort {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
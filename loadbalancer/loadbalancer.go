@@ -0,0 +1,1268 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Backend represents a backend server
+type Backend struct {
+	// ID names the backend in the admin API, logs and metrics, it stays
+	// the same across restarts and reordering
+	ID            string
+	URL           *url.URL
+	Alive         bool
+	mux           sync.RWMutex
+	ReverseProxy  *httputil.ReverseProxy
+	AvgLatency    int64 // in milliseconds
+	RequestCount  int64
+	TotalLatency  int64
+	active        int64 // requests in flight
+	clusterActive int64 // requests in flight on the other cluster nodes
+	latency       latencyStats
+	statuses      [4]int64       // responses by class, 2xx through 5xx
+	Drained       bool           // alive but failing readiness, kept out of rotation
+	Cordoned      bool           // drained by an operator, survives health checks
+	warming       int            // consecutive passing probes still needed before admission
+	failures      int            // proxy errors counted towards passive health
+	lastFailure   time.Time      // when the last of them happened
+	minute        minuteCounters // traffic since the history last rolled over
+	recentErrors  errorSamples   // for health webhooks
+	hint          weightHint
+	origin        string        // configured URL this member was resolved from, if any
+	throttle      *tokenBucket  // caps requests per second, nil if uncapped
+	clusterDown   bool          // seen down by most of the cluster
+	firstBytes    latencyWindow // recent times to first byte, for hedging
+	bytesSent     int64         // request body bytes sent to the backend
+	bytesReceived int64         // response body bytes received from it
+	pool          *ServerPool   // the pool the backend was created for
+}
+
+// SetAlive sets the alive status of the backend
+func (b *Backend) SetAlive(alive bool) {
+	b.mux.Lock()
+	b.Alive = alive
+	b.mux.Unlock()
+}
+
+// IsAlive returns the alive status of the backend
+func (b *Backend) IsAlive() bool {
+	b.mux.RLock()
+	alive := b.Alive
+	b.mux.RUnlock()
+	return alive
+}
+
+// setHealth applies the result of a health check; a warming backend only
+// comes alive once it has passed enough probes in a row. It reports
+// whether this check admitted the backend.
+func (b *Backend) setHealth(alive, ready bool) (admitted bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.warming > 0 {
+		if !alive {
+			b.warming = b.pool.settings().HealthCheck.WarmUp.Probes
+		} else if b.warming--; b.warming == 0 {
+			admitted = true
+		}
+	}
+	b.Alive = alive && b.warming == 0
+	b.Drained = !ready
+	return admitted
+}
+
+// WarmUpLeft returns how many passing probes the backend still needs
+// before admission, 0 once it is admitted
+func (b *Backend) WarmUpLeft() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.warming
+}
+
+// SetDrained takes the backend out of (or back into) rotation without
+// considering it dead
+func (b *Backend) SetDrained(drained bool) {
+	b.mux.Lock()
+	b.Drained = drained
+	b.mux.Unlock()
+}
+
+// SetCordoned drains or restores the backend on an operator's request
+func (b *Backend) SetCordoned(cordoned bool) {
+	b.mux.Lock()
+	b.Cordoned = cordoned
+	b.mux.Unlock()
+}
+
+// IsCordoned reports whether an operator drained the backend
+func (b *Backend) IsCordoned() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Cordoned
+}
+
+// IsAvailable reports whether the backend may receive new requests
+func (b *Backend) IsAvailable() bool {
+	b.mux.RLock()
+	available := b.Alive && !b.Drained && !b.Cordoned && !b.clusterDown
+	b.mux.RUnlock()
+	return available
+}
+
+// Status returns "up", "drained" or "down"
+func (b *Backend) Status() string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	switch {
+	case b.warming > 0:
+		return "warming"
+	case !b.Alive:
+		return "down"
+	case b.Drained, b.Cordoned:
+		return "drained"
+	}
+	return "up"
+}
+
+// UpdateLatency updates the average latency for this backend
+func (b *Backend) UpdateLatency(latency int64) {
+	atomic.AddInt64(&b.TotalLatency, latency)
+	atomic.AddInt64(&b.RequestCount, 1)
+
+	// The average comes from decayable sums so idle periods can fade it,
+	// see decayLatency
+	b.latency.mu.Lock()
+	b.latency.sum += float64(latency)
+	b.latency.weight++
+	b.latency.last = time.Now()
+	atomic.StoreInt64(&b.AvgLatency, int64(b.latency.sum/b.latency.weight))
+	b.latency.mu.Unlock()
+}
+
+// countStatus records the class of a response the backend sent
+func (b *Backend) countStatus(code int) {
+	if class := code/100 - 2; class >= 0 && class < len(b.statuses) {
+		atomic.AddInt64(&b.statuses[class], 1)
+	}
+}
+
+// StatusCounts returns the responses sent so far keyed by class
+func (b *Backend) StatusCounts() map[string]int64 {
+	counts := make(map[string]int64, len(b.statuses))
+	for i := range b.statuses {
+		counts[fmt.Sprintf("%dxx", i+2)] = atomic.LoadInt64(&b.statuses[i])
+	}
+	return counts
+}
+
+// GetAvgLatency returns the average latency
+func (b *Backend) GetAvgLatency() int64 {
+	return atomic.LoadInt64(&b.AvgLatency)
+}
+
+// ServerPool holds information about reachable backends
+type ServerPool struct {
+	Name string
+	// members is replaced, never modified, when backends come and go so
+	// the request path reads it without locking
+	members   atomic.Pointer[[]*Backend]
+	transport http.RoundTripper
+	egress    bool
+	probes    []ProbeConfig
+	rateLimit *RateLimitConfig
+	onBackup  atomic.Bool // all primaries are down, backups serve
+	zones     map[string]string
+	ids       map[string]string
+	attempts  rateWindow // requests sent to members, for pool rates
+	failures  rateWindow // of which failed or got a 5xx
+	// quorum is how many primaries must be available, quorumLost whether
+	// fewer are
+	quorum     int
+	quorumLost atomic.Bool
+	current    uint64
+	mux        sync.Mutex // serializes membership changes
+	// ctx ends the pool's discovery once a reload drops it, nil for
+	// pools without any
+	ctx    context.Context
+	cancel context.CancelFunc
+	// lb is the balancer the pool is installed on, nil until it is
+	lb *Balancer
+}
+
+// settings returns the config of the balancer running the pool, the
+// default config until the pool is installed on one
+func (s *ServerPool) settings() *Config {
+	if s == nil || s.lb == nil {
+		return defaultConfig()
+	}
+	return s.lb.config()
+}
+
+// lifetime is cancelled once the pool is dropped
+func (s *ServerPool) lifetime() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// close stops the pool's discovery; requests already sent to its
+// backends finish
+func (s *ServerPool) close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// snapshot returns the current members, which must not be modified
+func (s *ServerPool) snapshot() []*Backend {
+	if members := s.members.Load(); members != nil {
+		return *members
+	}
+	return nil
+}
+
+// AddBackend adds a backend to the server pool; once running, the backend
+// only gets traffic after passing the warm-up probes
+func (s *ServerPool) AddBackend(backend *Backend) {
+	warmUp := s.settings().HealthCheck.WarmUp
+	if s.lb != nil && s.lb.warmUpNew.Load() && warmUp.Probes > 0 {
+		backend.mux.Lock()
+		backend.Alive = false
+		backend.warming = warmUp.Probes
+		backend.mux.Unlock()
+		go s.warmUp(backend, time.Duration(warmUp.Interval))
+	}
+
+	s.mux.Lock()
+	old := s.snapshot()
+	backends := append(old[:len(old):len(old)], backend)
+	s.members.Store(&backends)
+	s.mux.Unlock()
+	watchers.added(s, backend)
+}
+
+// contains reports whether backend is a member of the pool
+func (s *ServerPool) contains(backend *Backend) bool {
+	for _, b := range s.snapshot() {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveBackend takes a backend out of the server pool
+func (s *ServerPool) RemoveBackend(backend *Backend) {
+	s.mux.Lock()
+	old := s.snapshot()
+	backends := make([]*Backend, 0, len(old))
+	for _, b := range old {
+		if b != backend {
+			backends = append(backends, b)
+		}
+	}
+	s.members.Store(&backends)
+	s.mux.Unlock()
+	if len(backends) < len(old) {
+		watchers.removed(s, backend)
+	}
+}
+
+// SyncMembers makes the members tagged with origin match want, creating
+// missing ones with create; it returns the URLs added and removed
+func (s *ServerPool) SyncMembers(origin string, want []string, create func(string) (*Backend, error)) (added, removed []string) {
+	have := map[string]*Backend{}
+	for _, b := range s.Backends() {
+		if b.origin == origin {
+			have[b.URL.String()] = b
+		}
+	}
+
+	wanted := map[string]bool{}
+	for _, member := range want {
+		wanted[member] = true
+		if _, ok := have[member]; ok {
+			continue
+		}
+		backend, err := create(member)
+		if err != nil {
+			slog.Warn("Member not added", "pool", s.Name, "member", member, "error", err)
+			continue
+		}
+		backend.origin = origin
+		s.AddBackend(backend)
+		added = append(added, member)
+	}
+	for member, b := range have {
+		if !wanted[member] {
+			s.RemoveBackend(b)
+			removed = append(removed, member)
+		}
+	}
+	return added, removed
+}
+
+// Backends returns a snapshot of the pool members
+func (s *ServerPool) Backends() []*Backend {
+	return append([]*Backend(nil), s.snapshot()...)
+}
+
+// NextIndex atomically increases the counter and returns next index, -1
+// when the pool has no members
+func (s *ServerPool) NextIndex() int {
+	return s.nextIndex(len(s.snapshot()))
+}
+
+// nextIndex advances the round-robin counter over n members. n comes from
+// the snapshot the caller indexes, so concurrent changes cannot push the
+// index out of its range.
+func (s *ServerPool) nextIndex(n int) int {
+	if n == 0 {
+		return -1
+	}
+	return int(atomic.AddUint64(&s.current, 1) % uint64(n))
+}
+
+// GetNextPeer returns next active peer using round-robin
+func (s *ServerPool) GetNextPeer() *Backend {
+	return s.NextPeerAvoiding(nil)
+}
+
+// NextPeerAvoiding is GetNextPeer skipping backends for which avoid
+// returns true; a nil avoid skips nothing
+func (s *ServerPool) NextPeerAvoiding(avoid func(*Backend) bool) *Backend {
+	backends := s.snapshot()
+	if len(backends) == 0 {
+		return nil
+	}
+	avoid = s.tierAvoid(backends, avoid)
+	next := s.nextIndex(len(backends))
+	l := len(backends) + next
+
+	for i := next; i < l; i++ {
+		idx := i % len(backends)
+		b := backends[idx]
+		if b.IsAvailable() && (avoid == nil || !avoid(b)) && b.admit() {
+			if i != next {
+				atomic.StoreUint64(&s.current, uint64(idx))
+			}
+			return b
+		}
+	}
+	return heaviestAlive(backends, avoid)
+}
+
+// heaviestAlive returns the live backend with the largest weight hint, used
+// when every backend turned the request away
+func heaviestAlive(backends []*Backend, avoid func(*Backend) bool) *Backend {
+	var best *Backend
+	bestWeight := -1.0
+	for _, b := range backends {
+		if avoid != nil && avoid(b) {
+			continue
+		}
+		if w := b.Weight(); b.IsAvailable() && w > bestWeight {
+			best, bestWeight = b, w
+		}
+	}
+	return best
+}
+
+// GetLeastLatencyPeer returns the backend with lowest average latency
+func (s *ServerPool) GetLeastLatencyPeer() *Backend {
+	return s.LeastLatencyPeerAvoiding(nil)
+}
+
+// LeastLatencyPeerAvoiding is GetLeastLatencyPeer skipping backends for
+// which avoid returns true; a nil avoid skips nothing
+func (s *ServerPool) LeastLatencyPeerAvoiding(avoid func(*Backend) bool) *Backend {
+	backends := s.snapshot()
+	avoid = s.tierAvoid(backends, avoid)
+
+	var best *Backend
+	minScore := math.Inf(1)
+
+	for _, backend := range backends {
+		if !backend.IsAvailable() || (avoid != nil && avoid(backend)) {
+			continue
+		}
+		latency := backend.GetAvgLatency()
+		if latency == 0 {
+			latency = unknownLatency
+		}
+		// Backends asking for less traffic look proportionally slower
+		score := float64(latency) / math.Max(backend.Weight(), 0.001)
+		if best == nil || score < minScore {
+			minScore = score
+			best = backend
+		}
+	}
+	return best
+}
+
+// HealthCheck pings backends and updates status
+func (s *ServerPool) HealthCheck(ctx context.Context, sem chan struct{}) healthSummary {
+	var mu sync.Mutex
+	var summary healthSummary
+	var wg sync.WaitGroup
+	for _, b := range s.Backends() {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			summary.Abandoned++
+			continue
+		}
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status := s.checkBackend(ctx, b)
+			mu.Lock()
+			summary.add(status)
+			mu.Unlock()
+		}(b)
+	}
+	wg.Wait()
+	return summary
+}
+
+// checkBackend probes one backend, updates its state and returns its
+// status, "" if the check was abandoned
+func (s *ServerPool) checkBackend(ctx context.Context, b *Backend) string {
+	// Probe through the same transport (and egress proxy) as live traffic
+	client := &http.Client{Transport: b.ReverseProxy.Transport}
+	result := runProbes(ctx, client, b.URL, s.probes)
+	if ctx.Err() != nil {
+		// The cycle was cut short, the results say nothing about b
+		slog.Warn("Health check abandoned", "backend", b.URL.String(), "backend_id", b.ID, "error", ctx.Err())
+		return ""
+	}
+	wasAlive := b.IsAlive()
+	if b.setHealth(result.alive, result.ready) {
+		slog.Info("Backend admitted", "backend", b.URL.String(), "backend_id", b.ID, "passing_probes", s.settings().HealthCheck.WarmUp.Probes)
+	}
+	if len(result.failed) > 0 {
+		reason := "failed probes: " + strings.Join(result.failed, ", ")
+		b.recentErrors.add(reason)
+		if wasAlive && !b.IsAlive() {
+			s.healthChanged(b, false, reason)
+		}
+		watchers.status(s, b, reason)
+		slog.Warn("Health check failed", "backend", b.URL.String(), "backend_id", b.ID, "status", b.Status(),
+			"avg_latency_ms", b.GetAvgLatency(), "failed_probes", strings.Join(result.failed, ", "))
+		return b.Status()
+	}
+	if !wasAlive && b.IsAlive() {
+		s.healthChanged(b, true, "health check passed")
+		go preconnect(b, s.settings().Transport)
+	}
+	watchers.status(s, b, "health check passed")
+	slog.Debug("Health check passed", "backend", b.URL.String(), "backend_id", b.ID, "status", b.Status(),
+		"avg_latency_ms", b.GetAvgLatency())
+	return b.Status()
+}
+
+// LeastConnPeerAvoiding returns the available backend with the fewest
+// requests in flight relative to its weight, skipping backends for which
+// avoid returns true
+func (s *ServerPool) LeastConnPeerAvoiding(avoid func(*Backend) bool) *Backend {
+	backends := s.snapshot()
+	avoid = s.tierAvoid(backends, avoid)
+
+	var best *Backend
+	minScore := math.Inf(1)
+	for _, backend := range backends {
+		if !backend.IsAvailable() || (avoid != nil && avoid(backend)) {
+			continue
+		}
+		active := float64(atomic.LoadInt64(&backend.active) + atomic.LoadInt64(&backend.clusterActive))
+		score := (active + 1) / math.Max(backend.Weight(), 0.001)
+		if best == nil || score < minScore {
+			minScore = score
+			best = backend
+		}
+	}
+	return best
+}
+
+// HashPeerAvoiding returns the available backend key maps to, skipping
+// backends for which avoid returns true. Rendezvous hashing keeps most keys
+// on the same backend when members come and go.
+func (s *ServerPool) HashPeerAvoiding(key string, avoid func(*Backend) bool) *Backend {
+	backends := s.snapshot()
+	avoid = s.tierAvoid(backends, avoid)
+
+	var best *Backend
+	var bestScore uint64
+	for _, backend := range backends {
+		if !backend.IsAvailable() || (avoid != nil && avoid(backend)) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(backend.URL.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = backend, score
+		}
+	}
+	return best
+}
+
+// isBackendAlive checks if a probe path of the backend answers 200 within
+// the probe's timeout
+func isBackendAlive(ctx context.Context, client *http.Client, u *url.URL, p ProbeConfig) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String()+p.Path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	// Drain a little so the connection can be reused for the next check
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode == http.StatusOK
+}
+
+// healthCheckRoutine runs periodic health checks, a cycle still running
+// when the next is due is cancelled
+func (lb *Balancer) healthCheckRoutine(interval time.Duration) {
+	t := time.NewTicker(interval)
+	for range t.C {
+		slog.Debug("Health check cycle started")
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		// Bounds the probes in flight across all pools
+		sem := make(chan struct{}, lb.config().HealthCheck.Concurrency)
+
+		var mu sync.Mutex
+		var total healthSummary
+		var wg sync.WaitGroup
+		for _, pool := range lb.pools() {
+			wg.Add(1)
+			go func(pool *ServerPool) {
+				defer wg.Done()
+				summary := pool.HealthCheck(ctx, sem)
+				mu.Lock()
+				total.merge(summary)
+				mu.Unlock()
+			}(pool)
+		}
+		wg.Wait()
+		cancel()
+
+		slog.Info("Health check cycle finished", "duration_ms", time.Since(start).Milliseconds(), "summary", total.String())
+		lb.lastHealthCycle.Store(&total)
+	}
+}
+
+// poolFor returns the pool serving a route, the default pool if unset
+func (lb *Balancer) poolFor(route *RouteConfig) *ServerPool {
+	if route != nil && route.Pool != "" {
+		return lb.pools()[route.Pool]
+	}
+	return lb.pools()[defaultPool]
+}
+
+// selectPeer picks a backend with the route's strategy, or the active
+// algorithm of the pool's balancer when the route does not set one; key
+// is what the hash strategy hashes, round-robin is used when it is empty
+func selectPeer(route *RouteConfig, pool *ServerPool, key string, avoid func(*Backend) bool) *Backend {
+	strategy := RoundRobin
+	if pool.lb != nil {
+		strategy = pool.lb.currentAlgorithm()
+	}
+	if route != nil && route.Strategy != "" {
+		strategy = route.Strategy
+	}
+
+	switch strategy {
+	case Hash:
+		if key != "" {
+			return pool.HashPeerAvoiding(key, avoid)
+		}
+	case LeastLatency:
+		return pool.LeastLatencyPeerAvoiding(avoid)
+	case LeastConn:
+		return pool.LeastConnPeerAvoiding(avoid)
+	}
+	return pool.NextPeerAvoiding(avoid)
+}
+
+// balance load balances the incoming request
+func (lb *Balancer) balance(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = r.WithContext(withBalancer(r.Context(), lb))
+
+	listener := listenerName(r.Context())
+	country := clientCountry(r)
+	route := lb.config().MatchRoute(listener, r.Host, r.URL.Path, country)
+	pool := lb.poolFor(route)
+	if shadow := lb.config().DryRunRoute(listener, r.Host, r.URL.Path, country); shadow != nil {
+		dryRuns.Record("route:"+routeKey(shadow), "route", r)
+	}
+
+	// Apply the route's upstream timeouts
+	timeouts := lb.config().TimeoutsFor(route)
+	ctx := withRoute(withTimeouts(r.Context(), timeouts), route)
+	if timeouts.Total > 0 {
+		var stop func()
+		ctx, stop = withTotalTimeout(ctx, time.Duration(timeouts.Total))
+		defer stop()
+	}
+	if route != nil && route.ResponseLimit != nil {
+		ctx = withResponseLimit(ctx, route.ResponseLimit)
+	}
+	r = r.WithContext(ctx)
+
+	// Count body bytes both ways for the route
+	if route != nil {
+		var in int64
+		r.Body = countBody(r.Body, &in)
+		cw := &countingWriter{ResponseWriter: w}
+		w = cw
+		defer func() { routeTraffic.add(routeKey(route), atomic.LoadInt64(&in), cw.n) }()
+	}
+
+	// Tag the request for attribution and tell the backend about it
+	labels := lb.config().LabelsFor(route)
+	setLabelHeaders(r.Header, lb.config().LabelHeaderPrefix, labels)
+	if l := listenerFrom(r.Context()); l != nil {
+		l.TLS.setClientCertHeader(r)
+	}
+	runChain(&exchange{
+		lb:       lb,
+		w:        w,
+		r:        r,
+		route:    route,
+		pool:     pool,
+		timeouts: timeouts,
+		labels:   labels,
+		start:    start,
+	}, lb.config().MiddlewareFor(route))
+}
+
+// algorithmHandler reports the active algorithm on GET and switches it on
+// POST {"name": "least-conn"}
+func (lb *Balancer) algorithmHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Name Strategy `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := lb.switchAlgorithm(req.Name); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"algorithm": lb.currentAlgorithm(),
+		"available": strategies,
+	})
+}
+
+// backendsHandler lists backends on GET, adds one on POST
+// {"pool": "default", "url": "http://localhost:8084", "id": "api-4"} and
+// removes one on DELETE with the same body, naming it by ID or URL
+func (lb *Balancer) backendsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lb.allBackends())
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Pool string `json:"pool"`
+		ID   string `json:"id"`
+		URL  string `json:"url"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.URL == "" && (r.Method == http.MethodPost || req.ID == "")) {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	var pool *ServerPool
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		pool, err = lb.addBackend(req.Pool, req.ID, req.URL)
+		status = http.StatusCreated
+	} else {
+		pool, err = lb.removeBackend(req.Pool, req.ID, req.URL)
+	}
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pool.GetBackends())
+}
+
+// drainHandler takes a backend out of rotation or puts it back on
+// POST {"pool": "default", "url": "http://localhost:8081", "drain": true},
+// naming the backend by "id" instead of "url" also works
+func (lb *Balancer) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Pool  string `json:"pool"`
+		ID    string `json:"id"`
+		URL   string `json:"url"`
+		Drain bool   `json:"drain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	pool, b, err := lb.drainBackend(req.Pool, req.ID, req.URL, req.Drain)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     b.ID,
+		"pool":   pool.Name,
+		"url":    b.URL.String(),
+		"status": b.Status(),
+	})
+}
+
+// newBackend parses rawURL and sets up its reverse proxy, failed requests
+// are retried on other members of pool
+func newBackend(rawURL string, pool *ServerPool) (*Backend, error) {
+	serverURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &Backend{
+		ID:       pool.idFor(rawURL, serverURL),
+		URL:      serverURL,
+		Alive:    true,
+		throttle: pool.rateLimit.bucketFor(rawURL),
+		pool:     pool,
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	proxy.Transport = pool.transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Oversized responses are counted as errors by the error handler
+		if err := limitResponse(resp); err != nil {
+			return err
+		}
+		countBackendResponse(backend, resp)
+		ttfb := markFirstByte(backend, resp)
+		backend.countStatus(resp.StatusCode)
+		pool.observe(resp.StatusCode >= 500)
+		backend.minute.response(ttfb, resp.StatusCode >= 500)
+		route := routeFrom(resp.Request.Context())
+		routeBackends.response(route, pool.Name, backend, resp.StatusCode, ttfb)
+		statsd.backendResponse(route, pool.Name, backend.ID, resp.StatusCode, ttfb)
+		if pool.settings().WeightHint.Enabled {
+			backend.observeWeightHeader(resp.Header)
+		}
+		return nil
+	}
+
+	// Egress proxies route by the Host in the request line, so it has to
+	// name the backend rather than the client-facing host
+	if pool.egress {
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			r.Host = serverURL.Host
+		}
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		markSent(r)
+		setDeadlineHeader(r)
+		countBackendBytes(backend, r)
+	}
+
+	// Custom error handler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+		// A hedged attempt that lost the race was cancelled, not failed
+		lost, pending := hedgeOutcome(r)
+		if lost {
+			return
+		}
+		slog.Warn("Proxy error", "backend", serverURL.Host, "backend_id", backend.ID, "path", r.URL.Path, "error", e)
+
+		// A client that went away says nothing about the backend
+		if !errors.Is(context.Cause(r.Context()), context.Canceled) {
+			pool.observe(true)
+			backend.minute.response(0, true)
+			backend.recentErrors.add(e.Error())
+			route := routeFrom(r.Context())
+			routeBackends.failure(route, pool.Name, backend)
+			statsd.backendFailure(route, pool.Name, backend.ID)
+		}
+
+		// Part of the response already reached the client, anything more
+		// would be appended to it
+		if responseSent(w) {
+			slog.Warn("Response cut short", "backend", serverURL.Host, "backend_id", backend.ID, "path", r.URL.Path)
+			return
+		}
+		// The other attempt of a hedged request may still answer
+		if pending {
+			return
+		}
+
+		// Another backend would likely send the same
+		if errors.Is(e, errResponseTooLarge) {
+			writeError(w, r, http.StatusBadGateway, "Response too large")
+			return
+		}
+		// Timeouts are not retried, the budget is already spent
+		if isTimeout(e) {
+			writeError(w, r, http.StatusGatewayTimeout, "Gateway timeout")
+			return
+		}
+		// Connection errors count against the backend right away, a
+		// client that went away says nothing about it
+		if r.Context().Err() == nil && backend.passiveFailure(time.Now()) {
+			slog.Warn("Backend marked down", "pool", pool.Name, "backend", serverURL.String(), "backend_id", backend.ID,
+				"failures", pool.settings().HealthCheck.Passive.Failures, "error", e)
+			pool.healthChanged(backend, false, "proxy error: "+e.Error())
+		}
+
+		// Streamed bodies are gone and non-idempotent requests may have
+		// been acted on, sending them again could duplicate or truncate
+		if !canRetry(r, e) {
+			writeError(w, r, http.StatusBadGateway, "Bad gateway")
+			return
+		}
+
+		// Later attempts skip every backend this request already failed on
+		r, tried := attemptedFor(r)
+		tried[backend] = true
+
+		retries := 3
+		ctx := r.Context()
+
+		for retries > 0 {
+			select {
+			case <-ctx.Done():
+				writeError(w, r, http.StatusGatewayTimeout, "Request timeout")
+				return
+			default:
+				retries--
+				peer := pool.NextPeerAvoiding(tried.avoid)
+				if peer != nil {
+					if err := rewindBody(r); err != nil {
+						writeError(w, r, http.StatusBadGateway, "Bad gateway")
+						return
+					}
+					peer.ReverseProxy.ServeHTTP(w, r)
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		writeError(w, r, http.StatusServiceUnavailable, "Service not available")
+	}
+
+	backend.ReverseProxy = proxy
+	return backend, nil
+}
+
+// buildPool creates a pool of lb from its configuration and starts any
+// discovery that keeps its members up to date
+func (lb *Balancer) buildPool(name string, poolCfg *PoolConfig) (*ServerPool, error) {
+	transport, err := newTransport(lb.config().Transport, poolCfg.Proxy, poolCfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", name, err)
+	}
+
+	pool := &ServerPool{
+		Name:      name,
+		transport: transport,
+		egress:    poolCfg.Proxy != nil,
+		probes:    poolCfg.Probes,
+		rateLimit: poolCfg.RateLimit,
+		zones:     poolCfg.Zones,
+		ids:       poolCfg.IDs,
+		quorum:    poolCfg.Quorum,
+		lb:        lb,
+	}
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
+	for _, urlStr := range poolCfg.Backends {
+		// Hostnames are expanded to one member per resolved address
+		if poolCfg.DNSRefresh > 0 && needsResolution(urlStr) {
+			origin, err := url.Parse(urlStr)
+			if err != nil {
+				return nil, err
+			}
+			target := newDNSTarget(pool, origin)
+			if target.refresh() != nil {
+				if err := target.addUnresolved(); err != nil {
+					return nil, err
+				}
+			}
+			go target.watch(time.Duration(poolCfg.DNSRefresh))
+			slog.Info("Configured backend", "backend", urlStr, "pool", name,
+				"dns_refresh", time.Duration(poolCfg.DNSRefresh))
+			continue
+		}
+
+		backend, err := newBackend(urlStr, pool)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddBackend(backend)
+		slog.Info("Configured backend", "backend", backend.URL.String(), "backend_id", backend.ID, "pool", name)
+	}
+	for _, urlStr := range poolCfg.Backup {
+		backend, err := newBackupBackend(urlStr, pool)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddBackend(backend)
+		slog.Info("Configured backup backend", "backend", backend.URL.String(), "backend_id", backend.ID, "pool", name)
+	}
+	if poolCfg.Consul != nil {
+		watcher := newConsulWatcher(pool, poolCfg.Consul)
+		watcher.refresh()
+		go watcher.watch()
+		slog.Info("Pool follows Consul service", "pool", name, "service", poolCfg.Consul.Service, "consul", poolCfg.Consul.Address)
+	}
+	if poolCfg.Docker != nil {
+		watcher := newDockerWatcher(pool, poolCfg.Docker)
+		watcher.refresh()
+		go watcher.watch()
+		slog.Info("Pool follows Docker containers", "pool", name, "label", poolCfg.Docker.Label)
+	}
+	if poolCfg.Proxy != nil {
+		slog.Info("Pool uses egress proxy", "pool", name, "proxy", poolCfg.Proxy.Redacted())
+	}
+	return pool, nil
+}
+
+// Start runs the health checker and the other background work the
+// balancer needs; programs embedding it call it once its pools exist.
+// Backends added from then on warm up before they get traffic.
+func (lb *Balancer) Start() {
+	lb.warmUpNew.Store(true)
+	go lb.healthCheckRoutine(time.Duration(lb.config().HealthCheck.Interval))
+	go lb.decayRoutine()
+	go lb.historyRoutine()
+	go lb.gossipRoutine()
+	go lb.preconnectRoutine()
+	snapshots.Start(lb, lb.config().Snapshots)
+}
+
+// Handler balances requests over the configured pools and serves the
+// admin endpoints under /lb/
+func (lb *Balancer) Handler() http.Handler {
+	admin := lb.adminHandler(false)
+	if lb.config().Admin.Address != "" {
+		// The admin endpoints have a listener of their own, load
+		// balancers probing this one still need the health checks
+		probes := http.NewServeMux()
+		probes.HandleFunc("/lb/healthz", healthzHandler)
+		probes.HandleFunc("/lb/readyz", lb.readyzHandler)
+		admin = probes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Route special endpoints
+		if strings.HasPrefix(r.URL.Path, "/lb/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		// Default: load balance
+		lb.balance(w, r)
+	})
+}
+
+// shutdownTimeout bounds how long requests in flight get to finish once
+// the balancer is told to stop
+const shutdownTimeout = 30 * time.Second
+
+// serving is a server and one of the listeners it serves
+type serving struct {
+	server *http.Server
+	ln     net.Listener
+}
+
+// serve runs every server until one fails or ctx is done, then shuts them
+// all down, letting requests in flight finish within shutdownTimeout
+func serve(ctx context.Context, servers []serving) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s serving) {
+			errs <- s.server.Serve(s.ln)
+		}(s)
+	}
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		slog.Info("Shutting down, waiting for requests in flight")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("Server not shut down cleanly", "error", err)
+			}
+		}(s.server)
+	}
+	wg.Wait()
+	return err
+}
+
+// Main runs the balancer as the command line and its config file
+// describe. It returns when -h was given or, after shutting down
+// gracefully, on SIGINT or SIGTERM, and exits on errors.
+func Main() {
+	lb := New()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// A second signal stops the balancer without waiting
+		<-ctx.Done()
+		stop()
+	}()
+	var err error
+	if cli, err = parseFlags(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fatal("Invalid flags", err)
+	}
+
+	cfg, err := loadConfig(cli.configPath)
+	if err != nil {
+		fatal("Config not loaded", err)
+	}
+	setupLogging(cfg.Log)
+
+	// Backends and routes kept in etcd take precedence over the file
+	var etcd *etcdSource
+	if cfg.Etcd != nil {
+		etcd = newEtcdSource(lb, cfg.Etcd, cli.configPath)
+		value, err := etcd.get()
+		if err != nil {
+			fatal("etcd config not read", err)
+		}
+		if cfg, err = etcd.load(value); err != nil {
+			fatal("etcd config not loaded", err)
+		}
+		setupLogging(cfg.Log)
+		slog.Info("Loaded configuration from etcd", "key", cfg.Etcd.Key, "revision", etcd.revision)
+	}
+	lb.setConfig(cfg)
+	maintenance.Reset(lb.config().Maintenance)
+	faults.Reset(lb.config().Routes)
+
+	if lb.config().GeoIP != nil {
+		if geoIP, err = loadGeoIP(lb.config().GeoIP); err != nil {
+			fatal("GeoIP database not loaded", err)
+		}
+		slog.Info("Loaded GeoIP database", "networks", len(geoIP.networks))
+	}
+	if accessLog, err = openAccessLog(lb.config().AccessLog); err != nil {
+		fatal("Access log not opened", err)
+	}
+	if statsd, err = newStatsD(lb.config().StatsD); err != nil {
+		fatal("StatsD not set up", err)
+	}
+	lb.ha = newHA(lb, lb.config().HA)
+
+	// Build each pool from its configured backends
+	built := map[string]*ServerPool{}
+	for _, name := range lb.config().PoolNames() {
+		pool, err := lb.buildPool(name, lb.config().Pools[name])
+		if err != nil {
+			fatal("Pool not built", err)
+		}
+		built[name] = pool
+	}
+	lb.reloadMu.Lock()
+	lb.switchConfig(cfg, built)
+	lb.reloadMu.Unlock()
+
+	if lb.config().State != nil {
+		// Starting without the state beats not starting
+		if restored, err := lb.loadState(lb.config().State); err != nil {
+			slog.Warn("State not restored", "file", lb.config().State.File, "error", err)
+		} else {
+			slog.Info("Restored backend state", "file", lb.config().State.File, "backends", restored)
+		}
+		go lb.stateRoutine(ctx, lb.config().State)
+	}
+
+	if etcd != nil {
+		go etcd.watch()
+	}
+	if lb.config().Algorithm != "" {
+		lb.setAlgorithm(lb.config().Algorithm)
+	}
+	lb.Start()
+	handler := lb.Handler()
+
+	// Setup one HTTP server per listener, telling requests which one
+	// they arrived on
+	var servers []serving
+	var first net.Listener
+	for i := range lb.config().Listeners {
+		l := &lb.config().Listeners[i]
+		server := &http.Server{
+			Handler: handler,
+			BaseContext: func(net.Listener) context.Context {
+				return withListener(context.Background(), l)
+			},
+		}
+		limits := lb.config().Server.merge(l.Server)
+		limits.apply(server)
+		server.ConnState = connections.track(l.Name)
+		listeners, err := l.Listen()
+		if err != nil {
+			fatal("Listener not started", err)
+		}
+		for _, ln := range listeners {
+			slog.Info("Load Balancer started", "address", ln.Addr().String(), "scheme", l.Scheme(), "listener", l.Name)
+			servers = append(servers, serving{server, ln})
+		}
+		if first == nil {
+			first = listeners[0]
+		}
+
+		redirects, err := l.ListenRedirect()
+		if err != nil {
+			fatal("Redirect listener not started", err)
+		}
+		if len(redirects) > 0 {
+			_, port, _ := net.SplitHostPort(listeners[0].Addr().String())
+			redirect := &http.Server{
+				Handler: l.RedirectHTTP.handler(port, http.HandlerFunc(lb.balance)),
+				BaseContext: func(net.Listener) context.Context {
+					return withListener(context.Background(), l)
+				},
+			}
+			limits.apply(redirect)
+			for _, ln := range redirects {
+				slog.Info("Redirecting HTTP to HTTPS", "address", ln.Addr().String())
+				servers = append(servers, serving{redirect, ln})
+			}
+		}
+	}
+	scheme := lb.config().Listeners[0].Scheme()
+	base := scheme + "://localhost"
+	if _, port, err := net.SplitHostPort(first.Addr().String()); err == nil {
+		base += ":" + port
+	}
+	adminBase := base
+
+	if lb.config().Admin.Address != "" {
+		ln, err := net.Listen("tcp", lb.config().Admin.Address)
+		if err != nil {
+			fatal("Admin listener not started", err)
+		}
+		server := &http.Server{Handler: lb.adminHandler(true), ReadHeaderTimeout: time.Duration(lb.config().Server.ReadHeaderTimeout)}
+		slog.Info("Admin listener started", "address", ln.Addr().String())
+		servers = append(servers, serving{server, ln})
+		adminBase = "http://localhost"
+		if _, port, err := net.SplitHostPort(ln.Addr().String()); err == nil {
+			adminBase += ":" + port
+		}
+	}
+	if lb.config().Control != nil {
+		server, ln, err := lb.listenControl(lb.config().Control)
+		if err != nil {
+			fatal("Control service not started", err)
+		}
+		slog.Info("Control service started", "address", ln.Addr().String(), "tls", lb.config().Control.TLS != nil)
+		servers = append(servers, serving{server, ln})
+	}
+	for _, p := range lb.config().Passthrough {
+		if err := lb.startPassthrough(p); err != nil {
+			fatal("TLS passthrough not started", err)
+		}
+	}
+	for _, t := range lb.config().TCP {
+		if err := lb.startTCPProxy(t); err != nil {
+			fatal("TCP proxy not started", err)
+		}
+	}
+	for _, u := range lb.config().UDP {
+		if err := lb.startUDPProxy(u); err != nil {
+			fatal("UDP proxy not started", err)
+		}
+	}
+	slog.Info("Available endpoints",
+		"proxy", base+"/*",
+		"dashboard", adminBase+"/lb/ui",
+		"stats", adminBase+"/lb/stats",
+		"stats_stream", adminBase+"/lb/stats/stream",
+		"stats_cluster", adminBase+"/lb/stats/cluster",
+		"metrics", adminBase+"/lb/metrics",
+		"algorithm", adminBase+"/lb/algorithm",
+		"har", adminBase+"/lb/har/start")
+
+	synthetics.Start(syntheticBaseURL(scheme, first.Addr()), lb.config().Synthetic)
+
+	if err := serve(ctx, servers); err != nil {
+		fatal("Server stopped", err)
+	}
+	if lb.config().State != nil {
+		if err := lb.saveState(lb.config().State); err != nil {
+			fatal("State not saved", err)
+		}
+		slog.Info("State saved", "file", lb.config().State.File)
+	}
+	slog.Info("Load Balancer stopped")
+}
@@ -0,0 +1,349 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testBackend answers every request with its name in X-Backend after delay
+func testBackend(t *testing.T, name string, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			time.Sleep(delay)
+		}
+		w.Header().Set("X-Backend", name)
+		fmt.Fprintf(w, "hello from %s", name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// installPool routes every request of a new balancer to a new pool of
+// urls with strategy
+func installPool(t *testing.T, strategy Strategy, urls ...string) (*Balancer, *ServerPool) {
+	t.Helper()
+	pool, err := NewPool("test", urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	r.PathPrefix("/").Name("test").Pool(pool).Strategy(strategy)
+	lb := New()
+	if err := lb.Install(r); err != nil {
+		t.Fatal(err)
+	}
+	return lb, pool
+}
+
+// send makes n requests through the balancer and counts who answered them
+func send(t *testing.T, h http.Handler, n int) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/work", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, body %q", i, rec.Code, rec.Body.String())
+		}
+		counts[rec.Header().Get("X-Backend")]++
+	}
+	return counts
+}
+
+func TestRoundRobinDistribution(t *testing.T) {
+	a, b, c := testBackend(t, "a", 0), testBackend(t, "b", 0), testBackend(t, "c", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL, b.URL, c.URL)
+
+	counts := send(t, lb.Handler(), 300)
+	for _, name := range []string{"a", "b", "c"} {
+		if counts[name] != 100 {
+			t.Errorf("backend %s served %d requests, want 100 (%v)", name, counts[name], counts)
+		}
+	}
+}
+
+func TestFailoverOnBackendDeath(t *testing.T) {
+	live, dying := testBackend(t, "live", 0), testBackend(t, "dying", 0)
+	lb, pool := installPool(t, RoundRobin, live.URL, dying.URL)
+
+	if counts := send(t, lb.Handler(), 10); counts["dying"] == 0 {
+		t.Fatalf("dying backend got no traffic while up: %v", counts)
+	}
+	dying.Close()
+	pool.HealthCheck(context.Background(), make(chan struct{}, 2))
+
+	for _, b := range pool.Backends() {
+		if want := b.URL.String() == live.URL; b.IsAlive() != want {
+			t.Errorf("%s alive = %v after health check, want %v", b.URL, b.IsAlive(), want)
+		}
+	}
+	if counts := send(t, lb.Handler(), 20); counts["live"] != 20 {
+		t.Errorf("requests after failover went to %v, want all on live", counts)
+	}
+}
+
+func TestLeastLatencyPrefersFasterBackend(t *testing.T) {
+	fast, slow := testBackend(t, "fast", 2*time.Millisecond), testBackend(t, "slow", 40*time.Millisecond)
+	lb, _ := installPool(t, LeastLatency, fast.URL, slow.URL)
+	h := lb.Handler()
+
+	// Both start at the unknown latency, the first requests measure them
+	send(t, h, 4)
+	if counts := send(t, h, 20); counts["fast"] < 18 {
+		t.Errorf("least-latency sent %v, want nearly all on fast", counts)
+	}
+}
+
+func TestLeastLatencyPeerSkipsDeadBackends(t *testing.T) {
+	pool, err := NewPool("latency", "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := pool.Backends()
+	for i, ms := range []int64{30, 10, 20} {
+		backends[i].UpdateLatency(ms)
+	}
+
+	if got := pool.GetLeastLatencyPeer(); got != backends[1] {
+		t.Fatalf("GetLeastLatencyPeer = %s, want %s", got.URL, backends[1].URL)
+	}
+	backends[1].SetAlive(false)
+	if got := pool.GetLeastLatencyPeer(); got != backends[2] {
+		t.Fatalf("with the fastest down GetLeastLatencyPeer = %s, want %s", got.URL, backends[2].URL)
+	}
+}
+
+// echoBackend answers with the request body it received
+func echoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// deadURL is the address of a server that no longer listens
+func deadURL(t *testing.T) string {
+	t.Helper()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	return dead.URL
+}
+
+func TestProxyErrorMarksBackendDown(t *testing.T) {
+	dead := deadURL(t)
+	lb, pool := installPool(t, RoundRobin, dead, testBackend(t, "live", 0).URL)
+
+	// No health check runs, the failed request alone takes it down
+	send(t, lb.Handler(), 2)
+	for _, b := range pool.Backends() {
+		if want := b.URL.String() != dead; b.IsAlive() != want {
+			t.Errorf("%s alive = %v, want %v", b.URL, b.IsAlive(), want)
+		}
+	}
+}
+
+func TestPassiveHealthThreshold(t *testing.T) {
+	lb, pool := installPool(t, RoundRobin, "http://10.0.0.1")
+	cfg := *lb.config()
+	cfg.HealthCheck.Passive = PassiveHealthConfig{Failures: 3, Window: Duration(time.Minute)}
+	lb.setConfig(&cfg)
+
+	b := pool.Backends()[0]
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if down := b.passiveFailure(now); down != (i == 3) {
+			t.Errorf("failure %d took the backend down = %v", i, down)
+		}
+	}
+	b.SetAlive(true)
+	// Failures spread wider than the window never add up
+	for i := 0; i < 5; i++ {
+		if b.passiveFailure(now.Add(time.Duration(i) * 2 * time.Minute)) {
+			t.Fatalf("failure %d outside the window took the backend down", i)
+		}
+	}
+}
+
+// admin sends a JSON admin request to lb and returns the recorded response
+func admin(t *testing.T, lb *Balancer, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:40000"
+	rec := httptest.NewRecorder()
+	// Without an admin token only the admin listener serves the endpoints
+	lb.adminHandler(true).ServeHTTP(rec, req)
+	return rec
+}
+
+// TestPoolConcurrentMutations is meant for go test -race: members come and
+// go while every selection path and the stats read them
+func TestPoolConcurrentMutations(t *testing.T) {
+	pool, err := NewPool("race", "http://10.0.0.1", "http://10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				pool.GetNextPeer()
+				pool.LeastConnPeerAvoiding(nil)
+				pool.GetLeastLatencyPeer()
+				pool.HashPeerAvoiding(fmt.Sprint(i), nil)
+				pool.GetBackends()
+				for _, b := range pool.Backends() {
+					b.UpdateLatency(int64(i))
+					b.SetAlive(!b.IsAlive())
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < 200; i++ {
+		b, err := newBackend(fmt.Sprintf("http://10.1.0.%d", i%250), pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.AddBackend(b)
+		if i%2 == 1 {
+			pool.RemoveBackend(b)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := len(pool.Backends()); got != 102 {
+		t.Errorf("pool has %d members, want 102", got)
+	}
+}
+
+func TestEmptyPool(t *testing.T) {
+	lb, pool := installPool(t, RoundRobin)
+
+	if i := pool.NextIndex(); i != -1 {
+		t.Errorf("NextIndex on an empty pool = %d, want -1", i)
+	}
+	for _, strategy := range strategies {
+		if b := selectPeer(&RouteConfig{Strategy: strategy}, pool, "key", nil); b != nil {
+			t.Errorf("%s picked %s from an empty pool", strategy, b.URL)
+		}
+	}
+	rec := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/work", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request to an empty pool got %d, want 503", rec.Code)
+	}
+}
+
+// TestPoolDrainedWhileSelecting empties and refills the pool under
+// concurrent round-robin selection, which must never index past the end
+func TestPoolDrainedWhileSelecting(t *testing.T) {
+	pool, err := NewPool("drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				pool.GetNextPeer()
+				pool.NextIndex()
+			}
+		}()
+	}
+
+	for round := 0; round < 50; round++ {
+		var added []*Backend
+		for i := 0; i < 3; i++ {
+			b, err := newBackend(fmt.Sprintf("http://10.2.0.%d", i+1), pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.AddBackend(b)
+			added = append(added, b)
+		}
+		for _, b := range added {
+			pool.RemoveBackend(b)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestServeShutsDownGracefully checks a request in flight when the
+// balancer is told to stop still gets its answer
+func TestServeShutsDownGracefully(t *testing.T) {
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, []serving{{server, ln}}) }()
+
+	answered := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			answered <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		answered <- string(body)
+	}()
+	<-started
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve = %v after shutdown, want nil", err)
+	}
+	if body := <-answered; body != "done" {
+		t.Errorf("request in flight got %q, want its answer", body)
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("listener still open after shutdown")
+	}
+}
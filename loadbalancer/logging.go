@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig selects the level and output format of the balancer's logs
+type LogConfig struct {
+	// Level is debug, info, warn or error; per-request lines are debug
+	Level string `json:"level"`
+	// Format is text or json
+	Format string `json:"format"`
+	// Sampling thins out the lines written for every request or probe
+	Sampling SamplingConfig `json:"sampling"`
+}
+
+// SamplingConfig keeps the first lines with the same message in each tick
+// and every Thereafter-th line after that; Thereafter 1 keeps them all
+type SamplingConfig struct {
+	First      int      `json:"first"`
+	Thereafter int      `json:"thereafter"`
+	Tick       Duration `json:"tick"`
+}
+
+// sampledMessages are the lines written per request, connection or probe
+var sampledMessages = map[string]bool{
+	"Forwarded":             true,
+	"Health check passed":   true,
+	"TCP connection closed": true,
+	"SNI connection closed": true,
+	"Dry run match":         true,
+}
+
+// logLevels maps config values onto slog levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// validate fills in defaults and checks level and format
+func (c *LogConfig) validate() error {
+	c.Level = strings.ToLower(c.Level)
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	if _, ok := logLevels[c.Level]; !ok {
+		return fmt.Errorf("log: unknown level %q", c.Level)
+	}
+	switch c.Format {
+	case "":
+		c.Format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("log: unknown format %q", c.Format)
+	}
+	if c.Sampling.First < 0 || c.Sampling.Thereafter < 0 || c.Sampling.Tick < 0 {
+		return fmt.Errorf("log: sampling settings must not be negative")
+	}
+	if c.Sampling.First == 0 {
+		c.Sampling.First = 100
+	}
+	if c.Sampling.Thereafter == 0 {
+		c.Sampling.Thereafter = 100
+	}
+	if c.Sampling.Tick == 0 {
+		c.Sampling.Tick = Duration(time.Second)
+	}
+	return nil
+}
+
+// setupLogging installs the configured logger as the default, the log
+// package included
+func setupLogging(c LogConfig) {
+	opts := &slog.HandlerOptions{Level: logLevels[c.Level]}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if c.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	if c.Sampling.Thereafter > 1 {
+		handler = &samplingHandler{Handler: handler, sampler: &logSampler{cfg: c.Sampling, counts: map[string]*sampleCount{}}}
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// sampleCount tracks one message within the current tick
+type sampleCount struct {
+	start   time.Time
+	seen    int
+	dropped int
+}
+
+// logSampler decides which high-volume lines are written, shared by every
+// handler derived from the same samplingHandler
+type logSampler struct {
+	cfg    SamplingConfig
+	mu     sync.Mutex
+	counts map[string]*sampleCount
+}
+
+// keep reports whether a line with msg is written, along with how many
+// were dropped in the tick that just ended
+func (s *logSampler) keep(msg string, now time.Time) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counts[msg]
+	dropped := 0
+	if c == nil || now.Sub(c.start) >= time.Duration(s.cfg.Tick) {
+		if c != nil {
+			dropped = c.dropped
+		}
+		c = &sampleCount{start: now}
+		s.counts[msg] = c
+	}
+	c.seen++
+	if c.seen <= s.cfg.First || (c.seen-s.cfg.First)%s.cfg.Thereafter == 0 {
+		return true, dropped
+	}
+	c.dropped++
+	return false, dropped
+}
+
+// samplingHandler drops most of the sampled messages once a tick has had
+// its share, reporting how many went missing when the next tick starts
+type samplingHandler struct {
+	slog.Handler
+	sampler *logSampler
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !sampledMessages[r.Message] {
+		return h.Handler.Handle(ctx, r)
+	}
+	keep, dropped := h.sampler.keep(r.Message, r.Time)
+	if dropped > 0 {
+		summary := slog.NewRecord(r.Time, r.Level, "Log lines dropped by sampling", r.PC)
+		summary.AddAttrs(slog.String("message", r.Message), slog.Int("dropped", dropped))
+		h.Handler.Handle(ctx, summary)
+	}
+	if !keep {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
+
+// fatal logs err and exits, for failures during startup
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
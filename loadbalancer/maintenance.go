@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// MaintenanceConfig sets which routes start out in maintenance; the admin
+// API switches them at runtime. Requests in maintenance get a 503 without
+// reaching a backend.
+type MaintenanceConfig struct {
+	// Enabled puts the whole balancer into maintenance
+	Enabled bool `json:"enabled,omitempty"`
+	// Routes are route names (or host and path prefix for unnamed routes)
+	Routes []string `json:"routes,omitempty"`
+	// Page is the 503 shown, the "503" error page when unset
+	Page *ErrorPage `json:"page,omitempty"`
+}
+
+// validate parses the page and checks the routes exist
+func (m *MaintenanceConfig) validate(routes []RouteConfig) error {
+	if m.Page != nil {
+		if err := m.Page.validate("maintenance"); err != nil {
+			return err
+		}
+	}
+	known := map[string]bool{}
+	for i := range routes {
+		known[routeKey(&routes[i])] = true
+	}
+	for _, name := range m.Routes {
+		if !known[name] {
+			return fmt.Errorf("maintenance: unknown route %q", name)
+		}
+	}
+	return nil
+}
+
+// maintenanceState is what is in maintenance right now
+type maintenanceState struct {
+	mu     sync.RWMutex
+	all    bool
+	routes map[string]bool
+}
+
+var maintenance = &maintenanceState{routes: map[string]bool{}}
+
+// Reset replaces the state with the configured one
+func (m *maintenanceState) Reset(cfg MaintenanceConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.all = cfg.Enabled
+	m.routes = map[string]bool{}
+	for _, name := range cfg.Routes {
+		m.routes[name] = true
+	}
+}
+
+// Active reports whether requests for route are held back
+func (m *maintenanceState) Active(route *RouteConfig) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.all || (route != nil && m.routes[routeKey(route)])
+}
+
+// Set switches maintenance for one route, or for everything when route
+// is ""
+func (m *maintenanceState) Set(route string, enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if route == "" {
+		m.all = enabled
+		return
+	}
+	if enabled {
+		m.routes[route] = true
+	} else {
+		delete(m.routes, route)
+	}
+}
+
+// Status lists what is in maintenance
+func (m *maintenanceState) Status() map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	routes := make([]string, 0, len(m.routes))
+	for name := range m.routes {
+		routes = append(routes, name)
+	}
+	sort.Strings(routes)
+	return map[string]interface{}{
+		"enabled": m.all,
+		"routes":  routes,
+	}
+}
+
+// serveMaintenance writes the maintenance page
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	page := requestConfig(r).Maintenance.Page
+	if page == nil {
+		page = requestConfig(r).ErrorPages["503"]
+	}
+	writePage(w, r, page, http.StatusServiceUnavailable, "Down for maintenance")
+}
+
+// maintenanceHandler shows or switches maintenance mode
+// POST {"route": "api", "enabled": true}, an empty route means every route
+func (lb *Balancer) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Route   string `json:"route"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Route != "" && lb.config().findRoute(req.Route) == nil {
+			http.Error(w, fmt.Sprintf("Unknown route %q", req.Route), http.StatusNotFound)
+			return
+		}
+		maintenance.Set(req.Route, req.Enabled)
+		slog.Info("Admin switched maintenance", "route", req.Route, "enabled", req.Enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.Status())
+}
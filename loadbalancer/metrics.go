@@ -0,0 +1,231 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// promLabels renders labels in Prometheus exposition syntax
+func promLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = promName(k) + `="` + promEscaper.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promName replaces characters that are not valid in Prometheus names
+func promName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// writeMetric writes a HELP/TYPE header followed by its samples
+func writeMetric(w io.Writer, name, typ, help string, samples []promSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, promLabels(s.labels), s.value)
+	}
+}
+
+type promSample struct {
+	labels Labels
+	value  interface{}
+}
+
+// metricsHandler exposes backend and per-label traffic in Prometheus format
+func (lb *Balancer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var up, requests, latency, weight, responses []promSample
+	for _, b := range lb.allBackends() {
+		labels := Labels{"pool": b.Pool, "backend": b.URL, "backend_id": b.ID}
+		counts := b.Responses
+		classes := make([]string, 0, len(counts))
+		for class := range counts {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			responses = append(responses, promSample{
+				Labels{"pool": labels["pool"], "backend": labels["backend"], "backend_id": labels["backend_id"], "class": class},
+				counts[class],
+			})
+		}
+		alive := 0
+		if b.Alive {
+			alive = 1
+		}
+		up = append(up, promSample{labels, alive})
+		requests = append(requests, promSample{labels, b.RequestCount})
+		latency = append(latency, promSample{labels, b.AvgLatency})
+		weight = append(weight, promSample{labels, b.Weight})
+	}
+	writeMetric(w, "lb_backend_up", "gauge", "Whether the backend passed its last health check.", up)
+	writeMetric(w, "lb_backend_requests_total", "counter", "Requests forwarded to the backend.", requests)
+	writeMetric(w, "lb_backend_avg_latency_ms", "gauge", "Average backend latency in milliseconds.", latency)
+	writeMetric(w, "lb_backend_weight", "gauge", "Smoothed weight hint reported by the backend.", weight)
+	writeMetric(w, "lb_backend_responses_total", "counter", "Responses received from the backend, by status class.", responses)
+
+	var backendBytes []promSample
+	for _, b := range lb.allBackends() {
+		backendBytes = append(backendBytes,
+			promSample{Labels{"pool": b.Pool, "backend": b.URL, "backend_id": b.ID, "direction": "sent"}, b.BytesSent},
+			promSample{Labels{"pool": b.Pool, "backend": b.URL, "backend_id": b.ID, "direction": "received"}, b.BytesReceived})
+	}
+	writeMetric(w, "lb_backend_bytes_total", "counter", "Body bytes sent to and received from the backend.", backendBytes)
+
+	var routeRequests, routeFailures, routeResponses, routeLatency, routeP95 []promSample
+	for _, s := range routeBackends.Snapshot() {
+		labels := Labels{"route": s["route"].(string), "pool": s["pool"].(string), "backend": s["backend"].(string), "backend_id": s["backend_id"].(string)}
+		routeRequests = append(routeRequests, promSample{labels, s["requests"]})
+		routeFailures = append(routeFailures, promSample{labels, s["failures"]})
+		routeLatency = append(routeLatency, promSample{labels, s["latency_ms_total"]})
+		routeP95 = append(routeP95, promSample{labels, s["p95_ms"]})
+		counts := s["responses"].(map[string]int64)
+		for _, class := range []string{"2xx", "3xx", "4xx", "5xx"} {
+			withClass := Labels{"class": class}
+			for k, v := range labels {
+				withClass[k] = v
+			}
+			routeResponses = append(routeResponses, promSample{withClass, counts[class]})
+		}
+	}
+	writeMetric(w, "lb_route_backend_requests_total", "counter", "Attempts on the backend for requests on the route.", routeRequests)
+	writeMetric(w, "lb_route_backend_failures_total", "counter", "Attempts on the backend for the route that got no response.", routeFailures)
+	writeMetric(w, "lb_route_backend_responses_total", "counter", "Responses from the backend for the route, by status class.", routeResponses)
+	writeMetric(w, "lb_route_backend_latency_ms_total", "counter", "Total time to first byte from the backend for the route, in milliseconds.", routeLatency)
+	writeMetric(w, "lb_route_backend_p95_latency_ms", "gauge", "Recent 95th percentile time to first byte from the backend for the route.", routeP95)
+
+	var poolRPS, poolErrors []promSample
+	for _, name := range lb.poolNames() {
+		summary := lb.pools()[name].Summary()
+		poolRPS = append(poolRPS, promSample{Labels{"pool": name}, summary.RPS})
+		poolErrors = append(poolErrors, promSample{Labels{"pool": name}, summary.ErrorRate})
+	}
+	writeMetric(w, "lb_pool_rps", "gauge", "Responses per second from the pool over the last minute.", poolRPS)
+	writeMetric(w, "lb_pool_error_rate", "gauge", "Share of the pool's attempts over the last minute that failed or got a 5xx.", poolErrors)
+
+	var reqs, errs, bytes, lat []promSample
+	for _, set := range trafficByLabels.Snapshot() {
+		labels := set["labels"].(Labels)
+		reqs = append(reqs, promSample{labels, set["requests"]})
+		errs = append(errs, promSample{labels, set["errors"]})
+		bytes = append(bytes, promSample{labels, set["bytes_out"]})
+		lat = append(lat, promSample{labels, set["latency_ms"]})
+	}
+	writeMetric(w, "lb_requests_total", "counter", "Requests handled, by traffic labels.", reqs)
+	writeMetric(w, "lb_request_errors_total", "counter", "Requests answered with a 5xx, by traffic labels.", errs)
+	writeMetric(w, "lb_response_bytes_total", "counter", "Response body bytes sent, by traffic labels.", bytes)
+	writeMetric(w, "lb_request_latency_ms_total", "counter", "Total request time in milliseconds, by traffic labels.", lat)
+
+	var routeBytes []promSample
+	for _, route := range routeTraffic.Snapshot() {
+		name := route["route"].(string)
+		routeBytes = append(routeBytes,
+			promSample{Labels{"route": name, "direction": "in"}, route["bytes_in"]},
+			promSample{Labels{"route": name, "direction": "out"}, route["bytes_out"]})
+	}
+	writeMetric(w, "lb_route_bytes_total", "counter", "Body bytes received from and sent to the route's clients.", routeBytes)
+
+	var connsOpen, connsAccepted []promSample
+	for _, l := range connections.Snapshot() {
+		labels := Labels{"listener": l["listener"].(string)}
+		connsOpen = append(connsOpen, promSample{labels, l["open"]})
+		connsAccepted = append(connsAccepted, promSample{labels, l["accepted"]})
+	}
+	writeMetric(w, "lb_client_connections", "gauge", "Client connections open on the listener.", connsOpen)
+	writeMetric(w, "lb_client_connections_total", "counter", "Client connections accepted by the listener.", connsAccepted)
+
+	var dry []promSample
+	for _, m := range dryRuns.Snapshot() {
+		dry = append(dry, promSample{Labels{"rule": m["rule"].(string), "action": m["action"].(string)}, m["matches"]})
+	}
+	writeMetric(w, "lb_dry_run_matches_total", "counter", "Requests a dry-run rule would have acted on.", dry)
+
+	writeMetric(w, "lb_client_concurrency_clients", "gauge", "Clients with requests in flight.",
+		[]promSample{{nil, clientsInFlight.clients()}})
+	writeMetric(w, "lb_client_concurrency_rejected_total", "counter", "Requests rejected because the client had too many in flight.",
+		[]promSample{{nil, clientsInFlight.rejected.Load()}})
+
+	var tcpConns, tcpBytes []promSample
+	for _, p := range tcpStats() {
+		name := p["name"].(string)
+		tcpConns = append(tcpConns, promSample{Labels{"proxy": name}, p["connections"]})
+		tcpBytes = append(tcpBytes,
+			promSample{Labels{"proxy": name, "direction": "in"}, p["bytes_in"]},
+			promSample{Labels{"proxy": name, "direction": "out"}, p["bytes_out"]})
+	}
+	writeMetric(w, "lb_tcp_connections_total", "counter", "Connections accepted by the TCP proxy.", tcpConns)
+	writeMetric(w, "lb_tcp_bytes_total", "counter", "Bytes relayed by the TCP proxy, in from clients and out to them.", tcpBytes)
+
+	var udpPkts, udpBytes []promSample
+	for _, p := range udpStats() {
+		name := p["name"].(string)
+		udpPkts = append(udpPkts,
+			promSample{Labels{"proxy": name, "direction": "in"}, p["packets_in"]},
+			promSample{Labels{"proxy": name, "direction": "out"}, p["packets_out"]})
+		udpBytes = append(udpBytes,
+			promSample{Labels{"proxy": name, "direction": "in"}, p["bytes_in"]},
+			promSample{Labels{"proxy": name, "direction": "out"}, p["bytes_out"]})
+	}
+	writeMetric(w, "lb_udp_packets_total", "counter", "Datagrams forwarded by the UDP proxy, in from clients and out to them.", udpPkts)
+	writeMetric(w, "lb_udp_bytes_total", "counter", "Bytes forwarded by the UDP proxy, in from clients and out to them.", udpBytes)
+
+	var mirrored []promSample
+	for _, m := range mirrorSnapshot() {
+		route := m["route"].(string)
+		for _, result := range []string{"mirrored", "failed", "dropped", "skipped"} {
+			mirrored = append(mirrored, promSample{Labels{"route": route, "result": result}, m[result]})
+		}
+	}
+	writeMetric(w, "lb_mirror_requests_total", "counter", "Requests sampled for mirroring, by outcome.", mirrored)
+
+	var injected []promSample
+	for _, f := range faults.Snapshot() {
+		route := f["route"].(string)
+		for _, fault := range []string{"delayed", "aborted", "reset"} {
+			injected = append(injected, promSample{Labels{"route": route, "fault": fault}, f[fault]})
+		}
+	}
+	writeMetric(w, "lb_faults_injected_total", "counter", "Requests a test fault was injected into, by fault.", injected)
+
+	var synUp, synLat, synFail []promSample
+	for _, check := range synthetics.Snapshot() {
+		labels := Labels{"check": check["name"].(string), "path": check["path"].(string)}
+		if ok, ran := check["ok"].(bool); ran {
+			value := 0
+			if ok {
+				value = 1
+			}
+			synUp = append(synUp, promSample{labels, value})
+			synLat = append(synLat, promSample{labels, check["latency_ms"]})
+		}
+		synFail = append(synFail, promSample{labels, check["failures"]})
+	}
+	writeMetric(w, "lb_synthetic_up", "gauge", "Whether the last synthetic check run succeeded.", synUp)
+	writeMetric(w, "lb_synthetic_latency_ms", "gauge", "End-to-end latency of the last synthetic check run.", synLat)
+	writeMetric(w, "lb_synthetic_failures_total", "counter", "Failed synthetic check runs.", synFail)
+
+	if lb.config().Debug.Runtime {
+		writeRuntimeMetrics(w)
+	}
+}
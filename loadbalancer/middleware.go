@@ -0,0 +1,386 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// exchange is one request on its way through the middleware chain.
+// Stages may replace the writer and request, or change the pool.
+type exchange struct {
+	lb       *Balancer
+	w        http.ResponseWriter
+	r        *http.Request
+	route    *RouteConfig
+	pool     *ServerPool
+	timeouts TimeoutConfig
+	labels   Labels
+	start    time.Time
+	// servedBy names what answered the request for the access log
+	servedBy string
+
+	// transform has the proxy filter response bodies
+	transform bool
+	// stale is a cached response kept in case no backend can answer
+	stale *cacheEntry
+	// peer is the backend that answered, nil if none did
+	peer *Backend
+	// user is who the route's auth accepted. Their credentials are gone
+	// from the request by then, so it must not be answered from or stored
+	// in the shared cache.
+	user string
+}
+
+// middleware is one stage of request handling; it calls next to hand the
+// exchange on, or answers the request itself
+type middleware func(x *exchange, next func())
+
+// stage is a middleware the chain can be built from
+type stage struct {
+	run middleware
+	// needsPool stages are only reached once the request has a pool;
+	// without one the chain answers 404 there
+	needsPool bool
+}
+
+// stages are the middleware that can be named in a chain. The proxy
+// always ends the chain and is not listed.
+var stages = map[string]stage{
+	"log":              {run: logRequests},
+	"security_headers": {run: addSecurityHeaders},
+	"maintenance":      {run: holdForMaintenance},
+	"ip_filter":        {run: filterClients},
+	"client_limit":     {run: limitClients},
+	"cors":             {run: applyCORS},
+	"jwt":              {run: checkJWT},
+	"auth":             {run: checkAuth},
+	"tenancy":          {run: pickTenantPool},
+	"script":           {run: runRouteScript},
+	"faults":           {run: injectFaults, needsPool: true},
+	"transform":        {run: transformBodies, needsPool: true},
+	"mirror":           {run: mirrorRequest, needsPool: true},
+	"compress":         {run: compressResponse, needsPool: true},
+	"har":              {run: recordHAR, needsPool: true},
+	"cache":            {run: serveFromCache, needsPool: true},
+}
+
+// defaultMiddleware is the chain used when neither the route nor the
+// config names one
+var defaultMiddleware = []string{
+	"log", "security_headers", "maintenance", "ip_filter", "client_limit", "cors", "jwt",
+	"auth", "tenancy", "script", "faults", "transform", "mirror", "compress", "har", "cache",
+}
+
+// validateMiddleware checks that a chain names known stages at most once
+func validateMiddleware(names []string) error {
+	for i, name := range names {
+		if _, ok := stages[name]; !ok {
+			return fmt.Errorf("middleware: unknown stage %q", name)
+		}
+		if slices.Contains(names[:i], name) {
+			return fmt.Errorf("middleware: stage %q listed twice", name)
+		}
+	}
+	return nil
+}
+
+// accessStages are the stages enforcing access rules, and serveStages
+// the ones that answer, forward, pick the pool for or rewrite a request
+// without the proxy; a chain must run the first before any of the second
+var (
+	accessStages = []string{"ip_filter", "jwt", "auth"}
+	serveStages  = []string{"tenancy", "script", "faults", "transform", "mirror", "cache"}
+)
+
+// validateChain checks the chain of route, nil for requests no route
+// matches, keeps the access checks configured for it ahead of the stages
+// that can answer without them, so custom chains cannot skip auth
+func (c *Config) validateChain(route *RouteConfig) error {
+	chain := c.MiddlewareFor(route)
+	for _, name := range accessStages {
+		var configured bool
+		switch name {
+		case "ip_filter":
+			configured = c.IPFilter != nil || (route != nil && route.IPFilter != nil)
+		case "jwt":
+			configured = route != nil && route.JWT != nil
+		case "auth":
+			configured = route != nil && route.Auth != nil
+		}
+		if !configured {
+			continue
+		}
+		at := slices.Index(chain, name)
+		if at < 0 {
+			return fmt.Errorf("middleware: %s is configured but the chain leaves out its stage", name)
+		}
+		for _, serve := range serveStages {
+			if i := slices.Index(chain, serve); i >= 0 && i < at {
+				return fmt.Errorf("middleware: stage %q must come after %q", serve, name)
+			}
+		}
+	}
+	return nil
+}
+
+// MiddlewareFor returns the stages requests to route go through, in order
+func (c *Config) MiddlewareFor(route *RouteConfig) []string {
+	if route != nil && route.Middleware != nil {
+		return route.Middleware
+	}
+	if c.Middleware != nil {
+		return c.Middleware
+	}
+	return defaultMiddleware
+}
+
+// runChain hands x to the first of names, each stage passing it on to the
+// next until the proxy forwards it
+func runChain(x *exchange, names []string) {
+	if len(names) == 0 {
+		proxy(x)
+		return
+	}
+	s := stages[names[0]]
+	if s.needsPool && x.pool == nil {
+		http.Error(x.w, "Not found", http.StatusNotFound)
+		return
+	}
+	s.run(x, func() { runChain(x, names[1:]) })
+}
+
+// logRequests counts the request towards its labels and writes the access log
+func logRequests(x *exchange, next func()) {
+	rec := &statusRecorder{ResponseWriter: x.w}
+	x.w = rec
+	defer func() {
+		trafficByLabels.Observe(x.labels, rec.status, rec.bytes, time.Since(x.start).Milliseconds())
+		accessLog.Log(x.r, rec.status, rec.bytes, time.Since(x.start), x.servedBy, x.labels)
+	}()
+	next()
+}
+
+func addSecurityHeaders(x *exchange, next func()) {
+	x.w = withSecurityHeaders(x.w, x.r, x.lb.config().SecurityHeaders)
+	next()
+}
+
+// holdForMaintenance keeps planned work from reaching a backend
+func holdForMaintenance(x *exchange, next func()) {
+	if maintenance.Active(x.route) {
+		x.servedBy = "maintenance"
+		serveMaintenance(x.w, x.r)
+		return
+	}
+	next()
+}
+
+// filterClients rejects filtered clients before doing any work for them
+func filterClients(x *exchange, next func()) {
+	if !clientAllowed(x.r, x.route) {
+		http.Error(x.w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	next()
+}
+
+// applyCORS answers preflights, which carry no credentials
+func applyCORS(x *exchange, next func()) {
+	var proceed bool
+	if x.w, proceed = handleCORS(x.w, x.r, x.route); proceed {
+		next()
+	}
+}
+
+func checkJWT(x *exchange, next func()) {
+	var proceed bool
+	if x.r, proceed = jwtAllowed(x.w, x.r, x.route); proceed {
+		next()
+	}
+}
+
+func checkAuth(x *exchange, next func()) {
+	var proceed bool
+	if x.user, proceed = authAllowed(x.w, x.r, x.route); proceed {
+		next()
+	}
+}
+
+// pickTenantPool keeps tenants with a pool of their own apart from the
+// rest; it runs after the access checks, which tell who the tenant is
+func pickTenantPool(x *exchange, next func()) {
+	var proceed bool
+	if x.pool, proceed = tenantPool(x.r, x.route, x.pool, x.user); !proceed {
+		http.Error(x.w, "Unknown tenant", http.StatusForbidden)
+		return
+	}
+	next()
+}
+
+func runRouteScript(x *exchange, next func()) {
+	var proceed bool
+	if x.pool, proceed = runScript(x.w, x.r, x.route, x.pool); !proceed {
+		x.servedBy = "script"
+		return
+	}
+	next()
+}
+
+// injectFaults stands in for a misbehaving backend
+func injectFaults(x *exchange, next func()) {
+	if !faults.inject(x.w, x.r, x.route) {
+		x.servedBy = "fault"
+		return
+	}
+	next()
+}
+
+// transformBodies filters the request body here, before anything else
+// copies it; response bodies are filtered by the proxy
+func transformBodies(x *exchange, next func()) {
+	if !transformRequest(x.w, x.r, x.route) {
+		return
+	}
+	x.transform = true
+	next()
+}
+
+// mirrorRequest copies a share of the requests to the route's shadow backend
+func mirrorRequest(x *exchange, next func()) {
+	x.r = mirror(x.r, x.route)
+	next()
+}
+
+// compressResponse compresses the response if the client accepts it
+func compressResponse(x *exchange, next func()) {
+	if cw := newCompressWriter(x.w, x.r, &x.lb.config().Compression); cw != nil {
+		x.w = cw
+		defer cw.Close()
+	}
+	next()
+}
+
+// recordHAR records sampled traffic while a HAR window is open
+func recordHAR(x *exchange, next func()) {
+	if record, cfg := recorder.sampled(); record {
+		var capture *harCapture
+		capture, x.r = newHARCapture(x.w, x.r, cfg)
+		x.w = capture
+		defer func() { recorder.add(capture.entry(x.servedBy)) }()
+	}
+	next()
+}
+
+// serveFromCache answers from the cache when the route allows it and
+// stores what a backend answers otherwise
+func serveFromCache(x *exchange, next func()) {
+	policy := x.lb.config().CacheFor(x.route)
+	if !policy.enabled || x.user != "" || !cacheableRequest(x.r, policy) {
+		next()
+		return
+	}
+	r := x.r
+	if !wantsRevalidation(r) {
+		entry, state := cache.Get(r)
+		if state == cacheFresh || state == cacheStale {
+			cache.count(state)
+			if state == cacheStale {
+				refreshCache(r, x.pool, x.timeouts, policy)
+			}
+			x.servedBy = "cache"
+			serveCached(x.w, entry, state)
+			return
+		}
+		// Kept in reserve in case no backend can answer
+		if state == cacheError {
+			x.stale = entry
+		}
+	}
+	cache.count(cacheMiss)
+	cw := &cacheWriter{ResponseWriter: x.w, limit: x.lb.config().Cache.MaxEntryBytes}
+	x.w = cw
+	next()
+	if x.peer != nil {
+		cw.store(r, policy)
+	}
+}
+
+// forward proxies r to peer, which counts it as active until the proxy
+// returns or panics, as it does when copying the body fails
+func forward(peer *Backend, w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&peer.active, 1)
+	defer atomic.AddInt64(&peer.active, -1)
+	peer.ReverseProxy.ServeHTTP(&sentTracker{ResponseWriter: w}, r)
+}
+
+// proxy ends the chain, forwarding the request to a member of its pool
+func proxy(x *exchange) {
+	// Without a default pool only paths matching a route are served
+	if x.pool == nil {
+		http.Error(x.w, "Not found", http.StatusNotFound)
+		return
+	}
+	w, r, route, pool := x.w, x.r, x.route, x.pool
+
+	// Prefer backends in the client's zone meeting the route's latency
+	// SLO, fall back to any below its request rate cap
+	avoid := avoidEither(pool.zoneAvoider(requestZone(r)), latencySLOs.avoider(route))
+	peer := admitPeer(r.Context(), route, pool, hashKey(r, route), avoid)
+
+	if peer != nil {
+		// Response filters sit outside the cache so it stores their output
+		var tw *transformWriter
+		if x.transform {
+			if tw = newTransformWriter(w, r, route); tw != nil {
+				w = tw
+			}
+		}
+		// Keep small bodies so a failed attempt can be retried whole
+		if err := bufferBody(r); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+		// Backend latency is time to first byte, filled in by the proxy
+		timing := &upstreamTiming{}
+		r = r.WithContext(withUpstreamTiming(r.Context(), timing))
+		x.r = r
+		if delay := hedgeDelay(route, peer, r); delay > 0 {
+			timing = serveHedged(w, r, route, pool, peer, delay, avoid)
+		} else {
+			forward(peer, w, r)
+		}
+		if timing.backend != nil {
+			// A retry may have been answered by another member
+			peer = timing.backend
+			latencySLOs.Observe(route, peer, timing.ttfb.Milliseconds())
+		}
+		x.peer = peer
+		x.servedBy = peer.URL.Host
+		if tw != nil {
+			tw.Close()
+		}
+
+		slog.Debug("Forwarded", "method", r.Method, "path", r.URL.Path, "backend", peer.URL.String(), "backend_id", peer.ID,
+			"ttfb_ms", timing.ttfb.Milliseconds(), "total_ms", time.Since(x.start).Milliseconds(),
+			"avg_ms", peer.GetAvgLatency(), "labels", x.labels.String())
+		return
+	}
+
+	if x.stale != nil {
+		cache.count(cacheError)
+		x.servedBy = "cache"
+		serveCached(w, x.stale, cacheError)
+		return
+	}
+	// Last resort for critical paths
+	if snapshots.Serve(w, r) {
+		x.servedBy = "snapshot"
+		slog.Warn("Served from snapshot, pool is down", "method", r.Method, "path", r.URL.Path, "pool", pool.Name)
+		return
+	}
+	writeError(w, r, http.StatusServiceUnavailable, "Service not available")
+}
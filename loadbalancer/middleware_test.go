@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareChains(t *testing.T) {
+	auth := &AuthConfig{Users: map[string]string{"admin": "secret"}}
+	for _, tc := range []struct {
+		name  string
+		route RouteConfig
+		ok    bool
+	}{
+		{"default chain", RouteConfig{PathPrefix: "/", Auth: auth}, true},
+		{"auth first", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"auth", "cache"}}, true},
+		{"no checks configured", RouteConfig{PathPrefix: "/", Middleware: []string{"cache"}}, true},
+		{"auth left out", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"log", "cache"}}, false},
+		{"cache before auth", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"cache", "auth"}}, false},
+		{"script before auth", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"script", "auth"}}, false},
+		{"tenancy before auth", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"tenancy", "auth"}}, false},
+		{"faults before auth", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"faults", "auth"}}, false},
+		{"transform before auth", RouteConfig{PathPrefix: "/", Auth: auth, Middleware: []string{"transform", "auth"}}, false},
+		{"unknown stage", RouteConfig{PathPrefix: "/", Middleware: []string{"gzip"}}, false},
+		{"stage twice", RouteConfig{PathPrefix: "/", Middleware: []string{"log", "log"}}, false},
+	} {
+		_, err := loadConfigWith("", func(cfg *Config) { cfg.Routes = []RouteConfig{tc.route} })
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: %v, want accepted %v", tc.name, err, tc.ok)
+		}
+	}
+
+	// A global IP filter binds the global chain
+	_, err := loadConfigWith("", func(cfg *Config) {
+		cfg.IPFilter = &IPFilterConfig{Allow: []string{"10.0.0.0/8"}}
+		cfg.Middleware = []string{"mirror", "ip_filter"}
+	})
+	if err == nil {
+		t.Error("global chain running mirror before the IP filter accepted")
+	}
+}
+
+// TestInstallChecksConfig checks routes built in code go through the same
+// checks as a config file, on a copy of the running config
+func TestInstallChecksConfig(t *testing.T) {
+	lb, _ := installPool(t, RoundRobin, testBackend(t, "a", 0).URL)
+	cfg, err := lb.config().clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.IPFilter = &IPFilterConfig{Allow: []string{"10.0.0.0/8"}}
+	cfg.Middleware = []string{"cache", "ip_filter"}
+	lb.setConfig(cfg)
+
+	pool, err := NewPool("other", testBackend(t, "b", 0).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	r.PathPrefix("/").Pool(pool)
+	if err := lb.Install(r); err == nil {
+		t.Error("routes installed under a chain running cache before the IP filter")
+	}
+	if lb.config() != cfg {
+		t.Error("refused routes replaced the running config")
+	}
+
+	cfg.Middleware = nil
+	if err := lb.Install(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Pool != "test" {
+		t.Errorf("installing routes changed the previous config's routes to %+v", cfg.Routes)
+	}
+	if route := lb.config().MatchRoute("", "", "/", ""); route == nil || route.Pool != "other" || route.labels == nil {
+		t.Errorf("installed route = %+v, want one to other with its labels", route)
+	}
+}
+
+func TestActiveCountAfterAbortedBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		// Promise more than is sent, then drop the connection
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	t.Cleanup(backend.Close)
+	lb, pool := installPool(t, RoundRobin, backend.URL)
+
+	// Under a server the proxy panics with http.ErrAbortHandler
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+	if resp, err := http.Get(front.URL + "/work"); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&pool.Backends()[0].active) != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&pool.Backends()[0].active); n != 0 {
+		t.Errorf("%d requests still active after the proxy gave up", n)
+	}
+}
@@ -0,0 +1,177 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig copies a share of a route's requests to a shadow backend.
+// Shadow responses are discarded and never delay or change the real one.
+type MirrorConfig struct {
+	Target string `json:"target"`
+	// Percent of requests mirrored, 0 to 100
+	Percent float64 `json:"percent"`
+	// MaxBodyBytes is the largest request body buffered for mirroring,
+	// requests with bigger bodies are not mirrored
+	MaxBodyBytes int64    `json:"max_body_bytes,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+	// Concurrency bounds shadow requests in flight, more are dropped
+	Concurrency int `json:"concurrency,omitempty"`
+
+	target *url.URL
+	slots  chan struct{}
+}
+
+// validate fills in defaults and parses the target
+func (m *MirrorConfig) validate() error {
+	u, err := url.Parse(m.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("mirror: target must be an http(s) URL")
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror: percent must be above 0 and at most 100")
+	}
+	if m.MaxBodyBytes <= 0 {
+		m.MaxBodyBytes = 1 << 20
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = Duration(5 * time.Second)
+	}
+	if m.Concurrency <= 0 {
+		m.Concurrency = 100
+	}
+	m.target = u
+	m.slots = make(chan struct{}, m.Concurrency)
+	return nil
+}
+
+// mirrorCounters are the outcomes of one route's mirroring
+type mirrorCounters struct {
+	mirrored, failed, dropped, skipped atomic.Int64
+}
+
+var (
+	mirrorMu    sync.Mutex
+	mirrorStats = map[string]*mirrorCounters{}
+)
+
+// mirrorCountersFor returns the counters of route, creating them if needed
+func mirrorCountersFor(route string) *mirrorCounters {
+	mirrorMu.Lock()
+	defer mirrorMu.Unlock()
+	c := mirrorStats[route]
+	if c == nil {
+		c = &mirrorCounters{}
+		mirrorStats[route] = c
+	}
+	return c
+}
+
+var mirrorClient = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	// The shadow's redirects are its own business
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// mirror sends a copy of r to the route's shadow backend when it is
+// sampled. The body is buffered so both copies can read it, r is returned
+// with a body that replays it.
+func mirror(r *http.Request, route *RouteConfig) *http.Request {
+	if route == nil || route.Mirror == nil {
+		return r
+	}
+	m := route.Mirror
+	if rand.Float64()*100 >= m.Percent {
+		return r
+	}
+	counters := mirrorCountersFor(routeKey(route))
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		counters.dropped.Add(1)
+		return r
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.MaxBodyBytes+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || int64(len(body)) > m.MaxBodyBytes {
+			<-m.slots
+			counters.skipped.Add(1)
+			return r
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout))
+	shadow := r.Clone(ctx)
+	shadow.RequestURI = ""
+	shadow.URL.Scheme = m.target.Scheme
+	shadow.URL.Host = m.target.Host
+	shadow.URL.Path = singleJoiningSlash(m.target.Path, r.URL.Path)
+	shadow.URL.RawPath = ""
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	shadow.Header.Set("X-Mirrored", "true")
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		resp, err := mirrorClient.Do(shadow)
+		if err != nil {
+			counters.failed.Add(1)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		counters.mirrored.Add(1)
+	}()
+	return r
+}
+
+// singleJoiningSlash joins a target's base path and a request path
+func singleJoiningSlash(a, b string) string {
+	switch aslash, bslash := len(a) > 0 && a[len(a)-1] == '/', len(b) > 0 && b[0] == '/'; {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && a != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// mirrorSnapshot returns the mirroring counters of every route
+func mirrorSnapshot() []map[string]interface{} {
+	mirrorMu.Lock()
+	defer mirrorMu.Unlock()
+	routes := make([]string, 0, len(mirrorStats))
+	for route := range mirrorStats {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	out := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		c := mirrorStats[route]
+		out = append(out, map[string]interface{}{
+			"route":    route,
+			"mirrored": c.mirrored.Load(),
+			"failed":   c.failed.Load(),
+			"dropped":  c.dropped.Load(),
+			"skipped":  c.skipped.Load(),
+		})
+	}
+	return out
+}
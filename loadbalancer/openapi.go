@@ -0,0 +1,18 @@
+package loadbalancer
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the admin endpoints automation relies on; the
+// client package follows it
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIHandler serves the admin API's OpenAPI document
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
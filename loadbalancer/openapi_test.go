@@ -0,0 +1,263 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/imransultan57/Load-blancer/client"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	var spec openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL)
+	// Reloading also sets up logging again
+	oldCLI, oldLogger := cli, slog.Default()
+	t.Cleanup(func() { cli = oldCLI; slog.SetDefault(oldLogger) })
+	cli.configPath = filepath.Join(t.TempDir(), "lb.json")
+	os.WriteFile(cli.configPath, []byte(`{"pools": {"test": {"backends": ["`+a.URL+`"]}}}`), 0o644)
+
+	// Every documented operation is called with a valid request, in an
+	// order that makes each one succeed; its status must be documented
+	// and its body must match the schema
+	calls := []struct{ method, path, body string }{
+		{"GET", "/lb/healthz", ""},
+		{"POST", "/lb/backends", `{"pool": "test", "url": "` + b.URL + `", "id": "b"}`},
+		{"GET", "/lb/backends", ""},
+		{"POST", "/lb/drain", `{"pool": "test", "id": "b", "drain": true}`},
+		{"GET", "/lb/stats", ""},
+		{"DELETE", "/lb/backends", `{"pool": "test", "id": "b"}`},
+		{"POST", "/lb/algorithm", `{"name": "least-conn"}`},
+		{"GET", "/lb/algorithm", ""},
+		{"POST", "/lb/reload", ""},
+	}
+	called := map[string]bool{}
+	for _, c := range calls {
+		where := c.method + " " + c.path
+		op, ok := spec.Paths[c.path][strings.ToLower(c.method)]
+		if !ok {
+			t.Errorf("%s is not in the spec", where)
+			continue
+		}
+		called[where] = true
+		if c.body != "" {
+			var body interface{}
+			json.Unmarshal([]byte(c.body), &body)
+			spec.check(t, where+" request", op.RequestBody.Content["application/json"].Schema, body)
+		}
+		rec := admin(t, lb, c.method, c.path, c.body)
+		resp, ok := op.Responses[strconv.Itoa(rec.Code)]
+		if !ok {
+			t.Errorf("%s: undocumented status %d, %q", where, rec.Code, rec.Body.String())
+			continue
+		}
+		if media, ok := resp.Content["application/json"]; ok {
+			var body interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("%s: %v", where, err)
+				continue
+			}
+			spec.check(t, where, media.Schema, body)
+		}
+	}
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			if where := strings.ToUpper(method) + " " + path; !called[where] {
+				t.Errorf("%s is documented but not checked against the handler", where)
+			}
+		}
+	}
+
+	// The client decodes exactly the documented properties
+	types := map[string]interface{}{
+		"BackendStats": client.Backend{},
+		"PoolStats":    client.Pool{},
+		"Stats":        client.Stats{},
+		"BackendRef":   client.BackendRef{},
+		"Algorithm":    client.Algorithm{},
+		"DrainResult":  client.DrainResult{},
+		"ReloadResult": client.ReloadResult{},
+	}
+	for name, v := range types {
+		var fields []string
+		typ := reflect.TypeOf(v)
+		for i := range typ.NumField() {
+			tag, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			if tag != "-" {
+				fields = append(fields, tag)
+			}
+		}
+		var props []string
+		for prop := range spec.Components.Schemas[name].Properties {
+			props = append(props, prop)
+		}
+		slices.Sort(fields)
+		slices.Sort(props)
+		if !slices.Equal(fields, props) {
+			t.Errorf("client.%s has fields %v, schema %s has %v", typ.Name(), fields, name, props)
+		}
+	}
+}
+
+// openAPIDoc is the part of openapi.json TestOpenAPISpec checks
+type openAPIDoc struct {
+	Paths map[string]map[string]struct {
+		RequestBody struct {
+			Content map[string]struct{ Schema *openAPISchema }
+		} `json:"requestBody"`
+		Responses map[string]struct {
+			Content map[string]struct{ Schema *openAPISchema }
+		}
+	}
+	Components struct {
+		Schemas map[string]*openAPISchema
+	}
+}
+
+// openAPISchema is the subset of JSON Schema the spec uses
+type openAPISchema struct {
+	Ref                  string `json:"$ref"`
+	Type                 string
+	Enum                 []string
+	Required             []string
+	Properties           map[string]*openAPISchema
+	Items                *openAPISchema
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+}
+
+// check reports where v does not match schema
+func (d *openAPIDoc) check(t *testing.T, where string, schema *openAPISchema, v interface{}) {
+	t.Helper()
+	if schema == nil {
+		t.Errorf("%s: no schema", where)
+		return
+	}
+	if schema.Ref != "" {
+		d.check(t, where, d.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")], v)
+		return
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: %v is not an object", where, v)
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				t.Errorf("%s: required %q is missing", where, name)
+			}
+		}
+		var additional *openAPISchema
+		if len(schema.AdditionalProperties) > 0 && string(schema.AdditionalProperties) != "true" {
+			json.Unmarshal(schema.AdditionalProperties, &additional)
+		}
+		for name, value := range obj {
+			switch prop, ok := schema.Properties[name]; {
+			case ok:
+				d.check(t, where+"."+name, prop, value)
+			case additional != nil:
+				d.check(t, where+"."+name, additional, value)
+			case string(schema.AdditionalProperties) != "true":
+				t.Errorf("%s: %q is not documented", where, name)
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			t.Errorf("%s: %v is not an array", where, v)
+			return
+		}
+		for i, item := range list {
+			d.check(t, fmt.Sprintf("%s[%d]", where, i), schema.Items, item)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok || (schema.Enum != nil && !slices.Contains(schema.Enum, s)) {
+			t.Errorf("%s: %v is not a string of %v", where, v, schema.Enum)
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != float64(int64(n)) {
+			t.Errorf("%s: %v is not an integer", where, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			t.Errorf("%s: %v is not a number", where, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			t.Errorf("%s: %v is not a boolean", where, v)
+		}
+	}
+}
+
+func TestAdminClient(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL)
+	// Reloading also sets up logging again
+	oldCLI, oldLogger := cli, slog.Default()
+	t.Cleanup(func() { cli = oldCLI; slog.SetDefault(oldLogger) })
+	srv := httptest.NewServer(lb.adminHandler(true))
+	t.Cleanup(srv.Close)
+	c, err := client.New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	backends, err := c.AddBackend(ctx, client.BackendRef{Pool: "test", URL: b.URL, ID: "b"})
+	if err != nil || len(backends) != 2 {
+		t.Fatalf("add backend: %v, %v", backends, err)
+	}
+	if _, err := c.AddBackend(ctx, client.BackendRef{Pool: "test", URL: b.URL}); !isStatus(err, http.StatusConflict) {
+		t.Errorf("adding a backend twice: %v, want 409", err)
+	}
+	drained, err := c.Drain(ctx, client.BackendRef{Pool: "test", ID: "b"}, true)
+	if err != nil || drained.Status != "drained" {
+		t.Errorf("drain: %+v, %v", drained, err)
+	}
+	algorithm, err := c.SetAlgorithm(ctx, client.LeastConn)
+	if err != nil || algorithm.Algorithm != client.LeastConn || len(algorithm.Available) == 0 {
+		t.Errorf("set algorithm: %+v, %v", algorithm, err)
+	}
+	stats, err := c.Stats(ctx, client.StatsQuery{Pool: "test", Unhealthy: true})
+	if err != nil || stats.Algorithm != client.LeastConn || len(stats.Backends) != 1 || stats.Backends[0].ID != "b" || stats.Raw["traffic"] == nil {
+		t.Errorf("stats of unhealthy backends: %+v, %v", stats, err)
+	}
+	if backends, err = c.RemoveBackend(ctx, client.BackendRef{Pool: "test", ID: "b"}); err != nil || len(backends) != 1 {
+		t.Errorf("remove backend: %v, %v", backends, err)
+	}
+
+	cli.configPath = ""
+	if _, err := c.Reload(ctx); !isStatus(err, http.StatusConflict) {
+		t.Errorf("reload without a config file: %v, want 409", err)
+	}
+	path := filepath.Join(t.TempDir(), "lb.json")
+	os.WriteFile(path, []byte(`{"pools": {"reloaded": {"backends": ["`+a.URL+`"]}}}`), 0o644)
+	cli.configPath = path
+	reloaded, err := c.Reload(ctx)
+	if err != nil || !slices.Contains(reloaded.Pools, "reloaded") {
+		t.Errorf("reload: %+v, %v", reloaded, err)
+	}
+}
+
+// isStatus reports whether err is an admin API error with status
+func isStatus(err error, status int) bool {
+	var apiErr *client.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
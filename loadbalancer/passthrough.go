@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PassthroughConfig accepts TLS connections on Address and forwards them
+// to a pool chosen by the SNI hostname, without terminating TLS, for
+// services that must do their own termination
+type PassthroughConfig struct {
+	Address string     `json:"address"`
+	Routes  []SNIRoute `json:"routes"`
+	// DefaultPool takes connections no route matches, including those
+	// without SNI; they are closed when it is empty
+	DefaultPool   string              `json:"default_pool,omitempty"`
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+}
+
+// SNIRoute sends connections for Host, "*.example.com" allowed, to Pool
+type SNIRoute struct {
+	Host string `json:"host"`
+	Pool string `json:"pool"`
+}
+
+// clientHelloTimeout bounds how long a client may take to send its hello
+const clientHelloTimeout = 5 * time.Second
+
+// validate checks the address and that the pools exist
+func (p *PassthroughConfig) validate(pools map[string]*PoolConfig) error {
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		return fmt.Errorf("passthrough: %w", err)
+	}
+	if len(p.Routes) == 0 && p.DefaultPool == "" {
+		return fmt.Errorf("passthrough %s: no routes configured", p.Address)
+	}
+	for _, route := range p.Routes {
+		if route.Host == "" {
+			return fmt.Errorf("passthrough %s: route without host", p.Address)
+		}
+		if _, ok := pools[route.Pool]; !ok {
+			return fmt.Errorf("passthrough %s: unknown pool %q", p.Address, route.Pool)
+		}
+	}
+	if _, ok := pools[p.DefaultPool]; p.DefaultPool != "" && !ok {
+		return fmt.Errorf("passthrough %s: unknown pool %q", p.Address, p.DefaultPool)
+	}
+	return p.ProxyProtocol.validate()
+}
+
+// poolFor returns the pool for an SNI hostname, exact names winning over
+// wildcards
+func (p *PassthroughConfig) poolFor(serverName string) string {
+	for _, route := range p.Routes {
+		if strings.EqualFold(route.Host, serverName) {
+			return route.Pool
+		}
+	}
+	for _, route := range p.Routes {
+		if serverName != "" && hostMatches(route.Host, serverName) {
+			return route.Pool
+		}
+	}
+	return p.DefaultPool
+}
+
+// startPassthrough listens on the configured address and forwards
+// connections to lb's pools until the process exits
+func (lb *Balancer) startPassthrough(p PassthroughConfig) error {
+	ln, err := net.Listen("tcp", p.Address)
+	if err != nil {
+		return fmt.Errorf("passthrough: %w", err)
+	}
+	if p.ProxyProtocol.Accept {
+		ln = proxyProtoListener{ln, p.ProxyProtocol.trusted}
+	}
+	slog.Info("TLS passthrough started", "address", ln.Addr().String())
+	go acceptLoop(ln, "SNI", func(conn net.Conn) { p.serve(lb, conn) })
+	return nil
+}
+
+// acceptLoop hands every connection accepted on ln to serve until the
+// listener is closed
+func acceptLoop(ln net.Listener, tag string, serve func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Accept failed", "proxy", tag, "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go serve(conn)
+	}
+}
+
+// serve reads the client hello, picks a backend by SNI and relays the
+// connection, hello included, to it
+func (p *PassthroughConfig) serve(lb *Balancer, conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello, err := peekServerName(conn)
+	if err != nil {
+		slog.Warn("SNI client hello unreadable", "client", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	pool := lb.pools()[p.poolFor(serverName)]
+	if pool == nil {
+		slog.Warn("SNI no pool for server name", "client", conn.RemoteAddr().String(), "server_name", serverName)
+		return
+	}
+	backend := selectPeer(nil, pool, "", nil)
+	if backend == nil {
+		slog.Warn("SNI no backend available", "client", conn.RemoteAddr().String(), "pool", pool.Name)
+		return
+	}
+
+	addr := net.JoinHostPort(backend.URL.Hostname(), backendPort(backend.URL))
+	upstream, err := net.DialTimeout("tcp", addr, time.Duration(lb.config().Timeouts.Connect))
+	if err != nil {
+		slog.Warn("SNI dial failed", "server_name", serverName, "error", err)
+		return
+	}
+	defer upstream.Close()
+
+	atomic.AddInt64(&backend.active, 1)
+	defer atomic.AddInt64(&backend.active, -1)
+	start := time.Now()
+	if p.ProxyProtocol.Send != "" {
+		if err := writeProxyHeader(upstream, p.ProxyProtocol.Send, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			return
+		}
+	}
+	if _, err := upstream.Write(hello); err != nil {
+		return
+	}
+	sent, received := relay(conn, upstream)
+	slog.Debug("SNI connection closed", "server_name", serverName, "backend", addr,
+		"duration", time.Since(start).Round(time.Millisecond), "bytes_in", sent+int64(len(hello)), "bytes_out", received)
+}
+
+// peekServerName reads the TLS client hello from conn and returns the SNI
+// hostname with the bytes consumed, which still have to reach the backend
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+	var sawHello bool
+	// A server handshake over a read-only view of the connection parses
+	// the hello for us and is aborted as soon as it has
+	err := tls.Server(readOnlyConn{io.TeeReader(conn, &buf), conn}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			sawHello = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !sawHello {
+		return "", nil, err
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// readOnlyConn feeds a TLS handshake the client's bytes while discarding
+// anything it tries to send back
+type readOnlyConn struct {
+	r io.Reader
+	net.Conn
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c readOnlyConn) Close() error                { return nil }
+
+// relay copies between client and upstream until both directions are done
+// and returns the bytes sent each way
+func relay(client, upstream net.Conn) (sent, received int64) {
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, client)
+		closeWrite(upstream)
+		done <- n
+	}()
+	received, _ = io.Copy(client, upstream)
+	closeWrite(client)
+	sent = <-done
+	return sent, received
+}
+
+// closeWrite half-closes TCP connections so the peer sees EOF while the
+// other direction keeps flowing
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,202 @@
+package loadbalancer
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoWriter encodes a protobuf message, leaving out zero values as
+// proto3 does
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wire int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (w *protoWriter) bytes(field int, b []byte) {
+	w.tag(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protoWriter) string(field int, s string) {
+	if s != "" {
+		w.bytes(field, []byte(s))
+	}
+}
+
+func (w *protoWriter) strings(field int, ss []string) {
+	for _, s := range ss {
+		w.bytes(field, []byte(s))
+	}
+}
+
+// int writes int32, int64 and enum fields
+func (w *protoWriter) int(field int, v int64) {
+	if v != 0 {
+		w.tag(field, wireVarint)
+		w.buf = binary.AppendUvarint(w.buf, uint64(v))
+	}
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	if v {
+		w.tag(field, wireVarint)
+		w.buf = append(w.buf, 1)
+	}
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	if v != 0 {
+		w.tag(field, wireFixed64)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+	}
+}
+
+// message writes the message encode builds as field
+func (w *protoWriter) message(field int, encode func(*protoWriter)) {
+	var inner protoWriter
+	encode(&inner)
+	w.bytes(field, inner.buf)
+}
+
+// counts writes a map<string, int64> field, keys in order
+func (w *protoWriter) counts(field int, m map[string]int64) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.message(field, func(entry *protoWriter) {
+			entry.string(1, k)
+			entry.int(2, m[k])
+		})
+	}
+}
+
+// protoReader walks the fields of a protobuf message:
+//
+//	r := protoReader{buf: msg}
+//	for r.next() {
+//		switch r.field {
+//		case 1:
+//			name = r.string()
+//		}
+//	}
+//	return r.err
+//
+// Unknown fields are skipped, so newer clients can talk to older servers.
+type protoReader struct {
+	buf   []byte
+	field int
+	wire  int
+	// varint holds the value of varint fields, data that of the others
+	varint uint64
+	data   []byte
+	err    error
+}
+
+// next reads the next field, false at the end of the message or on error
+func (r *protoReader) next() bool {
+	if r.err != nil || len(r.buf) == 0 {
+		return false
+	}
+	key, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errProtoTruncated
+		return false
+	}
+	r.buf = r.buf[n:]
+	r.field, r.wire = int(key>>3), int(key&7)
+	if r.field == 0 {
+		r.err = errors.New("protobuf: field number 0")
+		return false
+	}
+
+	size := 0
+	switch r.wire {
+	case wireVarint:
+		if r.varint, n = binary.Uvarint(r.buf); n <= 0 {
+			r.err = errProtoTruncated
+			return false
+		}
+		r.buf = r.buf[n:]
+		return true
+	case wireFixed64:
+		size = 8
+	case wireFixed32:
+		size = 4
+	case wireBytes:
+		length, n := binary.Uvarint(r.buf)
+		if n <= 0 || length > uint64(len(r.buf)-n) {
+			r.err = errProtoTruncated
+			return false
+		}
+		r.buf, size = r.buf[n:], int(length)
+	default:
+		r.err = errors.New("protobuf: unsupported wire type")
+		return false
+	}
+	if size > len(r.buf) {
+		r.err = errProtoTruncated
+		return false
+	}
+	r.data, r.buf = r.buf[:size], r.buf[size:]
+	return true
+}
+
+// expect checks the current field has the wire type its schema says
+func (r *protoReader) expect(wire int) bool {
+	if r.wire != wire && r.err == nil {
+		r.err = errors.New("protobuf: wrong wire type for field")
+	}
+	return r.err == nil
+}
+
+func (r *protoReader) string() string {
+	if !r.expect(wireBytes) {
+		return ""
+	}
+	return string(r.data)
+}
+
+// message returns the encoded message in the current field
+func (r *protoReader) message() []byte {
+	if !r.expect(wireBytes) {
+		return nil
+	}
+	return r.data
+}
+
+func (r *protoReader) int() int64 {
+	if !r.expect(wireVarint) {
+		return 0
+	}
+	return int64(r.varint)
+}
+
+func (r *protoReader) bool() bool {
+	return r.int() != 0
+}
+
+func (r *protoReader) double() float64 {
+	if !r.expect(wireFixed64) {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.data))
+}
@@ -0,0 +1,274 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolConfig controls PROXY protocol on a layer 4 listener so
+// original client addresses survive L4 proxying
+type ProxyProtocolConfig struct {
+	// Accept expects every connection to start with a PROXY header, as
+	// sent by an upstream load balancer
+	Accept bool `json:"accept,omitempty"`
+	// TrustedSources are the networks of the load balancers allowed to
+	// send PROXY headers; connections from anywhere else are dropped
+	TrustedSources []string `json:"trusted_sources,omitempty"`
+	// Send is "v1" or "v2" to announce the client to backends
+	Send string `json:"send,omitempty"`
+
+	trusted []netip.Prefix
+}
+
+// validate checks the version to send and parses the trusted sources
+func (p *ProxyProtocolConfig) validate() error {
+	switch p.Send {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("proxy_protocol: send must be v1 or v2")
+	}
+	var err error
+	if p.trusted, err = parseTrustedSources(p.Accept, p.TrustedSources); err != nil {
+		return fmt.Errorf("proxy_protocol: %w", err)
+	}
+	return nil
+}
+
+// parseTrustedSources parses the networks PROXY headers are taken from.
+// Anyone able to send one picks the address the balancer sees, loopback
+// included, so accepting them needs the sources spelled out.
+func parseTrustedSources(accept bool, sources []string) ([]netip.Prefix, error) {
+	if !accept {
+		return nil, nil
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("accepting PROXY headers needs trusted_sources")
+	}
+	trusted, err := parsePrefixes(sources)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_sources: %w", err)
+	}
+	return trusted, nil
+}
+
+// errUntrustedProxy closes connections with a PROXY header from a peer
+// outside the trusted sources
+var errUntrustedProxy = errors.New("proxy protocol: connection not from a trusted source")
+
+// proxyHeaderTimeout bounds how long a client may take to send its header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader announces a connection from src to dst in the given
+// version
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if version == "v1" {
+		if !sok || !dok {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP4"
+		if s.IP.To4() == nil {
+			family = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port)
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	if !sok || !dok {
+		// LOCAL command, the backend keeps the connection's own addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	srcIP, dstIP := s.IP.To4(), d.IP.To4()
+	family := byte(0x11) // TCP over IPv4
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+		family = 0x21 // TCP over IPv6
+	}
+	buf.WriteByte(0x21) // version 2, PROXY command
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readProxyHeader reads a v1 or v2 header; nil addresses mean the sender
+// did not announce a client (UNKNOWN or LOCAL)
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, nil, errors.New("proxy protocol: missing header")
+	}
+
+	// A v1 line is at most 107 bytes including CRLF
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol: malformed v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("proxy protocol: malformed v1 header")
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, errors.New("proxy protocol: malformed v1 addresses")
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 reads a binary header, the signature still unread
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, errors.New("proxy protocol: unsupported version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if head[12]&0x0f == 0 {
+		// LOCAL, e.g. the sender's own health checks
+		return nil, nil, nil
+	}
+
+	var size int
+	switch head[13] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable address
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("proxy protocol: short v2 address block")
+	}
+	srcIP := net.IP(append([]byte(nil), body[:size]...))
+	dstIP := net.IP(append([]byte(nil), body[size:2*size]...))
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// proxyProtoListener expects a PROXY header on every accepted connection,
+// which must come from one of the trusted networks
+type proxyProtoListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn), trusted: l.trusted}, nil
+}
+
+// proxyProtoConn reports the addresses from the PROXY header. The header
+// is read on first use rather than in Accept so a slow client cannot
+// hold up the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	r        *bufio.Reader
+	trusted  []netip.Prefix
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		if !c.fromTrustedSource() {
+			c.err = errUntrustedProxy
+			c.Conn.Close()
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+// fromTrustedSource reports whether the peer may send a PROXY header
+func (c *proxyProtoConn) fromTrustedSource() bool {
+	addr, err := netip.ParseAddrPort(c.Conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	for _, p := range c.trusted {
+		if p.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	if c.readHeader(); c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite keeps half-closes working for relayed connections
+func (c *proxyProtoConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+	return c.Conn.Close()
+}
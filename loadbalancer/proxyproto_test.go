@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// proxyHeaderConn dials a PROXY listener trusting sources and sends a
+// header claiming the client is at 127.0.0.9
+func proxyHeaderConn(t *testing.T, sources ...string) net.Conn {
+	t.Helper()
+	trusted, err := parsePrefixes(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := proxyProtoListener{inner, trusted}
+	t.Cleanup(func() { ln.Close() })
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	io.WriteString(client, "PROXY TCP4 127.0.0.9 127.0.0.1 5000 80\r\nhello")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func TestProxyProtocolTrustedSources(t *testing.T) {
+	conn := proxyHeaderConn(t, "127.0.0.0/8")
+	if got := conn.RemoteAddr().String(); got != "127.0.0.9:5000" {
+		t.Errorf("trusted peer: remote address %s, want the header's 127.0.0.9:5000", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("trusted peer: read %q, %v", buf, err)
+	}
+
+	// Anyone else could claim to be loopback
+	conn = proxyHeaderConn(t, "10.0.0.0/8")
+	if _, err := conn.Read(buf); err != errUntrustedProxy {
+		t.Errorf("untrusted peer: read error %v, want %v", err, errUntrustedProxy)
+	}
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil || addr.Port() == 5000 {
+		t.Errorf("untrusted peer: remote address %s comes from its header", conn.RemoteAddr())
+	}
+}
+
+func TestProxyProtocolNeedsTrustedSources(t *testing.T) {
+	l := ListenerConfig{Addresses: []string{":0"}, AcceptProxyProtocol: true}
+	if err := l.validate(); err == nil {
+		t.Error("listener accepting PROXY headers from anyone passed validation")
+	}
+	l.TrustedSources = []string{"10.0.0.0/8", "192.0.2.1"}
+	if err := l.validate(); err != nil {
+		t.Errorf("listener with trusted sources: %v", err)
+	}
+	if len(l.trusted) != 2 {
+		t.Errorf("parsed %d trusted sources, want 2", len(l.trusted))
+	}
+
+	p := ProxyProtocolConfig{Accept: true}
+	if err := p.validate(); err == nil {
+		t.Error("layer 4 listener accepting PROXY headers from anyone passed validation")
+	}
+	p.TrustedSources = []string{"not a network"}
+	if err := p.validate(); err == nil {
+		t.Error("malformed trusted source passed validation")
+	}
+}
@@ -0,0 +1,68 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RedirectHTTP runs plain HTTP listeners next to the TLS ones that send
+// clients over to HTTPS
+type RedirectHTTP struct {
+	Addresses []string `json:"addresses"`
+	// Port clients reach HTTPS on, defaults to that of the first listener
+	Port int `json:"port,omitempty"`
+	// Exempt path prefixes are proxied over plain HTTP instead, ACME
+	// HTTP-01 challenges by default
+	Exempt []string `json:"exempt,omitempty"`
+}
+
+// acmeChallengePrefix is where ACME HTTP-01 challenges are served
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// validate fills in defaults and checks the addresses
+func (rd *RedirectHTTP) validate() error {
+	if len(rd.Addresses) == 0 {
+		return fmt.Errorf("listener redirect_http: no addresses configured")
+	}
+	for _, addr := range rd.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("listener redirect_http: %w", err)
+		}
+	}
+	if rd.Port < 0 || rd.Port > 65535 {
+		return fmt.Errorf("listener redirect_http: invalid port %d", rd.Port)
+	}
+	if rd.Exempt == nil {
+		rd.Exempt = []string{acmeChallengePrefix}
+	}
+	return nil
+}
+
+// handler redirects requests to HTTPS on port, handing exempt paths to next
+func (rd *RedirectHTTP) handler(port string, next http.Handler) http.Handler {
+	if rd.Port != 0 {
+		port = strconv.Itoa(rd.Port)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range rd.Exempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
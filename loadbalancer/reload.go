@@ -0,0 +1,27 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// reloadHandler reads the config file again on POST and switches to it,
+// see reloadConfig
+func (lb *Balancer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := lb.reloadConfig(); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "reloaded",
+		"file":   cli.configPath,
+		"pools":  lb.poolNames(),
+	})
+}
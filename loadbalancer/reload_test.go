@@ -0,0 +1,81 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConfigReload(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL)
+	load := func(pools string) *Config {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "lb.json")
+		if err := os.WriteFile(path, []byte(`{"pools": {`+pools+`}}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	both := load(`"default": {"backends": ["` + a.URL + `"]}, "extra": {"backends": ["` + b.URL + `"]}`)
+	only := load(`"default": {"backends": ["` + a.URL + `"]}`)
+	if err := lb.applyConfig(both); err != nil {
+		t.Fatal(err)
+	}
+	kept := lb.pools()["default"]
+
+	// Requests keep flowing while reloads switch pools in and out
+	h := lb.Handler()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/work", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("request during reloads: status %d", rec.Code)
+					return
+				}
+			}
+		}()
+	}
+	var dropped []*ServerPool
+	for i := 0; i < 20; i++ {
+		dropped = append(dropped, lb.pools()["extra"])
+		if err := lb.applyConfig(only); err != nil {
+			t.Fatal(err)
+		}
+		if err := lb.applyConfig(both); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if lb.pools()["default"] != kept {
+		t.Error("a pool kept across reloads was rebuilt")
+	}
+	for i, pool := range dropped {
+		if pool.lifetime().Err() == nil {
+			t.Errorf("pool dropped by reload %d still running its discovery", i)
+		}
+	}
+	if lb.pools()["extra"].lifetime().Err() != nil {
+		t.Error("the running extra pool was stopped")
+	}
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// ResponseLimitConfig caps the size of upstream responses on a route so
+// a misbehaving backend cannot push an unbounded body through
+type ResponseLimitConfig struct {
+	MaxBytes int64 `json:"max_bytes"`
+	// Buffer reads responses of unknown length into memory, up to
+	// MaxBytes, before sending them so an oversized one still becomes a
+	// 502; unbuffered ones are cut off at the limit. Streaming content
+	// types are never buffered.
+	Buffer bool `json:"buffer,omitempty"`
+}
+
+// validate checks the limit is set
+func (c *ResponseLimitConfig) validate() error {
+	if c.MaxBytes <= 0 {
+		return fmt.Errorf("response_limit: max_bytes must be positive")
+	}
+	return nil
+}
+
+var errResponseTooLarge = errors.New("response exceeds the route's size limit")
+
+type responseLimitKey struct{}
+
+// withResponseLimit attaches the route's response limit to ctx
+func withResponseLimit(ctx context.Context, limit *ResponseLimitConfig) context.Context {
+	return context.WithValue(ctx, responseLimitKey{}, limit)
+}
+
+// limitResponse enforces the limit of resp's request: responses known to
+// be too large fail with errResponseTooLarge, others are buffered or
+// capped
+func limitResponse(resp *http.Response) error {
+	limit, _ := resp.Request.Context().Value(responseLimitKey{}).(*ResponseLimitConfig)
+	// Upgraded connections are not responses to cap, and the proxy needs
+	// their body as it is to write to
+	if limit == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	if resp.ContentLength > limit.MaxBytes {
+		return errResponseTooLarge
+	}
+	if resp.ContentLength >= 0 {
+		resp.Body = &cappedBody{ReadCloser: resp.Body, left: limit.MaxBytes, url: resp.Request.URL.String()}
+		return nil
+	}
+	if !limit.Buffer || timeoutsFrom(resp.Request.Context()).streams(resp) {
+		resp.Body = &cappedBody{ReadCloser: resp.Body, left: limit.MaxBytes, url: resp.Request.URL.String()}
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit.MaxBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit.MaxBytes {
+		return errResponseTooLarge
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// cappedBody fails reads past the limit, which aborts the response
+// mid-stream so the client sees it truncated rather than complete
+type cappedBody struct {
+	io.ReadCloser
+	left int64
+	url  string
+}
+
+func (c *cappedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.left+1 {
+		p = p[:c.left+1]
+	}
+	n, err := c.ReadCloser.Read(p)
+	if int64(n) > c.left {
+		n = int(c.left)
+		c.left = 0
+		slog.Warn("Response cut off at size limit", "url", c.url)
+		return n, errResponseTooLarge
+	}
+	c.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestResponseLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(n))
+		}
+		w.Write(bytes.Repeat([]byte("x"), n))
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	limit := &ResponseLimitConfig{MaxBytes: 1000}
+	cfg := *lb.config()
+	cfg.Routes = append([]RouteConfig{}, cfg.Routes...)
+	cfg.Routes[0].ResponseLimit = limit
+	lb.setConfig(&cfg)
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+
+	get := func(query string) (int, int, error) {
+		t.Helper()
+		resp, err := http.Get(front.URL + "/?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, len(body), err
+	}
+	if status, n, err := get("n=1000"); status != http.StatusOK || n != 1000 || err != nil {
+		t.Errorf("response at the limit: status %d, %d bytes, %v", status, n, err)
+	}
+	if status, _, _ := get("n=1001"); status != http.StatusBadGateway {
+		t.Errorf("oversized response: status %d, want 502", status)
+	}
+	if status, n, err := get("n=5000&chunked=1"); status != http.StatusOK || err == nil || n > 1000 {
+		t.Errorf("oversized chunked response: status %d, %d bytes, %v; want it cut off", status, n, err)
+	}
+	limit.Buffer = true
+	if status, _, _ := get("n=5000&chunked=1"); status != http.StatusBadGateway {
+		t.Errorf("oversized buffered response: status %d, want 502", status)
+	}
+	if status, n, err := get("n=500&chunked=1"); status != http.StatusOK || n != 500 || err != nil {
+		t.Errorf("buffered response: status %d, %d bytes, %v", status, n, err)
+	}
+}
@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// RetryConfig decides which failed requests are sent to another backend.
+// Idempotent requests are retried after any error but a timeout; others
+// only when the connection could not be made, so the backend never saw
+// them. Either way the body has to be replayable.
+type RetryConfig struct {
+	// MaxBodyBytes is the largest request body buffered so it can be sent
+	// again; requests with bigger bodies are streamed and never retried
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// NonIdempotent retries POST and PATCH after any error too, for
+	// backends known to deduplicate them
+	NonIdempotent bool `json:"non_idempotent"`
+}
+
+// validate checks the body limit
+func (c *RetryConfig) validate() error {
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry: max_body_bytes must not be negative")
+	}
+	return nil
+}
+
+// idempotentMethods may be repeated without changing the outcome
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// isIdempotent reports whether r may be repeated, counting requests that
+// carry an idempotency key like net/http's transport does
+func isIdempotent(r *http.Request) bool {
+	if idempotentMethods[r.Method] {
+		return true
+	}
+	_, key := r.Header["Idempotency-Key"]
+	_, xKey := r.Header["X-Idempotency-Key"]
+	return key || xKey
+}
+
+// bufferBody reads r's body into memory up to the retry limit and sets
+// GetBody so it can be sent again. Bigger bodies are left to stream with
+// GetBody unset, which keeps them from being retried.
+func bufferBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return nil
+	}
+	limit := requestConfig(r).Retry.MaxBodyBytes
+	if r.ContentLength > limit {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		// Chunked and over the limit, hand on what was read and the rest
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
+
+// canRetry reports whether r may go to another backend after err
+func canRetry(r *http.Request, err error) bool {
+	if r.GetBody == nil && r.Body != nil && r.Body != http.NoBody {
+		// The body was streamed and is gone
+		return false
+	}
+	return isIdempotent(r) || requestConfig(r).Retry.NonIdempotent || isDialError(err)
+}
+
+// isDialError reports whether err happened before the request was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// rewindBody gives r a fresh copy of its buffered body for another attempt
+func rewindBody(r *http.Request) error {
+	if r.GetBody == nil {
+		return nil
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
+// attempted holds the backends a request was already sent to, so failover
+// does not pick one of them again
+type attempted map[*Backend]bool
+
+type attemptedKey struct{}
+
+// attemptedFor returns the backends r was tried on, attaching an empty set
+// to the returned request the first time
+func attemptedFor(r *http.Request) (*http.Request, attempted) {
+	if a, ok := r.Context().Value(attemptedKey{}).(attempted); ok {
+		return r, a
+	}
+	a := attempted{}
+	return r.WithContext(context.WithValue(r.Context(), attemptedKey{}, a)), a
+}
+
+// avoid is the selection predicate skipping backends already tried
+func (a attempted) avoid(b *Backend) bool {
+	return a[b]
+}
+
+// sentTracker notes whether the proxy committed a response to the client,
+// after which neither a retry nor an error page can be written cleanly
+type sentTracker struct {
+	http.ResponseWriter
+	sent bool
+}
+
+func (s *sentTracker) WriteHeader(code int) {
+	// Informational responses leave the final status open
+	if code >= 200 {
+		s.sent = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *sentTracker) Write(b []byte) (int, error) {
+	s.sent = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *sentTracker) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// responseSent reports whether a sentTracker in w's chain saw the
+// response start
+func responseSent(w http.ResponseWriter) bool {
+	for {
+		if s, ok := w.(*sentTracker); ok {
+			return s.sent
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
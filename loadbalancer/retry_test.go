@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryOnConnectionError(t *testing.T) {
+	live := testBackend(t, "live", 0)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	lb, _ := installPool(t, RoundRobin, dead.URL, live.URL)
+
+	// No health check has run, so the dead backend is still in rotation
+	if counts := send(t, lb.Handler(), 10); counts["live"] != 10 {
+		t.Errorf("retried requests went to %v, want all answered by live", counts)
+	}
+}
+
+func TestRetryReplaysBufferedBody(t *testing.T) {
+	lb, _ := installPool(t, RoundRobin, deadURL(t), echoBackend(t).URL)
+	h := lb.Handler()
+
+	body := strings.Repeat("payload ", 1000)
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+		if got := rec.Body.String(); got != body {
+			t.Fatalf("request %d: backend got %d bytes, want %d", i, len(got), len(body))
+		}
+	}
+}
+
+func TestNoRetryAfterPostReachedBackend(t *testing.T) {
+	var hits atomic.Int64
+	// Reads the request, then drops the connection without answering
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(flaky.Close)
+	lb, _ := installPool(t, RoundRobin, flaky.URL, flaky.URL)
+
+	rec := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("order")))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", rec.Code)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("POST reached backends %d times, want 1", n)
+	}
+}
+
+func TestNoRetryOfStreamedBody(t *testing.T) {
+	lb, _ := installPool(t, RoundRobin, deadURL(t), echoBackend(t).URL)
+	cfg := *lb.config()
+	cfg.Retry.MaxBodyBytes = 16
+	lb.setConfig(&cfg)
+
+	// Round robin alternates, so one of the two lands on the dead backend
+	h := lb.Handler()
+	codes := map[int]int{}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/file", strings.NewReader(strings.Repeat("x", 64))))
+		codes[rec.Code]++
+	}
+	if codes[http.StatusOK] != 1 || codes[http.StatusBadGateway] != 1 {
+		t.Errorf("status codes %v, want one 200 and one 502 for a body too big to replay", codes)
+	}
+}
+
+func TestFailoverSkipsAttemptedBackends(t *testing.T) {
+	var hits [2]atomic.Int64
+	var urls []string
+	for i := range hits {
+		i := i
+		// Drops every connection without answering
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+		}))
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL)
+	}
+	lb, _ := installPool(t, RoundRobin, urls...)
+
+	rec := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/work", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503 once every backend failed", rec.Code)
+	}
+	for i := range hits {
+		if n := hits[i].Load(); n != 1 {
+			t.Errorf("backend %d tried %d times, want 1", i, n)
+		}
+	}
+}
+
+func TestNoErrorResponseAfterPartialWrite(t *testing.T) {
+	var hits atomic.Int64
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(other.Close)
+	_, pool := installPool(t, RoundRobin, deadURL(t), other.URL)
+
+	rec := httptest.NewRecorder()
+	w := &sentTracker{ResponseWriter: rec}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("partial"))
+	req := httptest.NewRequest(http.MethodGet, "/work", nil)
+	pool.Backends()[0].ReverseProxy.ErrorHandler(w, req, errors.New("connection reset"))
+
+	if got := rec.Body.String(); got != "partial" {
+		t.Errorf("client got %q, want only the partial response", got)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("request retried %d times after the response started", n)
+	}
+}
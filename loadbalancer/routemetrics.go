@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type routeKeyCtx struct{}
+
+// withRoute attaches the route a request matched to ctx, so the proxy
+// hooks can attribute backend traffic to it
+func withRoute(ctx context.Context, route *RouteConfig) context.Context {
+	return context.WithValue(ctx, routeKeyCtx{}, route)
+}
+
+// routeFrom returns the route attached to ctx, "" if there is none
+func routeFrom(ctx context.Context) string {
+	route, _ := ctx.Value(routeKeyCtx{}).(*RouteConfig)
+	if route == nil {
+		return ""
+	}
+	return routeKey(route)
+}
+
+// routeBackendKey names one backend's traffic on one route
+type routeBackendKey struct {
+	route, pool, id string
+}
+
+// routeBackendCounters accumulate one backend's traffic on one route
+type routeBackendCounters struct {
+	url       string
+	requests  atomic.Int64
+	failures  atomic.Int64
+	latencyMs atomic.Int64
+	statuses  [4]atomic.Int64 // responses by class, 2xx through 5xx
+	latency   latencyWindow
+}
+
+// routeBackendMetrics break backend traffic down by the route it came
+// from, so a regression can be traced to the paths that cause it
+type routeBackendMetrics struct {
+	mu   sync.RWMutex
+	sets map[routeBackendKey]*routeBackendCounters
+}
+
+var routeBackends = &routeBackendMetrics{sets: map[routeBackendKey]*routeBackendCounters{}}
+
+// counters returns the counters of b's traffic on route in pool
+func (m *routeBackendMetrics) counters(route, pool string, b *Backend) *routeBackendCounters {
+	key := routeBackendKey{route, pool, b.ID}
+	m.mu.RLock()
+	c := m.sets[key]
+	m.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c = m.sets[key]; c == nil {
+		c = &routeBackendCounters{url: b.URL.String()}
+		m.sets[key] = c
+	}
+	return c
+}
+
+// response records a response b sent for route, with its time to first
+// byte if it was measured
+func (m *routeBackendMetrics) response(route, pool string, b *Backend, status int, ttfb time.Duration) {
+	if route == "" {
+		return
+	}
+	c := m.counters(route, pool, b)
+	c.requests.Add(1)
+	if class := status/100 - 2; class >= 0 && class < len(c.statuses) {
+		c.statuses[class].Add(1)
+	}
+	if ttfb > 0 {
+		c.latencyMs.Add(ttfb.Milliseconds())
+		c.latency.Add(ttfb.Milliseconds())
+	}
+}
+
+// failure records an attempt on b for route that got no response
+func (m *routeBackendMetrics) failure(route, pool string, b *Backend) {
+	if route == "" {
+		return
+	}
+	c := m.counters(route, pool, b)
+	c.requests.Add(1)
+	c.failures.Add(1)
+}
+
+// Snapshot returns the traffic of every backend on every route, sorted by
+// route, pool and backend ID
+func (m *routeBackendMetrics) Snapshot() []map[string]interface{} {
+	m.mu.RLock()
+	keys := make([]routeBackendKey, 0, len(m.sets))
+	for k := range m.sets {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].pool != keys[j].pool {
+			return keys[i].pool < keys[j].pool
+		}
+		return keys[i].id < keys[j].id
+	})
+
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		m.mu.RLock()
+		c := m.sets[k]
+		m.mu.RUnlock()
+		responses := map[string]int64{}
+		for i := range c.statuses {
+			responses[fmt.Sprintf("%dxx", i+2)] = c.statuses[i].Load()
+		}
+		result = append(result, map[string]interface{}{
+			"route":            k.route,
+			"pool":             k.pool,
+			"backend_id":       k.id,
+			"backend":          c.url,
+			"requests":         c.requests.Load(),
+			"failures":         c.failures.Load(),
+			"responses":        responses,
+			"latency_ms_total": c.latencyMs.Load(),
+			"p95_ms":           c.latency.P95(),
+		})
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteBackendMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/products") {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(backend.Close)
+	pool, err := NewPool("shop", backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	router.PathPrefix("/api/orders").Name("orders").Pool(pool)
+	router.PathPrefix("/api/products").Name("products").Pool(pool)
+	lb := New()
+	if err := lb.Install(router); err != nil {
+		t.Fatal(err)
+	}
+	h := lb.Handler()
+	for _, path := range []string{"/api/orders/1", "/api/orders/2", "/api/products/1"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	byRoute := map[string]map[string]interface{}{}
+	for _, s := range routeBackends.Snapshot() {
+		if s["pool"] == "shop" {
+			byRoute[s["route"].(string)] = s
+		}
+	}
+	orders, products := byRoute["orders"], byRoute["products"]
+	if orders == nil || products == nil {
+		t.Fatalf("route breakdown %v, want orders and products", byRoute)
+	}
+	if orders["requests"] != int64(2) || products["requests"] != int64(1) {
+		t.Errorf("requests: orders %v, products %v; want 2 and 1", orders["requests"], products["requests"])
+	}
+	if p95 := products["p95_ms"].(int64); p95 < 30 || orders["p95_ms"].(int64) >= p95 {
+		t.Errorf("p95: orders %v, products %v; want products slower", orders["p95_ms"], p95)
+	}
+	want := `lb_route_backend_requests_total{backend="` + backend.URL + `",backend_id="` + pool.Backends()[0].ID + `",pool="shop",route="orders"} 2`
+	if rec := admin(t, lb, http.MethodGet, "/lb/metrics", ""); !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics lack %s", want)
+	}
+}
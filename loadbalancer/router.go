@@ -0,0 +1,227 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Strategy names a balancing algorithm
+type Strategy string
+
+const (
+	RoundRobin   Strategy = "round-robin"
+	LeastLatency Strategy = "least-latency"
+	LeastConn    Strategy = "least-conn"
+	// Hash keeps requests with the same hash_on attribute on one backend
+	Hash Strategy = "hash"
+)
+
+// strategies lists the algorithms selectPeer implements
+var strategies = []Strategy{RoundRobin, LeastLatency, LeastConn, Hash}
+
+// validate accepts the known strategies and the empty default
+func (s Strategy) validate() error {
+	if s == "" {
+		return nil
+	}
+	for _, known := range strategies {
+		if s == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown strategy %q", s)
+}
+
+// Router builds a routing table in code:
+//
+//	orders, _ := NewPool("orders", "http://10.0.0.5:8080")
+//	r := NewRouter()
+//	r.Host("api.example.com").PathPrefix("/orders").Pool(orders).Strategy(LeastConn)
+//	r.PathPrefix("/").Pool(web)
+//	err := lb.Install(r)
+type Router struct {
+	routes []*RouteBuilder
+}
+
+// RouteBuilder configures one route of a Router
+type RouteBuilder struct {
+	route RouteConfig
+	pool  *ServerPool
+}
+
+// NewRouter returns an empty routing table
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Route starts a new route matching every request
+func (r *Router) Route() *RouteBuilder {
+	b := &RouteBuilder{route: RouteConfig{PathPrefix: "/"}}
+	r.routes = append(r.routes, b)
+	return b
+}
+
+// Host starts a new route for a virtual host
+func (r *Router) Host(host string) *RouteBuilder {
+	return r.Route().Host(host)
+}
+
+// PathPrefix starts a new route for a path prefix
+func (r *Router) PathPrefix(prefix string) *RouteBuilder {
+	return r.Route().PathPrefix(prefix)
+}
+
+// Name sets the name used in labels, stats and logs
+func (b *RouteBuilder) Name(name string) *RouteBuilder {
+	b.route.Name = name
+	return b
+}
+
+// Host restricts the route to a virtual host, "*.example.com" allowed
+func (b *RouteBuilder) Host(host string) *RouteBuilder {
+	b.route.Host = host
+	return b
+}
+
+// PathPrefix restricts the route to paths starting with prefix
+func (b *RouteBuilder) PathPrefix(prefix string) *RouteBuilder {
+	b.route.PathPrefix = prefix
+	return b
+}
+
+// Pool sends the route's traffic to pool
+func (b *RouteBuilder) Pool(pool *ServerPool) *RouteBuilder {
+	b.pool = pool
+	return b
+}
+
+// Strategy sets the balancing algorithm for the route
+func (b *RouteBuilder) Strategy(s Strategy) *RouteBuilder {
+	b.route.Strategy = s
+	return b
+}
+
+// HashOn sets the attribute the hash strategy keys on, e.g. "header:X-Tenant"
+func (b *RouteBuilder) HashOn(on HashOn) *RouteBuilder {
+	b.route.HashOn = on
+	return b
+}
+
+// Timeouts overrides the global upstream timeouts
+func (b *RouteBuilder) Timeouts(t TimeoutConfig) *RouteBuilder {
+	b.route.Timeouts = &t
+	return b
+}
+
+// Label adds a traffic label
+func (b *RouteBuilder) Label(key, value string) *RouteBuilder {
+	if b.route.Labels == nil {
+		b.route.Labels = Labels{}
+	}
+	b.route.Labels[key] = value
+	return b
+}
+
+// NewPool builds a pool for use with a Router from backend URLs, using
+// the default transport settings and probes
+func NewPool(name string, backends ...string) (*ServerPool, error) {
+	transport, err := newTransport(defaultConfig().Transport, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	pool := &ServerPool{
+		Name:      name,
+		transport: transport,
+		probes:    append([]ProbeConfig(nil), defaultProbes...),
+	}
+	for _, rawURL := range backends {
+		backend, err := newBackend(rawURL, pool)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		pool.AddBackend(backend)
+	}
+	return pool, nil
+}
+
+// Routes checks the table and returns it as route configuration along
+// with the pools it refers to
+func (r *Router) Routes() ([]RouteConfig, map[string]*ServerPool, error) {
+	routes := make([]RouteConfig, 0, len(r.routes))
+	byName := map[string]*ServerPool{}
+	for i, b := range r.routes {
+		route := b.route
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return nil, nil, fmt.Errorf("route %d (%s): path prefix must start with /", i, route.Name)
+		}
+		if b.pool == nil || b.pool.Name == "" {
+			return nil, nil, fmt.Errorf("route %d (%s): no named pool", i, route.Name)
+		}
+		if other, ok := byName[b.pool.Name]; ok && other != b.pool {
+			return nil, nil, fmt.Errorf("route %d (%s): two pools named %q", i, route.Name, b.pool.Name)
+		}
+		if err := route.Strategy.validate(); err != nil {
+			return nil, nil, fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+		if err := route.HashOn.validate(); err != nil {
+			return nil, nil, fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+		byName[b.pool.Name] = b.pool
+		route.Pool = b.pool.Name
+		routes = append(routes, route)
+	}
+	return routes, byName, nil
+}
+
+// Install replaces lb's routing table with r, registering the pools its
+// routes use; a pool can only be installed on one balancer
+func (lb *Balancer) Install(r *Router) error {
+	routes, routePools, err := r.Routes()
+	if err != nil {
+		return err
+	}
+
+	lb.reloadMu.Lock()
+	defer lb.reloadMu.Unlock()
+	for name, pool := range routePools {
+		if pool.lb != nil && pool.lb != lb {
+			return fmt.Errorf("pool %s: installed on another balancer", name)
+		}
+	}
+	// Requests in flight share the running config, so the routes are
+	// checked on a copy of it the way a reload checks a config file
+	next, err := lb.config().clone()
+	if err != nil {
+		return err
+	}
+	next.Routes = routes
+	if next.Pools == nil {
+		next.Pools = map[string]*PoolConfig{}
+	}
+	for name, pool := range routePools {
+		next.Pools[name] = pool.poolConfig()
+	}
+	if err := next.normalize(); err != nil {
+		return err
+	}
+	current := lb.pools()
+	nextPools := make(map[string]*ServerPool, len(current)+len(routePools))
+	for name, pool := range current {
+		nextPools[name] = pool
+	}
+	for name, pool := range routePools {
+		nextPools[name] = pool
+	}
+
+	lb.switchConfig(next, nextPools)
+	return nil
+}
+
+// poolConfig describes a pool built in code for checking routes to it
+func (p *ServerPool) poolConfig() *PoolConfig {
+	cfg := &PoolConfig{Backends: []string{}, inCode: true}
+	for _, b := range p.snapshot() {
+		cfg.Backends = append(cfg.Backends, b.URL.String())
+	}
+	return cfg
+}
@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// ScriptConfig is a per-request policy hook written as a text/template.
+// Its output is discarded; the script acts through the methods of
+// scriptRequest, for example
+//
+//	{{if eq (.Header "X-Beta") "1"}}{{.SetPool "beta"}}{{end}}
+//	{{if not (.Claim "admin")}}{{.Reject 403 "Admins only"}}{{end}}
+type ScriptConfig struct {
+	Source string `json:"source,omitempty"`
+	File   string `json:"file,omitempty"`
+
+	tmpl *template.Template
+}
+
+// scriptFuncs are helpers available to scripts besides the template builtins
+var scriptFuncs = template.FuncMap{
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"contains":  strings.Contains,
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+}
+
+// validate reads and parses the script
+func (s *ScriptConfig) validate(name string) error {
+	var err error
+	if s.Source, err = inlineOrFile(s.Source, s.File); err != nil {
+		return fmt.Errorf("script: %w", err)
+	}
+	if strings.TrimSpace(s.Source) == "" {
+		return fmt.Errorf("script: source or file is required")
+	}
+	if s.tmpl, err = template.New(name).Funcs(scriptFuncs).Option("missingkey=zero").Parse(s.Source); err != nil {
+		return fmt.Errorf("script: %w", err)
+	}
+	return nil
+}
+
+// scriptRequest is what a script sees of the request, and collects the
+// decisions it makes
+type scriptRequest struct {
+	Method   string
+	Host     string
+	Path     string
+	ClientIP string
+	Country  string
+
+	r      *http.Request
+	pool   *ServerPool
+	status int
+	reason string
+}
+
+// Header returns a request header
+func (s *scriptRequest) Header(name string) string {
+	return s.r.Header.Get(name)
+}
+
+// Query returns a query parameter
+func (s *scriptRequest) Query(name string) string {
+	return s.r.URL.Query().Get(name)
+}
+
+// Cookie returns a cookie value, "" if the request has none by that name
+func (s *scriptRequest) Cookie(name string) string {
+	if c, err := s.r.Cookie(name); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Claim returns a claim of the verified bearer token, nil without one
+func (s *scriptRequest) Claim(name string) interface{} {
+	return jwtClaimsFrom(s.r.Context())[name]
+}
+
+// Percent is true for about pct percent of calls
+func (s *scriptRequest) Percent(pct float64) bool {
+	return rand.Float64()*100 < pct
+}
+
+// SetPool sends the request to another pool
+func (s *scriptRequest) SetPool(name string) (string, error) {
+	p, ok := balancerFrom(s.r.Context()).pools()[name]
+	if !ok {
+		return "", fmt.Errorf("unknown pool %q", name)
+	}
+	s.pool = p
+	return "", nil
+}
+
+// SetHeader sets a header on the request forwarded to the backend
+func (s *scriptRequest) SetHeader(name, value string) string {
+	s.r.Header.Set(name, value)
+	return ""
+}
+
+// DelHeader removes a header from the forwarded request
+func (s *scriptRequest) DelHeader(name string) string {
+	s.r.Header.Del(name)
+	return ""
+}
+
+// Reject answers the request with status instead of forwarding it
+func (s *scriptRequest) Reject(status int, reason string) (string, error) {
+	if status < 400 || status > 599 {
+		return "", fmt.Errorf("reject status %d is not an error status", status)
+	}
+	s.status, s.reason = status, reason
+	return "", nil
+}
+
+// runScript evaluates the route's script, returning the pool to use. It
+// writes the response itself and returns false when the script rejects
+// the request or fails.
+func runScript(w http.ResponseWriter, r *http.Request, route *RouteConfig, pool *ServerPool) (*ServerPool, bool) {
+	if route == nil || route.Script == nil {
+		return pool, true
+	}
+	s := &scriptRequest{
+		Method:  r.Method,
+		Host:    r.Host,
+		Path:    r.URL.Path,
+		Country: clientCountry(r),
+		r:       r,
+		pool:    pool,
+	}
+	if addr, ok := clientAddr(r); ok {
+		s.ClientIP = addr.String()
+	}
+	if err := route.Script.tmpl.Execute(io.Discard, s); err != nil {
+		// A broken policy must not let requests through unchecked
+		slog.Error("Route script failed", "route", routeKey(route), "path", r.URL.Path, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if s.status != 0 {
+		if s.reason == "" {
+			s.reason = http.StatusText(s.status)
+		}
+		http.Error(w, s.reason, s.status)
+		return nil, false
+	}
+	return s.pool, true
+}
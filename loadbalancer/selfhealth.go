@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ReadinessConfig decides when /lb/readyz reports the balancer ready to
+// take traffic
+type ReadinessConfig struct {
+	// Pools each need an available backend, every pool if empty
+	Pools []string `json:"pools,omitempty"`
+}
+
+// validate checks the required pools exist
+func (c *ReadinessConfig) validate(pools map[string]*PoolConfig) error {
+	for _, name := range c.Pools {
+		if _, ok := pools[name]; !ok {
+			return fmt.Errorf("readiness: unknown pool %q", name)
+		}
+	}
+	return nil
+}
+
+// startedAt is when the process started, for /lb/healthz
+var startedAt = time.Now()
+
+// healthzHandler answers liveness probes: the balancer is serving
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// readiness counts the available backends of the required pools and
+// lists those that have none; the balancer is ready when none are listed
+func (lb *Balancer) readiness() (available map[string]int, unavailable []string) {
+	required := lb.config().Readiness.Pools
+	if len(required) == 0 {
+		required = lb.poolNames()
+	}
+	available = map[string]int{}
+	unavailable = []string{}
+	for _, name := range required {
+		pool := lb.pools()[name]
+		if pool != nil {
+			for _, b := range pool.Backends() {
+				if b.IsAvailable() {
+					available[name]++
+				}
+			}
+		}
+		if available[name] == 0 {
+			unavailable = append(unavailable, name)
+		}
+	}
+	return available, unavailable
+}
+
+// readyzHandler answers readiness probes: 200 while every required pool
+// has an available backend, 503 naming the pools that do not
+func (lb *Balancer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	available, unavailable := lb.readiness()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	body := map[string]interface{}{"status": "ready", "available": available}
+	if len(unavailable) > 0 {
+		body["status"] = "not_ready"
+		body["unavailable"] = unavailable
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,32 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	lb, pool := installPool(t, RoundRobin, testBackend(t, "a", 0).URL)
+	if rec := admin(t, lb, http.MethodGet, "/lb/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("healthz status %d, want 200", rec.Code)
+	}
+	if rec := admin(t, lb, http.MethodGet, "/lb/readyz", ""); rec.Code != http.StatusOK {
+		t.Errorf("readyz status %d with a backend up, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	pool.Backends()[0].SetAlive(false)
+	rec := admin(t, lb, http.MethodGet, "/lb/readyz", "")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"unavailable":["test"]`) {
+		t.Errorf("readyz with no backend up: status %d, body %s; want 503 naming the pool", rec.Code, rec.Body.String())
+	}
+	if rec := admin(t, lb, http.MethodGet, "/lb/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("healthz status %d with no backend up, want 200", rec.Code)
+	}
+
+	cfg := *lb.config()
+	cfg.Readiness = ReadinessConfig{Pools: []string{"missing"}}
+	if err := cfg.Readiness.validate(cfg.Pools); err == nil {
+		t.Error("readiness accepted an unknown pool")
+	}
+}
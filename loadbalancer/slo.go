@@ -0,0 +1,240 @@
+package loadbalancer
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sloMaxAge drops samples older than this, so a backend avoided for a
+// route (and so no longer measured on it) gets another chance
+const sloMaxAge = time.Minute
+
+// latencySlots split sloMaxAge, samples expire a slot at a time
+const latencySlots = 6
+
+// windowSubBuckets is how many buckets each octave is split into. Finer
+// than the history's buckets, a window's percentile is within 1/8 of the
+// true value since it decides routing.
+const windowSubBuckets = 8
+
+// windowBuckets covers latencies up to about 18 hours, longer ones are
+// counted in the last bucket
+const windowBuckets = 24 * windowSubBuckets
+
+// windowBucket returns the window bucket of ms. Values below
+// windowSubBuckets get a bucket each, larger ones share a bucket with
+// those having the same four leading bits.
+func windowBucket(ms int64) int {
+	if ms < windowSubBuckets {
+		return int(max(ms, 0))
+	}
+	shift := bits.Len64(uint64(ms)) - 4
+	return min((shift+1)*windowSubBuckets+int(ms>>shift)-windowSubBuckets, windowBuckets-1)
+}
+
+// windowBucketFloor is the smallest latency counted in bucket i
+func windowBucketFloor(i int) int64 {
+	if i < windowSubBuckets {
+		return int64(i)
+	}
+	return int64(i%windowSubBuckets+windowSubBuckets) << (i/windowSubBuckets - 1)
+}
+
+// latencyWindow is a histogram of the latencies seen in the last
+// sloMaxAge. Each slot counts the samples of one part of it, and total
+// the samples of all live slots, so reading a percentile needs neither a
+// copy nor a sort.
+type latencyWindow struct {
+	mu    sync.Mutex
+	slots [latencySlots]struct {
+		// period numbers the part of the window the slot counts
+		period int64
+		counts [windowBuckets]uint32
+	}
+	total [windowBuckets]uint32
+	n     uint32
+}
+
+// advance expires the slots that fell out of the window at now and
+// returns the slot of now; w.mu must be held
+func (w *latencyWindow) advance(now time.Time) int {
+	period := now.UnixNano() / int64(sloMaxAge/latencySlots)
+	for i := range w.slots {
+		slot := &w.slots[i]
+		if slot.period > period-latencySlots || slot.period == 0 {
+			continue
+		}
+		for b, c := range slot.counts {
+			w.total[b] -= c
+			w.n -= c
+		}
+		slot.period, slot.counts = 0, [windowBuckets]uint32{}
+	}
+	i := int(period % latencySlots)
+	w.slots[i].period = period
+	return i
+}
+
+// Add records one sample
+func (w *latencyWindow) Add(ms int64) {
+	b := windowBucket(ms)
+	w.mu.Lock()
+	i := w.advance(time.Now())
+	w.slots[i].counts[b]++
+	w.total[b]++
+	w.n++
+	w.mu.Unlock()
+}
+
+// P95 returns the 95th percentile of recent samples, 0 if there are none
+func (w *latencyWindow) P95() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(time.Now())
+	if w.n == 0 {
+		return 0
+	}
+	rank, seen := w.n*95/100, uint32(0)
+	for b, c := range w.total {
+		if seen += c; seen > rank {
+			return windowBucketFloor(b)
+		}
+	}
+	return windowBucketFloor(windowBuckets - 1)
+}
+
+// idle reports whether the window holds no samples
+func (w *latencyWindow) idle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(time.Now())
+	return w.n == 0
+}
+
+// sloTracker keeps per-route, per-backend latency windows for routes that
+// have a latency SLO
+type sloTracker struct {
+	mu     sync.RWMutex
+	routes map[string]map[*Backend]*latencyWindow
+	// swept is when idle windows were last dropped, in Unix nanoseconds
+	swept atomic.Int64
+}
+
+var latencySLOs = &sloTracker{routes: map[string]map[*Backend]*latencyWindow{}}
+
+// routeKey identifies a route across the tracker
+func routeKey(route *RouteConfig) string {
+	if route.Name != "" {
+		return route.Name
+	}
+	return route.Host + route.PathPrefix
+}
+
+// window returns the window of backend on route, creating it if needed
+func (t *sloTracker) window(route string, b *Backend, create bool) *latencyWindow {
+	t.mu.RLock()
+	w := t.routes[route][b]
+	t.mu.RUnlock()
+	if w != nil || !create {
+		return w
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.routes[route] == nil {
+		t.routes[route] = map[*Backend]*latencyWindow{}
+	}
+	if w = t.routes[route][b]; w == nil {
+		w = &latencyWindow{}
+		t.routes[route][b] = w
+	}
+	return w
+}
+
+// Observe records a request's latency if its route has an SLO
+func (t *sloTracker) Observe(route *RouteConfig, b *Backend, ms int64) {
+	if route == nil || route.LatencySLO <= 0 {
+		return
+	}
+	t.window(routeKey(route), b, true).Add(ms)
+	if now := time.Now().UnixNano(); now-t.swept.Load() > int64(sloMaxAge) {
+		t.swept.Store(now)
+		t.sweep()
+	}
+}
+
+// sweep drops the windows without recent samples, those of removed
+// routes and backends among them
+func (t *sloTracker) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, backends := range t.routes {
+		for b, w := range backends {
+			if w.idle() {
+				delete(backends, b)
+			}
+		}
+		if len(backends) == 0 {
+			delete(t.routes, key)
+		}
+	}
+}
+
+// avoider returns a predicate matching backends that currently break the
+// route's SLO, or nil when the route has none
+func (t *sloTracker) avoider(route *RouteConfig) func(*Backend) bool {
+	if route == nil || route.LatencySLO <= 0 {
+		return nil
+	}
+	key := routeKey(route)
+	limit := time.Duration(route.LatencySLO).Milliseconds()
+	return func(b *Backend) bool {
+		w := t.window(key, b, false)
+		return w != nil && w.P95() > limit
+	}
+}
+
+// Snapshot returns the p95 of every tracked route/backend pair, with the
+// SLO each of routes sets
+func (t *sloTracker) Snapshot(routes []RouteConfig) []map[string]interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	slos := map[string]int64{}
+	for _, route := range routes {
+		if route.LatencySLO > 0 {
+			slos[routeKey(&route)] = time.Duration(route.LatencySLO).Milliseconds()
+		}
+	}
+
+	keys := make([]string, 0, len(t.routes))
+	for k := range t.routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := []map[string]interface{}{}
+	for _, key := range keys {
+		backends := []map[string]interface{}{}
+		for b, w := range t.routes[key] {
+			p95 := w.P95()
+			backends = append(backends, map[string]interface{}{
+				"url":       b.URL.String(),
+				"p95_ms":    p95,
+				"violating": p95 > slos[key],
+			})
+		}
+		sort.Slice(backends, func(i, j int) bool {
+			return backends[i]["url"].(string) < backends[j]["url"].(string)
+		})
+		result = append(result, map[string]interface{}{
+			"route":    key,
+			"slo_ms":   slos[key],
+			"backends": backends,
+		})
+	}
+	return result
+}
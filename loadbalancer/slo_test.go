@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	for ms := int64(0); ms < 1<<20; ms += 1 + ms/7 {
+		if floor := windowBucketFloor(windowBucket(ms)); floor > ms || ms-floor > ms/8 {
+			t.Fatalf("%dms counted in the bucket from %dms", ms, floor)
+		}
+	}
+
+	var w latencyWindow
+	for ms := int64(1); ms <= 1000; ms++ {
+		w.Add(ms)
+	}
+	if p95 := w.P95(); p95 < 950*7/8 || p95 > 950 {
+		t.Errorf("p95 = %d, want about 950", p95)
+	}
+	w.mu.Lock()
+	w.advance(time.Now().Add(sloMaxAge + sloMaxAge/latencySlots))
+	w.mu.Unlock()
+	if !w.idle() || w.P95() != 0 {
+		t.Errorf("samples older than %v kept", sloMaxAge)
+	}
+
+	// Windows without recent samples are dropped, as are their routes
+	tracker := &sloTracker{routes: map[string]map[*Backend]*latencyWindow{}}
+	route := &RouteConfig{Name: "slow", LatencySLO: Duration(time.Second)}
+	live, gone := &Backend{}, &Backend{}
+	tracker.Observe(route, live, 10)
+	tracker.Observe(&RouteConfig{Name: "removed", LatencySLO: Duration(time.Second)}, gone, 10)
+	old := tracker.window("removed", gone, false)
+	old.mu.Lock()
+	for i := range old.slots {
+		if old.slots[i].period != 0 {
+			old.slots[i].period -= latencySlots
+		}
+	}
+	old.mu.Unlock()
+	tracker.sweep()
+	if tracker.window("slow", live, false) == nil || tracker.routes["removed"] != nil {
+		t.Errorf("sweep kept %v", tracker.routes)
+	}
+}
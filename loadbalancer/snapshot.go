@@ -0,0 +1,176 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotConfig names a critical GET path whose last good response is kept
+// as a last resort for when its pool cannot answer at all
+type SnapshotConfig struct {
+	// Path including any query string, matched exactly
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	// MaxBytes caps the snapshot body, larger responses are not kept
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// validate fills in defaults and checks required fields
+func (s *SnapshotConfig) validate() error {
+	if !strings.HasPrefix(s.Path, "/") {
+		return fmt.Errorf("snapshot %s: path must start with /", s.Path)
+	}
+	if s.Interval <= 0 {
+		s.Interval = Duration(time.Minute)
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = Duration(10 * time.Second)
+	}
+	if s.MaxBytes <= 0 {
+		s.MaxBytes = 1 << 20
+	}
+	return nil
+}
+
+// snapshot is the last good response for a path
+type snapshot struct {
+	header http.Header
+	body   []byte
+	taken  time.Time
+}
+
+// snapshotStore holds the latest snapshot of every configured path
+type snapshotStore struct {
+	mu     sync.RWMutex
+	byPath map[string]*snapshot
+	served int64
+}
+
+var snapshots = &snapshotStore{byPath: map[string]*snapshot{}}
+
+// Start launches one refresher per configured path, fetching from the
+// pools of lb
+func (s *snapshotStore) Start(lb *Balancer, cfgs []SnapshotConfig) {
+	for _, cfg := range cfgs {
+		go s.loop(lb, cfg)
+	}
+	if len(cfgs) > 0 {
+		slog.Info("Snapshots enabled", "paths", len(cfgs))
+	}
+}
+
+// loop refreshes one path on its interval until the process exits
+func (s *snapshotStore) loop(lb *Balancer, cfg SnapshotConfig) {
+	t := time.NewTicker(time.Duration(cfg.Interval))
+	defer t.Stop()
+	for {
+		if err := s.take(lb, cfg); err != nil {
+			slog.Warn("Snapshot refresh failed, keeping previous", "path", cfg.Path, "error", err)
+		}
+		<-t.C
+	}
+}
+
+// take fetches the path from a live backend of its pool and stores it if
+// the answer was a complete 200
+func (s *snapshotStore) take(lb *Balancer, cfg SnapshotConfig) error {
+	path, _, _ := strings.Cut(cfg.Path, "?")
+	route := lb.config().MatchRoute("", "", path, "")
+	pool := lb.poolFor(route)
+	if pool == nil {
+		return fmt.Errorf("no pool serves this path")
+	}
+	peer := selectPeer(route, pool, "", nil)
+	if peer == nil {
+		return fmt.Errorf("no backend available")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeout))
+	defer cancel()
+	target := strings.TrimSuffix(peer.URL.String(), "/") + cfg.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "lb-snapshot/1.0")
+
+	resp, err := peer.ReverseProxy.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend %s returned %s", peer.URL.Host, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > cfg.MaxBytes {
+		return fmt.Errorf("response larger than %d bytes", cfg.MaxBytes)
+	}
+
+	header := resp.Header.Clone()
+	for _, h := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Set-Cookie", "Content-Length", "Date"} {
+		header.Del(h)
+	}
+	s.mu.Lock()
+	s.byPath[cfg.Path] = &snapshot{header: header, body: body, taken: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+// Serve answers r from its snapshot, reporting false if there is none
+func (s *snapshotStore) Serve(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	s.mu.Lock()
+	snap := s.byPath[r.URL.RequestURI()]
+	if snap != nil {
+		s.served++
+	}
+	s.mu.Unlock()
+	if snap == nil {
+		return false
+	}
+
+	header := w.Header()
+	for k, vs := range snap.header {
+		header[k] = append([]string(nil), vs...)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(snap.taken).Seconds())))
+	header.Set("X-LB-Snapshot", snap.taken.UTC().Format(http.TimeFormat))
+	header.Add("Warning", `111 - "Revalidation Failed"`)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(snap.body)
+	}
+	return true
+}
+
+// Stats reports the snapshot ages and how often they were served
+func (s *snapshotStore) Stats() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths := map[string]interface{}{}
+	for path, snap := range s.byPath {
+		paths[path] = map[string]interface{}{
+			"taken": snap.taken,
+			"bytes": len(snap.body),
+		}
+	}
+	return map[string]interface{}{
+		"paths":  paths,
+		"served": s.served,
+	}
+}
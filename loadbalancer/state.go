@@ -0,0 +1,191 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// StateConfig keeps what the balancer learned about its backends across
+// restarts, so a restart does not send full traffic to a backend known to
+// be bad
+type StateConfig struct {
+	// File the state is written to, atomically
+	File string `json:"file"`
+	// SaveInterval is how often the state is saved besides on shutdown,
+	// 1m if unset
+	SaveInterval Duration `json:"save_interval,omitempty"`
+	// MaxAge ignores state older than this on start, 1h if unset
+	MaxAge Duration `json:"max_age,omitempty"`
+}
+
+// validate fills in defaults and checks the file is set
+func (c *StateConfig) validate() error {
+	if c.File == "" {
+		return fmt.Errorf("state: file must be set")
+	}
+	if c.SaveInterval <= 0 {
+		c.SaveInterval = Duration(time.Minute)
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = Duration(time.Hour)
+	}
+	return nil
+}
+
+// savedState is the document written to the state file
+type savedState struct {
+	Saved    time.Time      `json:"saved"`
+	Backends []savedBackend `json:"backends"`
+}
+
+// savedBackend is what is kept of one backend, found again on start by
+// its pool and ID
+type savedBackend struct {
+	Pool         string        `json:"pool"`
+	ID           string        `json:"id"`
+	URL          string        `json:"url"`
+	Alive        bool          `json:"alive"`
+	Cordoned     bool          `json:"cordoned"`
+	Failures     int           `json:"failures"`
+	LastFailure  time.Time     `json:"last_failure"`
+	RecentErrors []errorSample `json:"recent_errors,omitempty"`
+	// The latency average's decayable sums and when it was last fed
+	LatencySum    float64   `json:"latency_sum"`
+	LatencyWeight float64   `json:"latency_weight"`
+	LatencyLast   time.Time `json:"latency_last"`
+	RequestCount  int64     `json:"request_count"`
+	TotalLatency  int64     `json:"total_latency"`
+	Statuses      [4]int64  `json:"statuses"`
+}
+
+// save returns what is kept of b
+func (b *Backend) save(pool string) savedBackend {
+	s := savedBackend{
+		Pool:         pool,
+		ID:           b.ID,
+		URL:          b.URL.String(),
+		RecentErrors: b.recentErrors.recent(),
+		RequestCount: atomic.LoadInt64(&b.RequestCount),
+		TotalLatency: atomic.LoadInt64(&b.TotalLatency),
+	}
+	for i := range b.statuses {
+		s.Statuses[i] = atomic.LoadInt64(&b.statuses[i])
+	}
+	b.mux.RLock()
+	s.Alive, s.Cordoned = b.Alive, b.Cordoned
+	s.Failures, s.LastFailure = b.failures, b.lastFailure
+	b.mux.RUnlock()
+	b.latency.mu.Lock()
+	s.LatencySum, s.LatencyWeight, s.LatencyLast = b.latency.sum, b.latency.weight, b.latency.last
+	b.latency.mu.Unlock()
+	return s
+}
+
+// restore puts saved state back into b; a backend that was down stays
+// down until it passes the warm-up probes
+func (b *Backend) restore(s savedBackend) {
+	atomic.StoreInt64(&b.RequestCount, s.RequestCount)
+	atomic.StoreInt64(&b.TotalLatency, s.TotalLatency)
+	for i := range b.statuses {
+		atomic.StoreInt64(&b.statuses[i], s.Statuses[i])
+	}
+	for _, e := range s.RecentErrors {
+		b.recentErrors.add(e.Error)
+	}
+	b.mux.Lock()
+	b.Cordoned = s.Cordoned
+	b.failures, b.lastFailure = s.Failures, s.LastFailure
+	if !s.Alive {
+		b.Alive = false
+		b.warming = b.pool.settings().HealthCheck.WarmUp.Probes
+	}
+	b.mux.Unlock()
+	b.latency.mu.Lock()
+	b.latency.sum, b.latency.weight, b.latency.last = s.LatencySum, s.LatencyWeight, s.LatencyLast
+	if s.LatencyWeight > 0 {
+		atomic.StoreInt64(&b.AvgLatency, int64(s.LatencySum/s.LatencyWeight))
+	}
+	b.latency.mu.Unlock()
+}
+
+// saveState writes the state of every backend to cfg.File
+func (lb *Balancer) saveState(cfg *StateConfig) error {
+	state := savedState{Saved: time.Now(), Backends: []savedBackend{}}
+	for _, name := range lb.poolNames() {
+		for _, b := range lb.pools()[name].snapshot() {
+			state.Backends = append(state.Backends, b.save(name))
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write beside the file and rename so a crash never leaves half a file
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.File), filepath.Base(cfg.File)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cfg.File)
+}
+
+// loadState restores the backends found in cfg.File and returns how many;
+// a missing or outdated file restores nothing
+func (lb *Balancer) loadState(cfg *StateConfig) (int, error) {
+	data, err := os.ReadFile(cfg.File)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("state %s: %w", cfg.File, err)
+	}
+	if age := time.Since(state.Saved); age > time.Duration(cfg.MaxAge) {
+		slog.Info("Saved state too old, not restored", "file", cfg.File, "age", age.Round(time.Second))
+		return 0, nil
+	}
+	restored := 0
+	for _, s := range state.Backends {
+		pool := lb.pools()[s.Pool]
+		if pool == nil {
+			continue
+		}
+		if b := pool.findBackend(s.ID, ""); b != nil {
+			b.restore(s)
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// stateRoutine saves the state every interval until ctx is done; Main
+// saves it once more when shutting down
+func (lb *Balancer) stateRoutine(ctx context.Context, cfg *StateConfig) {
+	t := time.NewTicker(time.Duration(cfg.SaveInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := lb.saveState(cfg); err != nil {
+				slog.Warn("State not saved", "file", cfg.File, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
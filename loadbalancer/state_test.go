@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatePersistence(t *testing.T) {
+	good, bad := testBackend(t, "good", 0).URL, deadURL(t)
+	cfg := &StateConfig{File: filepath.Join(t.TempDir(), "state.json")}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb, pool := installPool(t, RoundRobin, good, bad)
+	send(t, lb.Handler(), 4)
+	for _, b := range pool.Backends() {
+		if b.URL.String() == bad {
+			b.SetAlive(false)
+			b.SetCordoned(true)
+		}
+	}
+	if err := lb.saveState(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart builds the pool afresh
+	restarted, restartedPool := installPool(t, RoundRobin, good, bad)
+	if n, err := restarted.loadState(cfg); err != nil || n != 2 {
+		t.Fatalf("restored %d backends, %v; want 2", n, err)
+	}
+	for _, b := range restartedPool.Backends() {
+		switch b.URL.String() {
+		case good:
+			if !b.IsAlive() || atomic.LoadInt64(&b.RequestCount) != 4 || b.latency.weight != 4 {
+				t.Errorf("good backend restored alive=%v with %d requests, latency weight %v; want alive with 4 of each",
+					b.IsAlive(), b.RequestCount, b.latency.weight)
+			}
+		case bad:
+			if b.IsAlive() || !b.IsCordoned() || len(b.recentErrors.recent()) == 0 {
+				t.Errorf("bad backend restored alive=%v cordoned=%v, want down and cordoned with its errors", b.IsAlive(), b.IsCordoned())
+			}
+		}
+	}
+
+	// Outdated state is ignored
+	cfg.MaxAge = Duration(time.Nanosecond)
+	if n, err := restarted.loadState(cfg); err != nil || n != 0 {
+		t.Errorf("restored %d backends from outdated state, %v", n, err)
+	}
+}
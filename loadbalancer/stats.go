@@ -0,0 +1,322 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// BackendStats is what the admin API reports for one backend. Fields are
+// added over time but never renamed or removed.
+type BackendStats struct {
+	ID           string `json:"id"`
+	Pool         string `json:"pool"`
+	URL          string `json:"url"`
+	Alive        bool   `json:"alive"`
+	Status       string `json:"status"`
+	AvgLatency   int64  `json:"avg_latency"`
+	RequestCount int64  `json:"request_count"`
+	Active       int64  `json:"active"`
+	// ClusterActive is the requests in flight on the other cluster nodes
+	ClusterActive int64 `json:"cluster_active"`
+	// ClusterDown is set when most of the cluster sees the backend down
+	ClusterDown bool `json:"cluster_down,omitempty"`
+	// BytesSent and BytesReceived count request and response bodies
+	BytesSent     int64            `json:"bytes_sent"`
+	BytesReceived int64            `json:"bytes_received"`
+	Responses     map[string]int64 `json:"responses"`
+	Cordoned      bool             `json:"cordoned"`
+	Weight        float64          `json:"weight"`
+	Tier          string           `json:"tier"`
+	Zone          string           `json:"zone,omitempty"`
+	ResolvedFrom  string           `json:"resolved_from,omitempty"`
+}
+
+// PoolStats summarizes a pool, rates cover the last minute
+type PoolStats struct {
+	Name         string `json:"name"`
+	Backends     int    `json:"backends"`
+	Up           int    `json:"up"`
+	RequestCount int64  `json:"request_count"`
+	// RPS is the responses per second from the pool's members
+	RPS float64 `json:"rps"`
+	// ErrorRate is the share of attempts that failed or got a 5xx
+	ErrorRate float64 `json:"error_rate"`
+	// AvgLatency is the members' average weighted by their requests
+	AvgLatency int64 `json:"avg_latency"`
+}
+
+// Stats is the document served by /lb/stats
+type Stats struct {
+	Algorithm Strategy       `json:"algorithm"`
+	Pools     []PoolStats    `json:"pools"`
+	Backends  []BackendStats `json:"backends"`
+	// Matched is how many backends passed the filters, before paging
+	Matched  int                      `json:"matched"`
+	Traffic  []map[string]interface{} `json:"traffic"`
+	Cache    map[string]interface{}   `json:"cache"`
+	SLO      []map[string]interface{} `json:"slo"`
+	DryRun   []map[string]interface{} `json:"dry_run"`
+	Snapshot map[string]interface{}   `json:"snapshot"`
+	Health   *healthSummary           `json:"health"`
+	TCP      []map[string]interface{} `json:"tcp"`
+	UDP      []map[string]interface{} `json:"udp"`
+	Mirror   []map[string]interface{} `json:"mirror"`
+	Faults   []map[string]interface{} `json:"faults"`
+	// Routes counts body bytes from and to the clients of each route
+	Routes []map[string]interface{} `json:"routes"`
+	// Connections counts client connections by listener
+	Connections []map[string]interface{} `json:"connections"`
+	// RouteBackends breaks backend traffic down by route
+	RouteBackends []map[string]interface{} `json:"route_backends"`
+}
+
+// GetBackends returns all backends with their stats
+func (s *ServerPool) GetBackends() []BackendStats {
+	backends := s.snapshot()
+	result := make([]BackendStats, len(backends))
+	for i, b := range backends {
+		result[i] = s.backendStats(b)
+	}
+	return result
+}
+
+// backendStats returns the stats of b, a member of the pool
+func (s *ServerPool) backendStats(b *Backend) BackendStats {
+	stats := BackendStats{
+		ID:            b.ID,
+		Pool:          s.Name,
+		URL:           b.URL.String(),
+		Alive:         b.IsAlive(),
+		Status:        b.Status(),
+		AvgLatency:    b.GetAvgLatency(),
+		RequestCount:  atomic.LoadInt64(&b.RequestCount),
+		Active:        atomic.LoadInt64(&b.active),
+		ClusterActive: atomic.LoadInt64(&b.clusterActive),
+		ClusterDown:   b.isClusterDown(),
+		BytesSent:     atomic.LoadInt64(&b.bytesSent),
+		BytesReceived: atomic.LoadInt64(&b.bytesReceived),
+		Responses:     b.StatusCounts(),
+		Cordoned:      b.IsCordoned(),
+		Weight:        b.Weight(),
+		Tier:          "primary",
+		Zone:          s.zoneOf(b),
+	}
+	if b.isBackup() {
+		stats.Tier = "backup"
+	}
+	if b.origin != "" && !b.isBackup() {
+		stats.ResolvedFrom = b.origin
+	}
+	return stats
+}
+
+// Summary returns the pool's totals and last minute rates
+func (s *ServerPool) Summary() PoolStats {
+	stats := PoolStats{Name: s.Name}
+	var latencySum float64
+	for _, b := range s.snapshot() {
+		stats.Backends++
+		if b.IsAvailable() {
+			stats.Up++
+		}
+		requests := atomic.LoadInt64(&b.RequestCount)
+		stats.RequestCount += requests
+		latencySum += float64(b.GetAvgLatency() * requests)
+	}
+	if stats.RequestCount > 0 {
+		stats.AvgLatency = int64(latencySum / float64(stats.RequestCount))
+	}
+	now := time.Now()
+	attempts, failed := s.attempts.count(now), s.failures.count(now)
+	stats.RPS = float64(attempts) / rateWindowSeconds
+	if attempts > 0 {
+		stats.ErrorRate = float64(failed) / float64(attempts)
+	}
+	return stats
+}
+
+// observe counts an attempt on one of the pool's members for its rates
+func (s *ServerPool) observe(failed bool) {
+	now := time.Now()
+	s.attempts.add(now)
+	if failed {
+		s.failures.add(now)
+	}
+}
+
+// rateWindowSeconds is how far back pool rates look
+const rateWindowSeconds = 60
+
+// rateWindow counts events in one second buckets over the last minute
+// without locking; the second in progress has its own bucket
+type rateWindow struct {
+	buckets [rateWindowSeconds + 1]struct {
+		sec, n atomic.Int64
+	}
+}
+
+// add counts one event at now
+func (w *rateWindow) add(now time.Time) {
+	sec := now.Unix()
+	b := &w.buckets[sec%int64(len(w.buckets))]
+	if old := b.sec.Load(); old != sec && b.sec.CompareAndSwap(old, sec) {
+		b.n.Store(0)
+	}
+	b.n.Add(1)
+}
+
+// count returns the events in the whole seconds of the last minute
+func (w *rateWindow) count(now time.Time) int64 {
+	cur := now.Unix()
+	var total int64
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if sec := b.sec.Load(); sec < cur && sec >= cur-rateWindowSeconds {
+			total += b.n.Load()
+		}
+	}
+	return total
+}
+
+// allBackends returns the stats of every backend in every pool
+func (lb *Balancer) allBackends() []BackendStats {
+	result := []BackendStats{}
+	for _, name := range lb.poolNames() {
+		result = append(result, lb.pools()[name].GetBackends()...)
+	}
+	return result
+}
+
+// poolNames returns the names of the running pools in order
+func (lb *Balancer) poolNames() []string {
+	pools := lb.pools()
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// statsQuery narrows down the backends /lb/stats reports
+type statsQuery struct {
+	pool      string
+	unhealthy bool
+	sort      string
+	offset    int
+	limit     int
+}
+
+// parseStatsQuery reads ?pool=, ?unhealthy=true, ?sort=latency|requests,
+// ?offset= and ?limit=
+func (lb *Balancer) parseStatsQuery(v url.Values) (statsQuery, error) {
+	q := statsQuery{pool: v.Get("pool"), sort: v.Get("sort")}
+	if q.pool != "" && lb.pools()[q.pool] == nil {
+		return q, fmt.Errorf("unknown pool %q", q.pool)
+	}
+	switch q.sort {
+	case "", "latency", "requests":
+	default:
+		return q, fmt.Errorf("unknown sort %q, use latency or requests", q.sort)
+	}
+	if s := v.Get("unhealthy"); s != "" {
+		unhealthy, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, fmt.Errorf("unhealthy must be true or false")
+		}
+		q.unhealthy = unhealthy
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"offset", &q.offset}, {"limit", &q.limit}} {
+		if s := v.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("%s must be a non-negative integer", p.name)
+			}
+			*p.dst = n
+		}
+	}
+	return q, nil
+}
+
+// backends returns the backends of lb matching q, sorted and paged, and
+// how many matched in all
+func (q statsQuery) backends(lb *Balancer) ([]BackendStats, int) {
+	names := lb.poolNames()
+	if q.pool != "" {
+		names = []string{q.pool}
+	}
+	result := []BackendStats{}
+	for _, name := range names {
+		for _, b := range lb.pools()[name].GetBackends() {
+			if !q.unhealthy || b.Status != "up" {
+				result = append(result, b)
+			}
+		}
+	}
+	switch q.sort {
+	case "latency":
+		// Slowest first, for triage
+		sort.SliceStable(result, func(i, j int) bool { return result[i].AvgLatency > result[j].AvgLatency })
+	case "requests":
+		sort.SliceStable(result, func(i, j int) bool { return result[i].RequestCount > result[j].RequestCount })
+	}
+	matched := len(result)
+	if q.offset > len(result) {
+		q.offset = len(result)
+	}
+	result = result[q.offset:]
+	if q.limit > 0 && q.limit < len(result) {
+		result = result[:q.limit]
+	}
+	return result, matched
+}
+
+// statsHandler returns load balancer statistics
+func (lb *Balancer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := lb.parseStatsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lb.collectStats(q))
+}
+
+// collectStats gathers the statistics served by /lb/stats
+func (lb *Balancer) collectStats(q statsQuery) Stats {
+	backends, matched := q.backends(lb)
+	summaries := []PoolStats{}
+	for _, name := range lb.poolNames() {
+		if q.pool == "" || q.pool == name {
+			summaries = append(summaries, lb.pools()[name].Summary())
+		}
+	}
+	return Stats{
+		Algorithm:     lb.currentAlgorithm(),
+		Pools:         summaries,
+		Backends:      backends,
+		Matched:       matched,
+		Traffic:       trafficByLabels.Snapshot(),
+		Cache:         cache.Stats(),
+		SLO:           latencySLOs.Snapshot(lb.config().Routes),
+		DryRun:        dryRuns.Snapshot(),
+		Snapshot:      snapshots.Stats(),
+		Health:        lb.lastHealthCycle.Load(),
+		TCP:           tcpStats(),
+		UDP:           udpStats(),
+		Mirror:        mirrorSnapshot(),
+		Faults:        faults.Snapshot(),
+		Routes:        routeTraffic.Snapshot(),
+		Connections:   connections.Snapshot(),
+		RouteBackends: routeBackends.Snapshot(),
+	}
+}
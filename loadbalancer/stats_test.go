@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatsEndpoint(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, _ := installPool(t, RoundRobin, a.URL, b.URL)
+	h := lb.Handler()
+	send(t, h, 6)
+
+	rec := admin(t, lb, http.MethodGet, "/lb/stats", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var stats struct {
+		Algorithm string `json:"algorithm"`
+		Backends  []struct {
+			Pool         string `json:"pool"`
+			URL          string `json:"url"`
+			Alive        bool   `json:"alive"`
+			RequestCount int64  `json:"request_count"`
+		} `json:"backends"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Algorithm == "" {
+		t.Error("algorithm missing")
+	}
+	seen := map[string]int64{}
+	for _, b := range stats.Backends {
+		if b.Pool == "test" {
+			seen[b.URL] = b.RequestCount
+			if !b.Alive {
+				t.Errorf("%s reported down", b.URL)
+			}
+		}
+	}
+	for _, u := range []string{a.URL, b.URL} {
+		if seen[u] != 3 {
+			t.Errorf("%s request_count = %d, want 3 (%v)", u, seen[u], seen)
+		}
+	}
+}
+
+func TestStatsQuery(t *testing.T) {
+	a, b := testBackend(t, "a", 0), testBackend(t, "b", 0)
+	lb, pool := installPool(t, RoundRobin, a.URL, b.URL, "http://10.0.0.1")
+	pool.Backends()[2].SetAlive(false)
+	pool.Backends()[0].SetCordoned(true)
+	send(t, lb.Handler(), 3)
+
+	get := func(query string) Stats {
+		t.Helper()
+		rec := admin(t, lb, http.MethodGet, "/lb/stats?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, body %q", query, rec.Code, rec.Body.String())
+		}
+		var stats Stats
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := get("pool=test&unhealthy=true")
+	if stats.Matched != 2 || len(stats.Backends) != 2 {
+		t.Errorf("unhealthy matched %d, returned %v", stats.Matched, stats.Backends)
+	}
+	stats = get("sort=requests&limit=1")
+	if stats.Matched != 3 || len(stats.Backends) != 1 || stats.Backends[0].URL != b.URL {
+		t.Errorf("busiest backend = %v of %d, want %s", stats.Backends, stats.Matched, b.URL)
+	}
+	if len(stats.Pools) != 1 || stats.Pools[0].Name != "test" || stats.Pools[0].Up != 1 || stats.Pools[0].Backends != 3 {
+		t.Errorf("pool summary = %+v", stats.Pools)
+	}
+	if stats := get("offset=5"); len(stats.Backends) != 0 || stats.Matched != 3 {
+		t.Errorf("offset past the end returned %v, matched %d", stats.Backends, stats.Matched)
+	}
+	for _, bad := range []string{"pool=nope", "sort=name", "limit=-1", "unhealthy=maybe"} {
+		if rec := admin(t, lb, http.MethodGet, "/lb/stats?"+bad, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	var w rateWindow
+	start := time.Unix(1_000_000, 0)
+	for sec := 0; sec < 90; sec++ {
+		for i := 0; i < 5; i++ {
+			w.add(start.Add(time.Duration(sec) * time.Second))
+		}
+	}
+	// At second 90 the last whole minute is seconds 30 to 89
+	if got := w.count(start.Add(90 * time.Second)); got != 300 {
+		t.Errorf("count = %d, want 300", got)
+	}
+	if got := w.count(start.Add(10 * time.Minute)); got != 0 {
+		t.Errorf("count long after = %d, want 0", got)
+	}
+}
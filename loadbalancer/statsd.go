@@ -0,0 +1,176 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsDConfig sends backend request counters and latency timers to a
+// StatsD or DogStatsD agent over UDP
+type StatsDConfig struct {
+	// Address of the agent, e.g. localhost:8125
+	Address string `json:"address"`
+	// Prefix starts every metric name, "lb." if empty
+	Prefix string `json:"prefix,omitempty"`
+	// DogStatsD sends pool, backend, status class and route as tags;
+	// plain StatsD gets all but the route in the metric name instead
+	DogStatsD bool `json:"dogstatsd,omitempty"`
+	// Tags are added to every metric, DogStatsD only
+	Tags map[string]string `json:"tags,omitempty"`
+	// FlushInterval is the longest a metric waits to be sent, 1s if 0
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+	// MaxPacketBytes caps each datagram, 1432 if 0 to fit an Ethernet MTU
+	MaxPacketBytes int `json:"max_packet_bytes,omitempty"`
+}
+
+// validate fills in defaults and checks the address
+func (c *StatsDConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("statsd: address must be host:port")
+	}
+	if c.Prefix == "" {
+		c.Prefix = "lb."
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = Duration(time.Second)
+	}
+	if c.MaxPacketBytes <= 0 {
+		c.MaxPacketBytes = 1432
+	}
+	return nil
+}
+
+// statsdClient batches metric lines into datagrams; metrics that arrive
+// faster than they can be sent are dropped rather than slow requests
+type statsdClient struct {
+	cfg     *StatsDConfig
+	conn    net.Conn
+	tags    string // the configured tags, rendered
+	lines   chan string
+	dropped atomic.Int64
+}
+
+// statsd is nil when no agent is configured
+var statsd *statsdClient
+
+// newStatsD connects to the configured agent and starts sending
+func newStatsD(cfg *StatsDConfig) (*statsdClient, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	keys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, len(keys))
+	for i, k := range keys {
+		tags[i] = statsdName(k) + ":" + statsdName(cfg.Tags[k])
+	}
+	c := &statsdClient{cfg: cfg, conn: conn, tags: strings.Join(tags, ","), lines: make(chan string, 4096)}
+	go c.run()
+	return c, nil
+}
+
+// statsdName replaces characters that would break the line protocol
+var statsdName = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_").Replace
+
+// backendResponse reports one response received from a backend for a
+// request on route, "" if it matched none
+func (c *statsdClient) backendResponse(route, pool, id string, status int, ttfb time.Duration) {
+	if c == nil {
+		return
+	}
+	class := strconv.Itoa(status/100) + "xx"
+	c.send("backend.requests", "1", "c", route, pool, id, class)
+	if ttfb > 0 {
+		c.send("backend.latency", strconv.FormatInt(ttfb.Milliseconds(), 10), "ms", route, pool, id, "")
+	}
+}
+
+// backendFailure reports an attempt that got no response
+func (c *statsdClient) backendFailure(route, pool, id string) {
+	if c == nil {
+		return
+	}
+	c.send("backend.errors", "1", "c", route, pool, id, "")
+}
+
+// send queues one metric about backend id of pool, class naming the
+// response status class if there is one
+func (c *statsdClient) send(name, value, typ, route, pool, id, class string) {
+	pool, id = statsdName(pool), statsdName(id)
+	var line string
+	if c.cfg.DogStatsD {
+		tags := "pool:" + pool + ",backend:" + id
+		if class != "" {
+			tags += ",class:" + class
+		}
+		if route != "" {
+			tags += ",route:" + statsdName(route)
+		}
+		if c.tags != "" {
+			tags += "," + c.tags
+		}
+		line = c.cfg.Prefix + name + ":" + value + "|" + typ + "|#" + tags
+	} else {
+		// backend.requests becomes backend.<pool>.<id>.requests[.<class>]
+		group, metric, _ := strings.Cut(name, ".")
+		id = strings.ReplaceAll(id, ".", "_")
+		line = c.cfg.Prefix + group + "." + strings.ReplaceAll(pool, ".", "_") + "." + id + "." + metric
+		if class != "" {
+			line += "." + class
+		}
+		line += ":" + value + "|" + typ
+	}
+	select {
+	case c.lines <- line:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// run packs queued lines into datagrams, sending each when it is full or
+// the flush interval has passed
+func (c *statsdClient) run() {
+	t := time.NewTicker(time.Duration(c.cfg.FlushInterval))
+	defer t.Stop()
+	var buf bytes.Buffer
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		if _, err := c.conn.Write(buf.Bytes()); err != nil {
+			slog.Debug("StatsD packet not sent", "address", c.cfg.Address, "error", err)
+		}
+		buf.Reset()
+	}
+	for {
+		select {
+		case line := <-c.lines:
+			if buf.Len() > 0 && buf.Len()+1+len(line) > c.cfg.MaxPacketBytes {
+				flush()
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		case <-t.C:
+			if n := c.dropped.Swap(0); n > 0 {
+				slog.Warn("StatsD metrics dropped", "address", c.cfg.Address, "count", n)
+			}
+			flush()
+		}
+	}
+}
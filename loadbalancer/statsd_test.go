@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	cfg := &StatsDConfig{Address: agent.LocalAddr().String(), DogStatsD: true, Tags: map[string]string{"env": "test"},
+		FlushInterval: Duration(10 * time.Millisecond)}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	oldStatsD := statsd
+	t.Cleanup(func() { statsd = oldStatsD })
+	if statsd, err = newStatsD(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	lb, pool := installPool(t, RoundRobin, testBackend(t, "a", 0).URL)
+	send(t, lb.Handler(), 3)
+
+	id := pool.Backends()[0].ID
+	want := "lb.backend.requests:1|c|#pool:test,backend:" + id + ",class:2xx,route:test,env:test"
+	var got []string
+	buf := make([]byte, 2048)
+	agent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for strings.Count(strings.Join(got, "\n"), want) < 3 {
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("want 3 of %q, got %q: %v", want, got, err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	if !strings.Contains(strings.Join(got, "\n"), "lb.backend.latency:") {
+		t.Errorf("no latency timer in %q", got)
+	}
+}
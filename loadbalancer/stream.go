@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// statsStreamInterval is how often /lb/stats/stream pushes an update
+const statsStreamInterval = time.Second
+
+// statsStreamHandler pushes the /lb/stats document as Server-Sent Events
+// until the client goes away
+func (lb *Balancer) statsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := lb.parseStatsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// Clients reconnect after this many milliseconds if the stream drops
+	fmt.Fprintf(w, "retry: %d\n\n", statsStreamInterval.Milliseconds()*3)
+
+	t := time.NewTicker(statsStreamInterval)
+	defer t.Stop()
+	for id := 1; ; id++ {
+		data, err := json.Marshal(lb.collectStats(q))
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: stats\ndata: %s\n\n", id, data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyntheticCheck is a request periodically sent through the balancer itself
+// to verify the whole path: listener, routing, middleware and backends
+type SyntheticCheck struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	Host         string            `json:"host,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Interval     Duration          `json:"interval"`
+	Timeout      Duration          `json:"timeout"`
+	ExpectStatus int               `json:"expect_status"`
+	ExpectBody   string            `json:"expect_body,omitempty"`
+}
+
+// syntheticHistory is how many recent results are kept per check
+const syntheticHistory = 20
+
+// syntheticResult is the outcome of one check run
+type syntheticResult struct {
+	Time      time.Time `json:"time"`
+	OK        bool      `json:"ok"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// syntheticState accumulates results of one check
+type syntheticState struct {
+	check     SyntheticCheck
+	successes int64
+	failures  int64
+	recent    []syntheticResult
+}
+
+// syntheticMonitor runs the configured checks
+type syntheticMonitor struct {
+	mu     sync.RWMutex
+	states []*syntheticState
+}
+
+var synthetics syntheticMonitor
+
+// validate fills in defaults and checks required fields
+func (s *SyntheticCheck) validate() error {
+	if s.Name == "" {
+		s.Name = s.Path
+	}
+	if !strings.HasPrefix(s.Path, "/") {
+		return fmt.Errorf("synthetic check %s: path must start with /", s.Name)
+	}
+	if s.Method == "" {
+		s.Method = http.MethodGet
+	}
+	if s.Interval <= 0 {
+		s.Interval = Duration(30 * time.Second)
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = Duration(5 * time.Second)
+	}
+	if s.ExpectStatus == 0 {
+		s.ExpectStatus = http.StatusOK
+	}
+	return nil
+}
+
+// syntheticBaseURL turns a listener address into a URL we can dial locally
+func syntheticBaseURL(scheme string, addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return scheme + "://" + addr.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// Start launches one goroutine per check against the listener at base
+func (m *syntheticMonitor) Start(base string, checks []SyntheticCheck) {
+	client := &http.Client{
+		// The checks dial our own listener by IP, so its certificate
+		// cannot be verified against the name used
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		// Report redirects as they are rather than following them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	m.mu.Lock()
+	for _, check := range checks {
+		state := &syntheticState{check: check}
+		m.states = append(m.states, state)
+		go m.loop(client, base, state)
+	}
+	m.mu.Unlock()
+
+	if len(checks) > 0 {
+		slog.Info("Synthetic checks started", "checks", len(checks), "base", base)
+	}
+}
+
+// loop runs a check on its interval until the process exits
+func (m *syntheticMonitor) loop(client *http.Client, base string, state *syntheticState) {
+	t := time.NewTicker(time.Duration(state.check.Interval))
+	defer t.Stop()
+	for {
+		m.record(state, runSyntheticCheck(client, base, state.check))
+		<-t.C
+	}
+}
+
+// runSyntheticCheck sends a single check request
+func runSyntheticCheck(client *http.Client, base string, check SyntheticCheck) syntheticResult {
+	start := time.Now()
+	result := syntheticResult{Time: start}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(check.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, check.Method, base+check.Path, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+	for k, v := range check.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", "lb-synthetic/1.0")
+	req.Header.Set("X-LB-Synthetic", check.Name)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.LatencyMs = time.Since(start).Milliseconds()
+		result.Error = err.Error()
+		return result
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Status = resp.StatusCode
+
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case resp.StatusCode != check.ExpectStatus:
+		result.Error = fmt.Sprintf("expected status %d", check.ExpectStatus)
+	case check.ExpectBody != "" && !strings.Contains(string(body), check.ExpectBody):
+		result.Error = fmt.Sprintf("body does not contain %q", check.ExpectBody)
+	default:
+		result.OK = true
+	}
+	return result
+}
+
+// record stores a result and logs failures
+func (m *syntheticMonitor) record(state *syntheticState, result syntheticResult) {
+	m.mu.Lock()
+	if result.OK {
+		state.successes++
+	} else {
+		state.failures++
+	}
+	state.recent = append(state.recent, result)
+	if len(state.recent) > syntheticHistory {
+		state.recent = state.recent[len(state.recent)-syntheticHistory:]
+	}
+	m.mu.Unlock()
+
+	if !result.OK {
+		slog.Warn("Synthetic check failed", "method", state.check.Method, "path", state.check.Path,
+			"error", result.Error, "status", result.Status, "latency_ms", result.LatencyMs)
+	}
+}
+
+// Snapshot returns the state of every check
+func (m *syntheticMonitor) Snapshot() []map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]map[string]interface{}, 0, len(m.states))
+	for _, s := range m.states {
+		entry := map[string]interface{}{
+			"name":      s.check.Name,
+			"method":    s.check.Method,
+			"path":      s.check.Path,
+			"successes": s.successes,
+			"failures":  s.failures,
+			"recent":    append([]syntheticResult(nil), s.recent...),
+		}
+		if n := len(s.recent); n > 0 {
+			last := s.recent[n-1]
+			entry["ok"] = last.OK
+			entry["latency_ms"] = last.LatencyMs
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// syntheticHandler reports synthetic check results
+func syntheticHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"checks": synthetics.Snapshot(),
+	})
+}
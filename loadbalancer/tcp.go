@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TCPProxyConfig balances raw TCP connections on Address over a pool, for
+// protocols other than HTTP such as Redis or MySQL
+type TCPProxyConfig struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+	Pool    string `json:"pool"`
+	// Strategy is round-robin (the default) or least-conn
+	Strategy      Strategy            `json:"strategy,omitempty"`
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+}
+
+// validate fills in defaults and checks the address, pool and strategy
+func (t *TCPProxyConfig) validate(pools map[string]*PoolConfig) error {
+	if _, _, err := net.SplitHostPort(t.Address); err != nil {
+		return fmt.Errorf("tcp: %w", err)
+	}
+	if t.Name == "" {
+		t.Name = t.Address
+	}
+	if _, ok := pools[t.Pool]; !ok {
+		return fmt.Errorf("tcp %s: unknown pool %q", t.Name, t.Pool)
+	}
+	switch t.Strategy {
+	case "":
+		t.Strategy = RoundRobin
+	case RoundRobin, LeastConn:
+	default:
+		return fmt.Errorf("tcp %s: strategy must be %s or %s", t.Name, RoundRobin, LeastConn)
+	}
+	return t.ProxyProtocol.validate()
+}
+
+// tcpProxy is a running TCP proxy and its counters
+type tcpProxy struct {
+	lb          *Balancer
+	cfg         TCPProxyConfig
+	connections int64
+	active      int64
+	failed      int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+var tcpProxies []*tcpProxy
+
+// startTCPProxy listens on the configured address and balances connections
+// over lb's pool until the process exits
+func (lb *Balancer) startTCPProxy(cfg TCPProxyConfig) error {
+	ln, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return fmt.Errorf("tcp %s: %w", cfg.Name, err)
+	}
+	if cfg.ProxyProtocol.Accept {
+		ln = proxyProtoListener{ln, cfg.ProxyProtocol.trusted}
+	}
+	p := &tcpProxy{lb: lb, cfg: cfg}
+	tcpProxies = append(tcpProxies, p)
+	slog.Info("TCP proxy started", "proxy", cfg.Name, "address", ln.Addr().String(), "pool", cfg.Pool, "strategy", cfg.Strategy)
+	go acceptLoop(ln, "TCP "+cfg.Name, p.serve)
+	return nil
+}
+
+// serve relays one client connection to a backend, trying the others when
+// the chosen one cannot be reached
+func (p *tcpProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	atomic.AddInt64(&p.connections, 1)
+	atomic.AddInt64(&p.active, 1)
+	defer atomic.AddInt64(&p.active, -1)
+
+	pool := p.lb.pools()[p.cfg.Pool]
+	tried := map[*Backend]bool{}
+	avoid := func(b *Backend) bool { return tried[b] }
+	for {
+		var backend *Backend
+		if p.cfg.Strategy == LeastConn {
+			backend = pool.LeastConnPeerAvoiding(avoid)
+		} else {
+			backend = pool.NextPeerAvoiding(avoid)
+		}
+		if backend == nil {
+			atomic.AddInt64(&p.failed, 1)
+			slog.Warn("TCP no backend available", "proxy", p.cfg.Name, "client", conn.RemoteAddr().String())
+			return
+		}
+		tried[backend] = true
+
+		addr := net.JoinHostPort(backend.URL.Hostname(), backendPort(backend.URL))
+		upstream, err := net.DialTimeout("tcp", addr, time.Duration(p.lb.config().Timeouts.Connect))
+		if err != nil {
+			slog.Warn("TCP dial failed", "proxy", p.cfg.Name, "backend", addr, "error", err)
+			continue
+		}
+		p.relay(conn, upstream, backend)
+		return
+	}
+}
+
+// relay copies the connection both ways and accounts for its bytes
+func (p *tcpProxy) relay(conn, upstream net.Conn, backend *Backend) {
+	defer upstream.Close()
+	atomic.AddInt64(&backend.active, 1)
+	defer atomic.AddInt64(&backend.active, -1)
+
+	if send := p.cfg.ProxyProtocol.Send; send != "" {
+		if err := writeProxyHeader(upstream, send, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			return
+		}
+	}
+	start := time.Now()
+	sent, received := relay(conn, upstream)
+	atomic.AddInt64(&p.bytesIn, sent)
+	atomic.AddInt64(&p.bytesOut, received)
+	slog.Debug("TCP connection closed", "proxy", p.cfg.Name, "client", conn.RemoteAddr().String(),
+		"backend", upstream.RemoteAddr().String(), "duration", time.Since(start).Round(time.Millisecond),
+		"bytes_in", sent, "bytes_out", received)
+}
+
+// tcpStats returns the counters of every TCP proxy
+func tcpStats() []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(tcpProxies))
+	for _, p := range tcpProxies {
+		result = append(result, map[string]interface{}{
+			"name":        p.cfg.Name,
+			"address":     p.cfg.Address,
+			"pool":        p.cfg.Pool,
+			"strategy":    p.cfg.Strategy,
+			"connections": atomic.LoadInt64(&p.connections),
+			"active":      atomic.LoadInt64(&p.active),
+			"failed":      atomic.LoadInt64(&p.failed),
+			"bytes_in":    atomic.LoadInt64(&p.bytesIn),
+			"bytes_out":   atomic.LoadInt64(&p.bytesOut),
+		})
+	}
+	return result
+}
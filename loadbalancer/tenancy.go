@@ -0,0 +1,127 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+)
+
+// TenancyConfig sends each tenant of a route to its own pool. The tenant
+// is who the request authenticated as: a claim of the token the route's
+// jwt settings verified, or the user or API key name its auth accepted.
+// Behind a gateway that authenticates clients itself it can come from a
+// header the gateway sets instead.
+type TenancyConfig struct {
+	Claim string `json:"claim,omitempty"`
+	// User takes the user or API key name the route's auth accepted
+	User bool `json:"user,omitempty"`
+	// Header is only believed from TrustedSources, the gateways' networks;
+	// other clients could name any tenant, so it is removed from their
+	// requests
+	Header         string   `json:"header,omitempty"`
+	TrustedSources []string `json:"trusted_sources,omitempty"`
+	// Pools maps tenant identifiers onto pool names
+	Pools map[string]string `json:"pools"`
+	// Strict rejects unknown tenants instead of using the route's pool
+	Strict bool `json:"strict,omitempty"`
+
+	trusted []netip.Prefix
+}
+
+// validate checks the tenant source and that the pools exist
+func (t *TenancyConfig) validate(route *RouteConfig, pools map[string]*PoolConfig) error {
+	sources := 0
+	for _, set := range []bool{t.Claim != "", t.User, t.Header != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("tenancy: set one of claim, user or header")
+	}
+	if t.Claim != "" && route.JWT == nil {
+		return fmt.Errorf("tenancy: claim needs jwt on the route")
+	}
+	if t.User && route.Auth == nil {
+		return fmt.Errorf("tenancy: user needs auth on the route")
+	}
+	if t.Header != "" && len(t.TrustedSources) == 0 {
+		return fmt.Errorf("tenancy: header needs trusted_sources")
+	}
+	var err error
+	if t.trusted, err = parsePrefixes(t.TrustedSources); err != nil {
+		return fmt.Errorf("tenancy: trusted_sources: %w", err)
+	}
+	for tenant, pool := range t.Pools {
+		if _, ok := pools[pool]; !ok {
+			return fmt.Errorf("tenancy: tenant %s: unknown pool %q", tenant, pool)
+		}
+	}
+	return nil
+}
+
+// tenant returns the tenant of r, whose client authenticated as user,
+// "" if it has none. A tenant header from an untrusted peer is removed.
+func (t *TenancyConfig) tenant(r *http.Request, user string) string {
+	switch {
+	case t.User:
+		return user
+	case t.Header != "":
+		if !t.fromTrustedSource(r) {
+			r.Header.Del(t.Header)
+			return ""
+		}
+		return r.Header.Get(t.Header)
+	}
+	if v, ok := jwtClaimsFrom(r.Context())[t.Claim]; ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// fromTrustedSource reports whether r comes straight from a gateway
+// allowed to name the tenant
+func (t *TenancyConfig) fromTrustedSource(r *http.Request) bool {
+	peer, ok := peerAddr(r)
+	if !ok {
+		return false
+	}
+	for _, p := range t.trusted {
+		if p.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantPool returns the pool of the request's tenant, or pool when the
+// route has no tenancy or the tenant has no pool of its own. It returns
+// false for unknown tenants of strict routes.
+func tenantPool(r *http.Request, route *RouteConfig, pool *ServerPool, user string) (*ServerPool, bool) {
+	if route == nil || route.Tenancy == nil {
+		return pool, true
+	}
+	t := route.Tenancy
+	if name, ok := t.Pools[t.tenant(r, user)]; ok {
+		return balancerFrom(r.Context()).pools()[name], true
+	}
+	return pool, !t.Strict
+}
+
+type jwtClaimsKey struct{}
+
+// withJWTClaims records the claims of a verified token
+func withJWTClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, jwtClaimsKey{}, claims)
+}
+
+// jwtClaimsFrom returns the verified token claims of a request, nil if
+// it carried no valid token
+func jwtClaimsFrom(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(jwtClaimsKey{}).(map[string]interface{})
+	return claims
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantSource(t *testing.T) {
+	pools := map[string]*PoolConfig{"acme": {}}
+	route := &RouteConfig{JWT: &JWTConfig{}, Auth: &AuthConfig{}}
+
+	claim := &TenancyConfig{Claim: "org", Pools: map[string]string{"acme": "acme"}}
+	if err := claim.validate(route, pools); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant", "other")
+	r = r.WithContext(withJWTClaims(r.Context(), map[string]interface{}{"org": "acme"}))
+	if got := claim.tenant(r, ""); got != "acme" {
+		t.Errorf("claim: tenant %q, want acme", got)
+	}
+
+	user := &TenancyConfig{User: true}
+	if err := user.validate(route, pools); err != nil {
+		t.Fatal(err)
+	}
+	if got := user.tenant(r, "acme"); got != "acme" {
+		t.Errorf("user: tenant %q, want acme", got)
+	}
+
+	header := &TenancyConfig{Header: "X-Tenant", TrustedSources: []string{"10.0.0.0/8"}}
+	if err := header.validate(route, pools); err != nil {
+		t.Fatal(err)
+	}
+	gateway := httptest.NewRequest(http.MethodGet, "/", nil)
+	gateway.RemoteAddr = "10.1.2.3:4000"
+	gateway.Header.Set("X-Tenant", "acme")
+	if got := header.tenant(gateway, ""); got != "acme" {
+		t.Errorf("header from a trusted gateway: tenant %q, want acme", got)
+	}
+
+	// Any client could name another tenant
+	spoofed := httptest.NewRequest(http.MethodGet, "/", nil)
+	spoofed.RemoteAddr = "192.0.2.1:4000"
+	spoofed.Header.Set("X-Tenant", "acme")
+	if got := header.tenant(spoofed, ""); got != "" {
+		t.Errorf("header from an untrusted peer: tenant %q, want none", got)
+	}
+	if spoofed.Header.Get("X-Tenant") != "" {
+		t.Error("header from an untrusted peer was passed on to the backend")
+	}
+	strict := &RouteConfig{Tenancy: &TenancyConfig{Header: "X-Tenant", Pools: header.Pools, Strict: true, trusted: header.trusted}}
+	spoofed.Header.Set("X-Tenant", "acme")
+	if _, ok := tenantPool(spoofed, strict, nil, ""); ok {
+		t.Error("strict route let an untrusted peer name its tenant")
+	}
+}
+
+func TestTenancyValidate(t *testing.T) {
+	pools := map[string]*PoolConfig{"acme": {}}
+	for name, tc := range map[string]struct {
+		route   *RouteConfig
+		tenancy TenancyConfig
+	}{
+		"no source":          {&RouteConfig{}, TenancyConfig{}},
+		"two sources":        {&RouteConfig{JWT: &JWTConfig{}}, TenancyConfig{Claim: "org", Header: "X-Tenant", TrustedSources: []string{"10.0.0.0/8"}}},
+		"claim without jwt":  {&RouteConfig{}, TenancyConfig{Claim: "org"}},
+		"user without auth":  {&RouteConfig{}, TenancyConfig{User: true}},
+		"header from anyone": {&RouteConfig{}, TenancyConfig{Header: "X-Tenant"}},
+		"malformed source":   {&RouteConfig{}, TenancyConfig{Header: "X-Tenant", TrustedSources: []string{"gateway"}}},
+		"unknown pool":       {&RouteConfig{Auth: &AuthConfig{}}, TenancyConfig{User: true, Pools: map[string]string{"acme": "missing"}}},
+	} {
+		if err := tc.tenancy.validate(tc.route, pools); err == nil {
+			t.Errorf("%s: passed validation", name)
+		}
+	}
+}
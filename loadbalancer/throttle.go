@@ -0,0 +1,149 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig caps the requests per second sent to each member of a
+// pool. Traffic above a member's cap goes to other members; when all are
+// at their cap requests wait up to QueueTimeout for one to free up.
+type RateLimitConfig struct {
+	// RPS applies to every member, 0 leaves members without an override
+	// uncapped
+	RPS float64 `json:"rps,omitempty"`
+	// Burst is how many requests may go out at once, RPS rounded up if 0
+	Burst int `json:"burst,omitempty"`
+	// Backends overrides RPS for individual members, by URL
+	Backends map[string]float64 `json:"backends,omitempty"`
+	// QueueTimeout is how long a request waits for capacity, 0 fails
+	// it straight away
+	QueueTimeout Duration `json:"queue_timeout,omitempty"`
+}
+
+// validate checks the rates
+func (c *RateLimitConfig) validate() error {
+	if c.RPS < 0 || c.Burst < 0 || c.QueueTimeout < 0 {
+		return fmt.Errorf("rate_limit: values must not be negative")
+	}
+	for u, rps := range c.Backends {
+		if _, err := url.Parse(u); err != nil || rps <= 0 {
+			return fmt.Errorf("rate_limit: backend %q needs a positive rps", u)
+		}
+	}
+	return nil
+}
+
+// bucketFor returns the token bucket of the member at rawURL, nil if it
+// is not capped
+func (c *RateLimitConfig) bucketFor(rawURL string) *tokenBucket {
+	if c == nil {
+		return nil
+	}
+	rps := c.RPS
+	if override, ok := c.Backends[rawURL]; ok {
+		rps = override
+	}
+	if rps <= 0 {
+		return nil
+	}
+	burst := float64(c.Burst)
+	if burst == 0 {
+		burst = float64(int(rps + 0.999))
+	}
+	return &tokenBucket{rate: rps, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// tokenBucket admits rate requests per second with bursts of up to burst;
+// a nil bucket admits everything
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last call, with b.mu held
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// ready reports whether a request could be sent now
+func (b *tokenBucket) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= 1
+}
+
+// take uses up one request if one is available
+func (b *tokenBucket) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// throttled skips members that are at their request rate
+func throttled(b *Backend) bool {
+	return !b.throttle.ready()
+}
+
+// avoidEither skips members either predicate skips, nil predicates
+// skipping nothing
+func avoidEither(a, b func(*Backend) bool) func(*Backend) bool {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	return func(backend *Backend) bool { return a(backend) || b(backend) }
+}
+
+// admitPeer selects a member below its rate cap, preferring those avoid
+// does not skip. When every member is at its cap it waits for one up to
+// the pool's queue timeout and returns nil if none frees up.
+func admitPeer(ctx context.Context, route *RouteConfig, pool *ServerPool, key string, avoid func(*Backend) bool) *Backend {
+	if pool.rateLimit == nil {
+		peer := selectPeer(route, pool, key, avoid)
+		if peer == nil && avoid != nil {
+			peer = selectPeer(route, pool, key, nil)
+		}
+		return peer
+	}
+
+	deadline := time.Now().Add(time.Duration(pool.rateLimit.QueueTimeout))
+	for {
+		for _, skip := range []func(*Backend) bool{avoidEither(avoid, throttled), throttled} {
+			// Another request may take the last token between the checks
+			if peer := selectPeer(route, pool, key, skip); peer != nil && peer.throttle.take() {
+				return peer
+			}
+		}
+		if time.Now().After(deadline) || selectPeer(route, pool, key, nil) == nil {
+			// Out of time, or nothing alive to wait for
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import "log/slog"
+
+// backupOrigin marks members of a pool's backup tier
+const backupOrigin = "backup"
+
+// newBackupBackend creates a member of pool's backup tier
+func newBackupBackend(rawURL string, pool *ServerPool) (*Backend, error) {
+	b, err := newBackend(rawURL, pool)
+	if err != nil {
+		return nil, err
+	}
+	b.origin = backupOrigin
+	return b, nil
+}
+
+// isBackup reports whether b is in its pool's backup tier
+func (b *Backend) isBackup() bool {
+	return b.origin == backupOrigin
+}
+
+// tierAvoid extends avoid to skip the backup tier while any of the
+// members is an available primary, logging when the pool fails over and back
+func (s *ServerPool) tierAvoid(members []*Backend, avoid func(*Backend) bool) func(*Backend) bool {
+	hasBackups, primaryUp := false, false
+	for _, b := range members {
+		if b.isBackup() {
+			hasBackups = true
+		} else if b.IsAvailable() {
+			primaryUp = true
+		}
+	}
+	if !hasBackups {
+		return avoid
+	}
+	if s.onBackup.CompareAndSwap(primaryUp, !primaryUp) {
+		if primaryUp {
+			slog.Info("Pool back on primary tier", "pool", s.Name)
+		} else {
+			slog.Warn("Pool failed over to backup tier", "pool", s.Name)
+		}
+	}
+	if !primaryUp {
+		return avoid
+	}
+	return avoidEither(avoid, (*Backend).isBackup)
+}
@@ -0,0 +1,187 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeoutError is returned when an upstream timeout fires
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var (
+	errResponseHeaderTimeout = &timeoutError{"timeout awaiting response headers"}
+	errTotalTimeout          = &timeoutError{"total request timeout exceeded"}
+)
+
+type timeoutsKey struct{}
+
+// withTimeouts attaches the timeouts for a request to its context
+func withTimeouts(ctx context.Context, t TimeoutConfig) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, t)
+}
+
+// timeoutsFrom returns the timeouts attached to ctx, if any
+func timeoutsFrom(ctx context.Context) TimeoutConfig {
+	t, _ := ctx.Value(timeoutsKey{}).(TimeoutConfig)
+	return t
+}
+
+type totalTimeoutKey struct{}
+
+// totalTimeout is the running total timeout of a request
+type totalTimeout struct {
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// withTotalTimeout cancels ctx once d has passed, unless the response
+// turns out to stream first; stop releases it
+func withTotalTimeout(ctx context.Context, d time.Duration) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	total := &totalTimeout{
+		timer:    time.AfterFunc(d, func() { cancel(errTotalTimeout) }),
+		deadline: time.Now().Add(d),
+	}
+	return context.WithValue(ctx, totalTimeoutKey{}, total), func() {
+		total.timer.Stop()
+		cancel(nil)
+	}
+}
+
+// exemptFromTotal stops the total timeout of ctx and reports whether it
+// had yet to fire
+func exemptFromTotal(ctx context.Context) bool {
+	total, _ := ctx.Value(totalTimeoutKey{}).(*totalTimeout)
+	return total != nil && total.timer.Stop()
+}
+
+// setDeadlineHeader tells the backend how many milliseconds are left of
+// r's total timeout, so it can give up on work nobody will wait for. The
+// time left is sent rather than the deadline itself so clock skew between
+// hosts does not matter. A value from the client is never passed on.
+func setDeadlineHeader(r *http.Request) {
+	name := timeoutsFrom(r.Context()).DeadlineHeader
+	if name == "" {
+		return
+	}
+	r.Header.Del(name)
+	if total, _ := r.Context().Value(totalTimeoutKey{}).(*totalTimeout); total != nil {
+		left := max(time.Until(total.deadline), 0)
+		r.Header.Set(name, strconv.FormatInt(left.Milliseconds(), 10))
+	}
+}
+
+// streams reports whether resp is a stream the total timeout must not cut
+// off: an upgraded connection or one of the streaming content types
+func (t TimeoutConfig) streams(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	for _, st := range t.StreamingTypes {
+		if strings.EqualFold(mediaType, st) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeout reports whether err was caused by an exceeded deadline
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// timeoutTransport fails requests whose response headers take too long
+type timeoutTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeouts := timeoutsFrom(req.Context())
+	resp, err := t.awaitHeaders(req, timeouts.ResponseHeader)
+	if err != nil {
+		if context.Cause(req.Context()) == errTotalTimeout {
+			return nil, errTotalTimeout
+		}
+		return nil, err
+	}
+	if timeouts.streams(resp) && exemptFromTotal(req.Context()) {
+		slog.Debug("Streaming response exempt from total timeout", "url", req.URL.String(),
+			"status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
+	}
+	return resp, nil
+}
+
+// awaitHeaders sends req, failing it if the response headers take longer
+// than limit
+func (t *timeoutTransport) awaitHeaders(req *http.Request, limit Duration) (*http.Response, error) {
+	if limit <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(time.Duration(limit), func() {
+		cancel(errResponseHeaderTimeout)
+	})
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && err == nil {
+		// Headers raced the timer, the body is unusable now
+		resp.Body.Close()
+		resp, err = nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		if context.Cause(ctx) == errResponseHeaderTimeout {
+			return nil, errResponseHeaderTimeout
+		}
+		return nil, err
+	}
+
+	// Keep the context alive until the body has been consumed
+	body := &cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// The proxy writes to the body of an upgraded connection
+		resp.Body = &cancelOnCloseConn{cancelOnClose: body, Writer: conn}
+		return resp, nil
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// cancelOnClose releases a context once the wrapped body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// cancelOnCloseConn is a cancelOnClose that stays writable
+type cancelOnCloseConn struct {
+	*cancelOnClose
+	io.Writer
+}
@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamingExemptFromTotalTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/poll" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		}
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.Timeouts = TimeoutConfig{ResponseHeader: Duration(time.Second), Total: Duration(150 * time.Millisecond),
+		StreamingTypes: []string{"text/event-stream"}}
+	lb.setConfig(&cfg)
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(front.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if _, body := get("/events"); strings.Count(body, "data:") != 3 {
+		t.Errorf("event stream cut off: %q", body)
+	}
+	if _, body := get("/plain"); strings.Count(body, "data:") == 3 {
+		t.Errorf("plain response outlived the total timeout: %q", body)
+	}
+	if status, _ := get("/poll"); status != http.StatusGatewayTimeout {
+		t.Errorf("slow headers: status %d, want 504", status)
+	}
+
+	// Long polls are marked by config
+	cfg.Timeouts.Streaming = true
+	if status, body := get("/poll"); status != http.StatusOK || strings.Count(body, "data:") != 3 {
+		t.Errorf("long poll on a streaming route: status %d, body %q", status, body)
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Request-Deadline"))
+	}))
+	t.Cleanup(backend.Close)
+	lb, _ := installPool(t, RoundRobin, backend.URL)
+	cfg := *lb.config()
+	cfg.Timeouts.Total = Duration(5 * time.Second)
+	cfg.Timeouts.DeadlineHeader = "X-Request-Deadline"
+	cfg.Routes = append([]RouteConfig{}, cfg.Routes...)
+	lb.setConfig(&cfg)
+	front := httptest.NewServer(lb.Handler())
+	t.Cleanup(front.Close)
+
+	get := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, front.URL+"/", nil)
+		req.Header.Set("X-Request-Deadline", "999999")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if left, err := strconv.Atoi(get()); err != nil || left <= 4000 || left > 5000 {
+		t.Errorf("deadline header = %d (%v), want a little under 5000", left, err)
+	}
+
+	// Without a total timeout there is no deadline to pass on
+	cfg.Routes[0].Timeouts = &TimeoutConfig{Streaming: true}
+	if got := get(); got != "" {
+		t.Errorf("streaming route got deadline %q, want none", got)
+	}
+}
@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ListenerTLS terminates TLS on the balancer's listeners
+type ListenerTLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile enables mutual TLS, client certificates are verified
+	// against the CAs it contains
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+	// ClientAuth is "request" (verify if presented) or "require"
+	ClientAuth string `json:"client_auth,omitempty"`
+	// MinVersion is "1.2" or "1.3"
+	MinVersion string `json:"min_version,omitempty"`
+	// ClientCertHeader carries the verified client certificate subject to
+	// backends so they can authorize on it
+	ClientCertHeader string `json:"client_cert_header,omitempty"`
+}
+
+// defaultClientCertHeader is used when mutual TLS is on and no header is set
+const defaultClientCertHeader = "X-Client-Cert-Subject"
+
+// tlsVersions maps config values and wire versions onto names
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validate checks the fields that do not need the files to exist
+func (t *ListenerTLS) validate() error {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("listener tls: cert_file and key_file are required")
+	}
+	switch t.ClientAuth {
+	case "", "request", "require":
+	default:
+		return fmt.Errorf("listener tls: unknown client_auth %q", t.ClientAuth)
+	}
+	if t.ClientAuth != "" && t.ClientCAFile == "" {
+		return fmt.Errorf("listener tls: client_auth needs client_ca_file")
+	}
+	if t.ClientCAFile != "" && t.ClientCertHeader == "" {
+		t.ClientCertHeader = defaultClientCertHeader
+	}
+	if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		return fmt.Errorf("listener tls: unknown min_version %q", t.MinVersion)
+	}
+	return nil
+}
+
+// config loads the certificates and builds the server TLS config
+func (t *ListenerTLS) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("listener tls: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if v, ok := tlsVersions[t.MinVersion]; ok {
+		cfg.MinVersion = v
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("listener tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("listener tls: no certificates in %s", t.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.ClientAuth == "require" {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// setClientCertHeader replaces any client-supplied certificate header with
+// the subject of the certificate verified on this connection, if any
+func (t *ListenerTLS) setClientCertHeader(r *http.Request) {
+	if t == nil || t.ClientCertHeader == "" {
+		return
+	}
+	r.Header.Del(t.ClientCertHeader)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		r.Header.Set(t.ClientCertHeader, r.TLS.VerifiedChains[0][0].Subject.String())
+	}
+}
+
+// UpstreamTLS configures TLS from the balancer to a pool's https backends.
+// With a client certificate the backends can verify that traffic really
+// came through the balancer.
+type UpstreamTLS struct {
+	// CertFile and KeyFile hold the client certificate presented to backends
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// CAFile verifies backend certificates instead of the system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// ServerName overrides the name backend certificates are checked against
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+	MinVersion         string `json:"min_version,omitempty"`
+}
+
+// validate checks the fields that do not need the files to exist
+func (t *UpstreamTLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file go together")
+	}
+	if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		return fmt.Errorf("tls: unknown min_version %q", t.MinVersion)
+	}
+	return nil
+}
+
+// config loads the certificates and builds the client TLS config
+func (t *UpstreamTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if v, ok := tlsVersions[t.MinVersion]; ok {
+		cfg.MinVersion = v
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates in %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// tlsVersionName renders a negotiated TLS version
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return "TLS" + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
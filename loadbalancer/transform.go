@@ -0,0 +1,370 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"plugin"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BodyFilter inspects and may rewrite a request or response body. The
+// header belongs to the same message and may be changed as well.
+type BodyFilter interface {
+	Filter(body []byte, h http.Header) ([]byte, error)
+}
+
+// BodyFilterFunc adapts a plain function to BodyFilter
+type BodyFilterFunc func(body []byte, h http.Header) ([]byte, error)
+
+func (f BodyFilterFunc) Filter(body []byte, h http.Header) ([]byte, error) {
+	return f(body, h)
+}
+
+// bodyFilterTypes are the compiled-in filters, each built from its options
+var bodyFilterTypes = map[string]func(options json.RawMessage) (BodyFilter, error){
+	"json_redact": newJSONRedactFilter,
+	"replace":     newReplaceFilter,
+}
+
+// FilterConfig is one body filter, either compiled in (Type) or loaded
+// from a Go plugin exporting
+//
+//	func NewFilter(options []byte) (func(body []byte, h http.Header) ([]byte, error), error)
+type FilterConfig struct {
+	Type    string          `json:"type,omitempty"`
+	Plugin  string          `json:"plugin,omitempty"`
+	Options json.RawMessage `json:"options,omitempty"`
+	// ContentTypes limits the filter to these media types, a trailing
+	// "*" matches a prefix such as "text/*"
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	filter BodyFilter
+}
+
+// TransformConfig rewrites the bodies of a route's requests and responses
+type TransformConfig struct {
+	Request  []FilterConfig `json:"request,omitempty"`
+	Response []FilterConfig `json:"response,omitempty"`
+	// MaxBodyBytes is the largest body buffered for filtering; bigger
+	// requests get a 413 and bigger responses a 502 rather than passing
+	// through unfiltered
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+}
+
+// validate fills in defaults and builds every filter
+func (t *TransformConfig) validate() error {
+	if len(t.Request) == 0 && len(t.Response) == 0 {
+		return fmt.Errorf("transform: no request or response filters")
+	}
+	if t.MaxBodyBytes <= 0 {
+		t.MaxBodyBytes = 1 << 20
+	}
+	for _, filters := range [][]FilterConfig{t.Request, t.Response} {
+		for i := range filters {
+			if err := filters[i].build(); err != nil {
+				return fmt.Errorf("transform: filter %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// build creates the filter the config describes
+func (f *FilterConfig) build() error {
+	var err error
+	switch {
+	case (f.Type == "") == (f.Plugin == ""):
+		return errors.New("set either type or plugin")
+	case f.Plugin != "":
+		f.filter, err = loadFilterPlugin(f.Plugin, f.Options)
+	default:
+		newFilter, ok := bodyFilterTypes[f.Type]
+		if !ok {
+			return fmt.Errorf("unknown type %q", f.Type)
+		}
+		f.filter, err = newFilter(f.Options)
+		if f.Type == "json_redact" && len(f.ContentTypes) == 0 {
+			f.ContentTypes = []string{"application/json", "application/*+json"}
+		}
+	}
+	return err
+}
+
+// applies reports whether the filter handles a body of contentType
+func (f *FilterConfig) applies(contentType string) bool {
+	if len(f.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, want := range f.ContentTypes {
+		if prefix, suffix, ok := strings.Cut(want, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix) {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, want) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	filterPluginsMu sync.Mutex
+	filterPlugins   = map[string]func([]byte) (func([]byte, http.Header) ([]byte, error), error){}
+)
+
+// loadFilterPlugin opens a Go plugin once and builds a filter from it
+func loadFilterPlugin(path string, options json.RawMessage) (BodyFilter, error) {
+	filterPluginsMu.Lock()
+	defer filterPluginsMu.Unlock()
+
+	newFilter, ok := filterPlugins[path]
+	if !ok {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		sym, err := p.Lookup("NewFilter")
+		if err != nil {
+			return nil, err
+		}
+		newFilter, ok = sym.(func([]byte) (func([]byte, http.Header) ([]byte, error), error))
+		if !ok {
+			return nil, fmt.Errorf("plugin %s: NewFilter has type %T", path, sym)
+		}
+		filterPlugins[path] = newFilter
+	}
+	f, err := newFilter(options)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	return BodyFilterFunc(f), nil
+}
+
+// runFilters passes body through every filter that handles its content type
+func runFilters(filters []FilterConfig, body []byte, h http.Header) ([]byte, error) {
+	for i := range filters {
+		f := &filters[i]
+		if !f.applies(h.Get("Content-Type")) {
+			continue
+		}
+		var err error
+		if body, err = f.filter.Filter(body, h); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// newJSONRedactFilter replaces the values of the named fields, at any
+// depth, in JSON bodies
+func newJSONRedactFilter(options json.RawMessage) (BodyFilter, error) {
+	var o struct {
+		Fields      []string `json:"fields"`
+		Replacement string   `json:"replacement"`
+	}
+	if err := json.Unmarshal(options, &o); err != nil {
+		return nil, fmt.Errorf("json_redact: %w", err)
+	}
+	if len(o.Fields) == 0 {
+		return nil, errors.New("json_redact: fields is required")
+	}
+	if o.Replacement == "" {
+		o.Replacement = "[REDACTED]"
+	}
+	fields := map[string]bool{}
+	for _, name := range o.Fields {
+		fields[name] = true
+	}
+
+	var redact func(v interface{}) interface{}
+	redact = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				if fields[k] {
+					v[k] = o.Replacement
+				} else {
+					v[k] = redact(child)
+				}
+			}
+		case []interface{}:
+			for i, child := range v {
+				v[i] = redact(child)
+			}
+		}
+		return v
+	}
+	return BodyFilterFunc(func(body []byte, h http.Header) ([]byte, error) {
+		if len(bytes.TrimSpace(body)) == 0 {
+			return body, nil
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("json_redact: %w", err)
+		}
+		return json.Marshal(redact(doc))
+	}), nil
+}
+
+// newReplaceFilter replaces every occurrence of a string
+func newReplaceFilter(options json.RawMessage) (BodyFilter, error) {
+	var o struct {
+		Old string `json:"old"`
+		New string `json:"new"`
+	}
+	if err := json.Unmarshal(options, &o); err != nil {
+		return nil, fmt.Errorf("replace: %w", err)
+	}
+	if o.Old == "" {
+		return nil, errors.New("replace: old is required")
+	}
+	old, replacement := []byte(o.Old), []byte(o.New)
+	return BodyFilterFunc(func(body []byte, h http.Header) ([]byte, error) {
+		return bytes.ReplaceAll(body, old, replacement), nil
+	}), nil
+}
+
+// encoded reports whether a message body carries a content coding the
+// filters would not understand
+func encoded(h http.Header) bool {
+	ce := h.Get("Content-Encoding")
+	return ce != "" && !strings.EqualFold(ce, "identity")
+}
+
+// transformRequest runs the route's request filters over r's body,
+// writing the error response itself when the body cannot be filtered
+func transformRequest(w http.ResponseWriter, r *http.Request, route *RouteConfig) bool {
+	if route == nil || route.Transform == nil || len(route.Transform.Request) == 0 ||
+		r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	t := route.Transform
+	// An encoded body would slip past filters such as redaction
+	if encoded(r.Header) {
+		http.Error(w, "Encoded request bodies are not accepted", http.StatusUnsupportedMediaType)
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, t.MaxBodyBytes+1))
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return false
+	}
+	if int64(len(body)) > t.MaxBodyBytes {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if body, err = runFilters(t.Request, body, r.Header); err != nil {
+		slog.Warn("Request body filter failed", "route", routeKey(route), "path", r.URL.Path, "error", err)
+		http.Error(w, "Request body rejected", http.StatusBadRequest)
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
+
+// transformWriter holds back a response until its body has been filtered
+type transformWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	route  *RouteConfig
+	status int
+	// buffering is set once a filter applies to the response
+	buffering bool
+	body      bytes.Buffer
+	overflow  bool
+}
+
+// newTransformWriter wraps w when the route filters response bodies,
+// nil otherwise. Backends are asked for uncompressed responses so the
+// filters can read them.
+func newTransformWriter(w http.ResponseWriter, r *http.Request, route *RouteConfig) *transformWriter {
+	if route == nil || route.Transform == nil || len(route.Transform.Response) == 0 {
+		return nil
+	}
+	r.Header.Del("Accept-Encoding")
+	return &transformWriter{ResponseWriter: w, r: r, route: route}
+}
+
+func (t *transformWriter) WriteHeader(code int) {
+	if t.status != 0 {
+		return
+	}
+	t.status = code
+	h := t.Header()
+	for i := range t.route.Transform.Response {
+		if t.route.Transform.Response[i].applies(h.Get("Content-Type")) {
+			t.buffering = !encoded(h)
+			break
+		}
+	}
+	if !t.buffering {
+		t.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (t *transformWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if !t.buffering {
+		return t.ResponseWriter.Write(b)
+	}
+	if int64(t.body.Len()+len(b)) > t.route.Transform.MaxBodyBytes {
+		t.overflow = true
+		return 0, errors.New("response too large to transform")
+	}
+	return t.body.Write(b)
+}
+
+// Flush is held back while the body is buffered
+func (t *transformWriter) Flush() {
+	if !t.buffering {
+		http.NewResponseController(t.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (t *transformWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Close filters the buffered body and sends the response
+func (t *transformWriter) Close() {
+	if !t.buffering {
+		return
+	}
+	h := t.Header()
+	if t.overflow {
+		for k := range h {
+			delete(h, k)
+		}
+		writeError(t.ResponseWriter, t.r, http.StatusBadGateway, "Response too large to transform")
+		return
+	}
+	body, err := runFilters(t.route.Transform.Response, t.body.Bytes(), h)
+	if err != nil {
+		slog.Warn("Response body filter failed", "route", routeKey(t.route), "path", t.r.URL.Path, "error", err)
+		for k := range h {
+			delete(h, k)
+		}
+		writeError(t.ResponseWriter, t.r, http.StatusBadGateway, "Bad gateway")
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	t.ResponseWriter.WriteHeader(t.status)
+	t.ResponseWriter.Write(body)
+}
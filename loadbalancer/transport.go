@@ -0,0 +1,215 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig tunes the upstream connection pool of each backend
+type TransportConfig struct {
+	MaxIdleConns        int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`
+	KeepAlive           Duration `json:"keep_alive"`
+	DisableKeepAlives   bool     `json:"disable_keep_alives"`
+	TLSHandshakeTimeout Duration `json:"tls_handshake_timeout"`
+	// AttemptDelay staggers connection attempts to the addresses of a
+	// backend hostname, which race IPv6 against IPv4; 0 dials them in turn
+	AttemptDelay Duration `json:"attempt_delay"`
+	// Preconnect opens this many connections to each backend at startup,
+	// on recovery and again before they would idle out, so bursts do not
+	// wait for handshakes; at most max_idle_conns_per_host
+	Preconnect int `json:"preconnect,omitempty"`
+	// PreconnectPath is requested to open each connection, /health if unset
+	PreconnectPath string `json:"preconnect_path,omitempty"`
+}
+
+// validate checks the preconnected connections can all be kept idle
+func (c *TransportConfig) validate() error {
+	if c.Preconnect < 0 {
+		return fmt.Errorf("transport: preconnect must not be negative")
+	}
+	if c.Preconnect > 0 && c.DisableKeepAlives {
+		return fmt.Errorf("transport: preconnect needs keep-alives")
+	}
+	idle := c.MaxIdleConnsPerHost
+	if idle == 0 {
+		idle = http.DefaultMaxIdleConnsPerHost
+	}
+	if c.Preconnect > idle {
+		return fmt.Errorf("transport: preconnect %d exceeds max_idle_conns_per_host %d", c.Preconnect, idle)
+	}
+	if c.PreconnectPath == "" {
+		c.PreconnectPath = "/health"
+	}
+	return nil
+}
+
+// newTransport returns an upstream transport tuned by cfg that also applies
+// the connect and response-header timeouts carried in each request's context.
+// When egress is set, backends are reached through that proxy instead of
+// whatever the environment specifies, and upstream sets the TLS used
+// towards https backends.
+func newTransport(cfg TransportConfig, egress *EgressProxy, upstream *UpstreamTLS) (http.RoundTripper, error) {
+	dialer := &net.Dialer{KeepAlive: time.Duration(cfg.KeepAlive)}
+	if cfg.DisableKeepAlives {
+		dialer.KeepAlive = -1
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if egress != nil {
+		proxyURL, err := egress.parse()
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if upstream != nil {
+		tlsConfig, err := upstream.config()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if connect := timeoutsFrom(ctx).Connect; connect > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(connect))
+			defer cancel()
+		}
+		if cfg.AttemptDelay > 0 {
+			happy := &happyDialer{dialer: dialer, resolver: net.DefaultResolver, delay: time.Duration(cfg.AttemptDelay)}
+			return happy.DialContext(ctx, network, addr)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &timeoutTransport{next: transport}, nil
+}
+
+// EgressProxy is an HTTP or SOCKS5 proxy a pool reaches its backends through
+type EgressProxy struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// validate checks the proxy URL and scheme
+func (p *EgressProxy) validate() error {
+	_, err := p.parse()
+	return err
+}
+
+// parse returns the proxy URL with credentials applied
+func (p *EgressProxy) parse() (*url.URL, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy url: unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy url: missing host")
+	}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u, nil
+}
+
+// Redacted returns the proxy URL without its password, for logging
+func (p *EgressProxy) Redacted() string {
+	u, err := p.parse()
+	if err != nil {
+		return p.URL
+	}
+	return u.Redacted()
+}
+
+// preconnect opens cfg.Preconnect connections to b through its transport
+// and leaves them idle there. Each response is held until all have
+// arrived so no request reuses another's connection.
+func preconnect(b *Backend, cfg TransportConfig) {
+	if cfg.Preconnect <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := &http.Client{Transport: b.ReverseProxy.Transport}
+
+	var arrived, done sync.WaitGroup
+	arrived.Add(cfg.Preconnect)
+	var opened atomic.Int64
+	for i := 0; i < cfg.Preconnect; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL.String()+cfg.PreconnectPath, nil)
+			if err != nil {
+				arrived.Done()
+				return
+			}
+			resp, err := client.Do(req)
+			arrived.Done()
+			if err != nil {
+				return
+			}
+			arrived.Wait()
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			opened.Add(1)
+		}()
+	}
+	done.Wait()
+	slog.Debug("Backend connections warmed", "backend", b.URL.String(), "backend_id", b.ID, "connections", opened.Load())
+}
+
+// preconnectRoutine warms every backend's connections at startup and again
+// before the idle timeout would close them
+func (lb *Balancer) preconnectRoutine() {
+	cfg := lb.config().Transport
+	if cfg.Preconnect <= 0 {
+		return
+	}
+	warm := func() {
+		for _, name := range lb.poolNames() {
+			for _, b := range lb.pools()[name].Backends() {
+				if b.IsAlive() {
+					go preconnect(b, cfg)
+				}
+			}
+		}
+	}
+	warm()
+	if cfg.IdleConnTimeout <= 0 {
+		return
+	}
+	t := time.NewTicker(time.Duration(cfg.IdleConnTimeout) / 2)
+	defer t.Stop()
+	for range t.C {
+		warm()
+	}
+}
@@ -0,0 +1,46 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPreconnect(t *testing.T) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	cfg := defaultConfig().Transport
+	cfg.Preconnect = 4
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb, pool := installPool(t, RoundRobin, backend.URL)
+	preconnect(pool.Backends()[0], cfg)
+	if n := conns.Load(); n != 4 {
+		t.Fatalf("%d connections opened, want 4", n)
+	}
+
+	// The next requests find them idle
+	send(t, lb.Handler(), 3)
+	if n := conns.Load(); n != 4 {
+		t.Errorf("%d connections after preconnecting 4 and sending 3 requests", n)
+	}
+
+	cfg.Preconnect = cfg.MaxIdleConnsPerHost + 1
+	if err := cfg.validate(); err == nil {
+		t.Error("accepted more preconnected connections than can idle")
+	}
+}
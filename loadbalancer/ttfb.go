@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// upstreamTiming measures time to first byte of the backend response, so
+// slow clients reading the body do not count against the backend
+type upstreamTiming struct {
+	start   time.Time
+	ttfb    time.Duration
+	backend *Backend
+}
+
+type upstreamTimingKey struct{}
+
+// withUpstreamTiming attaches t to ctx for the proxy hooks to fill in
+func withUpstreamTiming(ctx context.Context, t *upstreamTiming) context.Context {
+	return context.WithValue(ctx, upstreamTimingKey{}, t)
+}
+
+// upstreamTimingFrom returns the timing attached to r, if any
+func upstreamTimingFrom(r *http.Request) *upstreamTiming {
+	t, _ := r.Context().Value(upstreamTimingKey{}).(*upstreamTiming)
+	return t
+}
+
+// markSent is called from the Director as each attempt is sent
+func markSent(r *http.Request) {
+	if t := upstreamTimingFrom(r); t != nil {
+		t.start = time.Now()
+	}
+}
+
+// markFirstByte is called from ModifyResponse once b's headers arrived,
+// it records the latency on b and returns it, 0 if it was not measured
+func markFirstByte(b *Backend, resp *http.Response) time.Duration {
+	t := upstreamTimingFrom(resp.Request)
+	if t == nil || t.start.IsZero() {
+		return 0
+	}
+	t.ttfb = time.Since(t.start)
+	t.backend = b
+	b.UpdateLatency(t.ttfb.Milliseconds())
+	b.firstBytes.Add(t.ttfb.Milliseconds())
+	return t.ttfb
+}
@@ -0,0 +1,204 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPProxyConfig forwards datagrams on Address to a pool, for DNS or
+// QUIC-style workloads. Each client address sticks to the backend its
+// source hashes to for as long as its session stays active.
+type UDPProxyConfig struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+	Pool    string `json:"pool"`
+	// SessionTimeout closes the upstream socket of an idle client
+	SessionTimeout Duration `json:"session_timeout,omitempty"`
+}
+
+// validate fills in defaults and checks the address and pool
+func (u *UDPProxyConfig) validate(pools map[string]*PoolConfig) error {
+	if _, _, err := net.SplitHostPort(u.Address); err != nil {
+		return fmt.Errorf("udp: %w", err)
+	}
+	if u.Name == "" {
+		u.Name = u.Address
+	}
+	if _, ok := pools[u.Pool]; !ok {
+		return fmt.Errorf("udp %s: unknown pool %q", u.Name, u.Pool)
+	}
+	if u.SessionTimeout <= 0 {
+		u.SessionTimeout = Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// udpSession relays the datagrams of one client address
+type udpSession struct {
+	upstream *net.UDPConn
+	backend  *Backend
+	lastSeen atomic.Int64 // unix nanoseconds
+}
+
+// udpProxy is a running UDP forwarder and its counters
+type udpProxy struct {
+	lb       *Balancer
+	cfg      UDPProxyConfig
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	total    int64
+	dropped  int64
+	pktsIn   int64
+	pktsOut  int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+var udpProxies []*udpProxy
+
+// startUDPProxy binds the configured address and forwards datagrams to
+// lb's pool until the process exits
+func (lb *Balancer) startUDPProxy(cfg UDPProxyConfig) error {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Address)
+	if err != nil {
+		return fmt.Errorf("udp %s: %w", cfg.Name, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("udp %s: %w", cfg.Name, err)
+	}
+	p := &udpProxy{lb: lb, cfg: cfg, conn: conn, sessions: map[string]*udpSession{}}
+	udpProxies = append(udpProxies, p)
+	slog.Info("UDP proxy started", "proxy", cfg.Name, "address", conn.LocalAddr().String(), "pool", cfg.Pool)
+	go p.serve()
+	go p.expireSessions()
+	return nil
+}
+
+// serve reads client datagrams and forwards each through its session
+func (p *udpProxy) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			slog.Error("UDP read failed", "proxy", p.cfg.Name, "error", err)
+			return
+		}
+		atomic.AddInt64(&p.pktsIn, 1)
+		atomic.AddInt64(&p.bytesIn, int64(n))
+
+		s := p.session(client)
+		if s == nil {
+			atomic.AddInt64(&p.dropped, 1)
+			continue
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			atomic.AddInt64(&p.dropped, 1)
+		}
+	}
+}
+
+// session returns the client's session, opening one to the backend its
+// address hashes to if needed; nil when no backend is available
+func (p *udpProxy) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.sessions[key]; s != nil {
+		if s.backend.IsAvailable() {
+			return s
+		}
+		// Move the client off a backend that failed its health checks
+		s.upstream.Close()
+		delete(p.sessions, key)
+	}
+
+	pool := p.lb.pools()[p.cfg.Pool]
+	if pool == nil {
+		return nil
+	}
+	backend := pool.HashPeerAvoiding(client.IP.String(), nil)
+	if backend == nil {
+		return nil
+	}
+	target, err := net.ResolveUDPAddr("udp", net.JoinHostPort(backend.URL.Hostname(), backendPort(backend.URL)))
+	if err != nil {
+		slog.Warn("UDP backend unreachable", "proxy", p.cfg.Name, "backend", backend.URL.String(), "error", err)
+		return nil
+	}
+	upstream, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		slog.Warn("UDP backend unreachable", "proxy", p.cfg.Name, "backend", backend.URL.String(), "error", err)
+		return nil
+	}
+
+	s := &udpSession{upstream: upstream, backend: backend}
+	p.sessions[key] = s
+	atomic.AddInt64(&p.total, 1)
+	atomic.AddInt64(&backend.active, 1)
+	go p.reply(client, s)
+	return s
+}
+
+// reply relays the backend's datagrams back to the client until the
+// session is closed
+func (p *udpProxy) reply(client *net.UDPAddr, s *udpSession) {
+	defer atomic.AddInt64(&s.backend.active, -1)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		if _, err := p.conn.WriteToUDP(buf[:n], client); err == nil {
+			atomic.AddInt64(&p.pktsOut, 1)
+			atomic.AddInt64(&p.bytesOut, int64(n))
+		}
+	}
+}
+
+// expireSessions closes sessions that have been idle for the timeout
+func (p *udpProxy) expireSessions() {
+	timeout := time.Duration(p.cfg.SessionTimeout)
+	for range time.Tick(timeout / 2) {
+		cutoff := time.Now().Add(-timeout).UnixNano()
+		p.mu.Lock()
+		for key, s := range p.sessions {
+			if s.lastSeen.Load() < cutoff {
+				s.upstream.Close()
+				delete(p.sessions, key)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// udpStats returns the counters of every UDP proxy
+func udpStats() []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(udpProxies))
+	for _, p := range udpProxies {
+		p.mu.Lock()
+		active := len(p.sessions)
+		p.mu.Unlock()
+		result = append(result, map[string]interface{}{
+			"name":        p.cfg.Name,
+			"address":     p.cfg.Address,
+			"pool":        p.cfg.Pool,
+			"sessions":    atomic.LoadInt64(&p.total),
+			"active":      active,
+			"dropped":     atomic.LoadInt64(&p.dropped),
+			"packets_in":  atomic.LoadInt64(&p.pktsIn),
+			"packets_out": atomic.LoadInt64(&p.pktsOut),
+			"bytes_in":    atomic.LoadInt64(&p.bytesIn),
+			"bytes_out":   atomic.LoadInt64(&p.bytesOut),
+		})
+	}
+	return result
+}
@@ -0,0 +1,19 @@
+package loadbalancer
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiAssets embed.FS
+
+// uiHandler serves the dashboard under /lb/ui/
+func uiHandler() http.Handler {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/lb/ui/", http.FileServer(http.FS(assets)))
+}
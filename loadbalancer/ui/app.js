@@ -0,0 +1,164 @@
+// Dashboard for the load balancer admin API. Follows /lb/stats/stream,
+// falling back to polling /lb/stats, and keeps a short latency history per
+// backend for the chart.
+(function () {
+  "use strict";
+
+  const POLL_MS = 2000;
+  const HISTORY = 90;
+  const COLORS = ["#0969da", "#1a7f37", "#cf222e", "#8250df", "#bf8700", "#1b7c83", "#d1242f", "#6e7781"];
+
+  const history = {};
+
+  function el(tag, attrs, children) {
+    const node = document.createElement(tag);
+    Object.entries(attrs || {}).forEach(([k, v]) => {
+      if (k === "text") node.textContent = v;
+      else if (k === "onclick") node.addEventListener("click", v);
+      else node.setAttribute(k, v);
+    });
+    (children || []).forEach((c) => node.appendChild(c));
+    return node;
+  }
+
+  // Changes need the admin token when one is configured; it is asked for
+  // once and kept for the session
+  async function post(path, body, retried) {
+    const headers = { "Content-Type": "application/json" };
+    const token = sessionStorage.getItem("lb-admin-token");
+    if (token) headers.Authorization = "Bearer " + token;
+    const resp = await fetch(path, { method: "POST", headers, body: JSON.stringify(body) });
+    if (resp.status === 401 && !retried) {
+      const entered = prompt("Admin token");
+      if (entered) {
+        sessionStorage.setItem("lb-admin-token", entered);
+        return post(path, body, true);
+      }
+    }
+    if (!resp.ok) alert(await resp.text());
+    return resp;
+  }
+
+  async function loadAlgorithms() {
+    const resp = await fetch("/lb/algorithm");
+    const data = await resp.json();
+    const select = document.getElementById("algorithm");
+    select.replaceChildren(...data.available.map((name) => el("option", { value: name, text: name })));
+    select.value = data.algorithm;
+    select.addEventListener("change", () => post("/lb/algorithm", { name: select.value }));
+  }
+
+  function renderBackends(backends) {
+    const total = backends.reduce((sum, b) => sum + b.request_count, 0) || 1;
+    const rows = backends.map((b) => {
+      const share = (100 * b.request_count) / total;
+      const drain = el("button", {
+        text: b.cordoned ? "Undrain" : "Drain",
+        onclick: () => post("/lb/drain", { pool: b.pool, id: b.id, drain: !b.cordoned }).then(refresh),
+      });
+      return el("tr", {}, [
+        el("td", { text: b.pool }),
+        el("td", { text: b.url }),
+        el("td", {}, [el("span", { class: "status " + b.status, text: b.status })]),
+        el("td", { text: b.request_count }),
+        el("td", {}, [el("div", { class: "bar", style: "width:" + share.toFixed(1) + "%" })]),
+        el("td", { text: b.active }),
+        el("td", { text: b.avg_latency + " ms" }),
+        el("td", { text: (b.responses && b.responses["5xx"]) || 0 }),
+        el("td", { text: Number(b.weight).toFixed(2) }),
+        el("td", {}, [drain]),
+      ]);
+    });
+    document.querySelector("#backends tbody").replaceChildren(...rows);
+  }
+
+  function renderTraffic(traffic) {
+    const rows = traffic.map((t) =>
+      el("tr", {}, [
+        el("td", { text: Object.entries(t.labels).map(([k, v]) => k + "=" + v).join(", ") }),
+        el("td", { text: t.requests }),
+        el("td", { text: t.errors }),
+        el("td", { text: t.bytes_out }),
+      ])
+    );
+    document.querySelector("#traffic tbody").replaceChildren(...rows);
+  }
+
+  function renderChart(backends) {
+    backends.forEach((b) => {
+      const key = b.pool + " " + b.url;
+      const series = (history[key] = history[key] || []);
+      series.push(b.avg_latency);
+      if (series.length > HISTORY) series.shift();
+    });
+
+    const canvas = document.getElementById("latency");
+    const ctx = canvas.getContext("2d");
+    const keys = Object.keys(history).sort();
+    const max = Math.max(10, ...keys.flatMap((k) => history[k]));
+    const w = canvas.width;
+    const h = canvas.height;
+
+    ctx.clearRect(0, 0, w, h);
+    ctx.strokeStyle = "#eaeef2";
+    ctx.fillStyle = "#8c959f";
+    ctx.font = "11px sans-serif";
+    for (let i = 0; i <= 4; i++) {
+      const y = h - (i * (h - 10)) / 4;
+      ctx.beginPath();
+      ctx.moveTo(0, y);
+      ctx.lineTo(w, y);
+      ctx.stroke();
+      ctx.fillText(Math.round((max * i) / 4), 2, y - 2);
+    }
+
+    const legend = [];
+    keys.forEach((key, i) => {
+      const color = COLORS[i % COLORS.length];
+      const series = history[key];
+      ctx.strokeStyle = color;
+      ctx.lineWidth = 2;
+      ctx.beginPath();
+      series.forEach((v, x) => {
+        const px = (x * w) / (HISTORY - 1);
+        const py = h - (v / max) * (h - 10);
+        if (x === 0) ctx.moveTo(px, py);
+        else ctx.lineTo(px, py);
+      });
+      ctx.stroke();
+      legend.push(el("span", { style: "color:" + color, text: "■ " + key }));
+    });
+    document.getElementById("legend").replaceChildren(...legend);
+  }
+
+  function render(stats) {
+    document.getElementById("algorithm").value = stats.algorithm;
+    renderBackends(stats.backends);
+    renderTraffic(stats.traffic);
+    renderChart(stats.backends);
+    document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+  }
+
+  async function refresh() {
+    try {
+      const resp = await fetch("/lb/stats");
+      render(await resp.json());
+    } catch (err) {
+      document.getElementById("updated").textContent = "stats unavailable: " + err;
+    }
+  }
+
+  function follow() {
+    if (!window.EventSource) {
+      setInterval(refresh, POLL_MS);
+      return;
+    }
+    const source = new EventSource("/lb/stats/stream");
+    source.addEventListener("stats", (ev) => render(JSON.parse(ev.data)));
+    source.onerror = () => {
+      document.getElementById("updated").textContent = "reconnecting...";
+    };
+  }
+
+  loadAlgorithms().then(refresh).then(follow);
+})();
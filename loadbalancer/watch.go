@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// Backend event types, numbered as the EventType enum in control.proto
+const (
+	eventAdded   = 1
+	eventRemoved = 2
+	eventStatus  = 3
+	// eventSynced follows the backends a watch starts with
+	eventSynced = 4
+)
+
+// backendEvent is a backend joining or leaving a pool, or changing status
+type backendEvent struct {
+	typ     int
+	backend BackendStats
+	// previous is the status before a change
+	previous string
+	reason   string
+	time     time.Time
+}
+
+// watchBuffer is how many events a watcher may fall behind before it is
+// dropped and has to watch again
+const watchBuffer = 256
+
+// watcher receives the events of one pool, or of all pools if pool is ""
+type watcher struct {
+	pool   string
+	events chan backendEvent
+	// lagged is set when events was closed because the watcher fell behind
+	lagged bool
+}
+
+// backendWatch fans backend events out to watchers
+type backendWatch struct {
+	mu   sync.Mutex
+	subs map[*watcher]struct{}
+	// last is the status last published for each backend, so a status
+	// reported from several places is only sent once
+	last map[*Backend]string
+}
+
+var watchers = &backendWatch{subs: map[*watcher]struct{}{}, last: map[*Backend]string{}}
+
+// subscribe returns a watcher for the events of pool from now on
+func (w *backendWatch) subscribe(pool string) *watcher {
+	sub := &watcher{pool: pool, events: make(chan backendEvent, watchBuffer)}
+	w.mu.Lock()
+	w.subs[sub] = struct{}{}
+	w.mu.Unlock()
+	return sub
+}
+
+// unsubscribe stops sending events to sub
+func (w *backendWatch) unsubscribe(sub *watcher) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.subs[sub]; ok {
+		delete(w.subs, sub)
+		close(sub.events)
+	}
+}
+
+// publish sends ev to the watchers of its pool; w.mu must be held.
+// Watchers too far behind are dropped rather than holding up the
+// balancer.
+func (w *backendWatch) publish(ev backendEvent) {
+	for sub := range w.subs {
+		if sub.pool != "" && sub.pool != ev.backend.Pool {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			sub.lagged = true
+			delete(w.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// added publishes that b joined pool
+func (w *backendWatch) added(pool *ServerPool, b *Backend) {
+	stats := pool.backendStats(b)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last[b] = stats.Status
+	w.publish(backendEvent{typ: eventAdded, backend: stats, time: time.Now()})
+}
+
+// removed publishes that b left pool
+func (w *backendWatch) removed(pool *ServerPool, b *Backend) {
+	stats := pool.backendStats(b)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.last, b)
+	w.publish(backendEvent{typ: eventRemoved, backend: stats, time: time.Now()})
+}
+
+// status publishes b's status if it changed since last published
+func (w *backendWatch) status(pool *ServerPool, b *Backend, reason string) {
+	stats := pool.backendStats(b)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	previous, known := w.last[b]
+	if previous == stats.Status || (!known && !pool.contains(b)) {
+		return
+	}
+	w.last[b] = stats.Status
+	w.publish(backendEvent{typ: eventStatus, backend: stats, previous: previous, reason: reason, time: time.Now()})
+}
@@ -0,0 +1,252 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookConfig posts backend and pool health changes to an HTTP
+// endpoint, e.g. a Slack incoming webhook
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Format is "slack" for Slack's message payload, otherwise "json"
+	// posts the event as it is
+	Format string `json:"format,omitempty"`
+	// Events limits what is sent, all of webhookEvents if empty
+	Events  []string          `json:"events,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Timeout Duration          `json:"timeout,omitempty"`
+
+	target *url.URL
+}
+
+// webhookEvents are the health changes webhooks can be told about
+var webhookEvents = map[string]bool{
+	"backend_down":    true,
+	"backend_up":      true,
+	"quorum_lost":     true,
+	"quorum_restored": true,
+	"became_primary":  true,
+	"became_standby":  true,
+}
+
+// validate fills in defaults and checks the URL and events
+func (c *WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook: url must be an http(s) URL")
+	}
+	switch c.Format {
+	case "":
+		c.Format = "json"
+	case "json", "slack":
+	default:
+		return fmt.Errorf("webhook %s: unknown format %q", u.Host, c.Format)
+	}
+	for _, e := range c.Events {
+		if !webhookEvents[e] {
+			return fmt.Errorf("webhook %s: unknown event %q", u.Host, e)
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(5 * time.Second)
+	}
+	c.target = u
+	return nil
+}
+
+// wants reports whether the webhook is told about event
+func (c *WebhookConfig) wants(event string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// healthEvent is what webhooks are sent
+type healthEvent struct {
+	Event     string        `json:"event"`
+	Time      time.Time     `json:"time"`
+	Node      string        `json:"node,omitempty"`
+	Pool      string        `json:"pool,omitempty"`
+	BackendID string        `json:"backend_id,omitempty"`
+	Backend   string        `json:"backend,omitempty"`
+	Reason    string        `json:"reason"`
+	Errors    []errorSample `json:"recent_errors,omitempty"`
+	// Available and Backends count the pool's primary members
+	Available int `json:"available"`
+	Backends  int `json:"backends"`
+}
+
+// text is the event as one line for chat
+func (e healthEvent) text() string {
+	switch e.Event {
+	case "backend_down", "backend_up":
+		state := "down"
+		if e.Event == "backend_up" {
+			state = "up"
+		}
+		return fmt.Sprintf("Backend %s (%s) in pool %s is %s: %s, %d/%d available",
+			e.BackendID, e.Backend, e.Pool, state, e.Reason, e.Available, e.Backends)
+	case "quorum_lost":
+		return fmt.Sprintf("Pool %s lost quorum: %d/%d available", e.Pool, e.Available, e.Backends)
+	case "became_primary", "became_standby":
+		return fmt.Sprintf("Node %s is now %s: %s", e.Node, strings.TrimPrefix(e.Event, "became_"), e.Reason)
+	}
+	return fmt.Sprintf("Pool %s has quorum again: %d/%d available", e.Pool, e.Available, e.Backends)
+}
+
+// errorSamplesKept is how many recent errors a backend remembers
+const errorSamplesKept = 5
+
+// errorSample is one error seen talking to a backend
+type errorSample struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// errorSamples is a ring of a backend's most recent errors
+type errorSamples struct {
+	mu      sync.Mutex
+	samples [errorSamplesKept]errorSample
+	n, next int
+}
+
+// add remembers err
+func (s *errorSamples) add(err string) {
+	s.mu.Lock()
+	s.samples[s.next] = errorSample{Time: time.Now(), Error: err}
+	s.next = (s.next + 1) % errorSamplesKept
+	if s.n < errorSamplesKept {
+		s.n++
+	}
+	s.mu.Unlock()
+}
+
+// recent returns the remembered errors, oldest first
+func (s *errorSamples) recent() []errorSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]errorSample, 0, s.n)
+	for i := 0; i < s.n; i++ {
+		result = append(result, s.samples[(s.next-s.n+i+errorSamplesKept)%errorSamplesKept])
+	}
+	return result
+}
+
+// healthChanged tells webhooks and watchers that b went up or down for
+// reason, and webhooks whether that cost or restored the pool's quorum
+func (s *ServerPool) healthChanged(b *Backend, up bool, reason string) {
+	available, total := 0, 0
+	for _, m := range s.snapshot() {
+		if m.isBackup() {
+			continue
+		}
+		total++
+		if m.IsAvailable() {
+			available++
+		}
+	}
+	ev := healthEvent{
+		Event:     "backend_down",
+		Time:      time.Now(),
+		Pool:      s.Name,
+		BackendID: b.ID,
+		Backend:   b.URL.String(),
+		Reason:    reason,
+		Errors:    b.recentErrors.recent(),
+		Available: available,
+		Backends:  total,
+	}
+	if up {
+		ev.Event = "backend_up"
+	}
+	webhooks := s.settings().Webhooks
+	notify(webhooks, ev)
+	watchers.status(s, b, reason)
+
+	quorum := s.quorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	pool := healthEvent{Time: ev.Time, Pool: s.Name, Available: available, Backends: total}
+	if available < quorum && s.quorumLost.CompareAndSwap(false, true) {
+		pool.Event, pool.Reason = "quorum_lost", fmt.Sprintf("fewer than %d backends available", quorum)
+		slog.Warn("Pool lost quorum", "pool", s.Name, "available", available, "quorum", quorum)
+		notify(webhooks, pool)
+	} else if available >= quorum && s.quorumLost.CompareAndSwap(true, false) {
+		pool.Event, pool.Reason = "quorum_restored", fmt.Sprintf("%d backends available", available)
+		slog.Info("Pool has quorum again", "pool", s.Name, "available", available, "quorum", quorum)
+		notify(webhooks, pool)
+	}
+}
+
+// webhookSlots bounds deliveries in flight, events beyond it are dropped
+var webhookSlots = make(chan struct{}, 16)
+
+var webhookClient = &http.Client{}
+
+// notify sends ev to every one of webhooks that wants it, in the background
+func notify(webhooks []WebhookConfig, ev healthEvent) {
+	for i := range webhooks {
+		hook := &webhooks[i]
+		if !hook.wants(ev.Event) {
+			continue
+		}
+		select {
+		case webhookSlots <- struct{}{}:
+			go func() {
+				defer func() { <-webhookSlots }()
+				if err := hook.deliver(ev); err != nil {
+					slog.Warn("Webhook not delivered", "webhook", hook.target.Host, "event", ev.Event, "error", err)
+				}
+			}()
+		default:
+			slog.Warn("Webhook dropped, too many in flight", "webhook", hook.target.Host, "event", ev.Event)
+		}
+	}
+}
+
+// deliver posts ev in the webhook's format
+func (c *WebhookConfig) deliver(ev healthEvent) error {
+	var payload interface{} = ev
+	if c.Format == "slack" {
+		payload = map[string]interface{}{"text": ev.text()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthWebhooks(t *testing.T) {
+	events := make(chan healthEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev healthEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err == nil {
+			events <- ev
+		}
+	}))
+	t.Cleanup(hook.Close)
+
+	dead := deadURL(t)
+	lb, pool := installPool(t, RoundRobin, dead)
+	cfg := *lb.config()
+	cfg.Webhooks = []WebhookConfig{{URL: hook.URL}}
+	if err := cfg.Webhooks[0].validate(); err != nil {
+		t.Fatal(err)
+	}
+	lb.setConfig(&cfg)
+
+	rec := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/work", nil))
+	got := map[string]healthEvent{}
+	for len(got) < 2 {
+		select {
+		case ev := <-events:
+			got[ev.Event] = ev
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got events %v, want backend_down and quorum_lost", got)
+		}
+	}
+	down := got["backend_down"]
+	if down.BackendID != pool.Backends()[0].ID || down.Backend != dead || len(down.Errors) != 1 {
+		t.Errorf("backend_down = %+v", down)
+	}
+	if lost := got["quorum_lost"]; lost.Pool != "test" || lost.Available != 0 || lost.Backends != 1 {
+		t.Errorf("quorum_lost = %+v", lost)
+	}
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWeightHintHeader is the response header backends send hints in
+const defaultWeightHintHeader = "X-LB-Weight-Hint"
+
+// WeightHintConfig controls the backend-driven weight feedback loop. A
+// backend answers with e.g. "X-LB-Weight-Hint: 0.2" to ask for a fifth of
+// its normal share, for instance while it garbage collects or reindexes.
+type WeightHintConfig struct {
+	Enabled bool   `json:"enabled"`
+	Header  string `json:"header"`
+	// Smoothing is the EWMA factor applied to each new hint, in (0, 1]
+	Smoothing float64 `json:"smoothing"`
+	// TTL after which a backend that stopped sending hints is back to full weight
+	TTL Duration `json:"ttl"`
+}
+
+// weightHint holds the smoothed hint of a backend
+type weightHint struct {
+	value uint64 // math.Float64bits of the smoothed weight in [0, 1]
+	at    int64  // unix nanoseconds of the last hint, 0 if none
+}
+
+// ObserveWeightHint folds a new hint into the smoothed weight
+func (b *Backend) ObserveWeightHint(hint float64) {
+	cfg := b.pool.settings().WeightHint
+	hint = math.Max(0, math.Min(1, hint))
+	for {
+		oldBits := atomic.LoadUint64(&b.hint.value)
+		old := b.Weight()
+		next := old + cfg.Smoothing*(hint-old)
+		if atomic.CompareAndSwapUint64(&b.hint.value, oldBits, math.Float64bits(next)) {
+			atomic.StoreInt64(&b.hint.at, time.Now().UnixNano())
+			return
+		}
+	}
+}
+
+// Weight returns the share of traffic the backend currently asks for,
+// 1 unless it sent a hint within the configured TTL
+func (b *Backend) Weight() float64 {
+	at := atomic.LoadInt64(&b.hint.at)
+	if at == 0 || time.Since(time.Unix(0, at)) > time.Duration(b.pool.settings().WeightHint.TTL) {
+		return 1
+	}
+	return math.Float64frombits(atomic.LoadUint64(&b.hint.value))
+}
+
+// admit decides whether a request picked for b should really go there,
+// rejecting a share of traffic matching the backend's weight hint
+func (b *Backend) admit() bool {
+	w := b.Weight()
+	return w >= 1 || rand.Float64() < w
+}
+
+// observeWeightHeader applies a weight hint found in a backend response and
+// strips it so it does not leak to clients
+func (b *Backend) observeWeightHeader(h http.Header) {
+	name := b.pool.settings().WeightHint.Header
+	v := h.Get(name)
+	if v == "" {
+		return
+	}
+	h.Del(name)
+	if hint, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(hint) {
+		b.ObserveWeightHint(hint)
+	}
+}
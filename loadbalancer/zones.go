@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ZoneConfig keeps requests in the zone they arrive in. A request's zone
+// comes from Header, then its listener, then Local; backends are put in
+// zones through their pool's zones map.
+type ZoneConfig struct {
+	// Header carries the zone set by a trusted front proxy, e.g. X-Zone
+	Header string `json:"header,omitempty"`
+	// Local is the zone this balancer runs in
+	Local string `json:"local,omitempty"`
+	// MinHealthy is the share of a zone's backends that must be available
+	// to keep traffic in the zone, any one if 0
+	MinHealthy float64 `json:"min_healthy,omitempty"`
+}
+
+// validate checks the healthy share
+func (z *ZoneConfig) validate() error {
+	if z.MinHealthy < 0 || z.MinHealthy > 1 {
+		return fmt.Errorf("zones: min_healthy must be between 0 and 1")
+	}
+	return nil
+}
+
+// requestZone returns the zone r arrived in, "" if unknown
+func requestZone(r *http.Request) string {
+	if h := requestConfig(r).Zones.Header; h != "" {
+		if zone := r.Header.Get(h); zone != "" {
+			return zone
+		}
+	}
+	if l := listenerFrom(r.Context()); l != nil && l.Zone != "" {
+		return l.Zone
+	}
+	return requestConfig(r).Zones.Local
+}
+
+// zoneOf returns the zone of b, looked up by its URL or the configured
+// URL it was resolved from
+func (s *ServerPool) zoneOf(b *Backend) string {
+	if zone, ok := s.zones[b.URL.String()]; ok {
+		return zone
+	}
+	return s.zones[b.origin]
+}
+
+// zoneAvoider skips backends outside zone while enough of the zone's
+// backends are available, nil when traffic may go anywhere
+func (s *ServerPool) zoneAvoider(zone string) func(*Backend) bool {
+	if zone == "" || len(s.zones) == 0 {
+		return nil
+	}
+	total, available := 0, 0
+	for _, b := range s.Backends() {
+		if s.zoneOf(b) == zone {
+			total++
+			if b.IsAvailable() {
+				available++
+			}
+		}
+	}
+	if available == 0 || float64(available) < s.settings().Zones.MinHealthy*float64(total) {
+		return nil
+	}
+	return func(b *Backend) bool { return s.zoneOf(b) != zone }
+}
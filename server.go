@@ -1,3 +1,6 @@
+//go:build ignore
+
+// Demo backend, run separately with: go run server.go <port>
 package main
 
 import (